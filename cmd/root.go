@@ -4,12 +4,17 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/zulfikawr/bitrim/internal/config"
 	"github.com/zulfikawr/bitrim/internal/metadata"
+	"github.com/zulfikawr/bitrim/internal/optimizer"
 	"github.com/zulfikawr/bitrim/internal/pipeline"
 	"github.com/spf13/cobra"
 )
@@ -20,7 +25,9 @@ var rootCmd = &cobra.Command{
 	Short: "Bitrim - High-concurrency asset optimizer",
 	Long: `Bitrim is a powerful cross-platform asset optimizer that:
   - Recursively scans directories
-  - Compresses images (JPG, PNG)
+  - Compresses images (JPG, PNG, animated GIF)
+  - Converts WebP, BMP and TIFF inputs to web formats
+  - Converts between JPEG, PNG and WebP
   - Converts images to WebP format
   - Minifies SVG files
   
@@ -32,6 +39,21 @@ Uses a worker pool pattern for maximum CPU concurrency.`,
 // Options for the optimizer
 var opts config.Options
 
+// Raw --background value, parsed into opts in runOptimizer
+var background string
+
+// Raw --min-saving value, parsed into opts in runOptimizer
+var minSaving string
+
+// Raw --max-bytes values, parsed into opts in runOptimizer
+var maxBytes, jpegMaxBytes, pngMaxBytes, webpMaxBytes string
+
+// Path of the --focal-points sidecar, loaded into opts in runOptimizer
+var focalPoints string
+
+// Deprecated --keep-exif, the same as --metadata all
+var keepExif bool
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 func Execute() {
 	err := rootCmd.Execute()
@@ -63,6 +85,41 @@ func init() {
 		"JPEG-specific quality (1-100, overrides --quality)",
 	)
 
+	rootCmd.Flags().Float64Var(
+		&opts.TargetSSIM,
+		"target-ssim",
+		0,
+		"Pick each image's quality as the lowest whose output reaches this SSIM against the source (e.g. 0.98; replaces --quality)",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.JPEGMode,
+		"jpeg-mode",
+		optimizer.JPEGBaseline,
+		"JPEG encoding: baseline or progressive (coarse to fine scans, usually smaller)",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.JPEGHuffman,
+		"jpeg-huffman",
+		optimizer.HuffmanOptimized,
+		"JPEG Huffman tables: optimized (built per image) or standard (baseline only)",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.Subsampling,
+		"subsampling",
+		optimizer.Subsampling420,
+		"JPEG chroma subsampling: 420, 422 or 444 (full color resolution)",
+	)
+
+	rootCmd.Flags().BoolVar(
+		&opts.JPEGLossless,
+		"jpeg-lossless",
+		false,
+		"Rewrite JPEGs from their DCT coefficients like jpegtran (no quality loss; ignores quality and subsampling)",
+	)
+
 	rootCmd.Flags().IntVar(
 		&opts.PNGQuality,
 		"png-quality",
@@ -74,14 +131,245 @@ func init() {
 		&opts.Width,
 		"width", "w",
 		0,
-		"Resize width in pixels (0 = no resize)",
+		"Resize width in pixels (0 = no resize; with --height, fill and crop to that box)",
+	)
+
+	rootCmd.Flags().IntVar(
+		&opts.Height,
+		"height",
+		0,
+		"Resize height in pixels (0 = no resize; with --width, fill and crop to that box)",
+	)
+
+	rootCmd.Flags().Float64Var(
+		&opts.Scale,
+		"scale",
+		0,
+		"Scale images by a percentage, e.g. 50 (0 = no scaling; not with --width or --height)",
+	)
+
+	rootCmd.Flags().IntVar(
+		&opts.MaxWidth,
+		"max-width",
+		0,
+		"Scale down images wider than this many pixels (0 = no limit)",
+	)
+
+	rootCmd.Flags().IntVar(
+		&opts.MaxHeight,
+		"max-height",
+		0,
+		"Scale down images taller than this many pixels (0 = no limit)",
+	)
+
+	rootCmd.Flags().Float64Var(
+		&opts.MaxMegapixels,
+		"max-megapixels",
+		0,
+		"Scale down images larger than this many megapixels (0 = no limit)",
+	)
+
+	rootCmd.Flags().BoolVar(
+		&opts.NoUpscale,
+		"no-upscale",
+		false,
+		"Never enlarge images past their source size",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.Resample,
+		"resample",
+		optimizer.ResampleLanczos,
+		"Resampling filter: lanczos, catmull-rom, mitchell, linear, box or nearest",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.Crop,
+		"crop",
+		optimizer.CropCenter,
+		"Where to crop when --width and --height fill a box: center, entropy, edges or skin",
+	)
+
+	rootCmd.Flags().StringVar(
+		&focalPoints,
+		"focal-points",
+		"",
+		"JSON file of focal points to crop around, keyed by path relative to the input, e.g. {\"a.jpg\": {\"x\": 0.5, \"y\": 0.3}}",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.Watermark.Path,
+		"watermark",
+		"",
+		"Image to stamp on every output after resizing, e.g. logo.png (PNG, JPEG, WebP, BMP or TIFF)",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.Watermark.Position,
+		"watermark-position",
+		optimizer.PositionBottomRight,
+		"Watermark position: center, top, bottom, left, right, top-left, top-right, bottom-left or bottom-right",
+	)
+
+	rootCmd.Flags().Float64Var(
+		&opts.Watermark.Scale,
+		"watermark-scale",
+		20,
+		"Watermark width in percent of the output width",
+	)
+
+	rootCmd.Flags().Float64Var(
+		&opts.Watermark.Margin,
+		"watermark-margin",
+		2,
+		"Watermark distance from the edges in percent of the output width",
+	)
+
+	rootCmd.Flags().Float64Var(
+		&opts.Watermark.Opacity,
+		"watermark-opacity",
+		0.5,
+		"Watermark opacity from 0 to 1",
+	)
+
+	rootCmd.Flags().StringSliceVar(
+		&opts.Watermark.Include,
+		"watermark-include",
+		nil,
+		"Only watermark images matching these globs by relative path, name or folder (e.g. 'gallery/*,*.jpg')",
+	)
+
+	rootCmd.Flags().StringSliceVar(
+		&opts.Watermark.Exclude,
+		"watermark-exclude",
+		nil,
+		"Never watermark images matching these globs by relative path, name or folder",
+	)
+
+	rootCmd.Flags().IntSliceVar(
+		&opts.Sizes,
+		"sizes",
+		nil,
+		"Also write each image at these widths, e.g. 320,640,1280, as name-640.jpg, listed in srcset.json",
+	)
+
+	rootCmd.Flags().Float64Var(
+		&opts.Sharpen,
+		"sharpen",
+		0,
+		"Sharpen downscaled images with this Gaussian sigma, e.g. 0.5 (0 = off)",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.PNGMode,
+		"png-mode",
+		optimizer.PNGQuantized,
+		"PNG encoding: quantized (palette sized by quality) or lossless (pixels unchanged)",
+	)
+
+	rootCmd.Flags().BoolVar(
+		&opts.Zopfli,
+		"zopfli",
+		false,
+		"Recompress PNGs with an exhaustive Zopfli-style deflate (much slower, a few percent smaller)",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.Dither,
+		"dither",
+		optimizer.DitherFloydSteinberg,
+		"PNG dithering when reducing colors: none, floyd-steinberg or ordered",
+	)
+
+	rootCmd.Flags().StringToStringVar(
+		&opts.Conversions,
+		"convert",
+		nil,
+		"Output format per input format, overriding the built-in targets, e.g. tiff=png,bmp=webp",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.To,
+		"to",
+		"",
+		"Output format for all inputs but GIF: jpeg, png or webp (--convert entries take precedence)",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.Format,
+		"format",
+		"",
+		"Output format selection: auto writes each image as the smallest of JPEG, PNG and WebP that keeps enough quality",
+	)
+
+	rootCmd.Flags().StringVar(
+		&background,
+		"background",
+		"#ffffff",
+		"Color transparent images are flattened onto for JPEG output (#rrggbb, #rgb, white or black)",
 	)
 
 	rootCmd.Flags().BoolVar(
 		&opts.WebP,
 		"webp",
 		false,
-		"Generate WebP copies alongside originals",
+		"Generate WebP copies alongside JPEG/PNG outputs",
+	)
+
+	rootCmd.Flags().IntVar(
+		&opts.WebPQuality,
+		"webp-quality",
+		0,
+		"WebP-specific quality (1-100, overrides --quality)",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.WebPMode,
+		"webp-mode",
+		optimizer.WebPLossy,
+		"WebP encoding: lossy, lossless, or smallest (keep the smaller per image)",
+	)
+
+	rootCmd.Flags().StringVar(
+		&minSaving,
+		"min-saving",
+		"1",
+		"Minimum saving for a re-encoded file to be written, in bytes (e.g. 512, 2kb) or percent (e.g. 5%); otherwise the original is copied",
+	)
+
+	rootCmd.Flags().StringVar(
+		&maxBytes,
+		"max-bytes",
+		"0",
+		"Largest allowed output size (e.g. 200kb); quality is lowered until each image fits, and files that cannot fit fail",
+	)
+
+	rootCmd.Flags().StringVar(
+		&jpegMaxBytes,
+		"jpeg-max-bytes",
+		"0",
+		"Largest allowed JPEG output size (overrides --max-bytes for JPEGs)",
+	)
+
+	rootCmd.Flags().StringVar(
+		&pngMaxBytes,
+		"png-max-bytes",
+		"0",
+		"Largest allowed PNG output size (overrides --max-bytes for PNGs)",
+	)
+
+	rootCmd.Flags().StringVar(
+		&webpMaxBytes,
+		"webp-max-bytes",
+		"0",
+		"Largest allowed WebP output size, WebP copies included (overrides --max-bytes for WebPs)",
+	)
+
+	rootCmd.Flags().BoolVar(
+		&opts.MaxBytesResize,
+		"max-bytes-resize",
+		false,
+		"Shrink images that miss their size budget at quality 50 (or losslessly) instead of failing them",
 	)
 
 	rootCmd.Flags().IntVar(
@@ -126,11 +414,47 @@ func init() {
 		"Comma-separated patterns to ignore (e.g., 'node_modules,dist,.git')",
 	)
 
+	rootCmd.Flags().StringSliceVar(
+		&opts.Metadata,
+		"metadata",
+		[]string{optimizer.MetadataICC},
+		"Metadata to keep: all, none, or any of copyright, camera and icc (GPS, serial numbers and maker notes are always removed)",
+	)
+
 	rootCmd.Flags().BoolVar(
-		&opts.KeepExif,
+		&keepExif,
 		"keep-exif",
 		false,
-		"Preserve EXIF metadata in JPEG files",
+		"Same as --metadata all",
+	)
+	rootCmd.Flags().MarkDeprecated("keep-exif", "use --metadata all instead")
+
+	rootCmd.Flags().BoolVar(
+		&opts.AutoOrient,
+		"auto-orient",
+		false,
+		"Rotate JPEGs upright according to their EXIF orientation",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.ICC,
+		"icc",
+		optimizer.ICCKeep,
+		"Embedded ICC profiles: keep (embed in JPEG/PNG output) or srgb (convert pixels to sRGB and drop the profile)",
+	)
+
+	rootCmd.Flags().BoolVar(
+		&opts.Flatten,
+		"flatten",
+		false,
+		"Write all files into the output root instead of mirroring subdirectories",
+	)
+
+	rootCmd.Flags().StringVar(
+		&opts.OnCollision,
+		"on-collision",
+		pipeline.CollisionSuffix,
+		"How to handle files that map to the same output path: error, suffix or skip",
 	)
 }
 
@@ -146,6 +470,147 @@ func runOptimizer(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("input must be a directory")
 	}
 
+	if !pipeline.ValidCollisionPolicy(opts.OnCollision) {
+		return fmt.Errorf("invalid --on-collision value %q (use error, suffix or skip)", opts.OnCollision)
+	}
+
+	if opts.Conversions, err = optimizer.CanonicalConversions(opts.Conversions); err != nil {
+		return fmt.Errorf("invalid --convert value: %w", err)
+	}
+	if err := optimizer.ValidateConversions(opts.Conversions); err != nil {
+		return fmt.Errorf("invalid --convert value: %w", err)
+	}
+	if opts.To != "" {
+		opts.To = optimizer.CanonicalFormat(opts.To)
+		if opts.Conversions, err = optimizer.ConvertAll(opts.Conversions, opts.To); err != nil {
+			return fmt.Errorf("invalid --to value: %w", err)
+		}
+	}
+	if !optimizer.ValidFormat(opts.Format) {
+		return fmt.Errorf("invalid --format value %q (use auto)", opts.Format)
+	}
+	if opts.Format == optimizer.AutoFormat && opts.To != "" {
+		return fmt.Errorf("--format auto and --to cannot be combined")
+	}
+	if opts.Background, err = optimizer.ParseColor(background); err != nil {
+		return fmt.Errorf("invalid --background value: %w", err)
+	}
+
+	if !optimizer.ValidWebPMode(opts.WebPMode) {
+		return fmt.Errorf("invalid --webp-mode value %q (use lossy, lossless or smallest)", opts.WebPMode)
+	}
+
+	opts.MinSavingBytes, opts.MinSavingPercent, err = parseMinSaving(minSaving)
+	if err != nil {
+		return fmt.Errorf("invalid --min-saving value: %w", err)
+	}
+
+	for _, budget := range []struct {
+		flag  string
+		value string
+		bytes *int64
+	}{
+		{"max-bytes", maxBytes, &opts.MaxBytes},
+		{"jpeg-max-bytes", jpegMaxBytes, &opts.JPEGMaxBytes},
+		{"png-max-bytes", pngMaxBytes, &opts.PNGMaxBytes},
+		{"webp-max-bytes", webpMaxBytes, &opts.WebPMaxBytes},
+	} {
+		if *budget.bytes, err = parseSize(budget.value); err != nil {
+			return fmt.Errorf("invalid --%s value: %w", budget.flag, err)
+		}
+	}
+	if opts.MaxBytesResize && opts.MaxBytes == 0 && opts.JPEGMaxBytes == 0 && opts.PNGMaxBytes == 0 && opts.WebPMaxBytes == 0 {
+		return fmt.Errorf("--max-bytes-resize requires --max-bytes or a per-format budget")
+	}
+
+	if opts.Width < 0 || opts.Height < 0 || opts.MaxWidth < 0 || opts.MaxHeight < 0 {
+		return fmt.Errorf("resize dimensions cannot be negative")
+	}
+	if opts.Scale < 0 || opts.MaxMegapixels < 0 || opts.Sharpen < 0 {
+		return fmt.Errorf("--scale, --max-megapixels and --sharpen cannot be negative")
+	}
+	if opts.Scale > 0 && (opts.Width > 0 || opts.Height > 0) {
+		return fmt.Errorf("--scale cannot be combined with --width or --height")
+	}
+	if !optimizer.ValidCrop(opts.Crop) {
+		return fmt.Errorf("invalid --crop value %q (use center, entropy, edges or skin)", opts.Crop)
+	}
+	if focalPoints != "" {
+		if opts.FocalPoints, err = optimizer.LoadFocalPoints(focalPoints); err != nil {
+			return fmt.Errorf("invalid --focal-points file: %w", err)
+		}
+	}
+
+	if opts.Watermark.Path != "" {
+		if !optimizer.ValidPosition(opts.Watermark.Position) {
+			return fmt.Errorf("invalid --watermark-position value %q (use center, top, bottom, left, right, top-left, top-right, bottom-left or bottom-right)", opts.Watermark.Position)
+		}
+		if opts.Watermark.Scale <= 0 || opts.Watermark.Scale > 100 {
+			return fmt.Errorf("invalid --watermark-scale value %v (use a percentage above 0, up to 100)", opts.Watermark.Scale)
+		}
+		if opts.Watermark.Margin < 0 || opts.Watermark.Margin >= 50 {
+			return fmt.Errorf("invalid --watermark-margin value %v (use a percentage from 0 to below 50)", opts.Watermark.Margin)
+		}
+		if opts.Watermark.Opacity <= 0 || opts.Watermark.Opacity > 1 {
+			return fmt.Errorf("invalid --watermark-opacity value %v (use a number above 0, up to 1)", opts.Watermark.Opacity)
+		}
+		for _, glob := range append(opts.Watermark.Include, opts.Watermark.Exclude...) {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("invalid watermark glob %q: %w", glob, err)
+			}
+		}
+		if opts.Watermark.Image, err = optimizer.LoadWatermark(opts.Watermark.Path); err != nil {
+			return fmt.Errorf("invalid --watermark file: %w", err)
+		}
+	}
+
+	for _, width := range opts.Sizes {
+		if width <= 0 {
+			return fmt.Errorf("invalid --sizes width %d (use positive pixel widths)", width)
+		}
+	}
+	slices.Sort(opts.Sizes)
+	opts.Sizes = slices.Compact(opts.Sizes)
+	if !optimizer.ValidResample(opts.Resample) {
+		return fmt.Errorf("invalid --resample value %q (use lanczos, catmull-rom, mitchell, linear, box or nearest)", opts.Resample)
+	}
+
+	if opts.TargetSSIM < 0 || opts.TargetSSIM > 1 {
+		return fmt.Errorf("invalid --target-ssim value %v (use a number between 0 and 1)", opts.TargetSSIM)
+	}
+
+	if !optimizer.ValidJPEGMode(opts.JPEGMode) {
+		return fmt.Errorf("invalid --jpeg-mode value %q (use baseline or progressive)", opts.JPEGMode)
+	}
+	if !optimizer.ValidHuffman(opts.JPEGHuffman) {
+		return fmt.Errorf("invalid --jpeg-huffman value %q (use optimized or standard)", opts.JPEGHuffman)
+	}
+	if opts.JPEGMode == optimizer.JPEGProgressive && opts.JPEGHuffman == optimizer.HuffmanStandard {
+		return fmt.Errorf("--jpeg-huffman standard requires --jpeg-mode baseline")
+	}
+	if !optimizer.ValidSubsampling(opts.Subsampling) {
+		return fmt.Errorf("invalid --subsampling value %q (use 420, 422 or 444)", opts.Subsampling)
+	}
+
+	if !optimizer.ValidPNGMode(opts.PNGMode) {
+		return fmt.Errorf("invalid --png-mode value %q (use quantized or lossless)", opts.PNGMode)
+	}
+
+	if keepExif && !cmd.Flags().Changed("metadata") {
+		opts.Metadata = []string{optimizer.MetadataAll}
+	}
+	if err := optimizer.ValidateMetadata(opts.Metadata); err != nil {
+		return fmt.Errorf("invalid --metadata value: %w", err)
+	}
+
+	if !optimizer.ValidICCMode(opts.ICC) {
+		return fmt.Errorf("invalid --icc value %q (use keep or srgb)", opts.ICC)
+	}
+
+	if !optimizer.ValidDither(opts.Dither) {
+		return fmt.Errorf("invalid --dither value %q (use none, floyd-steinberg or ordered)", opts.Dither)
+	}
+
 	// Handle replace flag
 	if opts.Replace {
 		// Show confirmation prompt
@@ -182,38 +647,91 @@ func runOptimizer(cmd *cobra.Command, args []string) error {
 
 	fmt.Printf("🚀 Bitrim initialized\n")
 	fmt.Printf("   Input:       %s\n", opts.Input)
-	
+
 	if opts.DryRun {
 		fmt.Printf("   Mode:        🏃 DRY RUN (no files will be written)\n")
 	}
-	
+
 	fmt.Printf("   Output:      %s\n", opts.Output)
 	fmt.Printf("   Quality:     %d%%\n", opts.Quality)
-	
+
+	if opts.TargetSSIM > 0 {
+		fmt.Printf("   Target SSIM: %g (replaces quality)\n", opts.TargetSSIM)
+	}
 	if opts.JPEGQuality > 0 {
 		fmt.Printf("   JPEG Quality: %d%%\n", opts.JPEGQuality)
 	}
 	if opts.PNGQuality > 0 {
 		fmt.Printf("   PNG Quality: %d%%\n", opts.PNGQuality)
 	}
-	
-	fmt.Printf("   WebP:        %v\n", opts.WebP)
+	if opts.JPEGMode != optimizer.JPEGBaseline || opts.JPEGHuffman != optimizer.HuffmanOptimized || opts.Subsampling != optimizer.Subsampling420 {
+		fmt.Printf("   JPEG Mode:   %s (huffman: %s, subsampling: %s)\n", opts.JPEGMode, opts.JPEGHuffman, opts.Subsampling)
+	}
+	if opts.JPEGLossless {
+		fmt.Printf("   JPEG Lossless: yes (JPEG sources keep their coefficients)\n")
+	}
+	if opts.PNGMode != optimizer.PNGQuantized || opts.Zopfli {
+		fmt.Printf("   PNG Mode:    %s (zopfli: %t)\n", opts.PNGMode, opts.Zopfli)
+	}
+	if opts.Dither != optimizer.DitherFloydSteinberg {
+		fmt.Printf("   Dither:      %s\n", opts.Dither)
+	}
+
+	if opts.WebP {
+		webPQuality := opts.Quality
+		if opts.WebPQuality > 0 {
+			webPQuality = opts.WebPQuality
+		}
+		fmt.Printf("   WebP:        %s (quality %d%%)\n", opts.WebPMode, webPQuality)
+	} else {
+		fmt.Printf("   WebP:        false\n")
+	}
 	fmt.Printf("   Concurrency: %d workers\n", opts.Concurrency)
-	
-	if opts.Width > 0 {
-		fmt.Printf("   Resize:      %dpx width\n", opts.Width)
+
+	if resize := formatResize(opts); resize != "" {
+		fmt.Printf("   Resize:      %s\n", resize)
+	}
+	if opts.Watermark.Image != nil {
+		fmt.Printf("   Watermark:   %s\n", formatWatermark(opts.Watermark))
+	}
+	if len(opts.Sizes) > 0 {
+		fmt.Printf("   Sizes:       %s px wide (srcset.json)\n", formatSizes(opts.Sizes))
+	}
+	if len(opts.Conversions) > 0 {
+		fmt.Printf("   Convert:     %s\n", formatConversions(optimizer.EffectiveConversions(opts.Conversions)))
+	}
+	if opts.Format == optimizer.AutoFormat {
+		fmt.Printf("   Format:      auto (smallest of jpeg, png, webp per image)\n")
+	}
+	if background != "#ffffff" {
+		fmt.Printf("   Background:  %s\n", optimizer.FormatColor(opts.Background))
 	}
 	if opts.MinSize > 0 {
 		fmt.Printf("   Min Size:    %s\n", formatBytes(opts.MinSize))
 	}
+	if minSaving != "1" {
+		fmt.Printf("   Min Saving:  %s\n", minSaving)
+	}
+	if budgets := formatBudgets(opts); budgets != "" {
+		fmt.Printf("   Max Bytes:   %s\n", budgets)
+	}
 	if opts.MaxDepth > 0 {
 		fmt.Printf("   Max Depth:   %d levels\n", opts.MaxDepth)
 	}
 	if opts.IgnorePatterns != "" {
 		fmt.Printf("   Ignore:      %s\n", opts.IgnorePatterns)
 	}
-	if opts.KeepExif {
-		fmt.Printf("   Keep EXIF:   true\n")
+	if metadataPolicy := strings.Join(opts.Metadata, ","); metadataPolicy != optimizer.MetadataICC {
+		fmt.Printf("   Metadata:    %s\n", metadataPolicy)
+	}
+	if opts.AutoOrient {
+		fmt.Printf("   Auto-orient: true\n")
+	}
+	if opts.ICC != optimizer.ICCKeep {
+		fmt.Printf("   ICC:         %s\n", opts.ICC)
+	}
+	if opts.Flatten {
+		fmt.Printf("   Layout:      flat (collisions: %s)\n", opts.OnCollision)
 	}
 	if opts.Replace {
 		fmt.Printf("   Mode:        🔴 REPLACE (files will be overwritten)\n")
@@ -232,11 +750,45 @@ func runOptimizer(cmd *cobra.Command, args []string) error {
 	fmt.Printf("   Total files:      %d\n", stats.TotalFiles())
 	fmt.Printf("   Successful:       %d\n", stats.SuccessfulFiles)
 	fmt.Printf("   Failed:           %d\n", stats.FailedFiles)
+	if stats.SkippedFiles > 0 {
+		fmt.Printf("   Skipped:          %d\n", stats.SkippedFiles)
+	}
+	if stats.KeptOriginalFiles > 0 {
+		fmt.Printf("   Kept original:    %d (re-encoding saved too little)\n", stats.KeptOriginalFiles)
+	}
+	if stats.CMYKFiles > 0 {
+		fmt.Printf("   CMYK converted:   %d (print images turned into sRGB)\n", stats.CMYKFiles)
+	}
+	if len(stats.LocationFiles) > 0 {
+		fmt.Printf("   Location removed: %d (images with GPS coordinates)\n", len(stats.LocationFiles))
+		sort.Strings(stats.LocationFiles)
+		for _, path := range stats.LocationFiles {
+			fmt.Printf("      📍 %s\n", path)
+		}
+	}
+	if len(stats.SkippedStepFiles) > 0 {
+		fmt.Printf("   Steps skipped:    %d (animated GIFs are not resized or copied)\n", len(stats.SkippedStepFiles))
+		sort.Strings(stats.SkippedStepFiles)
+		for _, path := range stats.SkippedStepFiles {
+			fmt.Printf("      🎞  %s\n", path)
+		}
+	}
 	fmt.Printf("   Total saved:      %s\n", formatBytes(stats.TotalBytesSaved))
 	if stats.SuccessfulFiles > 0 {
 		fmt.Printf("   Average per file: %s\n", formatBytes(stats.AverageSavingsPerFile()))
 	}
 	fmt.Printf("   Success rate:     %.1f%%\n", stats.SuccessRate())
+	if len(stats.Formats) > 1 {
+		formats := make([]string, 0, len(stats.Formats))
+		for format := range stats.Formats {
+			formats = append(formats, format)
+		}
+		sort.Strings(formats)
+		for _, format := range formats {
+			fs := stats.Formats[format]
+			fmt.Printf("   %-17s %d files, saved %s\n", strings.ToUpper(format)+":", fs.Files, formatBytes(fs.BytesSaved))
+		}
+	}
 	fmt.Printf("\n")
 
 	// Display output folder in a terminal-friendly format
@@ -256,6 +808,17 @@ func runOptimizer(cmd *cobra.Command, args []string) error {
 		} else {
 			fmt.Printf("📄 Metadata:      %s\n", metadataPath)
 		}
+
+		// The srcset manifest of --sizes
+		if len(opts.Sizes) > 0 {
+			manifest := metadata.CreateManifest(opts.Output, stats)
+			manifestPath := filepath.Join(opts.Output, "srcset.json")
+			if err := manifest.WriteToFile(manifestPath); err != nil {
+				fmt.Printf("⚠️  Warning: Could not write srcset manifest: %v\n", err)
+			} else {
+				fmt.Printf("📄 Srcset:        %s\n", manifestPath)
+			}
+		}
 	} else {
 		fmt.Printf("📄 Metadata:      (skipped in dry-run mode)\n")
 	}
@@ -269,10 +832,147 @@ func formatBytes(bytes int64) string {
 	size := float64(bytes)
 	unitIndex := 0
 
-	for size >= 1024 && unitIndex < len(units)-1 {
+	for (size >= 1024 || size <= -1024) && unitIndex < len(units)-1 {
 		size /= 1024
 		unitIndex++
 	}
 
 	return fmt.Sprintf("%.1f%s", size, units[unitIndex])
 }
+
+// parseMinSaving parses a --min-saving value: a percentage such as "5%" or
+// a size in bytes with an optional b, kb or mb suffix
+func parseMinSaving(value string) (int64, float64, error) {
+	v := strings.ToLower(strings.TrimSpace(value))
+	if strings.HasSuffix(v, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, 0, fmt.Errorf("%q is not a percentage between 0 and 100", value)
+		}
+		return 0, percent, nil
+	}
+
+	n, err := parseSize(value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%q is not a size in bytes or a percentage", value)
+	}
+	return n, 0, nil
+}
+
+// parseSize parses a size in bytes with an optional b, kb or mb suffix
+func parseSize(value string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"mb", 1024 * 1024}, {"kb", 1024}, {"b", 1}} {
+		if strings.HasSuffix(v, unit.suffix) {
+			v, multiplier = strings.TrimSuffix(v, unit.suffix), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size in bytes", value)
+	}
+	return n * multiplier, nil
+}
+
+// formatResize describes the configured resizing, or returns "" when
+// images keep their size
+func formatResize(opts config.Options) string {
+	var steps []string
+	switch {
+	case opts.Width > 0 && opts.Height > 0:
+		steps = append(steps, fmt.Sprintf("fill %dx%dpx (crop: %s)", opts.Width, opts.Height, opts.Crop))
+		if len(opts.FocalPoints) > 0 {
+			steps = append(steps, fmt.Sprintf("focal points: %d", len(opts.FocalPoints)))
+		}
+	case opts.Width > 0:
+		steps = append(steps, fmt.Sprintf("%dpx width", opts.Width))
+	case opts.Height > 0:
+		steps = append(steps, fmt.Sprintf("%dpx height", opts.Height))
+	case opts.Scale > 0:
+		steps = append(steps, fmt.Sprintf("%g%%", opts.Scale))
+	}
+	if opts.MaxWidth > 0 {
+		steps = append(steps, fmt.Sprintf("max width %dpx", opts.MaxWidth))
+	}
+	if opts.MaxHeight > 0 {
+		steps = append(steps, fmt.Sprintf("max height %dpx", opts.MaxHeight))
+	}
+	if opts.MaxMegapixels > 0 {
+		steps = append(steps, fmt.Sprintf("max %gMP", opts.MaxMegapixels))
+	}
+	if len(steps) == 0 {
+		return ""
+	}
+	if opts.NoUpscale {
+		steps = append(steps, "no upscaling")
+	}
+	steps = append(steps, opts.Resample)
+	if opts.Sharpen > 0 {
+		steps = append(steps, fmt.Sprintf("sharpen %g", opts.Sharpen))
+	}
+	return strings.Join(steps, ", ")
+}
+
+// formatWatermark describes the watermark and where it goes
+func formatWatermark(wm config.Watermark) string {
+	description := fmt.Sprintf("%s (%s, %g%% wide, %g%% margin, opacity %g)", wm.Path, wm.Position, wm.Scale, wm.Margin, wm.Opacity)
+	if len(wm.Include) > 0 {
+		description += ", only " + strings.Join(wm.Include, ",")
+	}
+	if len(wm.Exclude) > 0 {
+		description += ", except " + strings.Join(wm.Exclude, ",")
+	}
+	return description
+}
+
+// formatSizes lists the --sizes widths
+func formatSizes(sizes []int) string {
+	widths := make([]string, len(sizes))
+	for i, width := range sizes {
+		widths[i] = strconv.Itoa(width)
+	}
+	return strings.Join(widths, ", ")
+}
+
+// formatBudgets describes the configured output size budgets, or returns
+// "" when there are none
+func formatBudgets(opts config.Options) string {
+	var budgets []string
+	for _, budget := range []struct {
+		format string
+		bytes  int64
+	}{
+		{"all", opts.MaxBytes},
+		{"jpeg", opts.JPEGMaxBytes},
+		{"png", opts.PNGMaxBytes},
+		{"webp", opts.WebPMaxBytes},
+	} {
+		if budget.bytes > 0 {
+			budgets = append(budgets, budget.format+" "+formatBytes(budget.bytes))
+		}
+	}
+	if len(budgets) > 0 && opts.MaxBytesResize {
+		budgets = append(budgets, "shrinking allowed")
+	}
+	return strings.Join(budgets, ", ")
+}
+
+// formatConversions renders source->target format pairs in a stable order
+func formatConversions(conversions map[string]string) string {
+	sources := make([]string, 0, len(conversions))
+	for source := range conversions {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	pairs := make([]string, len(sources))
+	for i, source := range sources {
+		pairs[i] = source + "→" + conversions[source]
+	}
+	return strings.Join(pairs, ", ")
+}
@@ -5,10 +5,10 @@ go 1.25.5
 require (
 	github.com/disintegration/imaging v1.6.2
 	github.com/spf13/cobra v1.10.2
+	golang.org/x/image v0.34.0
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.10 // indirect
-	golang.org/x/image v0.34.0 // indirect
 )
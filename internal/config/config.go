@@ -1,5 +1,10 @@
 package config
 
+import (
+	"image"
+	"image/color"
+)
+
 // Options holds all CLI flags and configuration
 type Options struct {
 	// Input directory path
@@ -17,12 +22,113 @@ type Options struct {
 	// PNG-specific quality (overrides Quality if set)
 	PNGQuality int
 
-	// Resize width in pixels (0 = no resize)
-	Width int
+	// JPEG encoding: "progressive" or "baseline"
+	JPEGMode string
+
+	// JPEG Huffman tables: "optimized" (built per image) or "standard"
+	JPEGHuffman string
+
+	// JPEG chroma subsampling: "420", "422" or "444"
+	Subsampling string
+
+	// Rewrite JPEG sources from their DCT coefficients instead of
+	// re-encoding their pixels
+	JPEGLossless bool
+
+	// PNG encoding: "quantized" (palette sized by quality) or "lossless"
+	PNGMode string
+
+	// Recompress PNGs with the exhaustive Zopfli-style deflate encoder
+	Zopfli bool
+
+	// PNG dithering when reducing colors: "none", "floyd-steinberg" or
+	// "ordered"
+	Dither string
+
+	// Resize width and height in pixels (0 = no resize); one alone keeps
+	// the aspect ratio, both fill that box and crop the rest
+	Width  int
+	Height int
+
+	// Scale in percent (0 = no scaling), used without Width and Height
+	Scale float64
+
+	// Bounds images are scaled down to fit inside (0 = none)
+	MaxWidth      int
+	MaxHeight     int
+	MaxMegapixels float64
+
+	// Never enlarge an image past its source size
+	NoUpscale bool
+
+	// Resampling filter: "lanczos", "catmull-rom", "mitchell", "linear",
+	// "box" or "nearest"
+	Resample string
+
+	// Sigma of the sharpening applied after downscaling (0 = none)
+	Sharpen float64
+
+	// Where to crop when filling a box: "center", "entropy", "edges" or
+	// "skin"
+	Crop string
+
+	// Focal points by image path relative to Input, which crops are centered
+	// on instead
+	FocalPoints map[string]FocalPoint
+
+	// Overlay stamped on images after resizing
+	Watermark Watermark
+
+	// Widths to write extra copies of each image at, named after the width
+	// (e.g. photo-640.jpg), listed in a srcset manifest
+	Sizes []int
+
+	// Output format per input format (e.g. "tiff" -> "jpeg"), overriding
+	// the defaults for WebP, GIF, BMP and TIFF inputs
+	Conversions map[string]string
+
+	// Output format for every input but GIF ("jpeg", "png" or "webp"),
+	// merged into Conversions; empty keeps the per-format targets
+	To string
+
+	// Output format selection: "auto" writes each image in the smallest
+	// candidate format that keeps enough quality; empty follows Conversions
+	Format string
+
+	// Color transparent images are flattened onto for JPEG output (nil =
+	// white)
+	Background color.Color
 
 	// Generate WebP copies
 	WebP bool
 
+	// WebP-specific quality (overrides Quality if set)
+	WebPQuality int
+
+	// WebP encoding: "lossy", "lossless" or "smallest" (keep the smaller
+	// of the two per image)
+	WebPMode string
+
+	// SSIM the output of each image should reach against its source, the
+	// lowest quality doing so replacing the configured one (0 = off)
+	TargetSSIM float64
+
+	// Output size budgets in bytes (0 = none); the per-format ones
+	// override MaxBytes
+	MaxBytes     int64
+	JPEGMaxBytes int64
+	PNGMaxBytes  int64
+	WebPMaxBytes int64
+
+	// Let a size budget shrink images that miss it at the lowest quality
+	// it allows
+	MaxBytesResize bool
+
+	// Minimum saving for a re-encoded file to be written; smaller savings
+	// keep the original. The larger of the two applies.
+	MinSavingBytes   int64
+	MinSavingPercent float64
+
 	// Number of concurrent workers
 	Concurrency int
 
@@ -41,6 +147,52 @@ type Options struct {
 	// Patterns to ignore (comma-separated)
 	IgnorePatterns string
 
-	// Preserve EXIF metadata in JPG files
-	KeepExif bool
+	// Metadata to keep: "all", "none" or groups such as "copyright",
+	// "camera" and "icc"; nil keeps ICC profiles only
+	Metadata []string
+
+	// Rotate and flip JPEGs upright according to their EXIF orientation
+	AutoOrient bool
+
+	// Embedded ICC profile handling: "keep" or "srgb"
+	ICC string
+
+	// Write every file directly into the output root instead of mirroring
+	// the input directory tree
+	Flatten bool
+
+	// What to do when two files map to the same output path
+	// ("error", "suffix" or "skip")
+	OnCollision string
+}
+
+// FocalPoint is the point of an image a crop keeps in view, as fractions of
+// its width and height
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Watermark configures the overlay stamped on images
+type Watermark struct {
+	// Overlay file and its decoded image (nil = no watermark)
+	Path  string
+	Image image.Image
+
+	// Where to place it: "center", an edge ("top") or a corner
+	// ("bottom-right")
+	Position string
+
+	// Width of the overlay and its distance from the edges, in percent of
+	// the output width
+	Scale  float64
+	Margin float64
+
+	// Opacity from 0 (invisible) to 1
+	Opacity float64
+
+	// Globs selecting images by relative path, name or parent directory;
+	// an empty Include selects all
+	Include []string
+	Exclude []string
 }
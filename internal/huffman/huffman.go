@@ -0,0 +1,134 @@
+// Package huffman builds length-limited canonical Huffman codes.
+// It is shared by the WebP, PNG (deflate) and JPEG encoders.
+package huffman
+
+import "sort"
+
+// node is a leaf or package in the package-merge algorithm
+type node struct {
+	weight uint64
+	symbol int // >= 0 for leaves, -1 for packages
+	left   *node
+	right  *node
+}
+
+// Lengths returns the optimal code length for every symbol such that no code
+// is longer than maxBits. Symbols with a zero frequency get length 0. A single
+// used symbol gets length 1.
+func Lengths(freqs []uint32, maxBits int) []uint8 {
+	lengths := make([]uint8, len(freqs))
+
+	leaves := make([]*node, 0, len(freqs))
+	for sym, f := range freqs {
+		if f > 0 {
+			leaves = append(leaves, &node{weight: uint64(f), symbol: sym})
+		}
+	}
+
+	switch len(leaves) {
+	case 0:
+		return lengths
+	case 1:
+		lengths[leaves[0].symbol] = 1
+		return lengths
+	}
+
+	sort.SliceStable(leaves, func(i, j int) bool {
+		return leaves[i].weight < leaves[j].weight
+	})
+
+	// Package-merge: repeatedly pair up the cheapest items and merge the
+	// packages back into the leaf list, once per allowed bit of depth
+	list := leaves
+	for level := 1; level < maxBits; level++ {
+		packages := make([]*node, 0, len(list)/2)
+		for i := 0; i+1 < len(list); i += 2 {
+			packages = append(packages, &node{
+				weight: list[i].weight + list[i+1].weight,
+				symbol: -1,
+				left:   list[i],
+				right:  list[i+1],
+			})
+		}
+		list = mergeNodes(leaves, packages)
+	}
+
+	// Every occurrence of a leaf among the cheapest 2n-2 items adds a bit
+	for _, n := range list[:2*len(leaves)-2] {
+		countLeaves(n, lengths)
+	}
+	return lengths
+}
+
+// mergeNodes merges two weight-sorted lists, preferring leaves on ties
+func mergeNodes(a, b []*node) []*node {
+	out := make([]*node, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].weight <= b[j].weight {
+			out = append(out, a[i])
+			i++
+		} else {
+			out = append(out, b[j])
+			j++
+		}
+	}
+	out = append(out, a[i:]...)
+	return append(out, b[j:]...)
+}
+
+// countLeaves increments the length of every leaf below n
+func countLeaves(n *node, lengths []uint8) {
+	if n.symbol >= 0 {
+		lengths[n.symbol]++
+		return
+	}
+	countLeaves(n.left, lengths)
+	countLeaves(n.right, lengths)
+}
+
+// Codes returns the canonical codes for the given lengths. Codes are assigned
+// in order of increasing length, then increasing symbol value, and are
+// returned most-significant-bit first.
+func Codes(lengths []uint8) []uint16 {
+	var maxLen uint8
+	for _, l := range lengths {
+		if l > maxLen {
+			maxLen = l
+		}
+	}
+
+	count := make([]int, maxLen+1)
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+		}
+	}
+
+	next := make([]int, maxLen+2)
+	code := 0
+	for bits := 1; bits <= int(maxLen); bits++ {
+		code = (code + count[bits-1]) << 1
+		next[bits] = code
+	}
+
+	codes := make([]uint16, len(lengths))
+	for sym, l := range lengths {
+		if l > 0 {
+			codes[sym] = uint16(next[l])
+			next[l]++
+		}
+	}
+	return codes
+}
+
+// Reverse returns the low n bits of code in reverse order, for bit writers
+// that emit the least significant bit first
+func Reverse(code uint16, n uint8) uint16 {
+	var r uint16
+	for i := uint8(0); i < n; i++ {
+		r = r<<1 | code&1
+		code >>= 1
+	}
+	return r
+}
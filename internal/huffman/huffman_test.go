@@ -0,0 +1,46 @@
+package huffman
+
+import "testing"
+
+func TestLengthsRespectLimit(t *testing.T) {
+	// Fibonacci frequencies produce a maximally skewed unrestricted tree
+	freqs := make([]uint32, 30)
+	a, b := uint32(1), uint32(1)
+	for i := range freqs {
+		freqs[i] = a
+		a, b = b, a+b
+	}
+
+	lengths := Lengths(freqs, 7)
+	kraft := 0.0
+	for sym, l := range lengths {
+		if l == 0 || l > 7 {
+			t.Fatalf("symbol %d has invalid length %d", sym, l)
+		}
+		kraft += 1 / float64(uint(1)<<l)
+	}
+	if kraft > 1 {
+		t.Errorf("lengths violate the Kraft inequality: %f", kraft)
+	}
+}
+
+func TestCodesAreCanonical(t *testing.T) {
+	lengths := []uint8{2, 1, 3, 3, 0}
+	want := []uint16{0b10, 0b0, 0b110, 0b111, 0}
+	codes := Codes(lengths)
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Errorf("symbol %d: want code %b, got %b", i, want[i], codes[i])
+		}
+	}
+	if r := Reverse(0b110, 3); r != 0b011 {
+		t.Errorf("Reverse(110, 3) = %b", r)
+	}
+}
+
+func TestSingleSymbol(t *testing.T) {
+	lengths := Lengths([]uint32{0, 0, 5}, 15)
+	if lengths[2] != 1 || lengths[0] != 0 || lengths[1] != 0 {
+		t.Errorf("unexpected lengths %v", lengths)
+	}
+}
@@ -0,0 +1,262 @@
+// Package icc reads ICC color profiles and converts pixels to sRGB from the
+// matrix/TRC profiles used for RGB and gray working spaces, such as Adobe
+// RGB and Display P3, and from the lookup table profiles used for CMYK print
+// conditions, such as Coated FOGRA39.
+package icc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf16"
+)
+
+// Color spaces of profiles, as stored in the header
+const (
+	SpaceRGB  = "RGB"
+	SpaceGray = "GRAY"
+	SpaceCMYK = "CMYK"
+)
+
+const headerSize = 128
+
+var errShort = errors.New("icc: profile is truncated")
+
+// Profile is a parsed ICC profile
+type Profile struct {
+	// Color space of the data the profile describes (SpaceRGB, ...)
+	ColorSpace string
+
+	// Human readable name from the description tag, if any
+	Description string
+
+	tags map[string][]byte
+
+	// Matrix/TRC model: tone curves and, for RGB, the D50 colorants
+	curves    []curve
+	colorants [3][3]float64
+	matrix    bool
+
+	// Lookup table model, for profiles without a matrix
+	lut *lut
+}
+
+// Parse parses an ICC profile
+func Parse(data []byte) (*Profile, error) {
+	if len(data) < headerSize+4 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("icc: not an ICC profile")
+	}
+
+	p := &Profile{
+		ColorSpace: strings.TrimRight(string(data[16:20]), " "),
+		tags:       make(map[string][]byte),
+	}
+	count := int(binary.BigEndian.Uint32(data[headerSize:]))
+	if headerSize+4+12*count > len(data) {
+		return nil, errShort
+	}
+	for i := 0; i < count; i++ {
+		entry := data[headerSize+4+12*i:]
+		offset := int(binary.BigEndian.Uint32(entry[4:]))
+		size := int(binary.BigEndian.Uint32(entry[8:]))
+		if offset < 0 || size < 8 || offset+size > len(data) {
+			return nil, fmt.Errorf("icc: tag %q is out of bounds", entry[:4])
+		}
+		p.tags[string(entry[:4])] = data[offset : offset+size]
+	}
+
+	p.Description = p.text("desc")
+	p.parseMatrix()
+	if channels := map[string]int{SpaceGray: 1, SpaceRGB: 3, SpaceCMYK: 4}[p.ColorSpace]; !p.matrix && channels > 0 {
+		// Profiles with an unusable table are still reported, just not converted
+		p.lut, _ = p.parseLUT(channels, strings.TrimRight(string(data[20:24]), " "))
+	}
+	return p, nil
+}
+
+// CanConvert reports whether ToSRGB supports the profile
+func (p *Profile) CanConvert() bool {
+	return p.matrix || p.lut != nil
+}
+
+// parseMatrix reads the tone curves and colorants of a matrix/TRC profile.
+// Profiles that lack them are left without a matrix model.
+func (p *Profile) parseMatrix() {
+	switch p.ColorSpace {
+	case SpaceGray:
+		c, err := parseCurve(p.tags["kTRC"])
+		if err != nil {
+			return
+		}
+		p.curves = []curve{c}
+	case SpaceRGB:
+		for i, name := range []string{"r", "g", "b"} {
+			c, err := parseCurve(p.tags[name+"TRC"])
+			if err != nil {
+				return
+			}
+			xyz, err := parseXYZ(p.tags[name+"XYZ"])
+			if err != nil {
+				return
+			}
+			p.curves = append(p.curves, c)
+			for row := range 3 {
+				p.colorants[row][i] = xyz[row]
+			}
+		}
+	default:
+		return
+	}
+	p.matrix = true
+}
+
+// text returns the first string of a textDescriptionType or
+// multiLocalizedUnicodeType tag
+func (p *Profile) text(sig string) string {
+	tag := p.tags[sig]
+	if len(tag) < 12 {
+		return ""
+	}
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n == 0 || 12+n > len(tag) {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+n]), "\x00")
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+		length := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+length > len(tag) {
+			return ""
+		}
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
+
+// parseXYZ reads the single value of an XYZType tag
+func parseXYZ(tag []byte) ([3]float64, error) {
+	var xyz [3]float64
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return xyz, errors.New("icc: missing XYZ tag")
+	}
+	for i := range xyz {
+		xyz[i] = s15Fixed16(tag[8+4*i:])
+	}
+	return xyz, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// curve maps a value in [0, 1], such as an encoded channel, to another,
+// such as linear light
+type curve func(float64) float64
+
+// tableCurve interpolates linearly between evenly spaced samples
+func tableCurve(table []float64) curve {
+	n := len(table)
+	return func(x float64) float64 {
+		pos := math.Max(x, 0) * float64(n-1)
+		i := int(pos)
+		if i >= n-1 {
+			return table[n-1]
+		}
+		return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+	}
+}
+
+// curveSize returns the length of a curveType or parametricCurveType tag,
+// padded to four bytes as in lutAToBType
+func curveSize(tag []byte) int {
+	if len(tag) < 12 {
+		return 0
+	}
+	var n int
+	switch string(tag[:4]) {
+	case "curv":
+		n = 12 + 2*int(binary.BigEndian.Uint32(tag[8:]))
+	case "para":
+		kind := int(binary.BigEndian.Uint16(tag[8:]))
+		if kind > 4 {
+			return 0
+		}
+		n = 12 + 4*[]int{1, 3, 4, 5, 7}[kind]
+	}
+	return (n + 3) &^ 3
+}
+
+// parseCurve reads a curveType or parametricCurveType tag
+func parseCurve(tag []byte) (curve, error) {
+	if len(tag) < 12 {
+		return nil, errors.New("icc: missing tone curve")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if 12+2*n > len(tag) {
+			return nil, errShort
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return tableCurve(table), nil
+
+	case "para":
+		kind := binary.BigEndian.Uint16(tag[8:])
+		if kind > 4 {
+			return nil, fmt.Errorf("icc: unknown parametric curve %d", kind)
+		}
+		params := []int{1, 3, 4, 5, 7}[kind]
+		if 12+4*params > len(tag) {
+			return nil, errShort
+		}
+		// g, a, b, c, d, e, f with defaults that reduce every kind to kind 4
+		v := [7]float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < params; i++ {
+			v[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := v[0], v[1], v[2], v[3], v[4], v[5], v[6]
+		switch kind {
+		case 1, 2:
+			// Defined for x >= -b/a, constant below
+			if a != 0 {
+				d = -b / a
+			}
+		}
+		if kind == 2 {
+			e, f = c, c
+			c = 0
+		}
+		return func(x float64) float64 {
+			if x >= d {
+				base := a*x + b
+				if base < 0 {
+					base = 0
+				}
+				return math.Pow(base, g) + e
+			}
+			return c*x + f
+		}, nil
+	}
+	return nil, fmt.Errorf("icc: unknown curve type %q", tag[:4])
+}
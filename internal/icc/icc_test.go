@@ -0,0 +1,313 @@
+package icc
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+	"unicode/utf16"
+)
+
+// D50 colorants of Display P3
+var displayP3 = [3][3]float64{
+	{0.5151, 0.2920, 0.1571},
+	{0.2412, 0.6922, 0.0666},
+	{-0.0011, 0.0419, 0.7841},
+}
+
+// buildProfile assembles a matrix/TRC profile from tag data. RGB profiles
+// get the colorants and share one tone curve across channels; gray ones get
+// just the curve.
+func buildProfile(space string, colorants [3][3]float64, trc []byte, desc []byte) []byte {
+	tags := map[string][]byte{"desc": desc}
+	if space == SpaceGray {
+		tags["kTRC"] = trc
+	} else {
+		for i, name := range []string{"r", "g", "b"} {
+			xyz := append([]byte("XYZ \x00\x00\x00\x00"), make([]byte, 12)...)
+			for row := range 3 {
+				binary.BigEndian.PutUint32(xyz[8+4*row:], uint32(int32(math.Round(colorants[row][i]*65536))))
+			}
+			tags[name+"XYZ"] = xyz
+			tags[name+"TRC"] = trc
+		}
+	}
+
+	names := []string{"desc", "rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC", "kTRC"}
+	var present []string
+	for _, name := range names {
+		if tags[name] != nil {
+			present = append(present, name)
+		}
+	}
+
+	data := make([]byte, headerSize+4+12*len(present))
+	copy(data[16:], (space + "    ")[:4])
+	copy(data[20:], "XYZ ")
+	copy(data[36:], "acsp")
+	binary.BigEndian.PutUint32(data[headerSize:], uint32(len(present)))
+	for i, name := range present {
+		entry := data[headerSize+4+12*i:]
+		copy(entry, name)
+		binary.BigEndian.PutUint32(entry[4:], uint32(len(data)))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tags[name])))
+		data = append(data, tags[name]...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+	return data
+}
+
+// paraCurve returns a parametricCurveType tag
+func paraCurve(kind uint16, params ...float64) []byte {
+	tag := []byte("para\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(tag[8:], kind)
+	for _, p := range params {
+		tag = binary.BigEndian.AppendUint32(tag, uint32(int32(math.Round(p*65536))))
+	}
+	return tag
+}
+
+// srgbCurve is the sRGB transfer function as a parametric curve
+var srgbCurve = paraCurve(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)
+
+func textDesc(s string) []byte {
+	tag := []byte("desc\x00\x00\x00\x00")
+	tag = binary.BigEndian.AppendUint32(tag, uint32(len(s)+1))
+	return append(append(tag, s...), 0)
+}
+
+func mlucDesc(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	tag := []byte("mluc\x00\x00\x00\x00")
+	tag = binary.BigEndian.AppendUint32(tag, 1)
+	tag = binary.BigEndian.AppendUint32(tag, 12)
+	tag = append(tag, "enUS"...)
+	tag = binary.BigEndian.AppendUint32(tag, uint32(2*len(units)))
+	tag = binary.BigEndian.AppendUint32(tag, 28)
+	for _, u := range units {
+		tag = binary.BigEndian.AppendUint16(tag, u)
+	}
+	return tag
+}
+
+func TestParse(t *testing.T) {
+	p, err := Parse(buildProfile(SpaceRGB, displayP3, srgbCurve, mlucDesc("Display P3")))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if p.ColorSpace != SpaceRGB || p.Description != "Display P3" || !p.CanConvert() {
+		t.Errorf("unexpected profile %+v", p)
+	}
+	if p.IsSRGB() {
+		t.Error("Display P3 mistaken for sRGB")
+	}
+
+	srgb, err := Parse(buildProfile(SpaceRGB, srgbColorants, srgbCurve, textDesc("sRGB IEC61966-2.1")))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if srgb.Description != "sRGB IEC61966-2.1" || !srgb.IsSRGB() {
+		t.Errorf("sRGB profile not recognized: %+v", srgb)
+	}
+
+	// A CMYK profile without a lookup table parses but cannot be converted
+	cmyk := buildProfile(SpaceCMYK, [3][3]float64{}, nil, textDesc("Coated FOGRA39"))
+	if p, err := Parse(cmyk); err != nil || p.CanConvert() || p.ColorSpace != SpaceCMYK {
+		t.Errorf("unexpected CMYK profile %+v, %v", p, err)
+	}
+
+	if _, err := Parse([]byte("not a profile")); err == nil {
+		t.Error("expected garbage to be rejected")
+	}
+}
+
+func TestCurves(t *testing.T) {
+	table := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x40\x00\xff\xff")
+	for _, tc := range []struct {
+		name string
+		tag  []byte
+		in   float64
+		want float64
+	}{
+		{"identity", []byte("curv\x00\x00\x00\x00\x00\x00\x00\x00"), 0.3, 0.3},
+		{"gamma", []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x00"), 0.5, 0.25},
+		{"table", table, 0.25, 0.125},
+		{"para 0", paraCurve(0, 2), 0.5, 0.25},
+		{"para 1 below", paraCurve(1, 1, 2, -0.5), 0.2, 0},
+		{"para 2", paraCurve(2, 1, 2, -0.5, 0.1), 0.5, 0.6},
+		{"para 3 linear", srgbCurve, 0.02, 0.02 / 12.92},
+		{"para 3 power", srgbCurve, 0.5, srgbDecode(0.5)},
+		{"para 4", paraCurve(4, 1, 1, 0, 2, 0.5, 0.1, 0.05), 0.25, 0.55},
+	} {
+		c, err := parseCurve(tc.tag)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := c(tc.in); math.Abs(got-tc.want) > 1e-3 {
+			t.Errorf("%s: f(%v) = %v, want %v", tc.name, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestToSRGB(t *testing.T) {
+	p3, _ := Parse(buildProfile(SpaceRGB, displayP3, srgbCurve, nil))
+	srgb, _ := Parse(buildProfile(SpaceRGB, srgbColorants, srgbCurve, nil))
+
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{234, 51, 35, 255}) // sRGB red in Display P3
+	img.SetNRGBA(1, 0, color.NRGBA{128, 128, 128, 200})
+	img.SetNRGBA(2, 0, color.NRGBA{255, 255, 255, 255})
+	img.SetNRGBA(3, 0, color.NRGBA{255, 0, 0, 255}) // outside sRGB, clipped
+
+	out := p3.ToSRGB(img).(*image.NRGBA)
+	near := func(got, want color.NRGBA, tolerance int) bool {
+		d := func(a, b uint8) bool { return math.Abs(float64(a)-float64(b)) <= float64(tolerance) }
+		return d(got.R, want.R) && d(got.G, want.G) && d(got.B, want.B) && got.A == want.A
+	}
+	for i, want := range []color.NRGBA{{255, 0, 0, 255}, {128, 128, 128, 200}, {255, 255, 255, 255}, {255, 0, 0, 255}} {
+		if got := out.NRGBAAt(i, 0); !near(got, want, 3) {
+			t.Errorf("pixel %d: got %v, want about %v", i, got, want)
+		}
+	}
+
+	// An sRGB profile converts to the same pixels
+	ramp := image.NewNRGBA(image.Rect(0, 0, 256, 1))
+	for x := range 256 {
+		ramp.SetNRGBA(x, 0, color.NRGBA{uint8(x), uint8(255 - x), uint8(x / 2), 255})
+	}
+	same := srgb.ToSRGB(ramp).(*image.NRGBA)
+	for x := range 256 {
+		if got, want := same.NRGBAAt(x, 0), ramp.NRGBAAt(x, 0); !near(got, want, 1) {
+			t.Fatalf("sRGB round trip changed %v to %v", want, got)
+		}
+	}
+
+	// A linear gray profile brightens mid gray and keeps the image gray
+	linear, _ := Parse(buildProfile(SpaceGray, [3][3]float64{}, []byte("curv\x00\x00\x00\x00\x00\x00\x00\x00"), nil))
+	gray := image.NewGray(image.Rect(0, 0, 1, 1))
+	gray.Pix[0] = 128
+	g, ok := linear.ToSRGB(gray).(*image.Gray)
+	if !ok {
+		t.Fatal("gray image did not stay gray")
+	}
+	if want := uint8(math.Round(srgbEncode(128.0/255) * 255)); g.Pix[0] != want {
+		t.Errorf("linear gray 128 became %d, want %d", g.Pix[0], want)
+	}
+}
+
+// lutProfile assembles a CMYK profile whose A2B0 tag is lut
+func lutProfile(pcs string, lut []byte) []byte {
+	data := make([]byte, headerSize+4+12)
+	copy(data[16:], "CMYK")
+	copy(data[20:], pcs)
+	copy(data[36:], "acsp")
+	binary.BigEndian.PutUint32(data[headerSize:], 1)
+	entry := data[headerSize+4:]
+	copy(entry, "A2B0")
+	binary.BigEndian.PutUint32(entry[4:], uint32(len(data)))
+	binary.BigEndian.PutUint32(entry[8:], uint32(len(lut)))
+	data = append(data, lut...)
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+	return data
+}
+
+// identityCurve is a curveType tag that passes values through
+var identityCurve = []byte("curv\x00\x00\x00\x00\x00\x00\x00\x00")
+
+func TestLUT(t *testing.T) {
+	// lut16Type to XYZ with a two point grid holding naive CMYK: every
+	// corner is white, black or a primary
+	mft2 := []byte("mft2\x00\x00\x00\x00\x04\x03\x02\x00")
+	for i := range 9 {
+		if i%4 == 0 {
+			mft2 = binary.BigEndian.AppendUint32(mft2, 1<<16)
+		} else {
+			mft2 = binary.BigEndian.AppendUint32(mft2, 0)
+		}
+	}
+	mft2 = binary.BigEndian.AppendUint16(mft2, 2)
+	mft2 = binary.BigEndian.AppendUint16(mft2, 2)
+	for range 4 {
+		mft2 = append(mft2, 0, 0, 0xff, 0xff)
+	}
+	for node := range 16 {
+		c, m, y, k := node>>3&1, node>>2&1, node>>1&1, node&1
+		rgb := [3]float64{float64((1 - c) * (1 - k)), float64((1 - m) * (1 - k)), float64((1 - y) * (1 - k))}
+		for row := range 3 {
+			xyz := srgbColorants[row][0]*rgb[0] + srgbColorants[row][1]*rgb[1] + srgbColorants[row][2]*rgb[2]
+			mft2 = binary.BigEndian.AppendUint16(mft2, uint16(math.Round(xyz*32768)))
+		}
+	}
+	for range 3 {
+		mft2 = append(mft2, 0, 0, 0xff, 0xff)
+	}
+
+	// lutAToBType to Lab: paper white at no ink, mid gray elsewhere
+	mab := []byte("mAB \x00\x00\x00\x00\x04\x03\x00\x00")
+	bOff := 32
+	clutOff := bOff + 3*len(identityCurve)
+	aOff := clutOff + 20 + 16*3
+	for _, off := range []int{bOff, 0, 0, clutOff, aOff} {
+		mab = binary.BigEndian.AppendUint32(mab, uint32(off))
+	}
+	for range 3 {
+		mab = append(mab, identityCurve...)
+	}
+	mab = append(mab, 2, 2, 2, 2)
+	mab = append(mab, make([]byte, 12)...)
+	mab = append(mab, 1, 0, 0, 0)
+	for node := range 16 {
+		if node == 0 {
+			mab = append(mab, 255, 128, 128)
+		} else {
+			mab = append(mab, 128, 128, 128)
+		}
+	}
+	for range 4 {
+		mab = append(mab, identityCurve...)
+	}
+
+	near := func(got color.NRGBA, want [3]uint8) bool {
+		d := func(a, b uint8) bool { return math.Abs(float64(a)-float64(b)) <= 2 }
+		return d(got.R, want[0]) && d(got.G, want[1]) && d(got.B, want[2]) && got.A == 255
+	}
+	for _, tc := range []struct {
+		name    string
+		profile []byte
+		ink     [][4]uint8
+		want    [][3]uint8
+	}{
+		{
+			"lut16 XYZ", lutProfile("XYZ ", mft2),
+			[][4]uint8{{0, 0, 0, 0}, {255, 0, 0, 0}, {0, 255, 255, 0}, {0, 0, 0, 255}, {0, 0, 0, 128}},
+			[][3]uint8{{255, 255, 255}, {0, 255, 255}, {255, 0, 0}, {0, 0, 0}, {188, 188, 188}},
+		},
+		{
+			"AToB Lab", lutProfile("Lab ", mab),
+			[][4]uint8{{0, 0, 0, 0}, {0, 0, 0, 255}, {255, 255, 255, 255}},
+			[][3]uint8{{255, 255, 255}, {119, 119, 119}, {119, 119, 119}},
+		},
+	} {
+		p, err := Parse(tc.profile)
+		if err != nil {
+			t.Fatalf("%s: Parse failed: %v", tc.name, err)
+		}
+		if !p.CanConvert() || p.IsSRGB() {
+			t.Fatalf("%s: lookup table profile not convertible", tc.name)
+		}
+		img := image.NewCMYK(image.Rect(0, 0, len(tc.ink), 1))
+		for x, ink := range tc.ink {
+			img.SetCMYK(x, 0, color.CMYK{ink[0], ink[1], ink[2], ink[3]})
+		}
+		out := p.ToSRGB(img).(*image.NRGBA)
+		for x, want := range tc.want {
+			if got := out.NRGBAAt(x, 0); !near(got, want) {
+				t.Errorf("%s: ink %v became %v, want about %v", tc.name, tc.ink[x], got, want)
+			}
+		}
+	}
+}
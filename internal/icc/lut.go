@@ -0,0 +1,309 @@
+package icc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// lut is a device to PCS transform from an AToB tag: input curves, a
+// multidimensional lookup table, then output curves and, for lutAToBType,
+// a matrix stage between them
+type lut struct {
+	inputs, outputs int
+
+	inCurves []curve
+
+	// Grid points per input and the table entries, outputs per node,
+	// scaled to [0, 1]; no table means the inputs pass through
+	grid  []int
+	table []float64
+
+	// lutAToBType only: M curves and a 3x3 matrix with offsets
+	mCurves []curve
+	matrix  *[12]float64
+
+	outCurves []curve
+
+	// toXYZ converts the final [0, 1] outputs to D50 XYZ
+	toXYZ func([3]float64) [3]float64
+}
+
+// Reference white of the profile connection space
+var d50 = [3]float64{0.9642, 1.0, 0.8249}
+
+// maxInputs is the most channels a supported device space has (CMYK)
+const maxInputs = 4
+
+// parseLUT reads the first AToB tag (perceptual, then colorimetric, then
+// saturation intent) of a profile with inputs channels
+func (p *Profile) parseLUT(inputs int, pcs string) (*lut, error) {
+	for _, sig := range []string{"A2B0", "A2B1", "A2B2"} {
+		tag := p.tags[sig]
+		if tag == nil {
+			continue
+		}
+		var l *lut
+		var err error
+		switch string(tag[:4]) {
+		case "mft1":
+			l, err = parseLutN(tag, 1)
+		case "mft2":
+			l, err = parseLutN(tag, 2)
+		case "mAB ":
+			l, err = parseLutAToB(tag)
+		default:
+			return nil, errors.New("icc: unknown lookup table type")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if l.inputs != inputs || l.inputs > maxInputs || l.outputs != 3 {
+			return nil, errors.New("icc: lookup table has the wrong number of channels")
+		}
+
+		switch {
+		case pcs == "XYZ":
+			// u1Fixed15: 0x8000 is 1.0
+			l.toXYZ = func(v [3]float64) [3]float64 {
+				const scale = 65535.0 / 32768
+				return [3]float64{v[0] * scale, v[1] * scale, v[2] * scale}
+			}
+		case string(tag[:4]) == "mft2":
+			// Legacy 16-bit Lab: L* 100 is 0xff00, a* and b* 0 are 0x8000
+			l.toXYZ = func(v [3]float64) [3]float64 {
+				return labToXYZ(v[0]*65535/65280*100, v[1]*65535/256-128, v[2]*65535/256-128)
+			}
+		default:
+			l.toXYZ = func(v [3]float64) [3]float64 {
+				return labToXYZ(v[0]*100, v[1]*255-128, v[2]*255-128)
+			}
+		}
+		return l, nil
+	}
+	return nil, errors.New("icc: no device to PCS lookup table")
+}
+
+// parseLutN reads a lut8Type (bytes 1) or lut16Type (bytes 2) tag
+func parseLutN(tag []byte, bytes int) (*lut, error) {
+	if len(tag) < 52 {
+		return nil, errShort
+	}
+	l := &lut{inputs: int(tag[8]), outputs: int(tag[9])}
+	points := int(tag[10])
+	if l.inputs == 0 || l.outputs == 0 || points < 2 {
+		return nil, errors.New("icc: empty lookup table")
+	}
+
+	inEntries, outEntries, pos := 256, 256, 48
+	if bytes == 2 {
+		inEntries = int(binary.BigEndian.Uint16(tag[48:]))
+		outEntries = int(binary.BigEndian.Uint16(tag[50:]))
+		pos = 52
+	}
+	if inEntries < 2 || outEntries < 2 {
+		return nil, errors.New("icc: lookup table curves are too short")
+	}
+
+	nodes := 1
+	for i := 0; i < l.inputs; i++ {
+		nodes *= points
+		l.grid = append(l.grid, points)
+	}
+	size := bytes * (l.inputs*inEntries + nodes*l.outputs + l.outputs*outEntries)
+	if pos+size > len(tag) {
+		return nil, errShort
+	}
+
+	read := func(n int) []float64 {
+		values := make([]float64, n)
+		for i := range values {
+			if bytes == 1 {
+				values[i] = float64(tag[pos]) / 255
+			} else {
+				values[i] = float64(binary.BigEndian.Uint16(tag[pos:])) / 65535
+			}
+			pos += bytes
+		}
+		return values
+	}
+	for i := 0; i < l.inputs; i++ {
+		l.inCurves = append(l.inCurves, tableCurve(read(inEntries)))
+	}
+	l.table = read(nodes * l.outputs)
+	for i := 0; i < l.outputs; i++ {
+		l.outCurves = append(l.outCurves, tableCurve(read(outEntries)))
+	}
+	return l, nil
+}
+
+// parseLutAToB reads a lutAToBType tag
+func parseLutAToB(tag []byte) (*lut, error) {
+	if len(tag) < 32 {
+		return nil, errShort
+	}
+	l := &lut{inputs: int(tag[8]), outputs: int(tag[9])}
+	offset := func(at int) int { return int(binary.BigEndian.Uint32(tag[at:])) }
+	bOff, matrixOff, mOff, clutOff, aOff := offset(12), offset(16), offset(20), offset(24), offset(28)
+
+	curves := func(at, n int) ([]curve, error) {
+		var out []curve
+		for i := 0; i < n; i++ {
+			if at >= len(tag) {
+				return nil, errShort
+			}
+			c, err := parseCurve(tag[at:])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, c)
+			at += curveSize(tag[at:])
+		}
+		return out, nil
+	}
+
+	var err error
+	if bOff == 0 {
+		return nil, errors.New("icc: lookup table without B curves")
+	}
+	if l.outCurves, err = curves(bOff, l.outputs); err != nil {
+		return nil, err
+	}
+	if aOff != 0 {
+		if l.inCurves, err = curves(aOff, l.inputs); err != nil {
+			return nil, err
+		}
+	}
+	if mOff != 0 {
+		if l.mCurves, err = curves(mOff, l.outputs); err != nil {
+			return nil, err
+		}
+	}
+	if matrixOff != 0 {
+		if matrixOff+48 > len(tag) {
+			return nil, errShort
+		}
+		var m [12]float64
+		for i := range m {
+			m[i] = s15Fixed16(tag[matrixOff+4*i:])
+		}
+		l.matrix = &m
+	}
+
+	if clutOff != 0 {
+		if clutOff+20 > len(tag) || l.inputs > 16 {
+			return nil, errShort
+		}
+		nodes := 1
+		for i := 0; i < l.inputs; i++ {
+			points := int(tag[clutOff+i])
+			if points < 2 {
+				return nil, errors.New("icc: lookup table grid is too small")
+			}
+			l.grid = append(l.grid, points)
+			nodes *= points
+		}
+		precision := int(tag[clutOff+16])
+		pos := clutOff + 20
+		if (precision != 1 && precision != 2) || pos+precision*nodes*l.outputs > len(tag) {
+			return nil, errShort
+		}
+		l.table = make([]float64, nodes*l.outputs)
+		for i := range l.table {
+			if precision == 1 {
+				l.table[i] = float64(tag[pos+i]) / 255
+			} else {
+				l.table[i] = float64(binary.BigEndian.Uint16(tag[pos+2*i:])) / 65535
+			}
+		}
+	} else if l.inputs != l.outputs {
+		return nil, errors.New("icc: lookup table without grid changes the channel count")
+	}
+	return l, nil
+}
+
+// eval transforms device values in [0, 1] to D50 XYZ
+func (l *lut) eval(in [maxInputs]float64) [3]float64 {
+	for i, c := range l.inCurves {
+		in[i] = clamp01(c(in[i]))
+	}
+
+	var out [3]float64
+	if l.table != nil {
+		out = l.interpolate(in)
+	} else {
+		copy(out[:], in[:3])
+	}
+	for i, c := range l.mCurves {
+		out[i] = clamp01(c(out[i]))
+	}
+	if m := l.matrix; m != nil {
+		out = [3]float64{
+			clamp01(m[0]*out[0] + m[1]*out[1] + m[2]*out[2] + m[9]),
+			clamp01(m[3]*out[0] + m[4]*out[1] + m[5]*out[2] + m[10]),
+			clamp01(m[6]*out[0] + m[7]*out[1] + m[8]*out[2] + m[11]),
+		}
+	}
+	for i, c := range l.outCurves {
+		out[i] = clamp01(c(out[i]))
+	}
+	return l.toXYZ(out)
+}
+
+// interpolate looks v up in the grid, blending the surrounding nodes
+// multilinearly. The first input varies slowest.
+func (l *lut) interpolate(v [maxInputs]float64) [3]float64 {
+	n := l.inputs
+	var base, strides [maxInputs]int
+	var frac [maxInputs]float64
+	stride := l.outputs
+	for i := n - 1; i >= 0; i-- {
+		strides[i] = stride
+		stride *= l.grid[i]
+
+		pos := v[i] * float64(l.grid[i]-1)
+		base[i] = min(int(pos), l.grid[i]-2)
+		frac[i] = pos - float64(base[i])
+	}
+
+	var out [3]float64
+	for corner := 0; corner < 1<<n; corner++ {
+		weight, index := 1.0, 0
+		for i := 0; i < n; i++ {
+			if corner&(1<<i) != 0 {
+				weight *= frac[i]
+				index += (base[i] + 1) * strides[i]
+			} else {
+				weight *= 1 - frac[i]
+				index += base[i] * strides[i]
+			}
+		}
+		if weight == 0 {
+			continue
+		}
+		for o := range out {
+			out[o] += weight * l.table[index+o]
+		}
+	}
+	return out
+}
+
+// labToXYZ converts CIE Lab relative to D50 to XYZ
+func labToXYZ(L, a, b float64) [3]float64 {
+	fy := (L + 16) / 116
+	f := [3]float64{fy + a/500, fy, fy - b/200}
+	var xyz [3]float64
+	for i, t := range f {
+		if t > 6.0/29 {
+			xyz[i] = t * t * t
+		} else {
+			xyz[i] = 3 * (6.0 / 29) * (6.0 / 29) * (t - 4.0/29)
+		}
+		xyz[i] *= d50[i]
+	}
+	return xyz
+}
+
+func clamp01(v float64) float64 {
+	return math.Min(math.Max(v, 0), 1)
+}
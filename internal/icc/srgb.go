@@ -0,0 +1,238 @@
+package icc
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// fromXYZD50 converts D50 XYZ, the profile connection space, to linear
+// sRGB (Bradford-adapted from D65)
+var fromXYZD50 = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// srgbColorants are the D50 colorants of sRGB, for recognizing profiles
+// that describe it
+var srgbColorants = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// Tolerances for IsSRGB: colorants are stored with 16 fractional bits and
+// rounded differently by each profile vendor
+const (
+	colorantTolerance = 0.002
+	curveTolerance    = 0.5 / 255
+)
+
+// srgbDecode converts an sRGB encoded value in [0, 1] to linear light
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// srgbEncode converts linear light in [0, 1] to an sRGB encoded value
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// encodeTableSize is the resolution of the linear to sRGB lookup table,
+// fine enough to resolve the darkest 8-bit sRGB steps
+const encodeTableSize = 1 << 16
+
+// encodeTable maps linear light, scaled to encodeTableSize-1, to 8-bit sRGB
+var encodeTable = func() []uint8 {
+	t := make([]uint8, encodeTableSize)
+	for i := range t {
+		t[i] = uint8(math.Round(srgbEncode(float64(i)/(encodeTableSize-1)) * 255))
+	}
+	return t
+}()
+
+func encode8(linear float64) uint8 {
+	if linear <= 0 {
+		return 0
+	}
+	if linear >= 1 {
+		return 255
+	}
+	return encodeTable[int(linear*(encodeTableSize-1)+0.5)]
+}
+
+// IsSRGB reports whether the profile describes sRGB closely enough that
+// its pixels need no conversion
+func (p *Profile) IsSRGB() bool {
+	if !p.matrix || p.ColorSpace != SpaceRGB {
+		return false
+	}
+	for row := range 3 {
+		for col := range 3 {
+			if math.Abs(p.colorants[row][col]-srgbColorants[row][col]) > colorantTolerance {
+				return false
+			}
+		}
+	}
+	for _, c := range p.curves {
+		for i := 0; i <= 16; i++ {
+			x := float64(i) / 16
+			if math.Abs(srgbEncode(c(x))-x) > curveTolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ToSRGB converts img from the profile's color space to sRGB. Alpha is kept;
+// gray images stay gray with matrix/TRC profiles. CMYK profiles read the ink
+// of *image.CMYK images. It panics if the profile cannot be converted (see
+// CanConvert).
+func (p *Profile) ToSRGB(img image.Image) image.Image {
+	if !p.matrix {
+		if p.lut == nil {
+			panic("icc: profile has no matrix/TRC or lookup table model")
+		}
+		return p.lutToSRGB(img)
+	}
+
+	// Linear light of every 8-bit input level, per channel
+	var linear [3][256]float64
+	for ch := range linear {
+		c := p.curves[min(ch, len(p.curves)-1)]
+		for v := range 256 {
+			linear[ch][v] = c(float64(v) / 255)
+		}
+	}
+
+	b := img.Bounds()
+	if gray, ok := img.(*image.Gray); ok && p.ColorSpace == SpaceGray {
+		out := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+		var table [256]uint8
+		for v := range table {
+			table[v] = encode8(linear[0][v])
+		}
+		for y := 0; y < b.Dy(); y++ {
+			src := gray.Pix[y*gray.Stride : y*gray.Stride+b.Dx()]
+			dst := out.Pix[y*out.Stride:]
+			for x, v := range src {
+				dst[x] = table[v]
+			}
+		}
+		return out
+	}
+
+	// Linear source RGB to linear sRGB in one matrix; gray maps D50 white
+	// to sRGB white, so it only needs its curve
+	m := [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	if p.ColorSpace == SpaceRGB {
+		for row := range 3 {
+			for col := range 3 {
+				m[row][col] = 0
+				for k := range 3 {
+					m[row][col] += fromXYZD50[row][k] * p.colorants[k][col]
+				}
+			}
+		}
+	}
+
+	src, ok := img.(*image.NRGBA)
+	if !ok || src.Rect.Min != (image.Point{}) {
+		src = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+	}
+
+	out := image.NewNRGBA(src.Rect)
+	for y := 0; y < b.Dy(); y++ {
+		in := src.Pix[y*src.Stride : y*src.Stride+4*b.Dx()]
+		dst := out.Pix[y*out.Stride:]
+		for i := 0; i < len(in); i += 4 {
+			var rgb [3]float64
+			if p.ColorSpace == SpaceGray {
+				// Gray images stored as color use the red channel
+				rgb = [3]float64{linear[0][in[i]], linear[0][in[i]], linear[0][in[i]]}
+			} else {
+				rgb = [3]float64{linear[0][in[i]], linear[1][in[i+1]], linear[2][in[i+2]]}
+			}
+			for ch := range 3 {
+				dst[i+ch] = encode8(m[ch][0]*rgb[0] + m[ch][1]*rgb[1] + m[ch][2]*rgb[2])
+			}
+			dst[i+3] = in[i+3]
+		}
+	}
+	return out
+}
+
+// lutCacheSize bounds the colors lutToSRGB remembers, for photographs
+// where few repeat
+const lutCacheSize = 1 << 18
+
+// lutToSRGB converts img through the profile's lookup table. Results are
+// cached per input color, since print images repeat flat tints.
+func (p *Profile) lutToSRGB(img image.Image) image.Image {
+	b := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	cache := make(map[[maxInputs]uint8][3]uint8)
+	convert := func(key [maxInputs]uint8) [3]uint8 {
+		if rgb, ok := cache[key]; ok {
+			return rgb
+		}
+		var in [maxInputs]float64
+		for i, v := range key {
+			in[i] = float64(v) / 255
+		}
+		xyz := p.lut.eval(in)
+		var rgb [3]uint8
+		for ch := range 3 {
+			rgb[ch] = encode8(fromXYZD50[ch][0]*xyz[0] + fromXYZD50[ch][1]*xyz[1] + fromXYZD50[ch][2]*xyz[2])
+		}
+		if len(cache) < lutCacheSize {
+			cache[key] = rgb
+		}
+		return rgb
+	}
+
+	if p.ColorSpace == SpaceCMYK {
+		src, ok := img.(*image.CMYK)
+		if !ok || src.Rect.Min != (image.Point{}) {
+			src = image.NewCMYK(image.Rect(0, 0, b.Dx(), b.Dy()))
+			draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+		}
+		for y := 0; y < b.Dy(); y++ {
+			in := src.Pix[y*src.Stride : y*src.Stride+4*b.Dx()]
+			dst := out.Pix[y*out.Stride:]
+			for i := 0; i < len(in); i += 4 {
+				rgb := convert([maxInputs]uint8{in[i], in[i+1], in[i+2], in[i+3]})
+				copy(dst[i:], rgb[:])
+				dst[i+3] = 0xff
+			}
+		}
+		return out
+	}
+
+	src, ok := img.(*image.NRGBA)
+	if !ok || src.Rect.Min != (image.Point{}) {
+		src = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+	}
+	for y := 0; y < b.Dy(); y++ {
+		in := src.Pix[y*src.Stride : y*src.Stride+4*b.Dx()]
+		dst := out.Pix[y*out.Stride:]
+		for i := 0; i < len(in); i += 4 {
+			// Gray images stored as color use the red channel
+			key := [maxInputs]uint8{in[i], in[i+1], in[i+2]}
+			rgb := convert(key)
+			copy(dst[i:], rgb[:])
+			dst[i+3] = in[i+3]
+		}
+	}
+	return out
+}
@@ -0,0 +1,256 @@
+package jpeg
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// zigzag maps the position of a coefficient in a scan to its position in
+// the block
+var zigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// baseQuant are the luminance and chrominance quantization tables of
+// section K.1 of the specification, which quality scales
+var baseQuant = [2][64]uint16{
+	{
+		16, 11, 10, 16, 24, 40, 51, 61,
+		12, 12, 14, 19, 26, 58, 60, 55,
+		14, 13, 16, 24, 40, 57, 69, 56,
+		14, 17, 22, 29, 51, 87, 80, 62,
+		18, 22, 37, 56, 68, 109, 103, 77,
+		24, 35, 55, 64, 81, 104, 113, 92,
+		49, 64, 78, 87, 103, 121, 120, 101,
+		72, 92, 95, 98, 112, 100, 103, 99,
+	},
+	{
+		17, 18, 24, 47, 99, 99, 99, 99,
+		18, 21, 26, 66, 99, 99, 99, 99,
+		24, 26, 56, 99, 99, 99, 99, 99,
+		47, 66, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// dctCos holds the DCT basis: dctCos[u][x] = C(u)/2 * cos((2x+1)uπ/16)
+var dctCos = func() (t [8][8]float32) {
+	for u := 0; u < 8; u++ {
+		scale := 0.5
+		if u == 0 {
+			scale = 0.5 / math.Sqrt2
+		}
+		for x := 0; x < 8; x++ {
+			t[u][x] = float32(scale * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16))
+		}
+	}
+	return t
+}()
+
+// maxAC is the largest AC coefficient magnitude of 8-bit samples
+const maxAC = 1023
+
+// component is one color channel of the image and its quantized blocks
+type component struct {
+	id    byte
+	h, v  int // sampling factors
+	quant int // quantization table slot
+	table int // Huffman table index: 0 luma, 1 chroma
+
+	// Blocks per line and column covered by a scan of this component
+	// alone, which unlike interleaved scans skips the padding of the last
+	// MCUs
+	bw, bh int
+
+	// Coefficients of every block of the padded plane, row by row, in
+	// natural order
+	stride int
+	blocks [][64]int16
+}
+
+// encoder holds an image transformed and quantized, ready for its scans
+type encoder struct {
+	width, height int
+	hmax, vmax    int // largest sampling factors, which size the MCUs
+	mcux, mcuy    int // MCUs per line and column
+	comps         []component
+	quant         [4][64]uint16 // by slot, in natural order
+}
+
+// newEncoder converts img to YCbCr or gray planes, subsamples the chroma
+// and transforms and quantizes every block
+func newEncoder(img image.Image, opts *Options) *encoder {
+	b := img.Bounds()
+	e := &encoder{width: b.Dx(), height: b.Dy()}
+	scaled := scaledQuant(opts.Quality)
+	copy(e.quant[:], scaled[:])
+
+	planes := toPlanes(img)
+	if len(planes) == 1 {
+		e.comps = []component{{id: 1, h: 1, v: 1}}
+	} else {
+		h, v := 2, 2
+		switch opts.Subsampling {
+		case Subsampling422:
+			v = 1
+		case Subsampling444:
+			h, v = 1, 1
+		}
+		e.comps = []component{{id: 1, h: h, v: v}, {id: 2, h: 1, v: 1, quant: 1, table: 1}, {id: 3, h: 1, v: 1, quant: 1, table: 1}}
+	}
+
+	e.layout()
+	for i := range e.comps {
+		c := &e.comps[i]
+		e.transform(c, planes[i], e.hmax/c.h, e.vmax/c.v)
+	}
+	return e
+}
+
+// layout sizes the MCU grid from the sampling factors of the components and
+// allocates their blocks
+func (e *encoder) layout() {
+	e.hmax, e.vmax = 1, 1
+	for _, c := range e.comps {
+		e.hmax, e.vmax = max(e.hmax, c.h), max(e.vmax, c.v)
+	}
+	e.mcux = (e.width + 8*e.hmax - 1) / (8 * e.hmax)
+	e.mcuy = (e.height + 8*e.vmax - 1) / (8 * e.vmax)
+	for i := range e.comps {
+		c := &e.comps[i]
+		c.bw = ((e.width*c.h+e.hmax-1)/e.hmax + 7) / 8
+		c.bh = ((e.height*c.v+e.vmax-1)/e.vmax + 7) / 8
+		c.stride = e.mcux * c.h
+		c.blocks = make([][64]int16, c.stride*e.mcuy*c.v)
+	}
+}
+
+// scaledQuant scales the base quantization tables for quality as libjpeg
+// does
+func scaledQuant(quality int) [2][64]uint16 {
+	quality = min(max(quality, 1), 100)
+	scale := 200 - 2*quality
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var q [2][64]uint16
+	for i := range q {
+		for j, base := range baseQuant[i] {
+			q[i][j] = uint16(min(max((int(base)*scale+50)/100, 1), 255))
+		}
+	}
+	return q
+}
+
+// toPlanes returns the Y, Cb and Cr samples of img at full resolution, or
+// only Y for a gray image
+func toPlanes(img image.Image) [][]uint8 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	switch src := img.(type) {
+	case *image.Gray:
+		y := make([]uint8, w*h)
+		for row := 0; row < h; row++ {
+			copy(y[row*w:], src.Pix[src.PixOffset(b.Min.X, b.Min.Y+row):][:w])
+		}
+		return [][]uint8{y}
+	case *image.YCbCr:
+		y, cb, cr := make([]uint8, w*h), make([]uint8, w*h), make([]uint8, w*h)
+		for row := 0; row < h; row++ {
+			for col := 0; col < w; col++ {
+				yi := src.YOffset(b.Min.X+col, b.Min.Y+row)
+				ci := src.COffset(b.Min.X+col, b.Min.Y+row)
+				y[row*w+col], cb[row*w+col], cr[row*w+col] = src.Y[yi], src.Cb[ci], src.Cr[ci]
+			}
+		}
+		return [][]uint8{y, cb, cr}
+	}
+
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	}
+	y, cb, cr := make([]uint8, w*h), make([]uint8, w*h), make([]uint8, w*h)
+	for row := 0; row < h; row++ {
+		pix := rgba.Pix[rgba.PixOffset(rgba.Rect.Min.X, rgba.Rect.Min.Y+row):]
+		for col := 0; col < w; col++ {
+			p := pix[4*col:]
+			y[row*w+col], cb[row*w+col], cr[row*w+col] = color.RGBToYCbCr(p[0], p[1], p[2])
+		}
+	}
+	return [][]uint8{y, cb, cr}
+}
+
+// transform fills the blocks of c from a full-resolution plane, averaging
+// fx by fy samples into each one and repeating the last row and column
+// into the padding
+func (e *encoder) transform(c *component, plane []uint8, fx, fy int) {
+	rows := len(c.blocks) / c.stride
+	var block [64]float32
+	for by := 0; by < rows; by++ {
+		for bx := 0; bx < c.stride; bx++ {
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					sum := 0
+					for j := 0; j < fy; j++ {
+						row := min((by*8+y)*fy+j, e.height-1) * e.width
+						for i := 0; i < fx; i++ {
+							sum += int(plane[row+min((bx*8+x)*fx+i, e.width-1)])
+						}
+					}
+					n := fx * fy
+					block[y*8+x] = float32((sum+n/2)/n) - 128
+				}
+			}
+			fdct(&block)
+			quant := &e.quant[c.quant]
+			out := &c.blocks[by*c.stride+bx]
+			for i, v := range block {
+				out[i] = int16(math.Round(float64(v) / float64(quant[i])))
+			}
+
+			// Rounding can push an AC coefficient past the 10 bits the
+			// Huffman tables have sizes for
+			for i := 1; i < 64; i++ {
+				out[i] = min(max(out[i], -maxAC), maxAC)
+			}
+		}
+	}
+}
+
+// fdct applies the two-dimensional forward DCT to a block in place
+func fdct(block *[64]float32) {
+	var tmp [64]float32
+	for y := 0; y < 8; y++ {
+		row := block[y*8 : y*8+8]
+		for u := 0; u < 8; u++ {
+			var sum float32
+			for x, v := range row {
+				sum += dctCos[u][x] * v
+			}
+			tmp[y*8+u] = sum
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			var sum float32
+			for y := 0; y < 8; y++ {
+				sum += dctCos[v][y] * tmp[y*8+u]
+			}
+			block[v*8+u] = sum
+		}
+	}
+}
@@ -0,0 +1,627 @@
+package jpeg
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	errFormat      = errors.New("jpeg: invalid or truncated file")
+	errUnsupported = errors.New("jpeg: unsupported file type")
+)
+
+// More JPEG markers
+const (
+	markerRST0 = 0xd0
+	markerRST7 = 0xd7
+	markerDRI  = 0xdd
+	markerTEM  = 0x01
+)
+
+// maxDC is the largest DC coefficient magnitude of 8-bit samples
+const maxDC = 2047
+
+// Transcode rewrites a JPEG file from its quantized DCT coefficients, which
+// it never converts back to pixels, so the output decodes to exactly the
+// same image. Only the tables, the frame header and the scans are written:
+// metadata segments and restart markers are dropped. The quantization
+// tables and sampling of the source are kept, so Quality and Subsampling
+// are ignored.
+//
+// Baseline, extended and progressive Huffman-coded files with one or three
+// components are supported.
+func Transcode(w io.Writer, data []byte, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	e, err := readCoefficients(data)
+	if err != nil {
+		return err
+	}
+	return e.write(w, opts)
+}
+
+// decoder reads the coefficients of a JPEG file into an encoder, which can
+// then write them again
+type decoder struct {
+	data []byte
+	pos  int
+
+	e        *encoder
+	quant    [4][64]uint16 // natural order
+	hasQuant [4]bool
+	huff     [2][4]*huffDecoder // by class (DC, AC) and slot
+	restart  int                // MCUs per restart interval, 0 for none
+	scans    int
+	progress bool
+}
+
+// readCoefficients parses a JPEG file and decodes its scans into blocks of
+// quantized coefficients
+func readCoefficients(data []byte) (*encoder, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+		return nil, errFormat
+	}
+	d := &decoder{data: data, pos: 2}
+	for {
+		if d.pos >= len(data) || data[d.pos] != 0xff {
+			return nil, errFormat
+		}
+		for d.pos < len(data) && data[d.pos] == 0xff {
+			d.pos++
+		}
+		if d.pos >= len(data) {
+			return nil, errFormat
+		}
+		marker := data[d.pos]
+		d.pos++
+		switch {
+		case marker == markerEOI:
+			if d.scans == 0 {
+				return nil, errFormat
+			}
+			return d.e, nil
+		case marker == markerTEM || marker >= markerRST0 && marker <= markerRST7:
+			continue
+		}
+
+		if d.pos+2 > len(data) {
+			return nil, errFormat
+		}
+		n := int(data[d.pos])<<8 | int(data[d.pos+1])
+		if n < 2 || d.pos+n > len(data) {
+			return nil, errFormat
+		}
+		payload := data[d.pos+2 : d.pos+n]
+		d.pos += n
+
+		var err error
+		switch {
+		case marker == markerSOF0 || marker == markerSOF1 || marker == markerSOF2:
+			d.progress = marker == markerSOF2
+			err = d.readFrame(payload)
+		case marker == markerDHT:
+			err = d.readHuffman(payload)
+		case marker == markerDQT:
+			err = d.readQuant(payload)
+		case marker == markerDRI:
+			if len(payload) != 2 {
+				return nil, errFormat
+			}
+			d.restart = int(payload[0])<<8 | int(payload[1])
+		case marker == markerSOS:
+			err = d.readScan(payload)
+		case marker >= 0xc3 && marker <= 0xcf:
+			// Lossless, hierarchical and arithmetic-coded frames
+			err = errUnsupported
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readFrame parses the frame header and allocates the blocks
+func (d *decoder) readFrame(p []byte) error {
+	if d.e != nil || len(p) < 6 {
+		return errFormat
+	}
+	if p[0] != 8 {
+		return errUnsupported
+	}
+	e := &encoder{
+		height: int(p[1])<<8 | int(p[2]),
+		width:  int(p[3])<<8 | int(p[4]),
+	}
+	n := int(p[5])
+	if e.width == 0 || e.height == 0 || len(p) != 6+3*n {
+		return errFormat
+	}
+	if n != 1 && n != 3 {
+		return errUnsupported
+	}
+
+	units := 0
+	for i := 0; i < n; i++ {
+		c := component{id: p[6+3*i], h: int(p[7+3*i] >> 4), v: int(p[7+3*i] & 0x0f), quant: int(p[8+3*i])}
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 || c.quant > 3 {
+			return errFormat
+		}
+		for _, other := range e.comps {
+			if other.id == c.id {
+				return errFormat
+			}
+		}
+		if i > 0 {
+			c.table = 1
+		}
+		units += c.h * c.v
+		e.comps = append(e.comps, c)
+	}
+
+	// The rewritten file interleaves all components in one scan, which
+	// cannot hold more than 10 blocks per MCU
+	if n > 1 && units > 10 {
+		return errUnsupported
+	}
+
+	e.layout()
+	d.e = e
+	return nil
+}
+
+// readQuant parses a DQT segment, which may hold several tables
+func (d *decoder) readQuant(p []byte) error {
+	// Tables already in use by a scan cannot change
+	if d.scans > 0 {
+		return errUnsupported
+	}
+	for len(p) > 0 {
+		precision, slot := p[0]>>4, int(p[0]&0x0f)
+		if precision > 1 || slot > 3 {
+			return errFormat
+		}
+		size := 1 + 64*(1+int(precision))
+		if len(p) < size {
+			return errFormat
+		}
+		for i, n := range zigzag {
+			if precision == 0 {
+				d.quant[slot][n] = uint16(p[1+i])
+			} else {
+				d.quant[slot][n] = uint16(p[1+2*i])<<8 | uint16(p[2+2*i])
+			}
+		}
+		d.hasQuant[slot] = true
+		p = p[size:]
+	}
+	return nil
+}
+
+// readHuffman parses a DHT segment, which may hold several tables
+func (d *decoder) readHuffman(p []byte) error {
+	for len(p) > 0 {
+		if len(p) < 17 {
+			return errFormat
+		}
+		class, slot := int(p[0]>>4), int(p[0]&0x0f)
+		if class > 1 || slot > 3 {
+			return errFormat
+		}
+		var spec huffSpec
+		copy(spec.counts[:], p[1:17])
+		total := 0
+		for _, n := range spec.counts {
+			total += int(n)
+		}
+		if total == 0 || total > 256 || len(p) < 17+total {
+			return errFormat
+		}
+		spec.values = p[17 : 17+total]
+		h, err := newHuffDecoder(spec)
+		if err != nil {
+			return err
+		}
+		d.huff[class][slot] = h
+		p = p[17+total:]
+	}
+	return nil
+}
+
+// readScan parses a SOS segment and decodes the entropy-coded data that
+// follows it
+func (d *decoder) readScan(p []byte) error {
+	e := d.e
+	if e == nil || len(p) < 1 {
+		return errFormat
+	}
+	n := int(p[0])
+	if n < 1 || n > len(e.comps) || len(p) != 4+2*n {
+		return errFormat
+	}
+	if d.scans == 0 {
+		for _, c := range e.comps {
+			if !d.hasQuant[c.quant] {
+				return errFormat
+			}
+		}
+		e.quant = d.quant
+	}
+	d.scans++
+
+	s := scan{ss: int(p[1+2*n]), se: int(p[2+2*n]), ah: int(p[3+2*n] >> 4), al: int(p[3+2*n] & 0x0f)}
+	sr := &scanReader{r: &bitReader{data: d.data, pos: d.pos}, scan: s}
+	for i := 0; i < n; i++ {
+		ci := -1
+		for j, c := range e.comps {
+			if c.id == p[1+2*i] {
+				ci = j
+			}
+		}
+		if ci < 0 {
+			return errFormat
+		}
+		td, ta := p[2+2*i]>>4, p[2+2*i]&0x0f
+		if td > 3 || ta > 3 {
+			return errFormat
+		}
+		s.comps = append(s.comps, ci)
+		sr.dc[ci], sr.ac[ci] = d.huff[0][td], d.huff[1][ta]
+		if s.ss == 0 && s.ah == 0 && sr.dc[ci] == nil || s.se > 0 && sr.ac[ci] == nil {
+			return errFormat
+		}
+	}
+	sr.scan = s
+
+	if d.progress {
+		if s.se > 63 || s.ss > s.se || s.ss == 0 && s.se != 0 || s.ss > 0 && n != 1 || s.al > 13 || s.ah > 13 {
+			return errFormat
+		}
+	} else if s.ss != 0 || s.se != 63 || s.ah != 0 || s.al != 0 {
+		return errFormat
+	}
+
+	// An MCU is one block when a scan holds a single component
+	mcus := 0
+	next := func() error {
+		if d.restart > 0 && mcus > 0 && mcus%d.restart == 0 {
+			if err := sr.r.restart(mcus / d.restart); err != nil {
+				return err
+			}
+			sr.pred, sr.eobRun = [4]int{}, 0
+		}
+		mcus++
+		return nil
+	}
+	if n == 1 {
+		ci := s.comps[0]
+		c := &e.comps[ci]
+		for by := 0; by < c.bh; by++ {
+			for bx := 0; bx < c.bw; bx++ {
+				if err := next(); err != nil {
+					return err
+				}
+				if err := sr.block(ci, &c.blocks[by*c.stride+bx]); err != nil {
+					return err
+				}
+			}
+		}
+	} else {
+		for my := 0; my < e.mcuy; my++ {
+			for mx := 0; mx < e.mcux; mx++ {
+				if err := next(); err != nil {
+					return err
+				}
+				for _, ci := range s.comps {
+					c := &e.comps[ci]
+					for v := 0; v < c.v; v++ {
+						for h := 0; h < c.h; h++ {
+							if err := sr.block(ci, &c.blocks[(my*c.v+v)*c.stride+mx*c.h+h]); err != nil {
+								return err
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Skip the padding up to the next marker that is not a restart
+	d.pos = sr.r.pos
+	for d.pos+1 < len(d.data) {
+		if m := d.data[d.pos+1]; d.data[d.pos] == 0xff && m != 0 && m != 0xff && (m < markerRST0 || m > markerRST7) {
+			break
+		}
+		d.pos++
+	}
+	return nil
+}
+
+// scanReader decodes the blocks of one scan, the reverse of scanWriter
+type scanReader struct {
+	r      *bitReader
+	scan   scan
+	dc, ac [4]*huffDecoder // by component
+	pred   [4]int          // DC predictions
+	eobRun int             // blocks left in the current EOB run
+}
+
+// block decodes the part of a block the scan covers
+func (sr *scanReader) block(ci int, b *[64]int16) error {
+	s, r := sr.scan, sr.r
+	if s.ss == 0 {
+		if s.ah == 0 {
+			size, err := r.huffman(sr.dc[ci])
+			if err != nil {
+				return err
+			}
+			if size > 11 {
+				return errFormat
+			}
+			diff, err := r.receive(uint(size))
+			if err != nil {
+				return err
+			}
+			sr.pred[ci] += diff
+			v := sr.pred[ci] << s.al
+			if v < -maxDC || v > maxDC {
+				return errFormat
+			}
+			b[0] = int16(v)
+		} else {
+			bit, err := r.bits(1)
+			if err != nil {
+				return err
+			}
+			b[0] |= int16(bit) << s.al
+		}
+		if s.se == 0 {
+			return nil
+		}
+	}
+	if s.ah > 0 {
+		return sr.refineAC(sr.ac[ci], b)
+	}
+
+	// AC coefficients of a baseline scan, or the first scan of a
+	// progressive band
+	if sr.eobRun > 0 {
+		sr.eobRun--
+		return nil
+	}
+	for k := max(s.ss, 1); k <= s.se; k++ {
+		sym, err := r.huffman(sr.ac[ci])
+		if err != nil {
+			return err
+		}
+		run, size := int(sym>>4), uint(sym&0x0f)
+		if size == 0 {
+			if run != 0x0f {
+				if err := sr.readEOBRun(run); err != nil {
+					return err
+				}
+				sr.eobRun--
+				return nil
+			}
+			k += 15
+			continue
+		}
+		k += run
+		if k > s.se || size > 10 {
+			return errFormat
+		}
+		v, err := r.receive(size)
+		if err != nil {
+			return err
+		}
+		if v <<= s.al; v < -maxAC || v > maxAC {
+			return errFormat
+		}
+		b[zigzag[k]] = int16(v)
+	}
+	return nil
+}
+
+// refineAC decodes the next bit of the spectral band of a block, following
+// the reading of section G.1.2.3 of the specification that libjpeg and
+// image/jpeg implement
+func (sr *scanReader) refineAC(t *huffDecoder, b *[64]int16) error {
+	s, r := sr.scan, sr.r
+	delta := int16(1) << s.al
+	k := s.ss
+	if sr.eobRun == 0 {
+		for ; k <= s.se; k++ {
+			sym, err := r.huffman(t)
+			if err != nil {
+				return err
+			}
+			run, size := int(sym>>4), sym&0x0f
+			var v int16
+			switch size {
+			case 0:
+				if run != 0x0f {
+					if err := sr.readEOBRun(run); err != nil {
+						return err
+					}
+				}
+			case 1:
+				bit, err := r.bits(1)
+				if err != nil {
+					return err
+				}
+				v = delta
+				if bit == 0 {
+					v = -v
+				}
+			default:
+				return errFormat
+			}
+			if sr.eobRun > 0 {
+				break
+			}
+			if k, err = sr.refineNonZeroes(b, k, run, delta); err != nil {
+				return err
+			}
+			if k > s.se {
+				return errFormat
+			}
+			if v != 0 {
+				b[zigzag[k]] = v
+			}
+		}
+	}
+	if sr.eobRun > 0 {
+		sr.eobRun--
+		if _, err := sr.refineNonZeroes(b, k, -1, delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refineNonZeroes reads the correction bits of the non-zero coefficients
+// from position k, stopping at the zero coefficient after skipping nz
+// others (or never, if nz is negative), whose position it returns
+func (sr *scanReader) refineNonZeroes(b *[64]int16, k, nz int, delta int16) (int, error) {
+	for ; k <= sr.scan.se; k++ {
+		n := zigzag[k]
+		if b[n] == 0 {
+			if nz == 0 {
+				break
+			}
+			nz--
+			continue
+		}
+		bit, err := sr.r.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		if bit == 0 {
+			continue
+		}
+		if b[n] >= 0 {
+			b[n] += delta
+		} else {
+			b[n] -= delta
+		}
+	}
+	return k, nil
+}
+
+// readEOBRun reads the length of an EOB run whose symbol has the given run
+// bits
+func (sr *scanReader) readEOBRun(n int) error {
+	sr.eobRun = 1 << n
+	if n > 0 {
+		extra, err := sr.r.bits(uint(n))
+		if err != nil {
+			return err
+		}
+		sr.eobRun |= int(extra)
+	}
+	return nil
+}
+
+// huffDecoder decodes the codes of a DHT table by length, as section F.2.2.3
+// of the specification does
+type huffDecoder struct {
+	maxCode [maxCodeLength + 1]int32 // largest code of each length, -1 if none
+	offset  [maxCodeLength + 1]int32 // index in values of the code 0 of each length
+	values  []byte
+}
+
+// newHuffDecoder assigns the codes a DHT table describes
+func newHuffDecoder(spec huffSpec) (*huffDecoder, error) {
+	h := &huffDecoder{values: spec.values}
+	code, k := int32(0), int32(0)
+	for i, n := range spec.counts {
+		length := i + 1
+		h.maxCode[length] = -1
+		if n > 0 {
+			h.offset[length] = k - code
+			code += int32(n)
+			k += int32(n)
+			h.maxCode[length] = code - 1
+			if code > 1<<length {
+				return nil, errFormat
+			}
+		}
+		code <<= 1
+	}
+	return h, nil
+}
+
+// bitReader reads entropy-coded data most significant bit first, removing
+// the zero byte stuffed after every 0xff. Reading into a marker is an error.
+type bitReader struct {
+	data []byte
+	pos  int
+	acc  uint32
+	n    uint
+}
+
+// bits reads n bits (n <= 16)
+func (r *bitReader) bits(n uint) (uint32, error) {
+	for r.n < n {
+		if r.pos >= len(r.data) {
+			return 0, errFormat
+		}
+		b := r.data[r.pos]
+		if b == 0xff {
+			if r.pos+1 >= len(r.data) || r.data[r.pos+1] != 0 {
+				return 0, errFormat
+			}
+			r.pos++
+		}
+		r.pos++
+		r.acc = r.acc<<8 | uint32(b)
+		r.n += 8
+	}
+	r.n -= n
+	return r.acc >> r.n & (1<<n - 1), nil
+}
+
+// huffman reads one symbol
+func (r *bitReader) huffman(h *huffDecoder) (byte, error) {
+	code := int32(0)
+	for length := 1; length <= maxCodeLength; length++ {
+		bit, err := r.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | int32(bit)
+		if code <= h.maxCode[length] {
+			return h.values[code+h.offset[length]], nil
+		}
+	}
+	return 0, errFormat
+}
+
+// receive reads a value of n bits coded as category returns it
+func (r *bitReader) receive(n uint) (int, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	v, err := r.bits(n)
+	if err != nil {
+		return 0, err
+	}
+	if v < 1<<(n-1) {
+		return int(v) - 1<<n + 1, nil
+	}
+	return int(v), nil
+}
+
+// restart drops the padding bits of the current interval and reads the
+// restart marker ending it, the i-th of the scan
+func (r *bitReader) restart(i int) error {
+	r.acc, r.n = 0, 0
+	for r.pos+1 < len(r.data) && r.data[r.pos] == 0xff && r.data[r.pos+1] == 0xff {
+		r.pos++
+	}
+	if r.pos+1 >= len(r.data) || r.data[r.pos] != 0xff || r.data[r.pos+1] != byte(markerRST0+(i-1)%8) {
+		return errFormat
+	}
+	r.pos += 2
+	return nil
+}
@@ -0,0 +1,139 @@
+package jpeg
+
+import "github.com/zulfikawr/bitrim/internal/huffman"
+
+// maxCodeLength is the longest Huffman code JPEG allows
+const maxCodeLength = 16
+
+// huffSpec is a Huffman table as stored in a DHT segment
+type huffSpec struct {
+	// counts[i] is the number of codes of length i+1
+	counts [maxCodeLength]byte
+
+	// values lists the symbols in order of increasing code
+	values []byte
+}
+
+// Standard tables of section K.3 of the specification: luminance and
+// chrominance DC, then luminance and chrominance AC. They hold no EOB run
+// symbols, so progressive scans cannot use them.
+var (
+	standardDC = [2]huffSpec{
+		{
+			[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+			[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		},
+		{
+			[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+			[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		},
+	}
+	standardAC = [2]huffSpec{
+		{
+			[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+			[]byte{
+				0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+				0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+				0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+				0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+				0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+				0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+				0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+				0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+				0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+				0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+				0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+				0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+				0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+				0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+				0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+				0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+				0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+				0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+				0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+				0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+				0xf9, 0xfa,
+			},
+		},
+		{
+			[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+			[]byte{
+				0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+				0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+				0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+				0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+				0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+				0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+				0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+				0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+				0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+				0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+				0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+				0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+				0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+				0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+				0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+				0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+				0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+				0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+				0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+				0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+				0xf9, 0xfa,
+			},
+		},
+	}
+)
+
+// optimalSpec builds the table giving the shortest codes for the symbol
+// frequencies of a scan
+func optimalSpec(freqs *[256]uint32) huffSpec {
+	// A dummy symbol takes a code of its own, so that no real symbol gets
+	// the all-ones code, which JPEG reserves
+	weights := make([]uint32, 257)
+	copy(weights, freqs[:])
+	weights[256] = 1
+	lengths := huffman.Lengths(weights, maxCodeLength)
+
+	var spec huffSpec
+	for length := uint8(1); length <= maxCodeLength; length++ {
+		for sym, l := range lengths[:256] {
+			if l == length {
+				spec.counts[length-1]++
+				spec.values = append(spec.values, byte(sym))
+			}
+		}
+	}
+	return spec
+}
+
+// huffTable is a Huffman table in use by a scan: the codes of its symbols,
+// or while the scan is only counting symbols, their frequencies
+type huffTable struct {
+	codes   [256]uint16
+	lengths [256]uint8
+	freqs   *[256]uint32
+}
+
+// table assigns the codes a DHT segment describes
+func (s huffSpec) table() *huffTable {
+	t := new(huffTable)
+	code, k := uint16(0), 0
+	for i, n := range s.counts {
+		for j := byte(0); j < n; j++ {
+			t.codes[s.values[k]] = code
+			t.lengths[s.values[k]] = uint8(i + 1)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return t
+}
+
+// appendDHT appends the payload of a DHT segment entry for a table of class
+// 0 (DC) or 1 (AC)
+func (s huffSpec) appendDHT(out []byte, class, id int) []byte {
+	out = append(out, byte(class<<4|id))
+	out = append(out, s.counts[:]...)
+	return append(out, s.values...)
+}
@@ -0,0 +1,143 @@
+// Package jpeg implements a JPEG encoder that writes baseline or progressive
+// files, with the standard Huffman tables or tables built from each image's
+// own statistics, and a choice of chroma subsampling. It can also rewrite an
+// existing JPEG file from its DCT coefficients without any loss.
+package jpeg
+
+import (
+	"errors"
+	"image"
+	"io"
+	"slices"
+)
+
+// DefaultQuality is the quality used when no options are given
+const DefaultQuality = 75
+
+// Subsampling is the resolution chroma is stored at, relative to luma
+type Subsampling int
+
+// Chroma subsampling modes
+const (
+	Subsampling420 Subsampling = iota // halved both ways, as image/jpeg writes
+	Subsampling422                    // halved horizontally
+	Subsampling444                    // full resolution
+)
+
+// Options controls the encoding
+type Options struct {
+	// Quality ranges from 1 (smallest file) to 100 (best quality) and scales
+	// the standard quantization tables as libjpeg does
+	Quality int
+
+	// Progressive writes the coefficients in several scans, lowest
+	// frequencies and most significant bits first. Progressive scans
+	// always use optimized Huffman tables.
+	Progressive bool
+
+	// OptimizeHuffman builds the Huffman tables from the symbols the image
+	// actually uses instead of taking the standard ones
+	OptimizeHuffman bool
+
+	// Subsampling of the chroma planes; ignored for gray images
+	Subsampling Subsampling
+}
+
+var (
+	errEmptyImage = errors.New("jpeg: image has no pixels")
+	errTooLarge   = errors.New("jpeg: image dimensions exceed 65535x65535")
+)
+
+// JPEG markers
+const (
+	markerSOF0 = 0xc0 // baseline frame
+	markerSOF1 = 0xc1 // extended sequential frame
+	markerSOF2 = 0xc2 // progressive frame
+	markerDHT  = 0xc4
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOS  = 0xda
+	markerDQT  = 0xdb
+)
+
+// Encode writes img to w as a JPEG. *image.Gray images are stored as a
+// single gray component; everything else is converted to YCbCr, with
+// transparent pixels composited onto black.
+func Encode(w io.Writer, img image.Image, opts *Options) error {
+	if opts == nil {
+		opts = &Options{Quality: DefaultQuality}
+	}
+	b := img.Bounds()
+	if b.Dx() <= 0 || b.Dy() <= 0 {
+		return errEmptyImage
+	}
+	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
+		return errTooLarge
+	}
+
+	return newEncoder(img, opts).write(w, opts)
+}
+
+// write writes the file: the tables, the frame header and the scans
+func (e *encoder) write(w io.Writer, opts *Options) error {
+	out := []byte{0xff, markerSOI}
+	out = e.appendHeaders(out, opts.Progressive)
+	if opts.Progressive {
+		for _, s := range progressiveScript(len(e.comps)) {
+			out = e.appendScan(out, s, true)
+		}
+	} else {
+		out = e.appendScan(out, e.sequentialScan(), opts.OptimizeHuffman)
+	}
+	out = append(out, 0xff, markerEOI)
+	_, err := w.Write(out)
+	return err
+}
+
+// appendMarker appends a marker segment with its length
+func appendMarker(out []byte, marker byte, payload []byte) []byte {
+	n := len(payload) + 2
+	out = append(out, 0xff, marker, byte(n>>8), byte(n))
+	return append(out, payload...)
+}
+
+// appendHeaders appends the quantization tables and the frame header. Tables
+// with steps above 255 take 16-bit entries, which baseline files cannot
+// have.
+func (e *encoder) appendHeaders(out []byte, progressive bool) []byte {
+	var dqt []byte
+	var written [4]bool
+	wide := false
+	for _, c := range e.comps {
+		if written[c.quant] {
+			continue
+		}
+		written[c.quant] = true
+		table := &e.quant[c.quant]
+		if slices.Max(table[:]) > 255 {
+			wide = true
+			dqt = append(dqt, byte(0x10|c.quant))
+			for _, n := range zigzag {
+				dqt = append(dqt, byte(table[n]>>8), byte(table[n]))
+			}
+			continue
+		}
+		dqt = append(dqt, byte(c.quant))
+		for _, n := range zigzag {
+			dqt = append(dqt, byte(table[n]))
+		}
+	}
+	out = appendMarker(out, markerDQT, dqt)
+
+	sof := []byte{8, byte(e.height >> 8), byte(e.height), byte(e.width >> 8), byte(e.width), byte(len(e.comps))}
+	for _, c := range e.comps {
+		sof = append(sof, c.id, byte(c.h<<4|c.v), byte(c.quant))
+	}
+	marker := byte(markerSOF0)
+	if progressive {
+		marker = markerSOF2
+	} else if wide {
+		marker = markerSOF1
+	}
+	return appendMarker(out, marker, sof)
+}
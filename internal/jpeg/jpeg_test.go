@@ -0,0 +1,226 @@
+package jpeg
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	stdjpeg "image/jpeg"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// testImage returns a photo-like image: smooth gradients with noise
+func testImage(w, h int) *image.RGBA {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(x*200/w) + uint8(rng.Intn(12)),
+				G: uint8(y*180/h) + uint8(rng.Intn(12)),
+				B: uint8(128+60*math.Sin(float64(x+y)/9)) + uint8(rng.Intn(12)),
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+// psnr returns the peak signal-to-noise ratio between two images in dB
+func psnr(t *testing.T, want, got image.Image) float64 {
+	t.Helper()
+	if got.Bounds().Size() != want.Bounds().Size() {
+		t.Fatalf("size mismatch: want %v, got %v", want.Bounds(), got.Bounds())
+	}
+	var sum float64
+	b := want.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r1, g1, b1, _ := want.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			r2, g2, b2, _ := got.At(got.Bounds().Min.X+x, got.Bounds().Min.Y+y).RGBA()
+			for _, d := range []float64{float64(r1>>8) - float64(r2>>8), float64(g1>>8) - float64(g2>>8), float64(b1>>8) - float64(b2>>8)} {
+				sum += d * d
+			}
+		}
+	}
+	mse := sum / float64(3*b.Dx()*b.Dy())
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+func encode(t *testing.T, img image.Image, opts *Options) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if err := Encode(buf, img, opts); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 41, 27))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	images := map[string]image.Image{
+		"rgba":   testImage(67, 45),
+		"tiny":   testImage(1, 1),
+		"narrow": testImage(3, 40),
+		"gray":   gray,
+	}
+
+	for name, img := range images {
+		for _, sub := range []Subsampling{Subsampling420, Subsampling422, Subsampling444} {
+			for _, opts := range []Options{
+				{Quality: 90, Subsampling: sub},
+				{Quality: 90, Subsampling: sub, OptimizeHuffman: true},
+				{Quality: 90, Subsampling: sub, Progressive: true},
+				{Quality: 10, Subsampling: sub, Progressive: true},
+				{Quality: 100, Subsampling: sub, Progressive: true},
+			} {
+				t.Run(fmt.Sprintf("%s/%+v", name, opts), func(t *testing.T) {
+					data := encode(t, img, &opts)
+					got, err := stdjpeg.Decode(bytes.NewReader(data))
+					if err != nil {
+						t.Fatalf("output does not decode: %v", err)
+					}
+					if _, ok := got.(*image.Gray); ok != (name == "gray") {
+						t.Errorf("decoded as %T", got)
+					}
+
+					// At least as faithful as image/jpeg, which subsamples
+					// 4:2:0 and has the same quantization tables
+					buf := new(bytes.Buffer)
+					if err := stdjpeg.Encode(buf, img, &stdjpeg.Options{Quality: opts.Quality}); err != nil {
+						t.Fatalf("image/jpeg failed: %v", err)
+					}
+					reference, err := stdjpeg.Decode(buf)
+					if err != nil {
+						t.Fatalf("image/jpeg output does not decode: %v", err)
+					}
+					if p, want := psnr(t, img, got), psnr(t, img, reference); p < want-0.5 {
+						t.Errorf("PSNR %.1f dB, image/jpeg gets %.1f dB", p, want)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestEncodeMatchesProgressive(t *testing.T) {
+	// Progressive and baseline files hold the same coefficients, so they
+	// decode to the same pixels
+	img := testImage(80, 56)
+	baseline, err := stdjpeg.Decode(bytes.NewReader(encode(t, img, &Options{Quality: 80})))
+	if err != nil {
+		t.Fatalf("baseline does not decode: %v", err)
+	}
+	progressive, err := stdjpeg.Decode(bytes.NewReader(encode(t, img, &Options{Quality: 80, Progressive: true})))
+	if err != nil {
+		t.Fatalf("progressive does not decode: %v", err)
+	}
+	if p := psnr(t, baseline, progressive); !math.IsInf(p, 1) {
+		t.Errorf("progressive decodes differently (PSNR %.1f dB)", p)
+	}
+}
+
+func TestEncodeSizes(t *testing.T) {
+	img := testImage(256, 192)
+	standard := encode(t, img, &Options{Quality: 80})
+	optimized := encode(t, img, &Options{Quality: 80, OptimizeHuffman: true})
+	progressive := encode(t, img, &Options{Quality: 80, Progressive: true})
+	full := encode(t, img, &Options{Quality: 80, Subsampling: Subsampling444})
+
+	if !bytes.Contains(standard[:200], []byte{0xff, markerSOF0}) || !bytes.Contains(progressive[:200], []byte{0xff, markerSOF2}) {
+		t.Error("unexpected frame types")
+	}
+	if len(optimized) >= len(standard) {
+		t.Errorf("optimized tables (%d bytes) not smaller than standard ones (%d bytes)", len(optimized), len(standard))
+	}
+	if len(progressive) >= len(standard) {
+		t.Errorf("progressive (%d bytes) not smaller than baseline (%d bytes)", len(progressive), len(standard))
+	}
+	if len(full) <= len(standard) {
+		t.Errorf("4:4:4 (%d bytes) not larger than 4:2:0 (%d bytes)", len(full), len(standard))
+	}
+
+	// Against image/jpeg at the same quality
+	buf := new(bytes.Buffer)
+	if err := stdjpeg.Encode(buf, img, &stdjpeg.Options{Quality: 80}); err != nil {
+		t.Fatalf("image/jpeg failed: %v", err)
+	}
+	if len(progressive) >= buf.Len() {
+		t.Errorf("progressive (%d bytes) not smaller than image/jpeg (%d bytes)", len(progressive), buf.Len())
+	}
+}
+
+func TestOptimalSpecAvoidsAllOnes(t *testing.T) {
+	var freqs [256]uint32
+	for i := range freqs {
+		freqs[i] = uint32(i + 1)
+	}
+	spec := optimalSpec(&freqs)
+	if len(spec.values) != 256 {
+		t.Fatalf("expected 256 symbols, got %d", len(spec.values))
+	}
+	table := spec.table()
+	for sym, l := range table.lengths {
+		if l == 0 || l > maxCodeLength {
+			t.Fatalf("symbol %d has length %d", sym, l)
+		}
+		if table.codes[sym] == 1<<l-1 {
+			t.Errorf("symbol %d has the all-ones code", sym)
+		}
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	img := testImage(97, 61)
+	gray := image.NewGray(image.Rect(0, 0, 33, 20))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 5)
+	}
+	buf := new(bytes.Buffer)
+	if err := stdjpeg.Encode(buf, img, &stdjpeg.Options{Quality: 85}); err != nil {
+		t.Fatalf("image/jpeg failed: %v", err)
+	}
+	sources := map[string][]byte{
+		"image/jpeg":      buf.Bytes(),
+		"progressive 444": encode(t, img, &Options{Quality: 60, Progressive: true, Subsampling: Subsampling444}),
+		"gray":            encode(t, gray, &Options{Quality: 100}),
+	}
+
+	for name, src := range sources {
+		want, err := stdjpeg.Decode(bytes.NewReader(src))
+		if err != nil {
+			t.Fatalf("%s: source does not decode: %v", name, err)
+		}
+		for _, opts := range []Options{{}, {OptimizeHuffman: true}, {Progressive: true}} {
+			t.Run(fmt.Sprintf("%s/%+v", name, opts), func(t *testing.T) {
+				out := new(bytes.Buffer)
+				if err := Transcode(out, src, &opts); err != nil {
+					t.Fatalf("Transcode failed: %v", err)
+				}
+				got, err := stdjpeg.Decode(bytes.NewReader(out.Bytes()))
+				if err != nil {
+					t.Fatalf("output does not decode: %v", err)
+				}
+				if p := psnr(t, want, got); !math.IsInf(p, 1) {
+					t.Errorf("output decodes differently (PSNR %.1f dB)", p)
+				}
+				if name == "image/jpeg" && opts.Progressive && out.Len() >= len(src) {
+					t.Errorf("output (%d bytes) not smaller than source (%d bytes)", out.Len(), len(src))
+				}
+			})
+		}
+	}
+
+	if err := Transcode(io.Discard, sources["image/jpeg"][:len(sources["image/jpeg"])/2], nil); err == nil {
+		t.Error("truncated file transcoded without error")
+	}
+}
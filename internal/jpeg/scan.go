@@ -0,0 +1,390 @@
+package jpeg
+
+import "math/bits"
+
+// scan selects the components and the part of their coefficients one SOS
+// segment codes: positions ss to se in zigzag order, and with successive
+// approximation, the bits from al upward (ah is the bit position of the
+// previous scan of the same coefficients, or 0 for the first)
+type scan struct {
+	comps          []int
+	ss, se, ah, al int
+}
+
+// eobRunMax is the longest run of empty blocks an EOB run symbol can code
+const eobRunMax = 0x7fff
+
+// maxCorrectionBits bounds the correction bits held back with an EOB run
+// in a refinement scan, as libjpeg does for its decoder's buffer
+const maxCorrectionBits = 1000 - 63
+
+// sequentialScan returns the single scan of a baseline file
+func (e *encoder) sequentialScan() scan {
+	s := scan{se: 63}
+	for i := range e.comps {
+		s.comps = append(s.comps, i)
+	}
+	return s
+}
+
+// progressiveScript returns libjpeg's default progression: DC first at
+// half precision, then the low and high luma frequencies and the chroma at
+// reduced precision, and finally the remaining bits, luma last as its scan
+// is usually the largest
+func progressiveScript(ncomps int) []scan {
+	if ncomps == 1 {
+		y := []int{0}
+		return []scan{
+			{comps: y, al: 1},
+			{comps: y, ss: 1, se: 5, al: 2},
+			{comps: y, ss: 6, se: 63, al: 2},
+			{comps: y, ss: 1, se: 63, ah: 2, al: 1},
+			{comps: y, ah: 1},
+			{comps: y, ss: 1, se: 63, ah: 1},
+		}
+	}
+	y, cb, cr := []int{0}, []int{1}, []int{2}
+	return []scan{
+		{comps: []int{0, 1, 2}, al: 1},
+		{comps: y, ss: 1, se: 5, al: 2},
+		{comps: cr, ss: 1, se: 63, al: 1},
+		{comps: cb, ss: 1, se: 63, al: 1},
+		{comps: y, ss: 6, se: 63, al: 2},
+		{comps: y, ss: 1, se: 63, ah: 2, al: 1},
+		{comps: []int{0, 1, 2}, ah: 1},
+		{comps: cr, ss: 1, se: 63, ah: 1},
+		{comps: cb, ss: 1, se: 63, ah: 1},
+		{comps: y, ss: 1, se: 63, ah: 1},
+	}
+}
+
+// appendScan appends a scan with its Huffman tables. Optimized tables are
+// built from a first pass that only counts the symbols.
+func (e *encoder) appendScan(out []byte, s scan, optimize bool) []byte {
+	usesDC := s.ss == 0 && s.ah == 0
+	usesAC := s.se > 0
+
+	// Tables by class (DC, AC) and index (luma, chroma)
+	var specs [2][2]*huffSpec
+	for _, ci := range s.comps {
+		t := e.comps[ci].table
+		if usesDC {
+			specs[0][t] = &standardDC[t]
+		}
+		if usesAC {
+			specs[1][t] = &standardAC[t]
+		}
+	}
+	if optimize {
+		var counting [2][2]*huffTable
+		for class := range specs {
+			for t, spec := range specs[class] {
+				if spec != nil {
+					counting[class][t] = &huffTable{freqs: new([256]uint32)}
+				}
+			}
+		}
+		e.encodeScan(s, nil, counting)
+		for class := range specs {
+			for t, table := range counting[class] {
+				if table != nil {
+					spec := optimalSpec(table.freqs)
+					specs[class][t] = &spec
+				}
+			}
+		}
+	}
+
+	var tables [2][2]*huffTable
+	var dht []byte
+	for class := range specs {
+		for t, spec := range specs[class] {
+			if spec != nil {
+				tables[class][t] = spec.table()
+				dht = spec.appendDHT(dht, class, t)
+			}
+		}
+	}
+	if dht != nil {
+		out = appendMarker(out, markerDHT, dht)
+	}
+
+	sos := []byte{byte(len(s.comps))}
+	for _, ci := range s.comps {
+		c := e.comps[ci]
+		sos = append(sos, c.id, byte(c.table<<4|c.table))
+	}
+	sos = append(sos, byte(s.ss), byte(s.se), byte(s.ah<<4|s.al))
+	out = appendMarker(out, markerSOS, sos)
+
+	w := &bitWriter{buf: out}
+	e.encodeScan(s, w, tables)
+	return w.flush()
+}
+
+// scanWriter codes the blocks of one scan. With no bit writer it only
+// counts the Huffman symbols.
+type scanWriter struct {
+	bits   *bitWriter
+	tables [2][2]*huffTable
+	scan   scan
+	pred   [4]int // DC predictions
+
+	// AC table of the single component of a progressive AC scan
+	acTable int
+
+	// Pending run of blocks with nothing left to code in a progressive AC
+	// scan, and in a refinement scan, the correction bits that go with it
+	// and those of the current block not yet emitted
+	eobRun     int
+	eobBits    []byte
+	blockBits  []byte
+	absoluteAC [64]int
+}
+
+// encodeScan codes the blocks of a scan: in MCU order when it interleaves
+// several components, in the component's own block order otherwise
+func (e *encoder) encodeScan(s scan, bits *bitWriter, tables [2][2]*huffTable) {
+	sw := &scanWriter{bits: bits, tables: tables, scan: s}
+	if len(s.comps) == 1 {
+		c := &e.comps[s.comps[0]]
+		sw.acTable = c.table
+		for by := 0; by < c.bh; by++ {
+			for bx := 0; bx < c.bw; bx++ {
+				sw.block(s.comps[0], c.table, &c.blocks[by*c.stride+bx])
+			}
+		}
+	} else {
+		for my := 0; my < e.mcuy; my++ {
+			for mx := 0; mx < e.mcux; mx++ {
+				for _, ci := range s.comps {
+					c := &e.comps[ci]
+					for v := 0; v < c.v; v++ {
+						for h := 0; h < c.h; h++ {
+							sw.block(ci, c.table, &c.blocks[(my*c.v+v)*c.stride+mx*c.h+h])
+						}
+					}
+				}
+			}
+		}
+	}
+	sw.flushEOBRun()
+}
+
+// block codes the part of a block the scan covers
+func (sw *scanWriter) block(ci, table int, block *[64]int16) {
+	s := sw.scan
+	switch {
+	case s.ss == 0 && s.ah == 0:
+		sw.dc(ci, table, int(block[0])>>s.al)
+		if s.se > 0 {
+			sw.sequentialAC(table, block)
+		}
+	case s.ss == 0:
+		sw.raw(uint32(block[0]>>s.al)&1, 1)
+	case s.ah == 0:
+		sw.firstAC(table, block)
+	default:
+		sw.refineAC(table, block)
+	}
+}
+
+// dc codes the difference between a DC value and the previous one of the
+// same component
+func (sw *scanWriter) dc(ci, table int, value int) {
+	diff := value - sw.pred[ci]
+	sw.pred[ci] = value
+	size, extra := category(diff)
+	sw.symbol(sw.tables[0][table], byte(size))
+	sw.raw(extra, size)
+}
+
+// sequentialAC codes all AC coefficients of a block as a baseline scan
+// does, ending each block with its own EOB
+func (sw *scanWriter) sequentialAC(table int, block *[64]int16) {
+	t := sw.tables[1][table]
+	run := 0
+	for k := 1; k < 64; k++ {
+		v := int(block[zigzag[k]])
+		if v == 0 {
+			run++
+			continue
+		}
+		for ; run > 15; run -= 16 {
+			sw.symbol(t, 0xf0)
+		}
+		size, extra := category(v)
+		sw.symbol(t, byte(run<<4|int(size)))
+		sw.raw(extra, size)
+		run = 0
+	}
+	if run > 0 {
+		sw.symbol(t, 0x00)
+	}
+}
+
+// firstAC codes the spectral band of a block at reduced precision,
+// merging blocks whose band is empty into EOB runs
+func (sw *scanWriter) firstAC(table int, block *[64]int16) {
+	s, t := sw.scan, sw.tables[1][table]
+	run := 0
+	for k := s.ss; k <= s.se; k++ {
+		v := int(block[zigzag[k]])
+		if v < 0 {
+			v = -(-v >> s.al)
+		} else {
+			v >>= s.al
+		}
+		if v == 0 {
+			run++
+			continue
+		}
+		sw.flushEOBRun()
+		for ; run > 15; run -= 16 {
+			sw.symbol(t, 0xf0)
+		}
+		size, extra := category(v)
+		sw.symbol(t, byte(run<<4|int(size)))
+		sw.raw(extra, size)
+		run = 0
+	}
+	if run > 0 {
+		sw.eobRun++
+		if sw.eobRun == eobRunMax {
+			sw.flushEOBRun()
+		}
+	}
+}
+
+// refineAC codes the next bit of the spectral band of a block: a sign bit
+// for coefficients that become non-zero and a correction bit for those
+// already non-zero, which follows the next symbol
+func (sw *scanWriter) refineAC(table int, block *[64]int16) {
+	s, t := sw.scan, sw.tables[1][table]
+
+	// The last coefficient that becomes non-zero ends the coded part
+	eob := 0
+	for k := s.ss; k <= s.se; k++ {
+		v := int(block[zigzag[k]])
+		if v < 0 {
+			v = -v
+		}
+		sw.absoluteAC[k] = v >> s.al
+		if sw.absoluteAC[k] == 1 {
+			eob = k
+		}
+	}
+
+	run := 0
+	for k := s.ss; k <= s.se; k++ {
+		v := sw.absoluteAC[k]
+		if v == 0 {
+			run++
+			continue
+		}
+		for ; run > 15 && k <= eob; run -= 16 {
+			sw.flushEOBRun()
+			sw.symbol(t, 0xf0)
+			sw.emitBits(sw.blockBits)
+			sw.blockBits = sw.blockBits[:0]
+		}
+		if v > 1 {
+			sw.blockBits = append(sw.blockBits, byte(v&1))
+			continue
+		}
+		sw.flushEOBRun()
+		sw.symbol(t, byte(run<<4|1))
+		sign := uint32(1)
+		if block[zigzag[k]] < 0 {
+			sign = 0
+		}
+		sw.raw(sign, 1)
+		sw.emitBits(sw.blockBits)
+		sw.blockBits = sw.blockBits[:0]
+		run = 0
+	}
+	if run > 0 || len(sw.blockBits) > 0 {
+		sw.eobRun++
+		sw.eobBits = append(sw.eobBits, sw.blockBits...)
+		sw.blockBits = sw.blockBits[:0]
+		if sw.eobRun == eobRunMax || len(sw.eobBits) > maxCorrectionBits {
+			sw.flushEOBRun()
+		}
+	}
+}
+
+// flushEOBRun codes the pending EOB run and its correction bits
+func (sw *scanWriter) flushEOBRun() {
+	if sw.eobRun == 0 {
+		return
+	}
+	n := bits.Len(uint(sw.eobRun)) - 1
+	sw.symbol(sw.tables[1][sw.acTable], byte(n<<4))
+	sw.raw(uint32(sw.eobRun), uint(n))
+	sw.eobRun = 0
+	sw.emitBits(sw.eobBits)
+	sw.eobBits = sw.eobBits[:0]
+}
+
+// symbol codes a Huffman symbol, or counts it
+func (sw *scanWriter) symbol(t *huffTable, sym byte) {
+	if sw.bits == nil {
+		t.freqs[sym]++
+		return
+	}
+	sw.bits.write(uint32(t.codes[sym]), uint(t.lengths[sym]))
+}
+
+// raw writes the low n bits of v unless the scan is only counting symbols
+func (sw *scanWriter) raw(v uint32, n uint) {
+	if sw.bits != nil && n > 0 {
+		sw.bits.write(v, n)
+	}
+}
+
+// emitBits writes correction bits, one per byte
+func (sw *scanWriter) emitBits(bits []byte) {
+	for _, b := range bits {
+		sw.raw(uint32(b), 1)
+	}
+}
+
+// category returns the number of bits of a coefficient value and the bits
+// coding it: the value itself when positive, its complement when negative
+func category(v int) (uint, uint32) {
+	if v < 0 {
+		n := uint(bits.Len(uint(-v)))
+		return n, uint32(v-1) & (1<<n - 1)
+	}
+	return uint(bits.Len(uint(v))), uint32(v)
+}
+
+// bitWriter packs bits most significant first, stuffing a zero byte after
+// every 0xff byte
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+// write appends the low n bits of v (n <= 32)
+func (w *bitWriter) write(v uint32, n uint) {
+	w.acc = w.acc<<n | uint64(v&(1<<n-1))
+	w.nbits += n
+	for w.nbits >= 8 {
+		b := byte(w.acc >> (w.nbits - 8))
+		w.buf = append(w.buf, b)
+		if b == 0xff {
+			w.buf = append(w.buf, 0)
+		}
+		w.nbits -= 8
+	}
+}
+
+// flush pads the last byte with one bits and returns the written data
+func (w *bitWriter) flush() []byte {
+	if w.nbits > 0 {
+		w.write(1<<(8-w.nbits)-1, 8-w.nbits)
+	}
+	return w.buf
+}
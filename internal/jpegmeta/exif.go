@@ -0,0 +1,253 @@
+package jpegmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// exifHeader starts the payload of an APP1 segment holding EXIF data
+var exifHeader = []byte("Exif\x00\x00")
+
+// EXIF tags edited in place or pointing to other directories
+const (
+	tagImageWidth      = 0x0100
+	tagImageLength     = 0x0101
+	tagOrientation     = 0x0112
+	tagThumbnailOffset = 0x0201
+	tagThumbnailLength = 0x0202
+	tagExifIFD         = 0x8769
+	tagGPSIFD          = 0x8825
+	tagPixelXDimension = 0xa002
+	tagPixelYDimension = 0xa003
+	tagInteropIFD      = 0xa005
+	tagGPSLatitude     = 0x0002
+)
+
+// TIFF field types
+const (
+	typeShort = 3
+	typeLong  = 4
+)
+
+// typeSizes holds the size in bytes of a value of each TIFF field type
+var typeSizes = map[uint16]int{
+	1: 1, 2: 1, typeShort: 2, typeLong: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+var errBadExif = errors.New("jpegmeta: malformed EXIF data")
+
+// IsExif reports whether a segment holds EXIF data
+func IsExif(s Segment) bool {
+	return s.Marker == APP1 && bytes.HasPrefix(s.Data, exifHeader)
+}
+
+// Exif is the TIFF structure of an EXIF segment. Edits other than Strip
+// patch values in place or append to the end, so offsets elsewhere in the
+// data, such as those inside maker notes, stay valid.
+type Exif struct {
+	tiff  []byte
+	order binary.ByteOrder
+
+	// Offsets of the image, EXIF and thumbnail directories; 0 when absent
+	ifd0, exifIFD, ifd1 int
+}
+
+// ParseExif parses the payload of an EXIF segment
+func ParseExif(payload []byte) (*Exif, error) {
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return nil, errBadExif
+	}
+	return ParseTIFF(payload[len(exifHeader):])
+}
+
+// ParseTIFF parses EXIF data stored without the segment header, as in PNG,
+// WebP and TIFF files
+func ParseTIFF(data []byte) (*Exif, error) {
+	tiff := append([]byte(nil), data...)
+	if len(tiff) < 8 {
+		return nil, errBadExif
+	}
+
+	e := &Exif{tiff: tiff}
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		e.order = binary.LittleEndian
+	case "MM\x00*":
+		e.order = binary.BigEndian
+	default:
+		return nil, errBadExif
+	}
+	if !e.locate() {
+		return nil, errBadExif
+	}
+	return e, nil
+}
+
+// locate finds the directories, reporting false if the image directory
+// does not fit in the data
+func (e *Exif) locate() bool {
+	e.ifd0 = int(e.order.Uint32(e.tiff[4:]))
+	e.exifIFD, e.ifd1 = 0, 0
+	count, ok := e.entryCount(e.ifd0)
+	if !ok {
+		return false
+	}
+	if next := e.ifd0 + 2 + 12*count; next+4 <= len(e.tiff) {
+		if ifd1 := int(e.order.Uint32(e.tiff[next:])); ifd1 != 0 {
+			if _, ok := e.entryCount(ifd1); ok {
+				e.ifd1 = ifd1
+			}
+		}
+	}
+	if v, ok := e.uint(e.ifd0, tagExifIFD); ok {
+		if _, ok := e.entryCount(int(v)); ok {
+			e.exifIFD = int(v)
+		}
+	}
+	return true
+}
+
+// Payload returns the edited data as the payload of an APP1 segment
+func (e *Exif) Payload() []byte {
+	return append(append([]byte(nil), exifHeader...), e.tiff...)
+}
+
+// SetDimensions records the pixel size of the image the EXIF data describes
+func (e *Exif) SetDimensions(width, height int) {
+	for _, ifd := range []int{e.ifd0, e.exifIFD} {
+		if ifd == 0 {
+			continue
+		}
+		e.setUint(ifd, tagImageWidth, uint32(width))
+		e.setUint(ifd, tagImageLength, uint32(height))
+		e.setUint(ifd, tagPixelXDimension, uint32(width))
+		e.setUint(ifd, tagPixelYDimension, uint32(height))
+	}
+}
+
+// Orientation returns the EXIF orientation, from 1 (upright) to 8, or 1
+// when it is missing or invalid
+func (e *Exif) Orientation() int {
+	v, ok := e.uint(e.ifd0, tagOrientation)
+	if !ok || v < 1 || v > 8 {
+		return 1
+	}
+	return int(v)
+}
+
+// SetOrientation overwrites the orientation if the tag is present
+func (e *Exif) SetOrientation(orientation int) {
+	e.setUint(e.ifd0, tagOrientation, uint32(orientation))
+}
+
+// Thumbnail returns the embedded JPEG thumbnail, or nil if there is none
+func (e *Exif) Thumbnail() []byte {
+	offset, length, ok := e.thumbnail()
+	if !ok {
+		return nil
+	}
+	return e.tiff[offset : offset+length]
+}
+
+// SetThumbnail replaces the embedded JPEG thumbnail. The new one reuses the
+// old one's space when it fits and is appended otherwise. It reports false,
+// leaving the data unchanged, when there is no thumbnail to replace or the
+// segment would outgrow its size limit.
+func (e *Exif) SetThumbnail(data []byte) bool {
+	offset, length, ok := e.thumbnail()
+	if !ok {
+		return false
+	}
+	if len(data) > length {
+		offset = len(e.tiff)
+		if len(exifHeader)+offset+len(data) > maxPayload {
+			return false
+		}
+		e.tiff = append(e.tiff, data...)
+	} else {
+		copy(e.tiff[offset:], data)
+		clear(e.tiff[offset+len(data) : offset+length])
+	}
+	e.setUint(e.ifd1, tagThumbnailOffset, uint32(offset))
+	e.setUint(e.ifd1, tagThumbnailLength, uint32(len(data)))
+	return true
+}
+
+// thumbnail returns the position of the embedded thumbnail within the TIFF
+// data
+func (e *Exif) thumbnail() (int, int, bool) {
+	if e.ifd1 == 0 {
+		return 0, 0, false
+	}
+	offset, ok1 := e.uint(e.ifd1, tagThumbnailOffset)
+	length, ok2 := e.uint(e.ifd1, tagThumbnailLength)
+	if !ok1 || !ok2 || length == 0 || uint64(offset)+uint64(length) > uint64(len(e.tiff)) {
+		return 0, 0, false
+	}
+	return int(offset), int(length), true
+}
+
+// entryCount returns the number of entries of the directory at offset,
+// reporting false if it does not fit in the data
+func (e *Exif) entryCount(offset int) (int, bool) {
+	if offset < 8 || offset+2 > len(e.tiff) {
+		return 0, false
+	}
+	count := int(e.order.Uint16(e.tiff[offset:]))
+	if offset+2+12*count > len(e.tiff) {
+		return 0, false
+	}
+	return count, true
+}
+
+// entry returns the offset of the directory entry for tag
+func (e *Exif) entry(ifd int, tag uint16) (int, bool) {
+	count, ok := e.entryCount(ifd)
+	if !ok {
+		return 0, false
+	}
+	for i := 0; i < count; i++ {
+		at := ifd + 2 + 12*i
+		if e.order.Uint16(e.tiff[at:]) == tag {
+			return at, true
+		}
+	}
+	return 0, false
+}
+
+// uint reads a single SHORT or LONG value
+func (e *Exif) uint(ifd int, tag uint16) (uint32, bool) {
+	at, ok := e.entry(ifd, tag)
+	if !ok || e.order.Uint32(e.tiff[at+4:]) != 1 {
+		return 0, false
+	}
+	switch e.order.Uint16(e.tiff[at+2:]) {
+	case typeShort:
+		return uint32(e.order.Uint16(e.tiff[at+8:])), true
+	case typeLong:
+		return e.order.Uint32(e.tiff[at+8:]), true
+	}
+	return 0, false
+}
+
+// setUint overwrites a single SHORT or LONG value if the tag is present. A
+// SHORT too small for v is widened to a LONG, which takes the same space.
+func (e *Exif) setUint(ifd int, tag uint16, v uint32) {
+	at, ok := e.entry(ifd, tag)
+	if !ok || e.order.Uint32(e.tiff[at+4:]) != 1 {
+		return
+	}
+	switch e.order.Uint16(e.tiff[at+2:]) {
+	case typeShort:
+		if v <= 0xffff {
+			e.order.PutUint16(e.tiff[at+8:], uint16(v))
+			e.order.PutUint16(e.tiff[at+10:], 0)
+			return
+		}
+		e.order.PutUint16(e.tiff[at+2:], typeLong)
+		fallthrough
+	case typeLong:
+		e.order.PutUint32(e.tiff[at+8:], v)
+	}
+}
@@ -0,0 +1,468 @@
+package jpegmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"slices"
+	"testing"
+)
+
+// buildExif returns an EXIF payload with a copyright notice in the image
+// directory, pixel dimensions as SHORTs in the EXIF directory and, when
+// thumb is not nil, a thumbnail directory
+func buildExif(order binary.ByteOrder, width, height uint16, thumb []byte) []byte {
+	tiff := make([]byte, 108)
+	if order == binary.LittleEndian {
+		copy(tiff, "II*\x00")
+	} else {
+		copy(tiff, "MM\x00*")
+	}
+	order.PutUint32(tiff[4:], 8)
+
+	entry := func(at int, tag, typ uint16, count, value uint32) {
+		order.PutUint16(tiff[at:], tag)
+		order.PutUint16(tiff[at+2:], typ)
+		order.PutUint32(tiff[at+4:], count)
+		if typ == typeShort && count == 1 {
+			order.PutUint16(tiff[at+8:], uint16(value))
+		} else {
+			order.PutUint32(tiff[at+8:], value)
+		}
+	}
+
+	// Image directory at 8, copyright text at 38
+	order.PutUint16(tiff[8:], 2)
+	entry(10, 0x8298, 2, 9, 38)
+	entry(22, tagExifIFD, typeLong, 1, 48)
+	copy(tiff[38:], "Jane Doe\x00")
+
+	// EXIF directory at 48
+	order.PutUint16(tiff[48:], 2)
+	entry(50, tagPixelXDimension, typeShort, 1, uint32(width))
+	entry(62, tagPixelYDimension, typeShort, 1, uint32(height))
+
+	// Thumbnail directory at 78, thumbnail at 108
+	if thumb != nil {
+		order.PutUint32(tiff[34:], 78)
+		order.PutUint16(tiff[78:], 2)
+		entry(80, tagThumbnailOffset, typeLong, 1, 108)
+		entry(92, tagThumbnailLength, typeLong, 1, uint32(len(thumb)))
+		tiff = append(tiff, thumb...)
+	}
+	return append(append([]byte(nil), exifHeader...), tiff...)
+}
+
+func encodeJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatalf("failed to encode JPEG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadInsert(t *testing.T) {
+	plain := encodeJPEG(t, 8, 8)
+	segments := []Segment{
+		{Marker: APP1, Data: buildExif(binary.LittleEndian, 8, 8, nil)},
+		{Marker: APP2, Data: []byte("ICC_PROFILE\x00\x01\x01profile")},
+		{Marker: APP13, Data: []byte("Photoshop 3.0\x00iptc")},
+	}
+
+	withMeta, err := Insert(plain, segments)
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(withMeta)); err != nil {
+		t.Fatalf("JPEG with metadata does not decode: %v", err)
+	}
+
+	got, err := Read(withMeta)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(got) != len(segments) {
+		t.Fatalf("expected %d segments, got %d", len(segments), len(got))
+	}
+	for i := range segments {
+		if got[i].Marker != segments[i].Marker || !bytes.Equal(got[i].Data, segments[i].Data) {
+			t.Errorf("segment %d changed: %x %q", i, got[i].Marker, got[i].Data)
+		}
+	}
+	if !IsExif(got[0]) || IsExif(got[1]) {
+		t.Error("EXIF segment not recognized")
+	}
+
+	// Segments go after a leading JFIF segment
+	jfif := []Segment{{Marker: APP0, Data: []byte("JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00")}}
+	withJFIF, _ := Insert(plain, jfif)
+	withBoth, err := Insert(withJFIF, segments[:1])
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if got, _ := Read(withBoth); len(got) != 2 || got[0].Marker != APP0 || got[1].Marker != APP1 {
+		t.Errorf("unexpected segment order %v", got)
+	}
+
+	if _, err := Insert(plain, []Segment{{Marker: APP1, Data: make([]byte, 70000)}}); err == nil {
+		t.Error("expected an oversized segment to be rejected")
+	}
+	if _, err := Read([]byte("not a jpeg")); err == nil {
+		t.Error("expected Read to reject non-JPEG data")
+	}
+}
+
+func TestComponentsAdobe(t *testing.T) {
+	plain := encodeJPEG(t, 8, 8)
+	if n, err := Components(plain); err != nil || n != 1 {
+		t.Errorf("expected 1 component for gray, got %d, %v", n, err)
+	}
+	if _, ok := AdobeTransform(nil); ok {
+		t.Error("found an Adobe segment in none")
+	}
+
+	tagged, err := Insert(plain, []Segment{AdobeSegment(2)})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	segments, _ := Read(tagged)
+	if transform, ok := AdobeTransform(segments); !ok || transform != 2 {
+		t.Errorf("expected transform 2, got %d, %v", transform, ok)
+	}
+
+	if _, err := Components([]byte("not a jpeg")); err == nil {
+		t.Error("expected Components to reject non-JPEG data")
+	}
+}
+
+func TestExifEdits(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			oldThumb := encodeJPEG(t, 160, 120)
+			exif, err := ParseExif(buildExif(order, 4000, 3000, oldThumb))
+			if err != nil {
+				t.Fatalf("ParseExif failed: %v", err)
+			}
+			if !bytes.Equal(exif.Thumbnail(), oldThumb) {
+				t.Fatal("thumbnail not found")
+			}
+			if exif.Orientation() != 1 {
+				t.Errorf("expected a missing orientation to read as 1, got %d", exif.Orientation())
+			}
+
+			// 70000 does not fit a SHORT and is widened to a LONG
+			exif.SetDimensions(70000, 600)
+			if w, _ := exif.uint(exif.exifIFD, tagPixelXDimension); w != 70000 {
+				t.Errorf("expected width 70000, got %d", w)
+			}
+			if h, _ := exif.uint(exif.exifIFD, tagPixelYDimension); h != 600 {
+				t.Errorf("expected height 600, got %d", h)
+			}
+
+			// A smaller thumbnail reuses the old space, a larger one is appended
+			small := encodeJPEG(t, 16, 12)
+			size := len(exif.tiff)
+			if !exif.SetThumbnail(small) || len(exif.tiff) != size || !bytes.Equal(exif.Thumbnail(), small) {
+				t.Error("smaller thumbnail was not written in place")
+			}
+			large := append(encodeJPEG(t, 160, 120), make([]byte, len(oldThumb))...)
+			if !exif.SetThumbnail(large) || !bytes.Equal(exif.Thumbnail(), large) {
+				t.Error("larger thumbnail was not appended")
+			}
+			if exif.SetThumbnail(make([]byte, 70000)) {
+				t.Error("expected a thumbnail beyond the segment limit to be refused")
+			}
+
+			reparsed, err := ParseExif(exif.Payload())
+			if err != nil {
+				t.Fatalf("edited EXIF does not parse: %v", err)
+			}
+			if !bytes.Equal(reparsed.Thumbnail(), large) {
+				t.Error("thumbnail lost after reparsing")
+			}
+			if !bytes.Contains(exif.Payload(), []byte("Jane Doe")) {
+				t.Error("copyright lost")
+			}
+		})
+	}
+
+	if _, err := ParseExif([]byte("Exif\x00\x00XX")); err == nil {
+		t.Error("expected malformed EXIF to be rejected")
+	}
+}
+
+func TestICCSegments(t *testing.T) {
+	profile := make([]byte, 2*iccChunkSize+100)
+	for i := range profile {
+		profile[i] = byte(i * 7)
+	}
+
+	segments := ICCSegments(profile)
+	if len(segments) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(segments))
+	}
+	for _, s := range segments {
+		if !IsICC(s) || len(s.Data) > maxPayload {
+			t.Fatalf("bad chunk of %d bytes", len(s.Data))
+		}
+	}
+
+	// Chunks are reassembled by sequence number, whatever their order
+	shuffled := []Segment{segments[2], {Marker: APP1, Data: []byte("Exif\x00\x00")}, segments[0], segments[1]}
+	if got := ICCProfile(shuffled); !bytes.Equal(got, profile) {
+		t.Error("profile changed after reassembly")
+	}
+	if ICCProfile(segments[:2]) != nil {
+		t.Error("expected an incomplete profile to be ignored")
+	}
+	if ICCProfile(nil) != nil || ICCSegments(nil) != nil {
+		t.Error("expected no profile")
+	}
+}
+
+// tiffField is a field of a test directory; sub makes it a pointer to
+// another directory
+type tiffField struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+	sub      []tiffField
+}
+
+// buildTIFF returns a little-endian EXIF payload with ifd0 as its image
+// directory
+func buildTIFF(ifd0 []tiffField) []byte {
+	le := binary.LittleEndian
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	var dir func(fields []tiffField) uint32
+	dir = func(fields []tiffField) uint32 {
+		at := len(tiff)
+		tiff = le.AppendUint16(tiff, uint16(len(fields)))
+		tiff = append(tiff, make([]byte, 12*len(fields)+4)...)
+		for i, f := range fields {
+			e := at + 2 + 12*i
+			le.PutUint16(tiff[e:], f.tag)
+			le.PutUint16(tiff[e+2:], f.typ)
+			le.PutUint32(tiff[e+4:], f.count)
+			switch {
+			case f.sub != nil:
+				offset := dir(f.sub)
+				le.PutUint32(tiff[e+8:], offset)
+			case len(f.value) <= 4:
+				copy(tiff[e+8:], f.value)
+			default:
+				le.PutUint32(tiff[e+8:], uint32(len(tiff)))
+				tiff = append(tiff, f.value...)
+				if len(tiff)%2 != 0 {
+					tiff = append(tiff, 0)
+				}
+			}
+		}
+		return uint32(at)
+	}
+	dir(ifd0)
+	return append(append([]byte(nil), exifHeader...), tiff...)
+}
+
+func ascii(s string) tiffField {
+	return tiffField{typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+func tagged(tag uint16, f tiffField) tiffField {
+	f.tag = tag
+	return f
+}
+
+func TestExifStrip(t *testing.T) {
+	latitude := make([]byte, 24)
+	for i := range 3 {
+		binary.LittleEndian.PutUint32(latitude[8*i:], uint32(10+i))
+		binary.LittleEndian.PutUint32(latitude[8*i+4:], 1)
+	}
+	payload := buildTIFF([]tiffField{
+		tagged(0x010e, ascii("Holiday")),
+		tagged(0x010f, ascii("Acme")),
+		{tag: tagOrientation, typ: typeShort, count: 1, value: []byte{6, 0}},
+		tagged(0x013b, ascii("Jane Doe")),
+		{tag: tagExifIFD, typ: typeLong, count: 1, sub: []tiffField{
+			{tag: 0x829a, typ: 5, count: 1, value: []byte{1, 0, 0, 0, 200, 0, 0, 0}},
+			{tag: 0x927c, typ: 7, count: 16, value: []byte("ACME MAKER NOTES")},
+			{tag: tagPixelXDimension, typ: typeLong, count: 1, value: []byte{64, 0, 0, 0}},
+			tagged(0xa431, ascii("SN-1234567")),
+		}},
+		{tag: tagGPSIFD, typ: typeLong, count: 1, sub: []tiffField{
+			tagged(0x0001, ascii("N")),
+			{tag: tagGPSLatitude, typ: 5, count: 3, value: latitude},
+		}},
+	})
+
+	exif, err := ParseExif(payload)
+	if err != nil {
+		t.Fatalf("ParseExif failed: %v", err)
+	}
+	if !exif.HasLocation() {
+		t.Fatal("GPS coordinates not found")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		keep   []Category
+		want   []string
+		absent []string
+	}{
+		{"copyright", []Category{CategoryCopyright}, []string{"Jane Doe"}, []string{"Holiday", "Acme"}},
+		{"camera", []Category{CategoryCamera}, []string{"Acme"}, []string{"Holiday", "Jane Doe"}},
+		{"all", []Category{CategoryCopyright, CategoryCamera, CategoryOther}, []string{"Holiday", "Acme", "Jane Doe"}, nil},
+	} {
+		exif, _ := ParseExif(payload)
+		if !exif.Strip(func(c Category) bool { return slices.Contains(tc.keep, c) }) {
+			t.Fatalf("%s: expected fields to remain", tc.name)
+		}
+		out := exif.Payload()
+		for _, s := range tc.want {
+			if !bytes.Contains(out, []byte(s)) {
+				t.Errorf("%s: %q removed", tc.name, s)
+			}
+		}
+		for _, s := range append(tc.absent, "SN-1234567", "MAKER NOTES") {
+			if bytes.Contains(out, []byte(s)) {
+				t.Errorf("%s: %q kept", tc.name, s)
+			}
+		}
+
+		reparsed, err := ParseExif(out)
+		if err != nil {
+			t.Fatalf("%s: stripped EXIF does not parse: %v", tc.name, err)
+		}
+		if reparsed.HasLocation() || reparsed.Orientation() != 6 {
+			t.Errorf("%s: location kept or orientation lost", tc.name)
+		}
+		if _, ok := reparsed.uint(reparsed.exifIFD, tagPixelXDimension); !ok {
+			t.Errorf("%s: pixel dimensions lost", tc.name)
+		}
+		_, exposure := reparsed.entry(reparsed.exifIFD, 0x829a)
+		if exposure != slices.Contains(tc.keep, CategoryCamera) {
+			t.Errorf("%s: exposure time kept: %t", tc.name, exposure)
+		}
+	}
+
+	// The thumbnail survives
+	thumb := encodeJPEG(t, 160, 120)
+	exif, _ = ParseExif(buildExif(binary.BigEndian, 4000, 3000, thumb))
+	exif.Strip(func(Category) bool { return false })
+	if bytes.Contains(exif.Payload(), []byte("Jane Doe")) || !bytes.Equal(exif.Thumbnail(), thumb) {
+		t.Error("expected the copyright removed and the thumbnail kept")
+	}
+}
+
+func TestScrubXMP(t *testing.T) {
+	packet := `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description exif:GPSLatitude="52,22.5N" exif:GPSLongitude='4,53.6E' dc:format="image/jpeg"
+ aux:SerialNumber="SN-1234567">
+ <dc:creator><rdf:Seq><rdf:li>Jane Doe</rdf:li></rdf:Seq></dc:creator>
+ <exif:GPSAltitude>12/1</exif:GPSAltitude>
+ <exifEX:BodySerialNumber/>
+</rdf:Description></rdf:RDF></x:xmpmeta>
+<?xpacket end="w"?>`
+	s := Segment{Marker: APP1, Data: append(append([]byte(nil), xmpHeader...), packet...)}
+	if !IsXMP(s) || IsExif(s) {
+		t.Fatal("XMP segment not recognized")
+	}
+	scrubbed, location := ScrubXMP(s.Data)
+	if !location {
+		t.Error("GPS coordinates not found")
+	}
+	for _, gone := range []string{"GPS", "SerialNumber", "SN-1234567"} {
+		if bytes.Contains(scrubbed, []byte(gone)) {
+			t.Errorf("%q kept in %s", gone, scrubbed)
+		}
+	}
+	for _, kept := range []string{"Jane Doe", `dc:format="image/jpeg"`, `<?xpacket end="w"?>`} {
+		if !bytes.Contains(scrubbed, []byte(kept)) {
+			t.Errorf("%q removed from %s", kept, scrubbed)
+		}
+	}
+
+	// Vendor namespaces spell the names in any case
+	dji := `<rdf:Description drone-dji:GpsLatitude="52.375" drone-dji:GpsLongtitude="4.893"><drone-dji:gpsAltitude>12</drone-dji:gpsAltitude></rdf:Description>`
+	if !XMPHasLocation([]byte(dji)) {
+		t.Error("DJI GPS coordinates not found")
+	}
+	if scrubbed, _ := ScrubXMP(append(append([]byte(nil), xmpHeader...), dji...)); bytes.Contains(bytes.ToLower(scrubbed), []byte("gps")) {
+		t.Errorf("DJI GPS fields kept in %s", scrubbed)
+	}
+
+	if scrubbed, _ := ScrubXMP(append(append([]byte(nil), xmpHeader...), "<exif:GPSAltitude>1"...)); scrubbed != nil {
+		t.Error("expected an unterminated property to drop the packet")
+	}
+}
+
+// photoshopResource returns an unnamed Photoshop image resource block
+func photoshopResource(id uint16, data []byte) []byte {
+	block := binary.BigEndian.AppendUint16([]byte("8BIM"), id)
+	block = binary.BigEndian.AppendUint32(append(block, 0, 0), uint32(len(data)))
+	block = append(block, data...)
+	if len(data)%2 != 0 {
+		block = append(block, 0)
+	}
+	return block
+}
+
+func TestScrubPhotoshop(t *testing.T) {
+	gps := buildTIFF([]tiffField{{tag: tagGPSIFD, typ: typeLong, count: 1, sub: []tiffField{
+		{tag: tagGPSLatitude, typ: 5, count: 3, value: make([]byte, 24)},
+	}}})
+	iptc := photoshopResource(resourceIPTC, []byte("\x1c\x02\x74\x00\x09Jane Doe."))
+	photoshop := func(blocks ...[]byte) []byte {
+		return slices.Concat(append([][]byte{photoshopHeader}, blocks...)...)
+	}
+
+	for name, other := range map[string][]byte{
+		"exif": photoshopResource(resourceExif, gps[len(exifHeader):]),
+		"xmp":  photoshopResource(resourceXMP, []byte(`<rdf:Description exif:GPSLongitude="4,53.6E"/>`)),
+	} {
+		s := Segment{Marker: APP13, Data: photoshop(other, iptc)}
+		if !IsPhotoshop(s) {
+			t.Fatal("Photoshop segment not recognized")
+		}
+		scrubbed, location := ScrubPhotoshop(s.Data)
+		if !location {
+			t.Errorf("%s: GPS coordinates not found", name)
+		}
+		if !bytes.Equal(scrubbed, photoshop(iptc)) {
+			t.Errorf("%s: expected only the IPTC record kept, got %q", name, scrubbed)
+		}
+		if scrubbed, _ := ScrubPhotoshop(photoshop(other)); scrubbed != nil {
+			t.Errorf("%s: expected the segment dropped without an IPTC record", name)
+		}
+	}
+
+	if scrubbed, _ := ScrubPhotoshop(photoshop(iptc)[:len(photoshop(iptc))-4]); scrubbed != nil {
+		t.Error("expected a truncated resource to drop the segment")
+	}
+}
+
+func TestStrip(t *testing.T) {
+	data, err := Insert(encodeJPEG(t, 8, 8), []Segment{
+		{Marker: APP1, Data: buildExif(binary.LittleEndian, 8, 8, nil)},
+		{Marker: APP2, Data: []byte("ICC_PROFILE\x00\x01\x01profile")},
+		{Marker: 0xfe, Data: []byte("comment")},
+	})
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	stripped, err := Strip(data, IsICC)
+	if err != nil {
+		t.Fatalf("Strip failed: %v", err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Fatalf("stripped JPEG does not decode: %v", err)
+	}
+	got, _ := Read(stripped)
+	if len(got) != 1 || !IsICC(got[0]) || bytes.Contains(stripped, []byte("comment")) {
+		t.Errorf("expected only the ICC segment, got %v", got)
+	}
+}
@@ -0,0 +1,71 @@
+package jpegmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// photoshopHeader starts the payload of an APP13 segment holding Photoshop
+// image resources
+var photoshopHeader = []byte("Photoshop 3.0\x00")
+
+// Photoshop image resources, by ID
+const (
+	resourceIPTC = 0x0404 // IPTC-NAA record
+	resourceExif = 0x0422 // EXIF data, without its APP1 header
+	resourceXMP  = 0x0424 // XMP packet, without its APP1 header
+)
+
+// IsPhotoshop reports whether a segment holds Photoshop image resources
+func IsPhotoshop(s Segment) bool {
+	return s.Marker == APP13 && bytes.HasPrefix(s.Data, photoshopHeader)
+}
+
+// ScrubPhotoshop keeps only the IPTC record of the payload of a Photoshop
+// segment, as its other resources may repeat the EXIF and XMP data with
+// their GPS coordinates. It returns the new payload, or nil when no IPTC
+// record is left or the resources cannot be parsed, and reports whether
+// the EXIF or XMP resources held GPS coordinates.
+func ScrubPhotoshop(payload []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(payload, photoshopHeader) {
+		return nil, false
+	}
+	out := append([]byte(nil), photoshopHeader...)
+	iptc, location := false, false
+	for p := payload[len(photoshopHeader):]; len(p) > 0; {
+		// Signature, ID, padded Pascal name, size, padded data
+		if len(p) < 8 {
+			return nil, location
+		}
+		id := binary.BigEndian.Uint16(p[4:])
+		start := 6 + (int(p[6])+2)&^1
+		if len(p) < start+4 {
+			return nil, location
+		}
+		size := int(binary.BigEndian.Uint32(p[start:]))
+		start += 4
+		if size < 0 || len(p)-start < size {
+			return nil, location
+		}
+		data := p[start : start+size]
+		end := min(start+(size+1)&^1, len(p))
+
+		switch {
+		case string(p[:4]) != "8BIM":
+		case id == resourceIPTC:
+			out = append(out, p[:end]...)
+			iptc = true
+		case id == resourceExif:
+			if exif, err := ParseTIFF(data); err == nil && exif.HasLocation() {
+				location = true
+			}
+		case id == resourceXMP:
+			location = location || XMPHasLocation(data)
+		}
+		p = p[end:]
+	}
+	if !iptc {
+		return nil, location
+	}
+	return out, location
+}
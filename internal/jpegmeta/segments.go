@@ -0,0 +1,230 @@
+// Package jpegmeta reads the metadata segments of JPEG files, carries them
+// into re-encoded files and edits the EXIF data they hold.
+package jpegmeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Markers of the application segments that hold metadata
+const (
+	APP0  byte = 0xe0 // JFIF
+	APP1  byte = 0xe1 // EXIF or XMP
+	APP2  byte = 0xe2 // ICC profile
+	APP13 byte = 0xed // IPTC (Photoshop)
+	APP14 byte = 0xee // Adobe
+)
+
+const (
+	markerSOI = 0xd8
+	markerSOS = 0xda
+	markerEOI = 0xd9
+	markerCOM = 0xfe
+
+	// Largest payload of a segment; its length field counts itself
+	maxPayload = 0xffff - 2
+)
+
+var errNotJPEG = errors.New("jpegmeta: missing SOI marker")
+
+// Segment is an application segment without its marker and length bytes
+type Segment struct {
+	Marker byte
+	Data   []byte
+}
+
+// Read returns the application segments of a JPEG file in order. Scanning
+// stops at the first scan, after which no metadata may appear.
+func Read(data []byte) ([]Segment, error) {
+	var segments []Segment
+	err := headers(data, func(_ int, marker byte, payload []byte) {
+		if marker >= APP0 && marker <= 0xef {
+			segments = append(segments, Segment{Marker: marker, Data: append([]byte(nil), payload...)})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+// Components returns the number of color components of a JPEG file: 1 for
+// gray, 3 for YCbCr or RGB, 4 for CMYK or YCCK
+func Components(data []byte) (int, error) {
+	components := 0
+	err := headers(data, func(_ int, marker byte, payload []byte) {
+		// Start of frame markers, except DHT, JPG and DAC which share the range
+		isSOF := marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc
+		if isSOF && len(payload) >= 6 {
+			components = int(payload[5])
+		}
+	})
+	if err == nil && components == 0 {
+		err = errors.New("jpegmeta: missing frame header")
+	}
+	return components, err
+}
+
+// AdobeTransform returns the color transform recorded in an Adobe APP14
+// segment: 0 for CMYK or RGB, 1 for YCbCr, 2 for YCCK. It reports false if
+// there is no such segment.
+func AdobeTransform(segments []Segment) (byte, bool) {
+	for _, s := range segments {
+		if s.Marker == APP14 && len(s.Data) >= 12 && bytes.HasPrefix(s.Data, []byte("Adobe")) {
+			return s.Data[11], true
+		}
+	}
+	return 0, false
+}
+
+// AdobeSegment returns an Adobe APP14 segment recording a color transform
+func AdobeSegment(transform byte) Segment {
+	// Version 100, no flags
+	return Segment{Marker: APP14, Data: []byte{'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, transform}}
+}
+
+// Strip returns a copy of a JPEG file without the application and comment
+// segments before its first scan that keep rejects. The segments passed to
+// keep share memory with data.
+func Strip(data []byte, keep func(Segment) bool) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	last := 0
+	err := headers(data, func(pos int, marker byte, payload []byte) {
+		metadata := marker >= APP0 && marker <= 0xef || marker == markerCOM
+		if metadata && !keep(Segment{Marker: marker, Data: payload}) {
+			out = append(out, data[last:pos]...)
+			last = pos + 4 + len(payload)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(out, data[last:]...), nil
+}
+
+// headers calls visit for every marker segment of a JPEG file up to its
+// first scan, with the offset of its marker
+func headers(data []byte, visit func(pos int, marker byte, payload []byte)) error {
+	if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+		return errNotJPEG
+	}
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			return fmt.Errorf("jpegmeta: expected marker at offset %d", pos)
+		}
+		marker := data[pos+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte before a marker
+			pos++
+			continue
+		case marker == markerSOS || marker == markerEOI:
+			return nil
+		case marker >= 0xd0 && marker <= 0xd7 || marker == 0x01:
+			// Markers without a length
+			pos += 2
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return fmt.Errorf("jpegmeta: segment %#x at offset %d is truncated", marker, pos)
+		}
+		visit(pos, marker, data[pos+4:pos+2+length])
+		pos += 2 + length
+	}
+	return errors.New("jpegmeta: no image data")
+}
+
+// Insert returns a copy of a JPEG file with segments placed right after its
+// SOI marker, or after its JFIF segment when it starts with one
+func Insert(data []byte, segments []Segment) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != markerSOI {
+		return nil, errNotJPEG
+	}
+
+	at := 2
+	if len(data) >= 6 && data[2] == 0xff && data[3] == APP0 {
+		at += 2 + int(binary.BigEndian.Uint16(data[4:]))
+		if at > len(data) {
+			return nil, errors.New("jpegmeta: JFIF segment is truncated")
+		}
+	}
+
+	size := len(data)
+	for _, s := range segments {
+		if len(s.Data) > maxPayload {
+			return nil, fmt.Errorf("jpegmeta: segment %#x holds %d bytes, more than %d", s.Marker, len(s.Data), maxPayload)
+		}
+		size += 4 + len(s.Data)
+	}
+
+	out := make([]byte, 0, size)
+	out = append(out, data[:at]...)
+	for _, s := range segments {
+		out = append(out, 0xff, s.Marker)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(s.Data)+2))
+		out = append(out, s.Data...)
+	}
+	return append(out, data[at:]...), nil
+}
+
+// iccHeader starts every APP2 segment holding part of an ICC profile. It is
+// followed by the 1-based chunk number and the number of chunks.
+var iccHeader = []byte("ICC_PROFILE\x00")
+
+// iccChunkSize is the most profile data one APP2 segment carries
+const iccChunkSize = maxPayload - 14
+
+// IsICC reports whether a segment holds part of an ICC profile
+func IsICC(s Segment) bool {
+	return s.Marker == APP2 && len(s.Data) >= len(iccHeader)+2 && bytes.HasPrefix(s.Data, iccHeader)
+}
+
+// ICCProfile reassembles the ICC profile split across the APP2 segments of
+// a file. It returns nil if there is none or a chunk is missing.
+func ICCProfile(segments []Segment) []byte {
+	var chunks [][]byte
+	for _, s := range segments {
+		if !IsICC(s) {
+			continue
+		}
+		seq, count := int(s.Data[len(iccHeader)]), int(s.Data[len(iccHeader)+1])
+		if chunks == nil {
+			chunks = make([][]byte, count)
+		}
+		if count != len(chunks) || seq < 1 || seq > count {
+			return nil
+		}
+		chunks[seq-1] = s.Data[len(iccHeader)+2:]
+	}
+
+	var profile []byte
+	for _, c := range chunks {
+		if c == nil {
+			return nil
+		}
+		profile = append(profile, c...)
+	}
+	return profile
+}
+
+// ICCSegments splits an ICC profile into APP2 segments
+func ICCSegments(profile []byte) []Segment {
+	count := (len(profile) + iccChunkSize - 1) / iccChunkSize
+	if count == 0 || count > 255 {
+		return nil
+	}
+	segments := make([]Segment, count)
+	for i := range segments {
+		chunk := profile[i*iccChunkSize : min((i+1)*iccChunkSize, len(profile))]
+		data := append(append([]byte(nil), iccHeader...), byte(i+1), byte(count))
+		segments[i] = Segment{Marker: APP2, Data: append(data, chunk...)}
+	}
+	return segments
+}
@@ -0,0 +1,223 @@
+package jpegmeta
+
+// Category groups EXIF fields for Strip
+type Category int
+
+// Categories of EXIF fields
+const (
+	// Fields needed to read the data and display the image: orientation,
+	// resolution, pixel dimensions, directory pointers and the thumbnail
+	CategoryStructure Category = iota
+
+	// Author and copyright notices
+	CategoryCopyright
+
+	// Camera make and model, capture settings and dates
+	CategoryCamera
+
+	// Anything else, such as descriptions and the editing software
+	CategoryOther
+
+	// Location, serial numbers, the owner's name, the unique image ID and
+	// maker notes
+	CategoryPrivate
+)
+
+// Directories of EXIF data, which number their tags independently
+type directory int
+
+const (
+	dirImage directory = iota
+	dirExif
+	dirInterop
+	dirThumbnail
+	dirGPS
+)
+
+// category returns the category of a field in a directory
+func category(dir directory, tag uint16) Category {
+	switch dir {
+	case dirImage:
+		switch tag {
+		case tagImageWidth, tagImageLength, 0x0102, 0x0103, 0x0106, tagOrientation, 0x0115, 0x011a, 0x011b,
+			0x0128, 0x013e, 0x013f, 0x0211, 0x0212, 0x0213, 0x0214, tagExifIFD:
+			return CategoryStructure
+		case 0x013b, 0x8298, 0x9c9d: // Artist, Copyright, XPAuthor
+			return CategoryCopyright
+		case 0x010f, 0x0110, 0x0132: // Make, Model, DateTime
+			return CategoryCamera
+		case tagGPSIFD, 0xc62f: // camera serial number
+			return CategoryPrivate
+		}
+		return CategoryOther
+	case dirExif:
+		switch tag {
+		case 0x9000, 0x9101, 0xa000, 0xa001, tagPixelXDimension, tagPixelYDimension, tagInteropIFD, 0xa500:
+			return CategoryStructure
+		case 0x9286: // UserComment
+			return CategoryOther
+		case 0x927c, 0xa420, 0xa430, 0xa431, 0xa435: // MakerNote, ImageUniqueID, owner, body and lens serials
+			return CategoryPrivate
+		}
+		return CategoryCamera
+	case dirInterop, dirThumbnail:
+		return CategoryStructure
+	}
+	return CategoryPrivate
+}
+
+// HasLocation reports whether the data holds GPS coordinates
+func (e *Exif) HasLocation() bool {
+	gps, ok := e.uint(e.ifd0, tagGPSIFD)
+	if !ok {
+		return false
+	}
+	_, ok = e.entry(int(gps), tagGPSLatitude)
+	return ok
+}
+
+// Strip removes the fields whose category keep rejects, and private fields
+// whatever it says. The data is rebuilt, so nothing of the removed fields
+// remains; maker notes, whose internal offsets would break, are always
+// among them. Directories left empty are dropped, and so is a thumbnail
+// directory without a JPEG thumbnail. It reports whether any field is left.
+func (e *Exif) Strip(keep func(Category) bool) bool {
+	w := &exifWriter{e: e, keep: keep, out: append(append([]byte(nil), e.tiff[:4]...), 0, 0, 0, 0)}
+	e.order.PutUint32(w.out[4:], 8)
+	kept := len(w.entries(e.ifd0, dirImage))
+	ifd0 := w.write(e.ifd0, dirImage)
+	if _, _, ok := e.thumbnail(); ok {
+		if ifd1 := w.write(e.ifd1, dirThumbnail); ifd1 != 0 {
+			count := int(e.order.Uint16(w.out[ifd0:]))
+			e.order.PutUint32(w.out[ifd0+2+12*count:], uint32(ifd1))
+			kept++
+		}
+	}
+	e.tiff = w.out
+	e.locate()
+	return kept > 0
+}
+
+// exifWriter rebuilds EXIF data from the kept fields of another
+type exifWriter struct {
+	e    *Exif
+	keep func(Category) bool
+	out  []byte
+}
+
+// child returns the directory a pointer field leads to, if it is one
+func child(dir directory, tag uint16) (directory, bool) {
+	switch {
+	case dir == dirImage && tag == tagExifIFD:
+		return dirExif, true
+	case dir == dirExif && tag == tagInteropIFD:
+		return dirInterop, true
+	}
+	return 0, false
+}
+
+// entries returns the kept entries of the directory at offset. Pointers to
+// directories that keep nothing and fields whose value lies outside the
+// data are dropped.
+func (w *exifWriter) entries(offset int, dir directory) [][]byte {
+	e := w.e
+	count, ok := e.entryCount(offset)
+	if !ok {
+		return nil
+	}
+	var kept [][]byte
+	for i := 0; i < count; i++ {
+		entry := e.tiff[offset+2+12*i : offset+14+12*i]
+		tag := e.order.Uint16(entry)
+		c := category(dir, tag)
+		if c == CategoryPrivate || c != CategoryStructure && !w.keep(c) {
+			continue
+		}
+		size, ok := w.valueSize(entry)
+		if !ok {
+			continue
+		}
+		value := int(e.order.Uint32(entry[8:]))
+		switch sub, isPointer := child(dir, tag); {
+		case isPointer:
+			if len(w.entries(value, sub)) == 0 {
+				continue
+			}
+		case dir == dirThumbnail && (tag == tagThumbnailOffset || tag == tagThumbnailLength):
+			// Copied along with the thumbnail, which thumbnail validates
+		case size > 4 && value+size > len(e.tiff):
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return kept
+}
+
+// write appends the kept entries of the directory at offset and their
+// values, returning the new offset of the directory. An image directory is
+// written even when empty; other empty directories are left out and 0 is
+// returned.
+func (w *exifWriter) write(offset int, dir directory) int {
+	e := w.e
+	entries := w.entries(offset, dir)
+	if len(entries) == 0 && dir != dirImage {
+		return 0
+	}
+
+	w.align()
+	at := len(w.out)
+	w.out = append(w.out, 0, 0)
+	e.order.PutUint16(w.out[at:], uint16(len(entries)))
+	for _, entry := range entries {
+		w.out = append(w.out, entry...)
+	}
+	w.out = append(w.out, 0, 0, 0, 0) // no next directory
+
+	for i, entry := range entries {
+		field := at + 2 + 12*i
+		tag := e.order.Uint16(entry)
+		value := int(e.order.Uint32(entry[8:]))
+		size, _ := w.valueSize(entry)
+
+		// Appending may move the output, so offsets are stored afterwards
+		var offset int
+		switch sub, isPointer := child(dir, tag); {
+		case isPointer:
+			offset = w.write(value, sub)
+		case dir == dirThumbnail && tag == tagThumbnailOffset:
+			thumbOffset, length, _ := e.thumbnail()
+			offset = w.appendValue(e.tiff[thumbOffset : thumbOffset+length])
+		case size > 4:
+			offset = w.appendValue(e.tiff[value : value+size])
+		default:
+			continue
+		}
+		e.order.PutUint32(w.out[field+8:], uint32(offset))
+	}
+	return at
+}
+
+// appendValue appends a value at a word boundary and returns its offset
+func (w *exifWriter) appendValue(value []byte) int {
+	w.align()
+	at := len(w.out)
+	w.out = append(w.out, value...)
+	return at
+}
+
+func (w *exifWriter) align() {
+	if len(w.out)%2 != 0 {
+		w.out = append(w.out, 0)
+	}
+}
+
+// valueSize returns the size of a field's value, reporting false for
+// unknown types and sizes beyond any segment
+func (w *exifWriter) valueSize(entry []byte) (int, bool) {
+	size, ok := typeSizes[w.e.order.Uint16(entry[2:])]
+	count := w.e.order.Uint32(entry[4:])
+	if !ok || count > maxPayload {
+		return 0, false
+	}
+	return size * int(count), true
+}
@@ -0,0 +1,91 @@
+package jpegmeta
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// xmpHeader starts the payload of an APP1 segment holding an XMP packet
+var xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+// Private XMP properties, by local name: GPS fields in any case, as in the
+// exif namespace or DJI's drone-dji:GpsLatitude, and the serial numbers and
+// owner names of the exifEX and aux namespaces
+const xmpPrivateName = `[\w-]+:(?:(?i:gps)\w+|SerialNumber|BodySerialNumber|LensSerialNumber|CameraOwnerName|OwnerName|ImageUniqueID)`
+
+var (
+	// A private property written as an attribute of rdf:Description
+	xmpPrivateAttr = regexp.MustCompile(`\s` + xmpPrivateName + `\s*=\s*(?:"[^"]*"|'[^']*')`)
+
+	// The start tag of a private property written as an element
+	xmpPrivateElem = regexp.MustCompile(`<(` + xmpPrivateName + `)[\s/>]`)
+
+	// A private property giving coordinates, including DJI's misspelled
+	// GpsLongtitude
+	xmpLocation = regexp.MustCompile(`(?i):gps\w*(?:latitude|longt?itude)`)
+)
+
+// IsXMP reports whether a segment holds an XMP packet
+func IsXMP(s Segment) bool {
+	return s.Marker == APP1 && bytes.HasPrefix(s.Data, xmpHeader)
+}
+
+// XMPHasLocation reports whether an XMP packet stored outside JPEG, without
+// the APP1 header, holds GPS coordinates
+func XMPHasLocation(packet []byte) bool {
+	_, location := ScrubXMP(append(append([]byte(nil), xmpHeader...), packet...))
+	return location
+}
+
+// ScrubXMP removes the location, serial number and owner properties from the
+// payload of an XMP segment. It returns the new payload, or nil when a
+// property cannot be delimited and the packet must be dropped, and reports
+// whether the packet held GPS coordinates.
+func ScrubXMP(payload []byte) ([]byte, bool) {
+	packet := payload[len(xmpHeader):]
+	location := false
+
+	packet = xmpPrivateAttr.ReplaceAllFunc(packet, func(attr []byte) []byte {
+		location = location || xmpLocation.Match(attr)
+		return nil
+	})
+
+	var out []byte
+	for {
+		m := xmpPrivateElem.FindSubmatchIndex(packet)
+		if m == nil {
+			break
+		}
+		name := string(packet[m[2]:m[3]])
+		location = location || xmpLocation.MatchString(name)
+
+		// The element ends with its start tag when empty, or at its end tag
+		end := bytes.IndexByte(packet[m[0]:], '>')
+		if end < 0 {
+			return nil, location
+		}
+		end += m[0] + 1
+		if packet[end-2] != '/' {
+			closing := bytes.Index(packet[end:], []byte("</"+name+">"))
+			if closing < 0 {
+				return nil, location
+			}
+			end += closing + len("</"+name+">")
+		}
+		out = append(out, packet[:m[0]]...)
+		packet = packet[end:]
+	}
+	out = append(out, packet...)
+
+	// Drop lines the removed elements leave blank
+	lines := strings.Split(string(out), "\n")
+	kept := lines[:0]
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "" || i == len(lines)-1 {
+			kept = append(kept, line)
+		}
+	}
+	out = []byte(strings.Join(kept, "\n"))
+	return append(append([]byte(nil), xmpHeader...), out...), location
+}
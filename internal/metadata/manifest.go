@@ -0,0 +1,84 @@
+package metadata
+
+import (
+	"cmp"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/zulfikawr/bitrim/internal/optimizer"
+	"github.com/zulfikawr/bitrim/internal/pipeline"
+)
+
+// Manifest maps each source image to the outputs written from it, so that
+// a frontend can build srcset attributes
+type Manifest struct {
+	Images map[string]ManifestImage `json:"images"`
+}
+
+// ManifestImage lists the outputs of one source image, keyed in Manifest by
+// its path relative to the input directory
+type ManifestImage struct {
+	Width    int               `json:"width"`
+	Height   int               `json:"height"`
+	Variants []ManifestVariant `json:"variants"`
+}
+
+// ManifestVariant describes one output, its path relative to the output
+// directory with forward slashes
+type ManifestVariant struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// CreateManifest builds the manifest of the images written successfully,
+// their outputs ordered by format and width
+func CreateManifest(outputDir string, stats pipeline.PipelineStats) Manifest {
+	images := make(map[string]ManifestImage)
+	for _, result := range stats.ProcessedFiles {
+		if !result.Success || result.OutputWidth == 0 {
+			continue
+		}
+		entry := ManifestImage{Width: result.SourceWidth, Height: result.SourceHeight}
+		for _, output := range append([]optimizer.Result{result}, result.Variants...) {
+			if !output.Success {
+				continue
+			}
+			path, err := filepath.Rel(outputDir, output.OutputPath)
+			if err != nil {
+				path = output.OutputPath
+			}
+			entry.Variants = append(entry.Variants, ManifestVariant{
+				Path:   filepath.ToSlash(path),
+				Format: output.FileType,
+				Width:  output.OutputWidth,
+				Height: output.OutputHeight,
+				Bytes:  output.ProcessedSize,
+			})
+		}
+		slices.SortFunc(entry.Variants, func(a, b ManifestVariant) int {
+			return cmp.Or(cmp.Compare(a.Format, b.Format), cmp.Compare(a.Width, b.Width))
+		})
+
+		source := result.RelativePath
+		if source == "" {
+			source = filepath.Base(result.FilePath)
+		}
+		images[filepath.ToSlash(source)] = entry
+	}
+	return Manifest{Images: images}
+}
+
+// WriteToFile saves the manifest to a JSON file
+func (m *Manifest) WriteToFile(filePath string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filePath, data, 0644)
+}
@@ -3,24 +3,49 @@ package metadata
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/zulfikawr/bitrim/internal/config"
+	"github.com/zulfikawr/bitrim/internal/optimizer"
 	"github.com/zulfikawr/bitrim/internal/pipeline"
 )
 
 // ProcessingRecord represents a single file's processing record
 type ProcessingRecord struct {
-	InputFile        string `json:"input_file"`
-	OutputFile       string `json:"output_file"`
-	FileType         string `json:"file_type"`
-	OriginalSize     int64  `json:"original_size_bytes"`
-	ProcessedSize    int64  `json:"processed_size_bytes"`
-	BytesSaved       int64  `json:"bytes_saved"`
-	CompressionRatio string `json:"compression_ratio"`
-	Success          bool   `json:"success"`
-	Error            string `json:"error,omitempty"`
+	InputFile        string        `json:"input_file"`
+	RelativePath     string        `json:"relative_path"`
+	OutputFile       string        `json:"output_file"`
+	FileType         string        `json:"file_type"`
+	SourceFormat     string        `json:"source_format,omitempty"`
+	SourceColor      string        `json:"source_color,omitempty"`
+	OriginalSize     int64         `json:"original_size_bytes"`
+	ProcessedSize    int64         `json:"processed_size_bytes"`
+	BytesSaved       int64         `json:"bytes_saved"`
+	CompressionRatio string        `json:"compression_ratio"`
+	VariantOf        string        `json:"variant_of,omitempty"`
+	Encoding         string        `json:"encoding,omitempty"`
+	Quality          int           `json:"quality,omitempty"`
+	FittedWidth      int           `json:"fitted_width,omitempty"`
+	SourceWidth      int           `json:"source_width,omitempty"`
+	SourceHeight     int           `json:"source_height,omitempty"`
+	OutputWidth      int           `json:"output_width,omitempty"`
+	OutputHeight     int           `json:"output_height,omitempty"`
+	PSNR             float64       `json:"psnr,omitempty"`
+	SSIM             float64       `json:"ssim,omitempty"`
+	Crop             *CropRect     `json:"crop,omitempty"`
+	Watermarked      bool          `json:"watermarked,omitempty"`
+	SkippedSteps     []string      `json:"skipped_steps,omitempty"`
+	FormatChoice     *FormatChoice `json:"format_choice,omitempty"`
+	ICCProfile       string        `json:"icc_profile,omitempty"`
+	ICCAction        string        `json:"icc_action,omitempty"`
+	Success          bool          `json:"success"`
+	Skipped          bool          `json:"skipped,omitempty"`
+	KeptOriginal     bool          `json:"kept_original,omitempty"`
+	HasLocation      bool          `json:"has_location,omitempty"`
+	Error            string        `json:"error,omitempty"`
 }
 
 // MetadataFile represents the complete metadata document
@@ -33,23 +58,149 @@ type MetadataFile struct {
 
 // ProcessingConfig stores the options used for processing
 type ProcessingConfig struct {
-	Quality     int    `json:"quality"`
-	Width       int    `json:"width"`
-	WebP        bool   `json:"webp"`
-	Concurrency int    `json:"concurrency"`
-	InputDir    string `json:"input_directory"`
-	OutputDir   string `json:"output_directory"`
+	Quality       int               `json:"quality"`
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	Scale         float64           `json:"scale_percent"`
+	MaxWidth      int               `json:"max_width"`
+	MaxHeight     int               `json:"max_height"`
+	MaxMegapixels float64           `json:"max_megapixels"`
+	NoUpscale     bool              `json:"no_upscale"`
+	Resample      string            `json:"resample"`
+	Sharpen       float64           `json:"sharpen"`
+	Sizes         []int             `json:"sizes"`
+	Crop          string            `json:"crop"`
+	FocalPoints   int               `json:"focal_points"`
+	Watermark     *Watermark        `json:"watermark,omitempty"`
+	TargetSSIM    float64           `json:"target_ssim"`
+	JPEGMode      string            `json:"jpeg_mode"`
+	JPEGHuffman   string            `json:"jpeg_huffman"`
+	Subsampling   string            `json:"subsampling"`
+	JPEGLossless  bool              `json:"jpeg_lossless"`
+	PNGMode       string            `json:"png_mode"`
+	Zopfli        bool              `json:"zopfli"`
+	Dither        string            `json:"dither"`
+	Metadata      []string          `json:"metadata"`
+	AutoOrient    bool              `json:"auto_orient"`
+	ICC           string            `json:"icc"`
+	MinSaving     MinSaving         `json:"min_saving"`
+	MaxBytes      MaxBytes          `json:"max_bytes"`
+	Conversions   map[string]string `json:"conversions"`
+	Format        string            `json:"format,omitempty"`
+	To            string            `json:"to,omitempty"`
+	Background    string            `json:"background"`
+	WebP          bool              `json:"webp"`
+	WebPMode      string            `json:"webp_mode,omitempty"`
+	WebPQuality   int               `json:"webp_quality,omitempty"`
+	Flatten       bool              `json:"flatten"`
+	OnCollision   string            `json:"on_collision"`
+	Concurrency   int               `json:"concurrency"`
+	InputDir      string            `json:"input_directory"`
+	OutputDir     string            `json:"output_directory"`
+}
+
+// Watermark stores the watermark settings
+type Watermark struct {
+	Path     string   `json:"path"`
+	Position string   `json:"position"`
+	Scale    float64  `json:"scale_percent"`
+	Margin   float64  `json:"margin_percent"`
+	Opacity  float64  `json:"opacity"`
+	Include  []string `json:"include,omitempty"`
+	Exclude  []string `json:"exclude,omitempty"`
+}
+
+// FormatChoice stores how --format auto picked an image's output format
+type FormatChoice struct {
+	Class      string            `json:"class"`
+	MinSSIM    float64           `json:"min_ssim"`
+	Candidates []FormatCandidate `json:"candidates"`
+}
+
+// FormatCandidate stores an encoding tried by --format auto and how it did
+type FormatCandidate struct {
+	Format  string  `json:"format"`
+	Mode    string  `json:"mode,omitempty"`
+	Bytes   int64   `json:"bytes,omitempty"`
+	SSIM    float64 `json:"ssim,omitempty"`
+	Outcome string  `json:"outcome"`
+}
+
+// CropRect stores the region of a source kept by cropping, in pixels
+type CropRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// MinSaving stores the saving a re-encoded file needed to be written
+type MinSaving struct {
+	Bytes   int64   `json:"bytes"`
+	Percent float64 `json:"percent"`
+}
+
+// MaxBytes stores the output size budgets, 0 meaning none
+type MaxBytes struct {
+	All    int64 `json:"all"`
+	JPEG   int64 `json:"jpeg"`
+	PNG    int64 `json:"png"`
+	WebP   int64 `json:"webp"`
+	Resize bool  `json:"resize"`
 }
 
 // SummaryStats stores aggregated statistics
 type SummaryStats struct {
-	TotalFiles       int     `json:"total_files"`
-	SuccessfulFiles  int     `json:"successful_files"`
-	FailedFiles      int     `json:"failed_files"`
-	TotalBytesSaved  int64   `json:"total_bytes_saved"`
-	TotalOriginalSize int64  `json:"total_original_size_bytes"`
-	TotalProcessedSize int64 `json:"total_processed_size_bytes"`
-	SuccessRate      float64 `json:"success_rate_percent"`
+	TotalFiles         int     `json:"total_files"`
+	SuccessfulFiles    int     `json:"successful_files"`
+	FailedFiles        int     `json:"failed_files"`
+	SkippedFiles       int     `json:"skipped_files"`
+	KeptOriginalFiles  int     `json:"kept_original_files"`
+	CMYKFiles          int     `json:"cmyk_files"`
+	LocationFiles      int     `json:"location_files"`
+	SkippedStepFiles   int     `json:"skipped_step_files"`
+	TotalBytesSaved    int64   `json:"total_bytes_saved"`
+	TotalOriginalSize  int64   `json:"total_original_size_bytes"`
+	TotalProcessedSize int64   `json:"total_processed_size_bytes"`
+	SuccessRate        float64 `json:"success_rate_percent"`
+
+	// Savings per output format, including derived copies such as WebP
+	Formats map[string]FormatSummary `json:"formats,omitempty"`
+
+	// Quality of the outputs whose PSNR and SSIM were measured
+	Fidelity *FidelitySummary `json:"fidelity,omitempty"`
+}
+
+// worstFiles is how many of the least faithful outputs the summary lists
+const worstFiles = 10
+
+// FidelitySummary aggregates how faithfully the outputs reproduce their
+// sources
+type FidelitySummary struct {
+	Files    int     `json:"files"`
+	MeanPSNR float64 `json:"mean_psnr"`
+	MinPSNR  float64 `json:"min_psnr"`
+	MeanSSIM float64 `json:"mean_ssim"`
+	MinSSIM  float64 `json:"min_ssim"`
+
+	// Outputs with the lowest SSIM, worst first
+	Worst []FidelityRecord `json:"worst_files"`
+}
+
+// FidelityRecord stores the metrics of one output
+type FidelityRecord struct {
+	OutputFile string  `json:"output_file"`
+	PSNR       float64 `json:"psnr"`
+	SSIM       float64 `json:"ssim"`
+}
+
+// FormatSummary stores aggregated statistics for one output format
+type FormatSummary struct {
+	Files            int    `json:"files"`
+	OriginalSize     int64  `json:"original_size_bytes"`
+	ProcessedSize    int64  `json:"processed_size_bytes"`
+	BytesSaved       int64  `json:"bytes_saved"`
+	CompressionRatio string `json:"compression_ratio"`
 }
 
 // Create generates a metadata file from processing results
@@ -60,50 +211,216 @@ func Create(inputDir string, outputDir string, opts config.Options, stats pipeli
 	totalProcessed := int64(0)
 
 	for _, result := range stats.ProcessedFiles {
-		ratio := "N/A"
-		if result.OriginalSize > 0 {
-			ratio = formatPercentage(float64(result.BytesSaved) / float64(result.OriginalSize) * 100)
+		records = append(records, newRecord(result, ""))
+		for _, variant := range result.Variants {
+			records = append(records, newRecord(variant, result.FilePath))
 		}
 
-		records = append(records, ProcessingRecord{
-			InputFile:        result.FilePath,
-			OutputFile:       result.OutputPath,
-			FileType:         result.FileType,
-			OriginalSize:     result.OriginalSize,
-			ProcessedSize:    result.ProcessedSize,
-			BytesSaved:       result.BytesSaved,
-			CompressionRatio: ratio,
-			Success:          result.Success,
-			Error:            result.Error,
-		})
-
 		totalOriginal += result.OriginalSize
 		totalProcessed += result.ProcessedSize
 	}
 
+	formats := make(map[string]FormatSummary, len(stats.Formats))
+	for format, fs := range stats.Formats {
+		formats[format] = FormatSummary{
+			Files:            fs.Files,
+			OriginalSize:     fs.OriginalSize,
+			ProcessedSize:    fs.ProcessedSize,
+			BytesSaved:       fs.BytesSaved,
+			CompressionRatio: compressionRatio(fs.BytesSaved, fs.OriginalSize),
+		}
+	}
+
+	var watermark *Watermark
+	if wm := opts.Watermark; wm.Image != nil {
+		watermark = &Watermark{
+			Path:     wm.Path,
+			Position: wm.Position,
+			Scale:    wm.Scale,
+			Margin:   wm.Margin,
+			Opacity:  wm.Opacity,
+			Include:  wm.Include,
+			Exclude:  wm.Exclude,
+		}
+	}
+
+	// WebP settings only matter when copies were written
+	webPMode, webPQuality := "", 0
+	if opts.WebP {
+		webPMode, webPQuality = opts.WebPMode, opts.WebPQuality
+	}
+
 	return MetadataFile{
 		CreatedAt: time.Now(),
 		ProcessingConfig: ProcessingConfig{
-			Quality:     opts.Quality,
-			Width:       opts.Width,
+			Quality:       opts.Quality,
+			Width:         opts.Width,
+			Height:        opts.Height,
+			Scale:         opts.Scale,
+			MaxWidth:      opts.MaxWidth,
+			MaxHeight:     opts.MaxHeight,
+			MaxMegapixels: opts.MaxMegapixels,
+			NoUpscale:     opts.NoUpscale,
+			Resample:      opts.Resample,
+			Sharpen:       opts.Sharpen,
+			Sizes:         opts.Sizes,
+			Crop:          opts.Crop,
+			FocalPoints:   len(opts.FocalPoints),
+			Watermark:     watermark,
+			TargetSSIM:    opts.TargetSSIM,
+			JPEGMode:      opts.JPEGMode,
+			JPEGHuffman:   opts.JPEGHuffman,
+			Subsampling:   opts.Subsampling,
+			JPEGLossless:  opts.JPEGLossless,
+			PNGMode:       opts.PNGMode,
+			Zopfli:        opts.Zopfli,
+			Dither:        opts.Dither,
+			Metadata:      optimizer.EffectiveMetadata(opts.Metadata),
+			AutoOrient:    opts.AutoOrient,
+			ICC:           opts.ICC,
+			MinSaving:     MinSaving{Bytes: opts.MinSavingBytes, Percent: opts.MinSavingPercent},
+			MaxBytes: MaxBytes{
+				All:    opts.MaxBytes,
+				JPEG:   opts.JPEGMaxBytes,
+				PNG:    opts.PNGMaxBytes,
+				WebP:   opts.WebPMaxBytes,
+				Resize: opts.MaxBytesResize,
+			},
+			Conversions: optimizer.EffectiveConversions(opts.Conversions),
+			To:          opts.To,
+			Format:      opts.Format,
+			Background:  optimizer.FormatColor(optimizer.Background(opts)),
 			WebP:        opts.WebP,
+			WebPMode:    webPMode,
+			WebPQuality: webPQuality,
+			Flatten:     opts.Flatten,
+			OnCollision: opts.OnCollision,
 			Concurrency: opts.Concurrency,
 			InputDir:    inputDir,
 			OutputDir:   outputDir,
 		},
 		Summary: SummaryStats{
-			TotalFiles:        stats.TotalFiles(),
-			SuccessfulFiles:   stats.SuccessfulFiles,
-			FailedFiles:       stats.FailedFiles,
-			TotalBytesSaved:   stats.TotalBytesSaved,
-			TotalOriginalSize: totalOriginal,
+			TotalFiles:         stats.TotalFiles(),
+			SuccessfulFiles:    stats.SuccessfulFiles,
+			FailedFiles:        stats.FailedFiles,
+			SkippedFiles:       stats.SkippedFiles,
+			KeptOriginalFiles:  stats.KeptOriginalFiles,
+			CMYKFiles:          stats.CMYKFiles,
+			LocationFiles:      len(stats.LocationFiles),
+			SkippedStepFiles:   len(stats.SkippedStepFiles),
+			TotalBytesSaved:    stats.TotalBytesSaved,
+			TotalOriginalSize:  totalOriginal,
 			TotalProcessedSize: totalProcessed,
-			SuccessRate:       stats.SuccessRate(),
+			SuccessRate:        stats.SuccessRate(),
+			Formats:            formats,
+			Fidelity:           summarizeFidelity(records),
 		},
 		ProcessedFiles: records,
 	}
 }
 
+// newRecord converts a single optimizer result into a metadata record.
+// variantOf is the source file for derived outputs, empty otherwise.
+func newRecord(result optimizer.Result, variantOf string) ProcessingRecord {
+	// Only record the source format when the image was converted
+	sourceFormat := result.SourceFormat
+	if sourceFormat == result.FileType {
+		sourceFormat = ""
+	}
+
+	var crop *CropRect
+	if !result.Crop.Empty() {
+		crop = &CropRect{X: result.Crop.Min.X, Y: result.Crop.Min.Y, Width: result.Crop.Dx(), Height: result.Crop.Dy()}
+	}
+
+	return ProcessingRecord{
+		InputFile:        result.FilePath,
+		RelativePath:     result.RelativePath,
+		OutputFile:       result.OutputPath,
+		FileType:         result.FileType,
+		SourceFormat:     sourceFormat,
+		SourceColor:      result.SourceColor,
+		OriginalSize:     result.OriginalSize,
+		ProcessedSize:    result.ProcessedSize,
+		BytesSaved:       result.BytesSaved,
+		CompressionRatio: compressionRatio(result.BytesSaved, result.OriginalSize),
+		VariantOf:        variantOf,
+		Encoding:         result.Encoding,
+		Quality:          result.Quality,
+		FittedWidth:      result.FittedWidth,
+		SourceWidth:      result.SourceWidth,
+		SourceHeight:     result.SourceHeight,
+		OutputWidth:      result.OutputWidth,
+		OutputHeight:     result.OutputHeight,
+		PSNR:             round(result.PSNR, 2),
+		SSIM:             round(result.SSIM, 4),
+		Crop:             crop,
+		Watermarked:      result.Watermarked,
+		SkippedSteps:     result.SkippedSteps,
+		FormatChoice:     newFormatChoice(result.FormatChoice),
+		ICCProfile:       result.ICCProfile,
+		ICCAction:        result.ICCAction,
+		Success:          result.Success,
+		Skipped:          result.Skipped,
+		KeptOriginal:     result.KeptOriginal,
+		HasLocation:      result.HasLocation,
+		Error:            result.Error,
+	}
+}
+
+// summarizeFidelity aggregates the metrics of the successful records that
+// have them; nil when none do
+func summarizeFidelity(records []ProcessingRecord) *FidelitySummary {
+	var measured []FidelityRecord
+	var sumPSNR, sumSSIM float64
+	for _, record := range records {
+		if !record.Success || record.SSIM == 0 {
+			continue
+		}
+		measured = append(measured, FidelityRecord{OutputFile: record.OutputFile, PSNR: record.PSNR, SSIM: record.SSIM})
+		sumPSNR += record.PSNR
+		sumSSIM += record.SSIM
+	}
+	if len(measured) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(measured, func(i, j int) bool {
+		if measured[i].SSIM != measured[j].SSIM {
+			return measured[i].SSIM < measured[j].SSIM
+		}
+		return measured[i].PSNR < measured[j].PSNR
+	})
+	minPSNR := measured[0].PSNR
+	for _, m := range measured {
+		minPSNR = min(minPSNR, m.PSNR)
+	}
+
+	n := float64(len(measured))
+	return &FidelitySummary{
+		Files:    len(measured),
+		MeanPSNR: round(sumPSNR/n, 2),
+		MinPSNR:  minPSNR,
+		MeanSSIM: round(sumSSIM/n, 4),
+		MinSSIM:  measured[0].SSIM,
+		Worst:    measured[:min(len(measured), worstFiles)],
+	}
+}
+
+// round rounds v to the given number of decimal places
+func round(v float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(v*scale) / scale
+}
+
+// compressionRatio formats saved bytes as a percentage of the original size
+func compressionRatio(saved int64, original int64) string {
+	if original <= 0 {
+		return "N/A"
+	}
+	return formatPercentage(float64(saved) / float64(original) * 100)
+}
+
 // WriteToFile saves the metadata to a JSON file
 func (m *MetadataFile) WriteToFile(filePath string) error {
 	data, err := json.MarshalIndent(m, "", "  ")
@@ -118,3 +435,21 @@ func (m *MetadataFile) WriteToFile(filePath string) error {
 func formatPercentage(val float64) string {
 	return fmt.Sprintf("%.1f%%", val)
 }
+
+// newFormatChoice converts the --format auto decision of a result, if any
+func newFormatChoice(choice *optimizer.FormatChoice) *FormatChoice {
+	if choice == nil {
+		return nil
+	}
+	out := &FormatChoice{Class: choice.Class, MinSSIM: choice.Floor}
+	for _, c := range choice.Candidates {
+		out.Candidates = append(out.Candidates, FormatCandidate{
+			Format:  string(c.Format),
+			Mode:    c.Mode,
+			Bytes:   c.Size,
+			SSIM:    round(c.SSIM, 4),
+			Outcome: c.Outcome,
+		})
+	}
+	return out
+}
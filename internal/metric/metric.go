@@ -0,0 +1,180 @@
+// Package metric measures how faithfully an image reproduces another, such
+// as a re-encoded image its source.
+package metric
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+)
+
+var errSizeMismatch = errors.New("metric: images differ in size")
+
+// window is the side of the square SSIM windows, which overlap by half
+const window = 8
+
+// Stabilizing constants of SSIM for 8-bit samples
+const (
+	c1 = (0.01 * 255) * (0.01 * 255)
+	c2 = (0.03 * 255) * (0.03 * 255)
+)
+
+// SSIM returns the mean structural similarity of the luma of two images of
+// the same size: 1 when they are identical, lower the more their structure
+// differs. Transparent pixels are composited onto white first. Windows are
+// 8x8 squares overlapping by half rather than the Gaussian windows of the
+// original paper, which is much faster and ranks encodings alike.
+func SSIM(a, b image.Image) (float64, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return 0, errSizeMismatch
+	}
+	w, h := a.Bounds().Dx(), a.Bounds().Dy()
+	if w == 0 || h == 0 {
+		return 1, nil
+	}
+	ya, yb := luma(a), luma(b)
+
+	ww, wh := min(window, w), min(window, h)
+	n := float64(ww * wh)
+	var total float64
+	var count int
+	for _, y0 := range starts(h, wh) {
+		for _, x0 := range starts(w, ww) {
+			var sa, sb, saa, sbb, sab float64
+			for y := y0; y < y0+wh; y++ {
+				for x := x0; x < x0+ww; x++ {
+					pa, pb := float64(ya[y*w+x]), float64(yb[y*w+x])
+					sa += pa
+					sb += pb
+					saa += pa * pa
+					sbb += pb * pb
+					sab += pa * pb
+				}
+			}
+			ma, mb := sa/n, sb/n
+			va, vb := saa/n-ma*ma, sbb/n-mb*mb
+			cov := sab/n - ma*mb
+			total += (2*ma*mb + c1) * (2*cov + c2) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			count++
+		}
+	}
+	return total / float64(count), nil
+}
+
+// MaxPSNR is the PSNR reported for identical images, whose true PSNR is
+// infinite
+const MaxPSNR = 100
+
+// PSNR returns the peak signal-to-noise ratio in decibels between the RGB
+// samples of two images of the same size, higher the closer they are and
+// at most MaxPSNR. Transparent pixels are composited onto white first.
+func PSNR(a, b image.Image) (float64, error) {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return 0, errSizeMismatch
+	}
+	ra, rb := rgb(a), rgb(b)
+	if len(ra) == 0 {
+		return MaxPSNR, nil
+	}
+	var sum float64
+	for i := range ra {
+		d := float64(ra[i]) - float64(rb[i])
+		sum += d * d
+	}
+	if sum == 0 {
+		return MaxPSNR, nil
+	}
+	mse := sum / float64(len(ra))
+	return min(10*math.Log10(255*255/mse), MaxPSNR), nil
+}
+
+// starts returns the offsets of windows of size n over length, stepping by
+// half a window, the last one flush with the end
+func starts(length, n int) []int {
+	var offsets []int
+	step := max(n/2, 1)
+	for o := 0; o+n < length; o += step {
+		offsets = append(offsets, o)
+	}
+	return append(offsets, length-n)
+}
+
+// luma returns the BT.601 luma of img row by row, as image/jpeg stores it,
+// with transparent pixels composited onto white
+func luma(img image.Image) []uint8 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := make([]uint8, w*h)
+	switch src := img.(type) {
+	case *image.YCbCr:
+		for y := 0; y < h; y++ {
+			copy(out[y*w:], src.Y[src.YOffset(b.Min.X, b.Min.Y+y):][:w])
+		}
+		return out
+	case *image.Gray:
+		for y := 0; y < h; y++ {
+			copy(out[y*w:], src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):][:w])
+		}
+		return out
+	case *image.RGBA:
+		for y := 0; y < h; y++ {
+			pix := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < w; x++ {
+				p := pix[4*x:]
+				white := 0xff - uint32(p[3])
+				out[y*w+x] = lumaOf((uint32(p[0])+white)*0x101, (uint32(p[1])+white)*0x101, (uint32(p[2])+white)*0x101)
+			}
+		}
+		return out
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, a := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			white := 0xffff - a
+			out[y*w+x] = lumaOf(r+white, g+white, bl+white)
+		}
+	}
+	return out
+}
+
+// lumaOf returns the 8-bit luma of 16-bit RGB values
+func lumaOf(r, g, b uint32) uint8 {
+	return uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 24)
+}
+
+// rgb returns the 8-bit RGB samples of img row by row, with transparent
+// pixels composited onto white
+func rgb(img image.Image) []uint8 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := make([]uint8, 0, 3*w*h)
+	switch src := img.(type) {
+	case *image.YCbCr:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				yi, ci := src.YOffset(x, y), src.COffset(x, y)
+				r, g, bl := color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+				out = append(out, r, g, bl)
+			}
+		}
+		return out
+	case *image.RGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			pix := src.Pix[src.PixOffset(b.Min.X, y):][:4*w]
+			for x := 0; x < len(pix); x += 4 {
+				white := 0xff - pix[x+3]
+				out = append(out, pix[x]+white, pix[x+1]+white, pix[x+2]+white)
+			}
+		}
+		return out
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			white := 0xffff - a
+			out = append(out, uint8((r+white)>>8), uint8((g+white)>>8), uint8((bl+white)>>8))
+		}
+	}
+	return out
+}
@@ -0,0 +1,96 @@
+package metric
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// gradient returns an opaque image with noise of the given amplitude
+func gradient(w, h, noise int) *image.RGBA {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(min(x*255/w+rng.Intn(noise+1), 255))
+			img.SetRGBA(x, y, color.RGBA{v, uint8(y * 255 / h), v, 255})
+		}
+	}
+	return img
+}
+
+func TestSSIM(t *testing.T) {
+	ref := gradient(64, 40, 0)
+	if s, err := SSIM(ref, ref); err != nil || s != 1 {
+		t.Errorf("identical images: got %v, %v", s, err)
+	}
+
+	// More noise, less similarity
+	previous := 1.0
+	for _, noise := range []int{4, 16, 64} {
+		s, err := SSIM(ref, gradient(64, 40, noise))
+		if err != nil {
+			t.Fatalf("SSIM failed: %v", err)
+		}
+		if s >= previous || s <= 0 {
+			t.Errorf("noise %d: SSIM %v, previous %v", noise, s, previous)
+		}
+		previous = s
+	}
+
+	// Windows shrink to fit tiny images
+	if s, err := SSIM(gradient(3, 1, 0), gradient(3, 1, 0)); err != nil || s != 1 {
+		t.Errorf("tiny images: got %v, %v", s, err)
+	}
+
+	if _, err := SSIM(ref, gradient(64, 41, 0)); err == nil {
+		t.Error("expected an error for images of different sizes")
+	}
+}
+
+func TestSSIMCompositesOntoWhite(t *testing.T) {
+	transparent := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	white := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range white.Pix {
+		white.Pix[i] = 0xff
+	}
+	if s, err := SSIM(transparent, white); err != nil || s != 1 {
+		t.Errorf("transparent against white: got %v, %v", s, err)
+	}
+	if s, err := SSIM(image.NewRGBA(transparent.Rect), white); err != nil || s != 1 {
+		t.Errorf("transparent RGBA against white: got %v, %v", s, err)
+	}
+}
+
+func TestPSNR(t *testing.T) {
+	ref := gradient(64, 40, 0)
+	if p, err := PSNR(ref, ref); err != nil || p != MaxPSNR {
+		t.Errorf("identical images: got %v, %v", p, err)
+	}
+
+	// More noise, lower PSNR
+	previous := MaxPSNR + 1.0
+	for _, noise := range []int{4, 16, 64} {
+		p, err := PSNR(ref, gradient(64, 40, noise))
+		if err != nil {
+			t.Fatalf("PSNR failed: %v", err)
+		}
+		if p >= previous || p <= 0 {
+			t.Errorf("noise %d: PSNR %v, previous %v", noise, p, previous)
+		}
+		previous = p
+	}
+
+	// A single sample off by 255 in a 1x1 image is the worst case
+	black := image.NewGray(image.Rect(0, 0, 1, 1))
+	white := image.NewGray(black.Rect)
+	white.Pix[0] = 0xff
+	if p, err := PSNR(black, white); err != nil || p != 0 {
+		t.Errorf("black against white: got %v, %v", p, err)
+	}
+
+	if _, err := PSNR(ref, gradient(64, 41, 0)); err == nil {
+		t.Error("expected an error for images of different sizes")
+	}
+}
@@ -0,0 +1,259 @@
+package optimizer
+
+import (
+	"cmp"
+	"fmt"
+	"image"
+
+	"github.com/disintegration/imaging"
+	"github.com/zulfikawr/bitrim/internal/config"
+	"github.com/zulfikawr/bitrim/internal/metric"
+)
+
+// AutoFormat is the --format value that picks each image's output format
+const AutoFormat = "auto"
+
+// Image classes told apart by classify
+const (
+	ClassPhoto   = "photo"   // many colors, few hard edges: PNG is pruned
+	ClassGraphic = "graphic" // few colors: JPEG is pruned
+	ClassMixed   = "mixed"   // neither: every candidate is tried
+)
+
+// Outcomes of a --format auto candidate
+const (
+	CandidateChosen     = "chosen"
+	CandidateLarger     = "larger"      // met the floor, but a smaller one did too
+	CandidateBelowFloor = "below_floor" // missed the quality floor
+	CandidatePruned     = "pruned"      // skipped for the image's class or transparency
+)
+
+// Images with at most graphicMaxColors distinct colors are graphics; those
+// with at least photoMinColors and fewer than photoMaxEdges of their pixels
+// on a hard edge, a luma step above hardEdgeStep to a neighbor, are photos
+const (
+	graphicMaxColors = 256
+	photoMinColors   = 4096
+	photoMaxEdges    = 0.05
+	hardEdgeStep     = 64
+)
+
+// autoMinSSIM is the quality floor of --format auto without --target-ssim
+const autoMinSSIM = 0.95
+
+// FormatChoice records how --format auto picked an image's output format
+type FormatChoice struct {
+	// ClassPhoto, ClassGraphic or ClassMixed
+	Class string
+
+	// SSIM every candidate had to reach
+	Floor float64
+
+	// Every candidate, in the order tried
+	Candidates []Candidate
+}
+
+// Candidate is an encoding tried by --format auto
+type Candidate struct {
+	Format ImageFormat
+
+	// PNG or WebP mode the candidate was encoded with; empty for JPEG
+	Mode string
+
+	// Size of the encoding, its SSIM against the image and the quality it
+	// was encoded at; 0 when pruned
+	Size    int64
+	SSIM    float64
+	Quality int
+
+	// CandidateChosen, CandidateLarger, CandidateBelowFloor or
+	// CandidatePruned
+	Outcome string
+}
+
+// Chosen returns the candidate written
+func (c *FormatChoice) Chosen() Candidate {
+	for _, candidate := range c.Candidates {
+		if candidate.Outcome == CandidateChosen {
+			return candidate
+		}
+	}
+	return Candidate{}
+}
+
+// ValidFormat reports whether format is a known --format value
+func ValidFormat(format string) bool {
+	return format == "" || format == AutoFormat
+}
+
+// autoFormat reports whether --format auto can pick format
+func autoFormat(format ImageFormat) bool {
+	return format == FormatJPEG || format == FormatPNG || format == FormatWebP
+}
+
+// autoCandidates returns the encodings --format auto tries: JPEG, quantized
+// and lossless PNG, and WebP in the configured mode
+func autoCandidates(opts config.Options) []Candidate {
+	webPMode := opts.WebPMode
+	if webPMode == "" {
+		webPMode = WebPLossy
+	}
+	return []Candidate{
+		{Format: FormatJPEG},
+		{Format: FormatPNG, Mode: PNGQuantized},
+		{Format: FormatPNG, Mode: PNGLossless},
+		{Format: FormatWebP, Mode: webPMode},
+	}
+}
+
+// candidateOptions returns opts set up to encode as the candidate does, at
+// its quality once it has been encoded
+func candidateOptions(c Candidate, opts config.Options) config.Options {
+	switch c.Format {
+	case FormatJPEG:
+		opts.JPEGQuality = cmp.Or(c.Quality, opts.JPEGQuality)
+	case FormatPNG:
+		opts.PNGMode, opts.PNGQuality = c.Mode, cmp.Or(c.Quality, opts.PNGQuality)
+	case FormatWebP:
+		opts.WebPMode, opts.WebPQuality = c.Mode, cmp.Or(c.Quality, opts.WebPQuality)
+	}
+	return opts
+}
+
+// chooseFormat encodes img as every candidate its class does not prune and
+// picks the smallest output whose SSIM reaches the floor: --target-ssim, or
+// autoMinSSIM. Lossy candidates use their format's quality, or with
+// --target-ssim the lowest one that reaches it. When no candidate reaches the
+// floor, the most faithful one wins.
+func chooseFormat(img image.Image, resized bool, opts config.Options) (*FormatChoice, error) {
+	choice := &FormatChoice{Class: classify(img), Floor: opts.TargetSSIM}
+	if choice.Floor == 0 {
+		choice.Floor = autoMinSSIM
+	}
+	o, ok := img.(interface{ Opaque() bool })
+	opaque := !ok || o.Opaque()
+
+	best, fallback := -1, -1
+	for _, c := range autoCandidates(opts) {
+		if pruned(c, choice.Class, opaque) {
+			c.Outcome = CandidatePruned
+			choice.Candidates = append(choice.Candidates, c)
+			continue
+		}
+
+		copts := candidateOptions(c, opts)
+		encode := func(img image.Image, quality int, resized bool) ([]byte, string, error) {
+			return encodeAs(img, c.Format, quality, copts)
+		}
+		stored := storedPixels(img, c.Format, copts)
+		quality := formatQuality(c.Format, copts)
+		if opts.TargetSSIM > 0 && usesQuality(c.Format, copts) {
+			var err error
+			if quality, err = qualityForSSIM(stored, c.Format, opts.TargetSSIM, resized, encode); err != nil {
+				return nil, fmt.Errorf("%s: %w", c.Format, err)
+			}
+		}
+		data, _, err := encode(stored, quality, resized)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Format, err)
+		}
+		decoded, err := decodeData(data, c.Format)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Format, err)
+		}
+		if c.SSIM, err = metric.SSIM(stored, decoded); err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Format, err)
+		}
+		c.Size, c.Quality = int64(len(data)), quality
+
+		i := len(choice.Candidates)
+		c.Outcome = CandidateBelowFloor
+		if c.SSIM >= choice.Floor {
+			c.Outcome = CandidateLarger
+			if best < 0 || c.Size < choice.Candidates[best].Size {
+				best = i
+			}
+		}
+		if fallback < 0 || c.SSIM > choice.Candidates[fallback].SSIM {
+			fallback = i
+		}
+		choice.Candidates = append(choice.Candidates, c)
+	}
+
+	if best < 0 {
+		best = fallback
+	}
+	choice.Candidates[best].Outcome = CandidateChosen
+	return choice, nil
+}
+
+// pruned reports whether a candidate is ruled out: JPEG for images with
+// transparency, which it would lose, and by the classifier PNG for photos and
+// JPEG for graphics. WebP is always tried.
+func pruned(c Candidate, class string, opaque bool) bool {
+	if !opaque && c.Format == FormatJPEG {
+		return true
+	}
+	switch class {
+	case ClassPhoto:
+		return c.Format == FormatPNG
+	case ClassGraphic:
+		return c.Format == FormatJPEG
+	default:
+		return false
+	}
+}
+
+// encodeAs encodes img in format without carrying any metadata over
+func encodeAs(img image.Image, format ImageFormat, quality int, opts config.Options) ([]byte, string, error) {
+	switch format {
+	case FormatWebP:
+		return encodeWebP(img, opts.WebPMode, quality)
+	case FormatPNG:
+		return encodePNG(img, quality, nil, opts)
+	default:
+		return encodeJPEG(storedPixels(img, FormatJPEG, opts), quality, opts)
+	}
+}
+
+// classify tells photos from graphics by their number of distinct colors
+// and the share of their pixels on a hard edge
+func classify(img image.Image) string {
+	px := imaging.Clone(img)
+	w, h := px.Bounds().Dx(), px.Bounds().Dy()
+	if w == 0 || h == 0 {
+		return ClassMixed
+	}
+
+	colors := make(map[uint32]struct{})
+	hard := 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*px.Stride + 4*x
+			p := px.Pix[i : i+4]
+			if len(colors) < photoMinColors {
+				colors[uint32(p[0])<<24|uint32(p[1])<<16|uint32(p[2])<<8|uint32(p[3])] = struct{}{}
+			}
+			if x+1 < w && lumaStep(p, px.Pix[i+4:]) > hardEdgeStep ||
+				y+1 < h && lumaStep(p, px.Pix[i+px.Stride:]) > hardEdgeStep {
+				hard++
+			}
+		}
+	}
+
+	switch edges := float64(hard) / float64(w*h); {
+	case len(colors) <= graphicMaxColors:
+		return ClassGraphic
+	case len(colors) >= photoMinColors && edges < photoMaxEdges:
+		return ClassPhoto
+	default:
+		return ClassMixed
+	}
+}
+
+// lumaStep returns the luma difference of two RGBA pixels, from 0 to 255
+func lumaStep(a, b []uint8) int {
+	la := 299*int(a[0]) + 587*int(a[1]) + 114*int(a[2])
+	lb := 299*int(b[0]) + 587*int(b[1]) + 114*int(b[2])
+	return max(la-lb, lb-la) / 1000
+}
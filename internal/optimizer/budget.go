@@ -0,0 +1,163 @@
+package optimizer
+
+import (
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/disintegration/imaging"
+	"github.com/zulfikawr/bitrim/internal/config"
+)
+
+// shrinkQuality is the lowest quality a size budget goes down to before it
+// shrinks an image, when --max-bytes-resize allows that
+const shrinkQuality = 50
+
+// encodeFunc encodes an image at a quality. resized reports whether img was
+// scaled from the source, which JPEG metadata has to reflect.
+type encodeFunc func(img image.Image, quality int, resized bool) ([]byte, string, error)
+
+// fit is an encoding that fits a size budget
+type fit struct {
+	data     []byte
+	encoding string
+	quality  int
+
+	// The image encoded, and its width when it was shrunk to fit (0
+	// otherwise)
+	img   image.Image
+	width int
+}
+
+// maxBytes returns the size budget of an output format: its own, or the
+// general one; 0 means none
+func maxBytes(format ImageFormat, opts config.Options) int64 {
+	budget := int64(0)
+	switch format {
+	case FormatJPEG:
+		budget = opts.JPEGMaxBytes
+	case FormatPNG:
+		budget = opts.PNGMaxBytes
+	case FormatWebP:
+		budget = opts.WebPMaxBytes
+	}
+	if budget == 0 {
+		budget = opts.MaxBytes
+	}
+	return budget
+}
+
+// usesQuality reports whether the encoder of a format, in its configured
+// mode, trades quality for size
+func usesQuality(format ImageFormat, opts config.Options) bool {
+	switch format {
+	case FormatJPEG:
+		return true
+	case FormatPNG:
+		return opts.PNGMode != PNGLossless
+	case FormatWebP:
+		return opts.WebPMode != WebPLossless
+	default:
+		return false
+	}
+}
+
+// applyBudget makes an output fit the size budget of its format, unless it
+// already does, by lowering the quality and with --max-bytes-resize the
+// width. It records the quality settled on and any width in result, and
+// returns the data and image to write.
+func applyBudget(result *Result, format ImageFormat, data []byte, img image.Image, quality int, resized bool, opts config.Options, encode encodeFunc) ([]byte, image.Image, error) {
+	budget := maxBytes(format, opts)
+	if budget == 0 {
+		return data, img, nil
+	}
+	if int64(len(data)) <= budget {
+		return data, img, nil
+	}
+
+	f, err := fitBudget(img, quality, resized, budget, usesQuality(format, opts), opts.MaxBytesResize, encode)
+	if err != nil {
+		return nil, nil, err
+	}
+	result.Encoding, result.FittedWidth = f.encoding, f.width
+	result.Quality = effectiveQuality(f.encoding, f.quality)
+	return f.data, f.img, nil
+}
+
+// effectiveQuality returns the quality an output of the given encoding was
+// made with: quality itself, or 0 for lossless encodings, which ignore it
+func effectiveQuality(encoding string, quality int) int {
+	if encoding == JPEGLossless || encoding == PNGLossless || encoding == WebPLossless {
+		return 0
+	}
+	return quality
+}
+
+// fitBudget finds the largest encoding of img no bigger than budget bytes.
+// With searchQuality it binary-searches the highest quality up to quality,
+// sizes being assumed to grow with it. Should even the lowest quality be
+// too large, shrink binary-searches the largest width instead, at
+// shrinkQuality, which is then also the lowest quality searched. The error
+// tells the smallest size reached when nothing fits.
+func fitBudget(img image.Image, quality int, resized bool, budget int64, searchQuality bool, shrink bool, encode encodeFunc) (*fit, error) {
+	floor := 1
+	if shrink {
+		floor = min(shrinkQuality, quality)
+	}
+	smallest := -1
+	try := func(img image.Image, quality int, resized bool) (*fit, error) {
+		data, encoding, err := encode(img, quality, resized)
+		if err != nil {
+			return nil, err
+		}
+		if smallest < 0 || len(data) < smallest {
+			smallest = len(data)
+		}
+		if int64(len(data)) > budget {
+			return nil, nil
+		}
+		return &fit{data: data, encoding: encoding, quality: quality, img: img}, nil
+	}
+
+	var best *fit
+	if searchQuality {
+		for lo, hi := floor, quality; lo <= hi; {
+			q := (lo + hi) / 2
+			f, err := try(img, q, resized)
+			if err != nil {
+				return nil, err
+			}
+			if f != nil {
+				best, lo = f, q+1
+			} else {
+				hi = q - 1
+			}
+		}
+		quality = floor
+	}
+
+	if best == nil && shrink {
+		for lo, hi := 1, img.Bounds().Dx()-1; lo <= hi; {
+			width := (lo + hi) / 2
+			f, err := try(imaging.Resize(img, width, 0, imaging.Lanczos), quality, true)
+			if err != nil {
+				return nil, err
+			}
+			if f != nil {
+				f.width = width
+				best, lo = f, width+1
+			} else {
+				hi = width - 1
+			}
+		}
+	}
+
+	switch {
+	case best != nil:
+		return best, nil
+	case smallest < 0:
+		return nil, errors.New("lossless output cannot get smaller without shrinking")
+	default:
+		return nil, fmt.Errorf("the smallest output is %d bytes", smallest)
+	}
+}
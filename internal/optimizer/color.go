@@ -0,0 +1,115 @@
+package optimizer
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/zulfikawr/bitrim/internal/icc"
+	"github.com/zulfikawr/bitrim/internal/jpegmeta"
+	bitpng "github.com/zulfikawr/bitrim/internal/png"
+)
+
+// Handling of embedded ICC profiles selectable with --icc
+const (
+	ICCKeep = "keep" // embed the source profile in the output
+	ICCSRGB = "srgb" // convert the pixels to sRGB and drop the profile
+)
+
+// What happened to a file's ICC profile, recorded in Result.ICCAction
+const (
+	ICCKept      = "kept"
+	ICCConverted = "converted"
+	ICCDropped   = "dropped"
+)
+
+// ValidICCMode reports whether mode is a known ICC profile handling mode
+func ValidICCMode(mode string) bool {
+	switch mode {
+	case ICCKeep, ICCSRGB:
+		return true
+	default:
+		return false
+	}
+}
+
+// embeddedProfile returns the ICC profile of a JPEG or PNG file, or nil
+func embeddedProfile(data []byte, format ImageFormat) []byte {
+	switch format {
+	case FormatJPEG:
+		segments, err := jpegmeta.Read(data)
+		if err != nil {
+			return nil
+		}
+		return jpegmeta.ICCProfile(segments)
+	case FormatPNG:
+		profile, _ := bitpng.ICCProfile(data)
+		return profile
+	}
+	return nil
+}
+
+// manageColor applies the --icc mode to an image with an embedded profile.
+// It returns the image to encode and the profile to embed in the output, nil
+// to drop it, and records the outcome in result. Profiles are kept whenever
+// dropping them would shift colors: in keep mode when the output format can
+// embed them, and in srgb mode when they cannot be converted. An empty mode
+// means keep.
+func manageColor(img image.Image, profile []byte, target ImageFormat, mode string, result *Result) (image.Image, []byte) {
+	p, err := icc.Parse(profile)
+	if err == nil {
+		result.ICCProfile = p.Description
+	}
+
+	embeddable := target == FormatJPEG || target == FormatPNG
+	if mode == ICCSRGB || !embeddable {
+		switch {
+		case err == nil && p.IsSRGB():
+			result.ICCAction = ICCDropped
+			return img, nil
+		case err == nil && p.CanConvert():
+			result.ICCAction = ICCConverted
+			return p.ToSRGB(img), nil
+		case !embeddable:
+			result.ICCAction = ICCDropped
+			return img, nil
+		}
+	}
+	result.ICCAction = ICCKept
+	return img, profile
+}
+
+// cmykToSRGB converts a decoded CMYK image to sRGB through its embedded
+// CMYK profile, or with the naive ink model when there is no usable one, and
+// records the outcome in result. The profile never carries over.
+func cmykToSRGB(img *image.CMYK, profile []byte, result *Result) image.Image {
+	if profile != nil {
+		p, err := icc.Parse(profile)
+		if err == nil {
+			result.ICCProfile = p.Description
+		}
+		if err == nil && p.ColorSpace == icc.SpaceCMYK && p.CanConvert() {
+			result.ICCAction = ICCConverted
+			return p.ToSRGB(img)
+		}
+		result.ICCAction = ICCDropped
+	}
+
+	b := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Rect, img, b.Min, draw.Src)
+	return out
+}
+
+// toSRGB converts img from an embedded profile to sRGB for outputs that
+// cannot carry the profile, such as WebP copies. Images whose profile is
+// missing or not convertible are returned unchanged.
+func toSRGB(img image.Image, profile []byte) image.Image {
+	if profile == nil {
+		return img
+	}
+	p, err := icc.Parse(profile)
+	if err != nil || !p.CanConvert() || p.IsSRGB() {
+		return img
+	}
+	return p.ToSRGB(img)
+}
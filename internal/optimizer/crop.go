@@ -0,0 +1,241 @@
+package optimizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+	"github.com/zulfikawr/bitrim/internal/config"
+)
+
+// Crop strategies selectable with --crop
+const (
+	CropCenter  = "center"
+	CropEntropy = "entropy" // the most detailed window by luma entropy
+	CropEdges   = "edges"   // the window with the most edges
+	CropSkin    = "skin"    // skin tones first, then edges
+)
+
+// ValidCrop reports whether strategy is a known crop strategy
+func ValidCrop(strategy string) bool {
+	switch strategy {
+	case CropCenter, CropEntropy, CropEdges, CropSkin:
+		return true
+	default:
+		return false
+	}
+}
+
+// Saliency is measured on a copy of the image at most saliencySize pixels
+// on its longer side, comparing at most cropCandidates window positions
+// along each axis
+const (
+	saliencySize   = 256
+	cropCandidates = 32
+)
+
+// Luma histogram bins of the entropy strategy
+const entropyBins = 64
+
+// The skin strategy weighs skin tones by skinWeight and edges by
+// skinEdgeWeight, so faces win over busy backgrounds. Colors count as skin
+// once they are closer than skinThreshold to skinTone, ignoring pixels
+// darker than skinMinLightness.
+const (
+	skinWeight       = 1.8
+	skinEdgeWeight   = 0.2
+	skinThreshold    = 0.8
+	skinMinLightness = 0.2
+)
+
+// skinTone is the direction of typical skin colors in RGB space
+var skinTone = [3]float64{0.78, 0.57, 0.44}
+
+// LoadFocalPoints reads a sidecar JSON object mapping image paths relative
+// to the input directory to focal points, such as
+// {"products/shoe.jpg": {"x": 0.5, "y": 0.3}}
+func LoadFocalPoints(path string) (map[string]config.FocalPoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]config.FocalPoint
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	points := make(map[string]config.FocalPoint, len(raw))
+	for rel, point := range raw {
+		if point.X < 0 || point.X > 1 || point.Y < 0 || point.Y > 1 {
+			return nil, fmt.Errorf("focal point of %s is outside the image (use fractions from 0 to 1)", rel)
+		}
+		points[filepath.ToSlash(filepath.Clean(rel))] = point
+	}
+	return points, nil
+}
+
+// focalPoint returns the focal point of the image at relPath, or nil when
+// it has none. Sidecar keys use forward slashes on any OS.
+func focalPoint(relPath string, opts config.Options) *config.FocalPoint {
+	if point, ok := opts.FocalPoints[filepath.ToSlash(relPath)]; ok {
+		return &point
+	}
+	return nil
+}
+
+// cropWindow returns the w x h window of img to keep: centered on the focal
+// point when there is one, otherwise where the strategy finds the most
+// salient content. Ties go to the window closest to the center.
+func cropWindow(img image.Image, w, h int, strategy string, focal *config.FocalPoint) image.Rectangle {
+	b := img.Bounds()
+	slackX, slackY := b.Dx()-w, b.Dy()-h
+	x, y := slackX/2, slackY/2
+	switch {
+	case focal != nil:
+		x = clamp(int(focal.X*float64(b.Dx()))-w/2, 0, slackX)
+		y = clamp(int(focal.Y*float64(b.Dy()))-h/2, 0, slackY)
+	case strategy != CropCenter && strategy != "" && (slackX > 0 || slackY > 0):
+		x, y = salientWindow(img, w, h, strategy)
+	}
+	return image.Rect(x, y, x+w, y+h).Add(b.Min)
+}
+
+// salientWindow finds the offset of the most salient w x h window of img
+func salientWindow(img image.Image, w, h int, strategy string) (int, int) {
+	b := img.Bounds()
+	f := min(1, float64(saliencySize)/float64(max(b.Dx(), b.Dy())))
+	small := imaging.Resize(img, max(int(float64(b.Dx())*f), 1), max(int(float64(b.Dy())*f), 1), imaging.Box)
+	sw, sh := small.Bounds().Dx(), small.Bounds().Dy()
+	ww, wh := min(max(int(float64(w)*f), 1), sw), min(max(int(float64(h)*f), 1), sh)
+
+	var score func(x, y int) float64
+	if strategy == CropEntropy {
+		luma := make([]uint8, sw*sh)
+		for i := range luma {
+			p := small.Pix[4*i:]
+			luma[i] = uint8((299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])) / 1000)
+		}
+		score = func(x, y int) float64 {
+			return windowEntropy(luma, sw, x, y, ww, wh)
+		}
+	} else {
+		sums := integral(saliency(small, strategy == CropSkin), sw, sh)
+		score = func(x, y int) float64 {
+			return sums[(y+wh)*(sw+1)+x+ww] - sums[y*(sw+1)+x+ww] - sums[(y+wh)*(sw+1)+x] + sums[y*(sw+1)+x]
+		}
+	}
+
+	bestX, bestY := (sw-ww)/2, (sh-wh)/2
+	best, bestDist := math.Inf(-1), math.Inf(1)
+	for _, y := range offsets(sh - wh) {
+		for _, x := range offsets(sw - ww) {
+			s := score(x, y)
+			dist := math.Hypot(float64(x-(sw-ww)/2), float64(y-(sh-wh)/2))
+			if s > best || (s == best && dist < bestDist) {
+				best, bestDist, bestX, bestY = s, dist, x, y
+			}
+		}
+	}
+	return clamp(int(float64(bestX)/f+0.5), 0, b.Dx()-w), clamp(int(float64(bestY)/f+0.5), 0, b.Dy()-h)
+}
+
+// offsets returns up to cropCandidates evenly spread offsets from 0 to slack
+func offsets(slack int) []int {
+	n := min(slack, cropCandidates-1)
+	if n == 0 {
+		return []int{0}
+	}
+	out := make([]int, n+1)
+	for i := range out {
+		out[i] = i * slack / n
+	}
+	return out
+}
+
+// saliency scores every pixel of img by its edge strength, the absolute
+// luma Laplacian, or with skin by its skin tone and then its edges
+func saliency(img *image.NRGBA, skin bool) []float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	luma := make([]float64, w*h)
+	for i := range luma {
+		p := img.Pix[4*i:]
+		luma[i] = (0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])) / 255
+	}
+
+	scores := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			c := luma[i]
+			lap := 4 * c
+			lap -= luma[y*w+max(x-1, 0)] + luma[y*w+min(x+1, w-1)]
+			lap -= luma[max(y-1, 0)*w+x] + luma[min(y+1, h-1)*w+x]
+			scores[i] = math.Abs(lap)
+			if skin {
+				scores[i] *= skinEdgeWeight
+				if c >= skinMinLightness {
+					scores[i] += skinWeight * skinScore(img.Pix[4*i:])
+				}
+			}
+		}
+	}
+	return scores
+}
+
+// skinScore returns how close the color of an RGBA pixel is to a skin
+// tone, from 0 to 1
+func skinScore(p []uint8) float64 {
+	r, g, b := float64(p[0]), float64(p[1]), float64(p[2])
+	mag := math.Sqrt(r*r + g*g + b*b)
+	if mag == 0 {
+		return 0
+	}
+	dr, dg, db := r/mag-skinTone[0], g/mag-skinTone[1], b/mag-skinTone[2]
+	closeness := 1 - math.Sqrt(dr*dr+dg*dg+db*db)
+	if closeness <= skinThreshold {
+		return 0
+	}
+	return (closeness - skinThreshold) / (1 - skinThreshold)
+}
+
+// integral returns the summed-area table of a w x h score map, with a zero
+// row and column in front
+func integral(scores []float64, w, h int) []float64 {
+	sums := make([]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		row := 0.0
+		for x := 0; x < w; x++ {
+			row += scores[y*w+x]
+			sums[(y+1)*(w+1)+x+1] = sums[y*(w+1)+x+1] + row
+		}
+	}
+	return sums
+}
+
+// windowEntropy returns the Shannon entropy of the luma histogram of a
+// window
+func windowEntropy(luma []uint8, stride, x0, y0, w, h int) float64 {
+	var hist [entropyBins]int
+	for y := y0; y < y0+h; y++ {
+		for _, v := range luma[y*stride+x0 : y*stride+x0+w] {
+			hist[int(v)*entropyBins/256]++
+		}
+	}
+	n := float64(w * h)
+	entropy := 0.0
+	for _, count := range hist {
+		if count > 0 {
+			p := float64(count) / n
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// clamp limits v to [lo, hi]
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
@@ -0,0 +1,253 @@
+package optimizer
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/zulfikawr/bitrim/internal/config"
+	"github.com/zulfikawr/bitrim/internal/webp"
+)
+
+// DefaultConversions maps input formats that are not written back in their
+// own format to the format they are re-encoded as. Entries passed with
+// --convert take precedence.
+var DefaultConversions = map[string]string{
+	string(FormatWebP): string(FormatWebP),
+	string(FormatGIF):  string(FormatGIF),
+	string(FormatBMP):  string(FormatPNG),
+	string(FormatTIFF): string(FormatJPEG),
+}
+
+// outputExtensions are the extensions given to converted files
+var outputExtensions = map[ImageFormat]string{
+	FormatJPEG: ".jpg",
+	FormatPNG:  ".png",
+	FormatWebP: ".webp",
+	FormatGIF:  ".gif",
+}
+
+// FormatFromExt returns the raster image format for a file extension, or ""
+// if images with that extension are not supported
+func FormatFromExt(ext string) ImageFormat {
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		return FormatJPEG
+	case ".png":
+		return FormatPNG
+	case ".webp":
+		return FormatWebP
+	case ".gif":
+		return FormatGIF
+	case ".bmp":
+		return FormatBMP
+	case ".tif", ".tiff":
+		return FormatTIFF
+	default:
+		return ""
+	}
+}
+
+// TargetFormat returns the format an image in the source format is written as
+func TargetFormat(source ImageFormat, conversions map[string]string) ImageFormat {
+	if target, ok := conversions[string(source)]; ok {
+		return ImageFormat(target)
+	}
+	if target, ok := DefaultConversions[string(source)]; ok {
+		return ImageFormat(target)
+	}
+	return source
+}
+
+// EffectiveConversions returns the defaults merged with the user's overrides
+func EffectiveConversions(conversions map[string]string) map[string]string {
+	merged := make(map[string]string, len(DefaultConversions)+len(conversions))
+	for source, target := range DefaultConversions {
+		merged[source] = target
+	}
+	for source, target := range conversions {
+		merged[source] = target
+	}
+	return merged
+}
+
+// ValidateConversions checks that every source is a supported input format
+// and every target one we can encode
+func ValidateConversions(conversions map[string]string) error {
+	sources := make([]string, 0, len(conversions))
+	for source := range conversions {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	for _, source := range sources {
+		if FormatFromExt("."+source) == "" {
+			return fmt.Errorf("unsupported input format %q (use jpeg, png, webp, gif, bmp or tiff)", source)
+		}
+		target := ImageFormat(conversions[source])
+		if _, ok := outputExtensions[target]; !ok {
+			return fmt.Errorf("unsupported output format %q for %s (use jpeg, png or webp)", target, source)
+		}
+		// GIF output only exists to keep animations
+		if target == FormatGIF && FormatFromExt("."+source) != FormatGIF {
+			return fmt.Errorf("only gif can be kept as gif, not %s", source)
+		}
+	}
+	return nil
+}
+
+// CanonicalFormat returns the format named by name, which may be an alias
+// such as jpg or tif, or name itself if it names none
+func CanonicalFormat(name string) string {
+	if format := FormatFromExt("." + name); format != "" {
+		return string(format)
+	}
+	return name
+}
+
+// CanonicalConversions returns conversions with aliases such as jpg and tif
+// replaced by the format names TargetFormat looks up, on both sides. Aliases
+// of one source given different targets are an error.
+func CanonicalConversions(conversions map[string]string) (map[string]string, error) {
+	if conversions == nil {
+		return nil, nil
+	}
+	sources := make([]string, 0, len(conversions))
+	for source := range conversions {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	canonical := make(map[string]string, len(conversions))
+	given := make(map[string]string, len(conversions))
+	for _, source := range sources {
+		format, target := CanonicalFormat(source), CanonicalFormat(conversions[source])
+		if prev, ok := canonical[format]; ok && prev != target {
+			return nil, fmt.Errorf("conflicting conversions %s=%s and %s=%s", given[format], conversions[given[format]], source, conversions[source])
+		}
+		canonical[format], given[format] = target, source
+	}
+	return canonical, nil
+}
+
+// ConvertAll returns conversions extended so that every input format but
+// GIF, whose animations only survive as GIF, is written as target. Entries
+// already in conversions take precedence.
+func ConvertAll(conversions map[string]string, target string) (map[string]string, error) {
+	format := ImageFormat(CanonicalFormat(target))
+	switch format {
+	case FormatJPEG, FormatPNG, FormatWebP:
+	default:
+		return nil, fmt.Errorf("unsupported output format %q (use jpeg, png or webp)", target)
+	}
+	canonical, err := CanonicalConversions(conversions)
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]string, len(canonical)+5)
+	for _, source := range []ImageFormat{FormatJPEG, FormatPNG, FormatWebP, FormatBMP, FormatTIFF} {
+		merged[string(source)] = string(format)
+	}
+	for source, t := range canonical {
+		merged[source] = t
+	}
+	return merged, nil
+}
+
+// ConvertedPath returns outputPath with its extension changed to match the
+// output format of the image, or unchanged if the format is kept
+func ConvertedPath(outputPath string, conversions map[string]string) string {
+	ext := filepath.Ext(outputPath)
+	source := FormatFromExt(ext)
+	target := TargetFormat(source, conversions)
+	if source == "" || target == source {
+		return outputPath
+	}
+	return withExtension(outputPath, target)
+}
+
+// withExtension returns path with the extension of format
+func withExtension(path string, format ImageFormat) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + outputExtensions[format]
+}
+
+// decodeImage reads an image of the given format. WebP goes through our own
+// decoder for correct colors; everything else is handled by imaging, which
+// covers JPEG, PNG, GIF (first frame, when converted), BMP and TIFF.
+func decodeImage(path string, format ImageFormat) (image.Image, error) {
+	if format != FormatWebP {
+		return imaging.Open(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return webp.Decode(f)
+}
+
+// ParseColor parses a background color given as hex (#fff or #ffffff, the #
+// optional) or as white or black
+func ParseColor(value string) (color.NRGBA, error) {
+	switch strings.ToLower(value) {
+	case "white":
+		return color.NRGBA{0xff, 0xff, 0xff, 0xff}, nil
+	case "black":
+		return color.NRGBA{0, 0, 0, 0xff}, nil
+	}
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 3 {
+		hex = strings.Repeat(hex[0:1], 2) + strings.Repeat(hex[1:2], 2) + strings.Repeat(hex[2:3], 2)
+	}
+	var r, g, b uint8
+	if len(hex) != 6 {
+		return color.NRGBA{}, fmt.Errorf("%q is not a color (use #rrggbb, #rgb, white or black)", value)
+	}
+	if _, err := fmt.Sscanf(hex, "%02x%02x%02x", &r, &g, &b); err != nil {
+		return color.NRGBA{}, fmt.Errorf("%q is not a color (use #rrggbb, #rgb, white or black)", value)
+	}
+	return color.NRGBA{r, g, b, 0xff}, nil
+}
+
+// FormatColor returns a color as #rrggbb
+func FormatColor(c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return fmt.Sprintf("#%02x%02x%02x", n.R, n.G, n.B)
+}
+
+// Background returns the color transparent images are flattened onto for
+// formats without transparency: --background, or white
+func Background(opts config.Options) color.Color {
+	if opts.Background == nil {
+		return color.White
+	}
+	return opts.Background
+}
+
+// storedPixels returns img as an output format stores it: composited onto
+// the background for JPEG, which has no alpha channel, unchanged otherwise
+func storedPixels(img image.Image, format ImageFormat, opts config.Options) image.Image {
+	if format != FormatJPEG {
+		return img
+	}
+	if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		return flattenAlpha(img, Background(opts))
+	}
+	return img
+}
+
+// flattenAlpha composites img onto an opaque background, for output formats
+// without transparency
+func flattenAlpha(img image.Image, bg color.Color) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Over)
+	return out
+}
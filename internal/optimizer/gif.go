@@ -0,0 +1,344 @@
+package optimizer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"os"
+	"path/filepath"
+
+	"github.com/zulfikawr/bitrim/internal/config"
+)
+
+// gifFrame is a frame of the optimized animation before palette assignment
+type gifFrame struct {
+	rect     image.Rectangle
+	pix      []color.RGBA // rect.Dx()*rect.Dy() pixels; transparent where unchanged
+	delay    int
+	disposal byte
+}
+
+// Steps animated GIFs go without, as listed in Result.SkippedSteps
+const (
+	StepResize = "resize"
+	StepSizes  = "sizes"
+	StepWebP   = "webp"
+)
+
+// gifSkippedSteps returns the steps opts ask for that animated GIFs go
+// without, as only their frames are optimized
+func gifSkippedSteps(opts config.Options) []string {
+	var skipped []string
+	if opts.Width > 0 || opts.Height > 0 || opts.Scale > 0 || opts.MaxWidth > 0 || opts.MaxHeight > 0 || opts.MaxMegapixels > 0 {
+		skipped = append(skipped, StepResize)
+	}
+	if len(opts.Sizes) > 0 {
+		skipped = append(skipped, StepSizes)
+	}
+	if opts.WebP {
+		skipped = append(skipped, StepWebP)
+	}
+	return skipped
+}
+
+// errGIFTruncated reports a GIF whose blocks end early
+var errGIFTruncated = errors.New("gif: truncated block")
+
+// processGIF writes the optimized GIF for ProcessImage
+func processGIF(result Result, originalData []byte, outputPath string, policy metadataPolicy, opts config.Options, dryRun bool) Result {
+	processedData, err := optimizeGIF(originalData)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to optimize GIF: %v", err)
+		return result
+	}
+	if keepOriginal(result.OriginalSize, int64(len(processedData)), opts) {
+		if original := scrubbedOriginal(originalData, FormatGIF, policy); original != nil {
+			processedData = original
+			result.KeptOriginal = true
+		}
+	}
+
+	result.OutputPath = outputPath
+
+	// Write file (only if not dry-run)
+	if !dryRun {
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			result.Error = fmt.Sprintf("failed to create output directory: %v", err)
+			return result
+		}
+		if err := os.WriteFile(outputPath, processedData, 0644); err != nil {
+			result.Error = fmt.Sprintf("failed to write output file: %v", err)
+			return result
+		}
+	}
+
+	result.ProcessedSize = int64(len(processedData))
+	result.BytesSaved = result.OriginalSize - result.ProcessedSize
+	result.Success = true
+	return result
+}
+
+// gifXMP returns the XMP packet of a GIF file's application extension, or
+// nil if it has none. The packet is stored raw, so the bytes returned run on
+// into the magic trailer that lets readers skip it as data sub-blocks.
+func gifXMP(data []byte) ([]byte, error) {
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF")) {
+		return nil, errors.New("gif: not a GIF file")
+	}
+	// skip returns the end of the data sub-blocks starting at i
+	skip := func(i int) (int, error) {
+		for i < len(data) && data[i] != 0 {
+			i += 1 + int(data[i])
+		}
+		if i >= len(data) {
+			return 0, errGIFTruncated
+		}
+		return i + 1, nil
+	}
+
+	p := 13
+	if data[10]&0x80 != 0 {
+		p += 3 << (data[10]&7 + 1)
+	}
+	for p < len(data) {
+		var err error
+		switch data[p] {
+		case 0x21: // extension: label, then sub-blocks
+			if p+2 > len(data) {
+				return nil, errGIFTruncated
+			}
+			if data[p+1] == 0xff && bytes.HasPrefix(data[p+2:], []byte("\x0bXMP DataXMP")) {
+				start := p + 2 + 12
+				end, err := skip(start)
+				if err != nil {
+					return nil, err
+				}
+				return data[start:end], nil
+			}
+			p, err = skip(p + 2)
+		case 0x2c: // image: descriptor, color table, LZW code size, sub-blocks
+			if p+10 > len(data) {
+				return nil, errGIFTruncated
+			}
+			flags := data[p+9]
+			p += 10
+			if flags&0x80 != 0 {
+				p += 3 << (flags&7 + 1)
+			}
+			p, err = skip(p + 1)
+		default: // trailer
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, errGIFTruncated
+}
+
+// optimizeGIF re-encodes a (possibly animated) GIF so that it plays back
+// identically: every frame is cropped to the area it actually changes,
+// frames that change nothing are merged into their predecessor, and palettes
+// are rebuilt from the colors in use. Loop count and disposal methods are
+// kept.
+func optimizeGIF(data []byte) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	frames := diffFrames(g)
+	out := buildGIF(g, frames)
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// diffFrames replays the animation on a canvas and returns the frames needed
+// to reproduce it
+func diffFrames(g *gif.GIF) []gifFrame {
+	screen := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	for _, m := range g.Image {
+		screen = screen.Union(m.Bounds())
+	}
+
+	canvas := image.NewRGBA(screen)
+	var frames []gifFrame
+	var prevShown *image.RGBA
+
+	for i, m := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+
+		before := cloneRGBA(canvas)
+		draw.Draw(canvas, m.Bounds(), m, m.Bounds().Min, draw.Over)
+		shown := cloneRGBA(canvas)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, m.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, before.Pix)
+		}
+
+		// A frame that shows the same picture as its predecessor and leaves
+		// the canvas as it found it only extends the previous frame's delay
+		if prevShown != nil && bytes.Equal(shown.Pix, prevShown.Pix) && bytes.Equal(canvas.Pix, before.Pix) {
+			frames[len(frames)-1].delay += delay
+			continue
+		}
+		prevShown = shown
+
+		// Background disposal clears the whole frame rectangle afterwards,
+		// so only other frames can be shrunk to the area that changed
+		rect := m.Bounds().Intersect(screen)
+		if disposal != gif.DisposalBackground {
+			rect = changedRect(before, shown, rect)
+			if rect.Empty() {
+				// Nothing changes, but the frame is still needed to show the
+				// canvas as left by the previous disposal
+				rect = image.Rectangle{Min: m.Bounds().Intersect(screen).Min}
+				rect.Max = rect.Min.Add(image.Pt(1, 1))
+			}
+		}
+
+		frames = append(frames, cropFrame(before, shown, rect, delay, disposal))
+	}
+	return frames
+}
+
+// changedRect returns the bounding box of the pixels in r that differ
+// between a and b
+func changedRect(a, b *image.RGBA, r image.Rectangle) image.Rectangle {
+	var changed image.Rectangle
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i := a.PixOffset(x, y)
+			if !bytes.Equal(a.Pix[i:i+4], b.Pix[i:i+4]) {
+				changed = changed.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return changed
+}
+
+// cropFrame extracts the pixels of shown within rect, leaving pixels that
+// did not change transparent when the palette has room for it
+func cropFrame(before, shown *image.RGBA, rect image.Rectangle, delay int, disposal byte) gifFrame {
+	f := gifFrame{
+		rect:     rect,
+		pix:      make([]color.RGBA, 0, rect.Dx()*rect.Dy()),
+		delay:    delay,
+		disposal: disposal,
+	}
+
+	changedColors := make(map[color.RGBA]struct{})
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := shown.RGBAAt(x, y)
+			if c != before.RGBAAt(x, y) {
+				changedColors[c] = struct{}{}
+				f.pix = append(f.pix, c)
+			} else {
+				f.pix = append(f.pix, color.RGBA{})
+			}
+		}
+	}
+
+	// Without a free palette slot for transparency, unchanged pixels are
+	// drawn again in their current color. This only happens for frames with
+	// 256 opaque colors, which cover their whole rectangle, so the pixels
+	// still come from the frame's own palette.
+	if len(changedColors) >= 256 {
+		i := 0
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				f.pix[i] = shown.RGBAAt(x, y)
+				i++
+			}
+		}
+	}
+	return f
+}
+
+// buildGIF assigns palettes to the frames: one global palette when all
+// frames fit in 256 colors together, otherwise a local palette per frame
+func buildGIF(src *gif.GIF, frames []gifFrame) *gif.GIF {
+	out := &gif.GIF{
+		LoopCount: src.LoopCount,
+		Config: image.Config{
+			Width:  src.Config.Width,
+			Height: src.Config.Height,
+		},
+	}
+
+	global := color.Palette{}
+	globalIndex := make(map[color.RGBA]uint8)
+	fits := true
+	for _, f := range frames {
+		for _, c := range f.pix {
+			if _, ok := globalIndex[c]; ok {
+				continue
+			}
+			if len(global) == 256 {
+				fits = false
+				break
+			}
+			globalIndex[c] = uint8(len(global))
+			global = append(global, c)
+		}
+		if !fits {
+			break
+		}
+	}
+
+	if fits {
+		out.Config.ColorModel = global
+		if p, ok := src.Config.ColorModel.(color.Palette); ok && int(src.BackgroundIndex) < len(p) {
+			if i, ok := globalIndex[color.RGBAModel.Convert(p[src.BackgroundIndex]).(color.RGBA)]; ok {
+				out.BackgroundIndex = i
+			}
+		}
+	}
+
+	for _, f := range frames {
+		palette, index := global, globalIndex
+		if !fits {
+			palette, index = color.Palette{}, make(map[color.RGBA]uint8)
+			for _, c := range f.pix {
+				if _, ok := index[c]; !ok {
+					index[c] = uint8(len(palette))
+					palette = append(palette, c)
+				}
+			}
+		}
+
+		m := image.NewPaletted(f.rect, palette)
+		for i, c := range f.pix {
+			m.Pix[(i/f.rect.Dx())*m.Stride+i%f.rect.Dx()] = index[c]
+		}
+		out.Image = append(out.Image, m)
+		out.Delay = append(out.Delay, f.delay)
+		out.Disposal = append(out.Disposal, f.disposal)
+	}
+	return out
+}
+
+func cloneRGBA(m *image.RGBA) *image.RGBA {
+	c := *m
+	c.Pix = append([]uint8(nil), m.Pix...)
+	return &c
+}
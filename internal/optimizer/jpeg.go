@@ -0,0 +1,300 @@
+package optimizer
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"slices"
+
+	"github.com/disintegration/imaging"
+	"github.com/zulfikawr/bitrim/internal/config"
+	bitjpeg "github.com/zulfikawr/bitrim/internal/jpeg"
+	"github.com/zulfikawr/bitrim/internal/jpegmeta"
+)
+
+// thumbnailQuality is the JPEG quality of regenerated EXIF thumbnails
+const thumbnailQuality = 75
+
+// JPEG encodings selectable with --jpeg-mode
+const (
+	JPEGProgressive = "progressive"
+	JPEGBaseline    = "baseline"
+)
+
+// Huffman tables selectable with --jpeg-huffman
+const (
+	HuffmanOptimized = "optimized" // built from each image's own statistics
+	HuffmanStandard  = "standard"  // the example tables of the JPEG standard
+)
+
+// Chroma subsampling selectable with --subsampling
+const (
+	Subsampling420 = "420"
+	Subsampling422 = "422"
+	Subsampling444 = "444"
+)
+
+// JPEGLossless is the encoding of JPEGs rewritten from their DCT
+// coefficients with --jpeg-lossless
+const JPEGLossless = "lossless"
+
+// ValidJPEGMode reports whether mode is a known JPEG encoding mode
+func ValidJPEGMode(mode string) bool {
+	switch mode {
+	case JPEGProgressive, JPEGBaseline:
+		return true
+	default:
+		return false
+	}
+}
+
+// ValidHuffman reports whether tables names a known choice of Huffman tables
+func ValidHuffman(tables string) bool {
+	switch tables {
+	case HuffmanOptimized, HuffmanStandard:
+		return true
+	default:
+		return false
+	}
+}
+
+// ValidSubsampling reports whether mode is a known chroma subsampling
+func ValidSubsampling(mode string) bool {
+	switch mode {
+	case Subsampling420, Subsampling422, Subsampling444:
+		return true
+	default:
+		return false
+	}
+}
+
+// encodeJPEG encodes img with the configured scans, Huffman tables and
+// chroma subsampling, and returns the data together with its encoding.
+// Empty settings mean baseline, optimized and 4:2:0.
+func encodeJPEG(img image.Image, quality int, opts config.Options) ([]byte, string, error) {
+	mode := opts.JPEGMode
+	if mode == "" {
+		mode = JPEGBaseline
+	}
+	subsampling := bitjpeg.Subsampling420
+	switch opts.Subsampling {
+	case Subsampling422:
+		subsampling = bitjpeg.Subsampling422
+	case Subsampling444:
+		subsampling = bitjpeg.Subsampling444
+	}
+
+	buf := new(bytes.Buffer)
+	err := bitjpeg.Encode(buf, img, &bitjpeg.Options{
+		Quality:         quality,
+		Progressive:     mode == JPEGProgressive,
+		OptimizeHuffman: opts.JPEGHuffman != HuffmanStandard,
+		Subsampling:     subsampling,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mode, nil
+}
+
+// transcodeJPEG rewrites a JPEG file from its DCT coefficients with the
+// configured scans and Huffman tables, so its pixels do not change. Of its
+// metadata, only the JFIF and Adobe segments stay, as they tell decoders
+// how to read the colors.
+func transcodeJPEG(data []byte, opts config.Options) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := bitjpeg.Transcode(buf, data, &bitjpeg.Options{
+		Progressive:     opts.JPEGMode == JPEGProgressive,
+		OptimizeHuffman: opts.JPEGHuffman != HuffmanStandard,
+	})
+	if err != nil {
+		return nil, err
+	}
+	segments, err := jpegmeta.Read(data)
+	if err != nil {
+		return nil, err
+	}
+	segments = slices.DeleteFunc(segments, func(s jpegmeta.Segment) bool {
+		return s.Marker != jpegmeta.APP0 && s.Marker != jpegmeta.APP14
+	})
+	return jpegmeta.Insert(buf.Bytes(), segments)
+}
+
+// jpegMetadata returns the metadata segments of a JPEG file that a policy
+// keeps: EXIF with the fields of its groups, and with everything, the XMP
+// packet; both without private fields. IPTC goes with the copyright group,
+// without the other Photoshop resources. EXIF and XMP data that cannot be
+// scrubbed is dropped. The ICC profile in
+// APP2 is handled by --icc.
+func jpegMetadata(data []byte, policy metadataPolicy) ([]jpegmeta.Segment, error) {
+	segments, err := jpegmeta.Read(data)
+	if err != nil {
+		return nil, err
+	}
+	kept := segments[:0]
+	for _, s := range segments {
+		switch {
+		case jpegmeta.IsExif(s):
+			exif, err := jpegmeta.ParseExif(s.Data)
+			if err != nil || !exif.Strip(policy.keeps) {
+				continue
+			}
+			s.Data = exif.Payload()
+		case jpegmeta.IsXMP(s) && policy.all:
+			if s.Data, _ = jpegmeta.ScrubXMP(s.Data); s.Data == nil {
+				continue
+			}
+		case jpegmeta.IsPhotoshop(s) && policy.copyright:
+			if s.Data, _ = jpegmeta.ScrubPhotoshop(s.Data); s.Data == nil {
+				continue
+			}
+		default:
+			continue
+		}
+		kept = append(kept, s)
+	}
+	return kept, nil
+}
+
+// carryMetadata adds metadata to a re-encoded JPEG: the segments of
+// original that policy keeps, unless it is nil, and an ICC profile, unless
+// it is nil. When img was resized or rotated upright, the EXIF pixel
+// dimensions are updated, the orientation reset and the thumbnail
+// regenerated from it.
+func carryMetadata(original []byte, encoded []byte, policy metadataPolicy, profile []byte, img image.Image, resized bool, oriented bool) ([]byte, error) {
+	var segments []jpegmeta.Segment
+	if original != nil {
+		var err error
+		if segments, err = jpegMetadata(original, policy); err != nil {
+			return nil, err
+		}
+	}
+	for i, s := range segments {
+		if !(resized || oriented) || !jpegmeta.IsExif(s) {
+			continue
+		}
+		exif, err := jpegmeta.ParseExif(s.Data)
+		if err != nil {
+			continue
+		}
+		if oriented {
+			exif.SetOrientation(1)
+		}
+		exif.SetDimensions(img.Bounds().Dx(), img.Bounds().Dy())
+		if exif.Thumbnail() != nil {
+			if thumb, err := exifThumbnail(img); err == nil {
+				exif.SetThumbnail(thumb)
+			}
+		}
+		segments[i].Data = exif.Payload()
+	}
+
+	// APP2 goes between EXIF and IPTC, the order cameras write them in
+	segments = append(segments, jpegmeta.ICCSegments(profile)...)
+	slices.SortStableFunc(segments, func(a, b jpegmeta.Segment) int {
+		return int(a.Marker) - int(b.Marker)
+	})
+	return jpegmeta.Insert(encoded, segments)
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG file, or 1 when it
+// has none
+func jpegOrientation(data []byte) int {
+	segments, err := jpegmeta.Read(data)
+	if err != nil {
+		return 1
+	}
+	for _, s := range segments {
+		if !jpegmeta.IsExif(s) {
+			continue
+		}
+		if exif, err := jpegmeta.ParseExif(s.Data); err == nil {
+			return exif.Orientation()
+		}
+	}
+	return 1
+}
+
+// Color models of print JPEGs, recorded in Result.SourceColor
+const (
+	ColorCMYK = "cmyk"
+	ColorYCCK = "ycck"
+)
+
+// isCMYK reports whether a JPEG file has four components, CMYK or YCCK
+func isCMYK(data []byte) bool {
+	components, err := jpegmeta.Components(data)
+	return err == nil && components == 4
+}
+
+// decodeCMYK decodes a four-component JPEG file to ink values, 255 being
+// full coverage, and returns its color model. The decoder only accepts
+// files with an Adobe segment, whose ink it reads inverted as Photoshop
+// writes it; files without one store plain ink, so they are tagged as
+// Adobe CMYK for decoding and inverted back.
+func decodeCMYK(data []byte) (*image.CMYK, string, error) {
+	segments, err := jpegmeta.Read(data)
+	if err != nil {
+		return nil, "", err
+	}
+	transform, adobe := jpegmeta.AdobeTransform(segments)
+	model := ColorCMYK
+	if adobe && transform != 0 {
+		model = ColorYCCK
+	}
+	if !adobe {
+		if data, err = jpegmeta.Insert(data, []jpegmeta.Segment{jpegmeta.AdobeSegment(0)}); err != nil {
+			return nil, "", err
+		}
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	cmyk, ok := img.(*image.CMYK)
+	if !ok {
+		return nil, "", fmt.Errorf("four-component JPEG decoded as %T", img)
+	}
+	if !adobe {
+		for i, v := range cmyk.Pix {
+			cmyk.Pix[i] = 255 - v
+		}
+	}
+	return cmyk, model, nil
+}
+
+// orient rotates and flips img as an EXIF orientation asks, so that it
+// displays upright without the tag
+func orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// exifThumbnail encodes a thumbnail of img within the usual 160x120 EXIF
+// thumbnail size, turned for portrait images
+func exifThumbnail(img image.Image) ([]byte, error) {
+	width, height := 160, 120
+	if img.Bounds().Dy() > img.Bounds().Dx() {
+		width, height = height, width
+	}
+	buf := new(bytes.Buffer)
+	err := jpeg.Encode(buf, imaging.Fit(img, width, height, imaging.Lanczos), &jpeg.Options{Quality: thumbnailQuality})
+	return buf.Bytes(), err
+}
@@ -0,0 +1,44 @@
+package optimizer
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/zulfikawr/bitrim/internal/config"
+	bitpng "github.com/zulfikawr/bitrim/internal/png"
+)
+
+// PNG encodings selectable with --png-mode
+const (
+	PNGQuantized = "quantized" // reduce to a palette sized by quality
+	PNGLossless  = "lossless"  // keep every pixel, only recompress
+)
+
+// ValidPNGMode reports whether mode is a known PNG encoding mode
+func ValidPNGMode(mode string) bool {
+	switch mode {
+	case PNGQuantized, PNGLossless:
+		return true
+	default:
+		return false
+	}
+}
+
+// encodePNG encodes img in the configured mode, searching filters and
+// deflate settings for the smallest file, and embeds profile unless it is
+// nil. An empty mode means quantized.
+func encodePNG(img image.Image, quality int, profile []byte, opts config.Options) ([]byte, string, error) {
+	mode := opts.PNGMode
+	if mode == "" {
+		mode = PNGQuantized
+	}
+	if mode == PNGQuantized {
+		img = quantizePNG(img, quality, opts.Dither)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := bitpng.Encode(buf, img, &bitpng.Options{Zopfli: opts.Zopfli, ICCProfile: profile}); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mode, nil
+}
@@ -0,0 +1,207 @@
+package optimizer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zulfikawr/bitrim/internal/jpegmeta"
+	bitpng "github.com/zulfikawr/bitrim/internal/png"
+	"github.com/zulfikawr/bitrim/internal/webp"
+)
+
+// Metadata policies selectable with --metadata, besides a list of groups
+const (
+	MetadataAll  = "all"  // every group, and any other field that is not private
+	MetadataNone = "none" // nothing; ICC profiles are converted to sRGB
+)
+
+// Metadata groups that --metadata can keep. GPS coordinates, serial
+// numbers, owner names and maker notes are removed whatever the policy.
+const (
+	MetadataCopyright = "copyright" // EXIF artist and copyright, IPTC
+	MetadataCamera    = "camera"    // EXIF make, model, capture settings and dates
+	MetadataICC       = "icc"       // embedded ICC profiles, handled as --icc says
+)
+
+// DefaultMetadata is the policy used when none is given: ICC profiles only
+var DefaultMetadata = []string{MetadataICC}
+
+// EffectiveMetadata returns the policy a --metadata value stands for
+func EffectiveMetadata(values []string) []string {
+	if values == nil {
+		return DefaultMetadata
+	}
+	return values
+}
+
+// metadataPolicy is a parsed --metadata value
+type metadataPolicy struct {
+	all, copyright, camera, icc bool
+}
+
+// ValidateMetadata checks a --metadata value: all, none, or a list of
+// groups
+func ValidateMetadata(values []string) error {
+	_, err := parseMetadataPolicy(values)
+	return err
+}
+
+// parseMetadataPolicy parses a --metadata value; nil means DefaultMetadata
+func parseMetadataPolicy(values []string) (metadataPolicy, error) {
+	values = EffectiveMetadata(values)
+	var p metadataPolicy
+	for _, value := range values {
+		switch value = strings.ToLower(strings.TrimSpace(value)); value {
+		case MetadataAll, MetadataNone:
+			if len(values) > 1 {
+				return p, fmt.Errorf("%q cannot be combined with other values", value)
+			}
+			if value == MetadataAll {
+				p = metadataPolicy{all: true, copyright: true, camera: true, icc: true}
+			}
+		case MetadataCopyright:
+			p.copyright = true
+		case MetadataCamera:
+			p.camera = true
+		case MetadataICC:
+			p.icc = true
+		default:
+			return p, fmt.Errorf("unknown metadata group %q (use all, none, copyright, camera or icc)", value)
+		}
+	}
+	return p, nil
+}
+
+// exif reports whether the policy keeps any EXIF field
+func (p metadataPolicy) exif() bool {
+	return p.copyright || p.camera || p.all
+}
+
+// keeps reports whether EXIF fields of a category are kept. Structure is
+// decided by jpegmeta and private fields are never kept.
+func (p metadataPolicy) keeps(c jpegmeta.Category) bool {
+	switch c {
+	case jpegmeta.CategoryCopyright:
+		return p.copyright
+	case jpegmeta.CategoryCamera:
+		return p.camera
+	case jpegmeta.CategoryOther:
+		return p.all
+	}
+	return false
+}
+
+// sourceExif returns the EXIF data of a JPEG, PNG, WebP or TIFF file, or nil
+// if it has none or it cannot be parsed
+func sourceExif(data []byte, format ImageFormat) *jpegmeta.Exif {
+	var exif *jpegmeta.Exif
+	switch format {
+	case FormatJPEG:
+		segments, _ := jpegmeta.Read(data)
+		for _, s := range segments {
+			if jpegmeta.IsExif(s) {
+				exif, _ = jpegmeta.ParseExif(s.Data)
+				break
+			}
+		}
+	case FormatPNG:
+		tiff, _ := bitpng.Exif(data)
+		if tiff == nil {
+			tiff, _ = bitpng.RawExif(data)
+		}
+		if tiff != nil {
+			exif, _ = jpegmeta.ParseTIFF(tiff)
+		}
+	case FormatWebP:
+		if tiff := webp.Exif(data); tiff != nil {
+			exif, _ = jpegmeta.ParseTIFF(tiff)
+		}
+	case FormatTIFF:
+		exif, _ = jpegmeta.ParseTIFF(data)
+	}
+	return exif
+}
+
+// hasLocation reports whether a file holds GPS coordinates in its EXIF data
+// or its XMP packet, or in a JPEG, in their copies among the Photoshop
+// resources
+func hasLocation(data []byte, format ImageFormat) bool {
+	if exif := sourceExif(data, format); exif != nil && exif.HasLocation() {
+		return true
+	}
+	switch format {
+	case FormatPNG:
+		packet, _ := bitpng.XMP(data)
+		return packet != nil && jpegmeta.XMPHasLocation(packet)
+	case FormatWebP:
+		packet := webp.XMP(data)
+		return packet != nil && jpegmeta.XMPHasLocation(packet)
+	case FormatGIF:
+		packet, _ := gifXMP(data)
+		return packet != nil && jpegmeta.XMPHasLocation(packet)
+	case FormatJPEG:
+	default:
+		return false
+	}
+	segments, _ := jpegmeta.Read(data)
+	for _, s := range segments {
+		var location bool
+		switch {
+		case jpegmeta.IsXMP(s):
+			_, location = jpegmeta.ScrubXMP(s.Data)
+		case jpegmeta.IsPhotoshop(s):
+			_, location = jpegmeta.ScrubPhotoshop(s.Data)
+		}
+		if location {
+			return true
+		}
+	}
+	return false
+}
+
+// scrubbedOriginal returns a source file to copy instead of its re-encoded
+// output, with the metadata the policy removes taken out, or nil when that
+// is not possible. JPEG metadata segments are filtered without touching
+// the image data; PNG, WebP and GIF files carrying EXIF or XMP data, which
+// may hold a location, are never copied.
+func scrubbedOriginal(data []byte, format ImageFormat, policy metadataPolicy) []byte {
+	switch format {
+	case FormatJPEG:
+	case FormatPNG:
+		exif, err := bitpng.Exif(data)
+		raw, rawErr := bitpng.RawExif(data)
+		xmp, xmpErr := bitpng.XMP(data)
+		if exif != nil || raw != nil || xmp != nil || err != nil || rawErr != nil || xmpErr != nil {
+			return nil
+		}
+		return data
+	case FormatWebP:
+		if webp.Exif(data) != nil || webp.XMP(data) != nil {
+			return nil
+		}
+		return data
+	case FormatGIF:
+		if xmp, err := gifXMP(data); xmp != nil || err != nil {
+			return nil
+		}
+		return data
+	default:
+		return data
+	}
+
+	// The ICC profile stays, as the pixels are still in its color space
+	stripped, err := jpegmeta.Strip(data, func(s jpegmeta.Segment) bool {
+		return s.Marker == jpegmeta.APP0 || s.Marker == jpegmeta.APP14 || jpegmeta.IsICC(s)
+	})
+	if err != nil {
+		return nil
+	}
+	if !policy.exif() {
+		return stripped
+	}
+	out, err := carryMetadata(data, stripped, policy, nil, nil, false, false)
+	if err != nil {
+		return nil
+	}
+	return out
+}
@@ -1,23 +1,25 @@
 package optimizer
 
 import (
-	"bytes"
 	"fmt"
 	"image"
-	"image/color"
-	"image/draw"
-	"image/jpeg"
-	"image/png"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/disintegration/imaging"
 	"github.com/zulfikawr/bitrim/internal/config"
+	"github.com/zulfikawr/bitrim/internal/metric"
 )
 
-// ProcessImage handles JPEG and PNG compression and conversion
-func ProcessImage(inputPath string, outputDir string, opts config.Options, dryRun bool) Result {
+// ProcessImage handles JPEG and PNG compression and conversion. WebP, GIF,
+// BMP and TIFF inputs are converted to their target format (see
+// TargetFormat); GIFs kept as GIF are optimized frame by frame instead. The
+// compressed image is written to outputPath. relPath is the input's path
+// relative to the input directory, which focal points and watermark globs
+// are matched against.
+func ProcessImage(inputPath string, relPath string, outputPath string, opts config.Options, dryRun bool) Result {
 	result := Result{
 		FilePath: inputPath,
 		Success:  false,
@@ -33,68 +35,217 @@ func ProcessImage(inputPath string, outputDir string, opts config.Options, dryRu
 	result.OriginalSize = int64(len(originalData))
 	ext := strings.ToLower(filepath.Ext(inputPath))
 
-	// Determine file type and set result
-	if ext == ".jpg" || ext == ".jpeg" {
-		result.FileType = "jpeg"
-	} else if ext == ".png" {
-		result.FileType = "png"
-	} else {
+	// Determine source and output formats
+	source := FormatFromExt(ext)
+	if source == "" {
 		result.Error = "unsupported image format"
 		return result
 	}
+	target := TargetFormat(source, opts.Conversions)
+	result.SourceFormat = string(source)
+	result.FileType = string(target)
 
-	// Decode image
-	img, err := imaging.Open(inputPath)
+	policy, err := parseMetadataPolicy(opts.Metadata)
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid metadata policy: %v", err)
+		return result
+	}
+	result.HasLocation = hasLocation(originalData, source)
+
+	// Animated GIFs keep all their frames and skip resizing and copies,
+	// which is reported. One the watermark applies to fails, rather than
+	// going out unmarked.
+	if target == FormatGIF {
+		if watermarks(relPath, opts) {
+			result.Error = "animated GIFs cannot be watermarked; exclude them with --watermark-exclude or convert them with --convert gif=png"
+			return result
+		}
+		result.SkippedSteps = gifSkippedSteps(opts)
+		return processGIF(result, originalData, outputPath, policy, opts, dryRun)
+	}
+
+	// Decode image. Print JPEGs hold ink rather than light and are turned
+	// into sRGB right away, through their own profile when they have one.
+	embedded := embeddedProfile(originalData, source)
+	var img image.Image
+	if source == FormatJPEG && isCMYK(originalData) {
+		var cmyk *image.CMYK
+		if cmyk, result.SourceColor, err = decodeCMYK(originalData); err == nil {
+			img = cmykToSRGB(cmyk, embedded, &result)
+			embedded = nil
+		}
+	} else {
+		img, err = decodeImage(inputPath, source)
+	}
 	if err != nil {
 		result.Error = fmt.Sprintf("failed to decode image: %v", err)
 		return result
 	}
+	result.SourceWidth, result.SourceHeight = img.Bounds().Dx(), img.Bounds().Dy()
+
+	// Convert wide-gamut images to sRGB, or carry their profile over. A
+	// policy without the icc group converts as --icc srgb does.
+	var profile []byte
+	if embedded != nil {
+		mode := opts.ICC
+		if !policy.icc {
+			mode = ICCSRGB
+		}
+		// Any format may win with --format auto, so only sRGB is safe
+		colorTarget := target
+		if opts.Format == AutoFormat {
+			colorTarget = FormatWebP
+		}
+		img, profile = manageColor(img, embedded, colorTarget, mode, &result)
+	}
+
+	// Turn the pixels upright so the output needs no orientation tag
+	oriented := false
+	if opts.AutoOrient && source == FormatJPEG {
+		if orientation := jpegOrientation(originalData); orientation != 1 {
+			img = orient(img, orientation)
+			oriented = true
+		}
+	}
 
-	// Resize if width is specified
-	if opts.Width > 0 {
-		img = imaging.Resize(img, opts.Width, 0, imaging.Lanczos)
+	// Resize as --width, --height, --scale and the limits ask; --sizes
+	// copies are scaled from the full image, or the part the fill crop keeps
+	full := img
+	var resized bool
+	img, result.Crop, resized = resize(img, opts, focalPoint(relPath, opts))
+	if !result.Crop.Empty() {
+		full = imaging.Crop(full, result.Crop)
 	}
 
-	// Determine quality to use
-	quality := opts.Quality
-	if result.FileType == "jpeg" && opts.JPEGQuality > 0 {
-		quality = opts.JPEGQuality
-	} else if result.FileType == "png" && opts.PNGQuality > 0 {
-		quality = opts.PNGQuality
+	// Stamp the watermark on the images it applies to
+	result.Watermarked = watermarks(relPath, opts)
+	if result.Watermarked {
+		img = applyWatermark(img, opts.Watermark)
 	}
 
+	// With --format auto, write the smallest candidate format that keeps
+	// enough quality
+	if opts.Format == AutoFormat {
+		choice, err := chooseFormat(img, resized, opts)
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to choose format: %v", err)
+			return result
+		}
+		chosen := choice.Chosen()
+		target, opts = chosen.Format, candidateOptions(chosen, opts)
+		result.FileType, result.FormatChoice = string(target), choice
+		outputPath = withExtension(outputPath, target)
+	}
+
+	quality := formatQuality(target, opts)
+
 	// In dry-run mode, skip directory creation and file writing
 	if !dryRun {
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
 			result.Error = fmt.Sprintf("failed to create output directory: %v", err)
 			return result
 		}
 	}
 
 	// Process original format
-	filename := filepath.Base(inputPath)
-	outputPath := filepath.Join(outputDir, filename)
 	result.OutputPath = outputPath
 
-	// Encode to buffer to measure size
-	buf := new(bytes.Buffer)
+	// Add the kept ICC profile and the EXIF, XMP and IPTC data of a JPEG
+	// source that the metadata policy keeps to JPEG output
+	var exifSource []byte
+	if policy.exif() && source == FormatJPEG {
+		exifSource = originalData
+	}
+
+	// A JPEG whose pixels are unchanged can keep its coefficients
+	transcode := opts.JPEGLossless && source == FormatJPEG && target == FormatJPEG && result.SourceColor == "" && result.ICCAction != ICCConverted && !oriented && !resized && !result.Watermarked
+
+	encode := func(img image.Image, quality int, resized bool) ([]byte, string, error) {
+		switch target {
+		case FormatWebP:
+			return encodeWebP(img, opts.WebPMode, quality)
+		case FormatPNG:
+			// For PNG: Apply quantization based on quality to reduce file
+			// size (higher quality = fewer colors reduced) unless lossless
+			return encodePNG(img, quality, profile, opts)
+		}
 
-	if result.FileType == "jpeg" {
-		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
-	} else if result.FileType == "png" {
-		// For PNG: Apply quantization based on quality to reduce file size
-		// Higher quality = fewer colors reduced
-		quantizedImg := quantizePNG(img, quality)
-		err = png.Encode(buf, quantizedImg)
+		// Files the transcoder cannot read are re-encoded instead
+		var data []byte
+		var encoding string
+		var err error
+		if transcode {
+			if data, err = transcodeJPEG(originalData, opts); err == nil {
+				encoding = JPEGLossless
+			}
+		}
+		if data == nil {
+			// JPEG has no alpha channel; composite transparent sources onto
+			// the background
+			if data, encoding, err = encodeJPEG(storedPixels(img, FormatJPEG, opts), quality, opts); err != nil {
+				return nil, "", err
+			}
+		}
+		if exifSource != nil || profile != nil {
+			data, err = carryMetadata(exifSource, data, policy, profile, img, resized, oriented)
+		}
+		return data, encoding, err
+	}
+
+	// With --target-ssim, each image gets the lowest quality that reaches
+	// it; --format auto has already searched the chosen format's
+	if opts.TargetSSIM > 0 && usesQuality(target, opts) && !transcode && result.FormatChoice == nil {
+		if quality, err = qualityForSSIM(storedPixels(img, target, opts), target, opts.TargetSSIM, resized, encode); err != nil {
+			result.Error = fmt.Sprintf("failed to search quality: %v", err)
+			return result
+		}
 	}
 
+	processedData, encoding, err := encode(img, quality, resized)
 	if err != nil {
 		result.Error = fmt.Sprintf("failed to encode image: %v", err)
 		return result
 	}
+	result.Encoding, result.Quality = encoding, effectiveQuality(encoding, quality)
+
+	// Encodings that fit a size budget need the pixels, as coefficients
+	// kept as they are cannot get any smaller
+	transcode = false
+	budget := maxBytes(target, opts)
+	if processedData, img, err = applyBudget(&result, target, processedData, img, quality, resized, opts, encode); err != nil {
+		result.Error = fmt.Sprintf("failed to fit in %d bytes: %v", budget, err)
+		return result
+	}
+
+	// Keep the source when re-encoding does not save enough, minus the
+	// metadata the policy removes. A converted, rotated, resized or
+	// watermarked image, including a CMYK one now in sRGB, is always
+	// written, as is one over budget. With --format auto, a source in a
+	// format it can pick competes with the chosen one and keeps its format.
+	keepable := target == source || result.FormatChoice != nil && autoFormat(source)
+	if keepable && result.SourceColor == "" && !oriented && !resized && !result.Watermarked && keepOriginal(result.OriginalSize, int64(len(processedData)), opts) {
+		if original := scrubbedOriginal(originalData, source, policy); original != nil && (maxBytes(source, opts) == 0 || int64(len(original)) <= maxBytes(source, opts)) {
+			if target != source {
+				target, outputPath = source, withExtension(outputPath, source)
+				result.FileType, result.OutputPath = string(target), outputPath
+			}
+			processedData = original
+			result.KeptOriginal = true
+			result.Encoding = ""
+			result.Quality = 0
+			if result.ICCAction != "" {
+				result.ICCAction = ICCKept
+			}
+		}
+	}
+	if result.KeptOriginal {
+		result.OutputWidth, result.OutputHeight = result.SourceWidth, result.SourceHeight
+		result.PSNR, result.SSIM = metric.MaxPSNR, 1
+	} else {
+		measure(&result, storedPixels(img, target, opts), processedData, target)
+	}
 
 	// Write compressed image to disk (only if not dry-run)
-	processedData := buf.Bytes()
 	if !dryRun {
 		if err := os.WriteFile(outputPath, processedData, 0644); err != nil {
 			result.Error = fmt.Sprintf("failed to write output file: %v", err)
@@ -105,20 +256,64 @@ func ProcessImage(inputPath string, outputDir string, opts config.Options, dryRu
 	result.ProcessedSize = int64(len(processedData))
 	result.BytesSaved = result.OriginalSize - result.ProcessedSize
 
-	// Generate WebP if flag is set
-	if opts.WebP {
-		// WebP encoding would be added here once libwebp is available
-		if !dryRun {
-			fmt.Printf("⚠️  WebP output requested but not available on this system\n")
+	// Generate a WebP copy of the (resized) image if flag is set, unless
+	// the output already is one
+	if opts.WebP && target != FormatWebP {
+		result.Variants = append(result.Variants, writeWebP(toSRGB(img, profile), inputPath, outputPath, result.OriginalSize, opts, dryRun))
+	}
+
+	// With --sizes, write a copy at every width narrower than the source,
+	// and a WebP copy of each
+	for _, width := range opts.Sizes {
+		if width >= full.Bounds().Dx() {
+			continue
+		}
+		sized := scaleToWidth(full, width, opts)
+		if result.Watermarked {
+			sized = applyWatermark(sized, opts.Watermark)
+		}
+		variant := writeVariant(sized, target, true, inputPath, SizedPath(outputPath, width), result.OriginalSize, opts, dryRun, encode)
+		result.Variants = append(result.Variants, variant)
+		if opts.WebP && target != FormatWebP && variant.Success {
+			result.Variants = append(result.Variants, writeWebP(toSRGB(sized, profile), inputPath, variant.OutputPath, result.OriginalSize, opts, dryRun))
 		}
 	}
+	for i := range result.Variants {
+		result.Variants[i].SourceWidth, result.Variants[i].SourceHeight = result.SourceWidth, result.SourceHeight
+	}
 
 	result.Success = true
 	return result
 }
 
-// ProcessSVG handles SVG minification
-func ProcessSVG(inputPath string, outputDir string, dryRun bool) Result {
+// formatQuality returns the quality configured for an output format
+func formatQuality(format ImageFormat, opts config.Options) int {
+	switch {
+	case format == FormatJPEG && opts.JPEGQuality > 0:
+		return opts.JPEGQuality
+	case format == FormatPNG && opts.PNGQuality > 0:
+		return opts.PNGQuality
+	case format == FormatWebP && opts.WebPQuality > 0:
+		return opts.WebPQuality
+	default:
+		return opts.Quality
+	}
+}
+
+// keepOriginal reports whether an output of processedSize falls short of the
+// minimum saving over originalSize, in which case the source is copied
+// unchanged instead
+func keepOriginal(originalSize int64, processedSize int64, opts config.Options) bool {
+	required := opts.MinSavingBytes
+	if percent := int64(math.Ceil(float64(originalSize) * opts.MinSavingPercent / 100)); percent > required {
+		required = percent
+	}
+	return originalSize-processedSize < required
+}
+
+// ProcessSVG handles SVG minification.
+// The minified SVG is written to outputPath.
+func ProcessSVG(inputPath string, outputPath string, dryRun bool) Result {
 	result := Result{
 		FilePath: inputPath,
 		FileType: "svg",
@@ -136,7 +331,7 @@ func ProcessSVG(inputPath string, outputDir string, dryRun bool) Result {
 
 	// In dry-run mode, skip directory creation
 	if !dryRun {
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
 			result.Error = fmt.Sprintf("failed to create output directory: %v", err)
 			return result
 		}
@@ -145,8 +340,6 @@ func ProcessSVG(inputPath string, outputDir string, dryRun bool) Result {
 	// Minify SVG (remove whitespace and comments)
 	minified := minifySVG(originalData)
 
-	filename := filepath.Base(inputPath)
-	outputPath := filepath.Join(outputDir, filename)
 	result.OutputPath = outputPath
 
 	// Write file (only if not dry-run)
@@ -196,65 +389,3 @@ func minifySVG(data []byte) []byte {
 
 	return []byte(result.String())
 }
-
-// quantizePNG reduces PNG color palette based on quality setting
-// Quality 100 = full colors, Quality 1 = highly reduced palette
-func quantizePNG(img image.Image, quality int) image.Image {
-	// Calculate number of colors based on quality
-	// Quality 100 = 256 colors (no reduction)
-	// Quality 50 = 128 colors
-	// Quality 1 = 16 colors
-	maxColors := 16 + (quality * 240 / 100) // Range: 16 to 256
-	if maxColors > 256 {
-		maxColors = 256
-	}
-	if maxColors < 16 {
-		maxColors = 16
-	}
-
-	// Create a new paletted image with reduced colors
-	bounds := img.Bounds()
-	paletted := image.NewPaletted(bounds, nil)
-
-	// Generate palette by downsampling original colors
-	palette := generatePalette(img, maxColors)
-	paletted.Palette = palette
-
-	// Draw image onto paletted surface
-	draw.FloydSteinberg.Draw(paletted, bounds, img, image.Point{})
-
-	return paletted
-}
-
-// generatePalette creates a color palette from the image
-func generatePalette(img image.Image, numColors int) color.Palette {
-	// Start with a basic palette
-	palette := make([]color.Color, 0, numColors)
-
-	// Add black and white
-	palette = append(palette, color.RGBA{0, 0, 0, 255})
-	palette = append(palette, color.RGBA{255, 255, 255, 255})
-
-	// Add grayscale colors
-	greyStep := 255 / (numColors / 2)
-	for i := 1; i < numColors/2; i++ {
-		grey := uint8(i * greyStep)
-		palette = append(palette, color.RGBA{grey, grey, grey, 255})
-	}
-
-	// Add primary colors
-	palette = append(palette, color.RGBA{255, 0, 0, 255})
-	palette = append(palette, color.RGBA{0, 255, 0, 255})
-	palette = append(palette, color.RGBA{0, 0, 255, 255})
-	palette = append(palette, color.RGBA{255, 255, 0, 255})
-	palette = append(palette, color.RGBA{255, 0, 255, 255})
-	palette = append(palette, color.RGBA{0, 255, 255, 255})
-
-	// Fill remaining with interpolated colors
-	for len(palette) < numColors {
-		palette = append(palette, color.RGBA{128, 128, 128, 255})
-	}
-
-	// Trim to exact size
-	return color.Palette(palette[:numColors])
-}
@@ -1,9 +1,35 @@
 package optimizer
 
 import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/zulfikawr/bitrim/internal/config"
+	"github.com/zulfikawr/bitrim/internal/jpegmeta"
+	"github.com/zulfikawr/bitrim/internal/metric"
+	bitpng "github.com/zulfikawr/bitrim/internal/png"
+	bitwebp "github.com/zulfikawr/bitrim/internal/webp"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
 )
 
 func TestProcessSVG(t *testing.T) {
@@ -26,7 +52,7 @@ func TestProcessSVG(t *testing.T) {
 	}
 
 	// Process the SVG
-	result := ProcessSVG(svgPath, outputDir, false)
+	result := ProcessSVG(svgPath, filepath.Join(outputDir, "test.svg"), false)
 
 	if !result.Success {
 		t.Fatalf("ProcessSVG failed: %s", result.Error)
@@ -64,3 +90,1908 @@ func TestMinifySVG(t *testing.T) {
 		t.Error("minified SVG content mismatch")
 	}
 }
+
+func TestProcessImageWebP(t *testing.T) {
+	testDir := t.TempDir()
+	pngPath := filepath.Join(testDir, "icon.png")
+
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), 128, uint8(255 - x)})
+		}
+	}
+	writePNG(t, pngPath, img)
+
+	sizes := make(map[string]int64)
+	for _, mode := range []string{WebPLossy, WebPLossless, WebPSmallest} {
+		t.Run(mode, func(t *testing.T) {
+			opts := config.Options{Quality: 80, WebP: true, WebPMode: mode}
+			result := ProcessImage(pngPath, filepath.Base(pngPath), filepath.Join(testDir, mode, "icon.png"), opts, false)
+			if !result.Success {
+				t.Fatalf("ProcessImage failed: %s", result.Error)
+			}
+			if len(result.Variants) != 1 {
+				t.Fatalf("expected 1 WebP variant, got %d", len(result.Variants))
+			}
+
+			variant := result.Variants[0]
+			if !variant.Success || variant.FileType != "webp" {
+				t.Fatalf("unexpected WebP variant: %+v", variant)
+			}
+			if variant.OutputPath != filepath.Join(testDir, mode, "icon.webp") {
+				t.Errorf("unexpected WebP path %s", variant.OutputPath)
+			}
+			sizes[variant.Encoding] = variant.ProcessedSize
+
+			switch mode {
+			case WebPSmallest:
+				for encoding, size := range sizes {
+					if variant.ProcessedSize > size {
+						t.Errorf("smallest mode wrote %d bytes, but %s encoding gave %d", variant.ProcessedSize, encoding, size)
+					}
+				}
+			default:
+				if variant.Encoding != mode {
+					t.Errorf("expected %s encoding, got %q", mode, variant.Encoding)
+				}
+			}
+
+			data, err := os.Open(variant.OutputPath)
+			if err != nil {
+				t.Fatalf("WebP output missing: %v", err)
+			}
+			defer data.Close()
+			decoded, err := webp.Decode(data)
+			if err != nil {
+				t.Fatalf("WebP output does not decode: %v", err)
+			}
+			if decoded.Bounds().Dx() != 64 || decoded.Bounds().Dy() != 64 {
+				t.Errorf("unexpected WebP size %v", decoded.Bounds())
+			}
+			if _, opaque := decoded.(*image.YCbCr); opaque {
+				t.Errorf("transparency was dropped from the %s WebP", mode)
+			}
+		})
+	}
+}
+
+func TestProcessImageConvertsFormats(t *testing.T) {
+	testDir := t.TempDir()
+
+	// Half transparent, half opaque red
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			a := uint8(255)
+			if x < 16 {
+				a = 0
+			}
+			img.SetNRGBA(x, y, color.NRGBA{200, 20, 20, a})
+		}
+	}
+
+	encoders := map[string]func(io.Writer) error{
+		"in.gif":  func(w io.Writer) error { return gif.Encode(w, img, nil) },
+		"in.bmp":  func(w io.Writer) error { return bmp.Encode(w, img) },
+		"in.tif":  func(w io.Writer) error { return tiff.Encode(w, img, nil) },
+		"in.webp": func(w io.Writer) error { return bitwebp.EncodeLossless(w, img) },
+	}
+	for name, encode := range encoders {
+		f, err := os.Create(filepath.Join(testDir, name))
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		if err := encode(f); err != nil {
+			t.Fatalf("failed to encode %s: %v", name, err)
+		}
+		f.Close()
+	}
+
+	cases := []struct {
+		input       string
+		conversions map[string]string
+		want        ImageFormat
+		alpha       bool // whether the input keeps the transparent half
+	}{
+		{"in.gif", map[string]string{"gif": "png"}, FormatPNG, false},
+		{"in.bmp", nil, FormatPNG, false},
+		{"in.tif", nil, FormatJPEG, true},
+		{"in.webp", nil, FormatWebP, true},
+		{"in.bmp", map[string]string{"bmp": "webp"}, FormatWebP, false},
+		{"in.webp", map[string]string{"webp": "jpeg"}, FormatJPEG, true},
+	}
+
+	// Extension aliases name the same formats, as sources and as targets
+	aliased, err := CanonicalConversions(map[string]string{"tif": "jpg", "jpg": "webp", "jpeg": "webp"})
+	if err != nil {
+		t.Fatalf("CanonicalConversions failed: %v", err)
+	}
+	if err := ValidateConversions(aliased); err != nil {
+		t.Fatalf("aliased conversions do not validate: %v", err)
+	}
+	if TargetFormat(FormatTIFF, aliased) != FormatJPEG || TargetFormat(FormatJPEG, aliased) != FormatWebP {
+		t.Errorf("aliases ignored: %v", aliased)
+	}
+	if _, err := CanonicalConversions(map[string]string{"jpg": "png", "jpeg": "webp"}); err == nil {
+		t.Error("expected an error for aliases of one source with different targets")
+	}
+	if got := ConvertedPath(filepath.Join("out", "a.jpg"), aliased); got != filepath.Join("out", "a.webp") {
+		t.Errorf("expected a.jpg -> a.webp, got %s", got)
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.input+"->"+string(tc.want), func(t *testing.T) {
+			opts := config.Options{Quality: 90, Conversions: tc.conversions, WebPMode: WebPLossless}
+			outputPath := ConvertedPath(filepath.Join(testDir, "out", string(tc.want), tc.input), tc.conversions)
+			if filepath.Ext(outputPath) != outputExtensions[tc.want] {
+				t.Fatalf("expected %s extension, got %s", outputExtensions[tc.want], outputPath)
+			}
+
+			result := ProcessImage(filepath.Join(testDir, tc.input), tc.input, outputPath, opts, false)
+			if !result.Success {
+				t.Fatalf("ProcessImage failed: %s", result.Error)
+			}
+			if result.FileType != string(tc.want) || result.SourceFormat != string(FormatFromExt(filepath.Ext(tc.input))) {
+				t.Errorf("expected %s -> %s, got %s -> %s", filepath.Ext(tc.input), tc.want, result.SourceFormat, result.FileType)
+			}
+
+			out, err := decodeImage(outputPath, tc.want)
+			if err != nil {
+				t.Fatalf("output does not decode: %v", err)
+			}
+			if !tc.alpha {
+				return
+			}
+			// JPEG output has the transparent half composited onto white
+			c := color.NRGBAModel.Convert(out.At(4, 4)).(color.NRGBA)
+			if tc.want == FormatJPEG {
+				if c.R < 240 || c.G < 240 || c.B < 240 {
+					t.Errorf("expected transparent area flattened onto white, got %v", c)
+				}
+			} else if c.A != 0 {
+				t.Errorf("expected transparency to be kept, got %v", c)
+			}
+		})
+	}
+}
+
+func TestProcessImageConvertsAll(t *testing.T) {
+	testDir := t.TempDir()
+
+	// Transparent on the left, opaque blue on the right
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 16; x < 32; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{20, 20, 200, 255})
+		}
+	}
+	inputPath := filepath.Join(testDir, "in.png")
+	writePNG(t, inputPath, img)
+
+	conversions, err := ConvertAll(map[string]string{"tif": "png"}, "jpg")
+	if err != nil {
+		t.Fatalf("ConvertAll failed: %v", err)
+	}
+	for source, want := range map[ImageFormat]ImageFormat{
+		FormatJPEG: FormatJPEG, FormatPNG: FormatJPEG, FormatWebP: FormatJPEG,
+		FormatBMP: FormatJPEG, FormatTIFF: FormatPNG, FormatGIF: FormatGIF,
+	} {
+		if got := TargetFormat(source, conversions); got != want {
+			t.Errorf("%s is written as %s, want %s", source, got, want)
+		}
+	}
+	if _, err := ConvertAll(nil, "gif"); err == nil {
+		t.Error("expected an error converting everything to gif")
+	}
+
+	bg, err := ParseColor("#f80")
+	if err != nil || FormatColor(bg) != "#ff8800" {
+		t.Fatalf("ParseColor(#f80) = %s, %v", FormatColor(bg), err)
+	}
+	if _, err := ParseColor("#12345"); err == nil {
+		t.Error("expected an error for a five digit color")
+	}
+
+	outputPath := ConvertedPath(filepath.Join(testDir, "out", "in.png"), conversions)
+	if filepath.Ext(outputPath) != ".jpg" {
+		t.Fatalf("expected .jpg extension, got %s", outputPath)
+	}
+	opts := config.Options{Quality: 95, Conversions: conversions, Background: bg}
+	result := ProcessImage(inputPath, filepath.Base(inputPath), outputPath, opts, false)
+	if !result.Success {
+		t.Fatalf("ProcessImage failed: %s", result.Error)
+	}
+	if result.SourceFormat != string(FormatPNG) || result.FileType != string(FormatJPEG) {
+		t.Errorf("expected png -> jpeg, got %s -> %s", result.SourceFormat, result.FileType)
+	}
+
+	out, err := decodeImage(outputPath, FormatJPEG)
+	if err != nil {
+		t.Fatalf("output does not decode: %v", err)
+	}
+	c := color.NRGBAModel.Convert(out.At(4, 4)).(color.NRGBA)
+	if c.R < 240 || c.G < 120 || c.G > 150 || c.B > 20 {
+		t.Errorf("expected transparent area flattened onto #ff8800, got %v", c)
+	}
+	if result.SSIM < 0.9 {
+		t.Errorf("expected fidelity measured against the flattened image, got SSIM %v", result.SSIM)
+	}
+}
+
+func TestProcessImageAutoFormat(t *testing.T) {
+	testDir := t.TempDir()
+
+	// Flat blocks in four colors, and smooth gradients with fine noise
+	graphic := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	photo := image.NewNRGBA(image.Rect(0, 0, 96, 96))
+	palette := []color.NRGBA{{255, 255, 255, 255}, {30, 60, 200, 255}, {230, 40, 40, 255}, {20, 20, 20, 255}}
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 96; x++ {
+			if x < 64 && y < 64 {
+				graphic.SetNRGBA(x, y, palette[(x/16+y/32)%4])
+			}
+			noise := uint8((x*7 + y*13) % 5)
+			photo.SetNRGBA(x, y, color.NRGBA{uint8(40 + 2*x), uint8(30 + 2*y), uint8(80 + x + y/2 + int(noise)), 255})
+		}
+	}
+	// Many colors, but hard edges everywhere
+	mixed := image.NewNRGBA(image.Rect(0, 0, 96, 96))
+	draw.Draw(mixed, mixed.Bounds(), photo, image.Point{}, draw.Src)
+	for y := 0; y < 96; y += 4 {
+		for x := 0; x < 96; x++ {
+			mixed.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 255})
+		}
+	}
+
+	// A photo with a transparent band, which JPEG cannot keep
+	cutout := image.NewNRGBA(photo.Bounds())
+	draw.Draw(cutout, cutout.Bounds(), photo, image.Point{}, draw.Src)
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 24; x++ {
+			cutout.Pix[cutout.PixOffset(x, y)+3] = 0
+		}
+	}
+
+	cases := []struct {
+		name       string
+		img        image.Image
+		webPMode   string
+		targetSSIM float64
+		class      string
+		pruned     []ImageFormat
+	}{
+		{"graphic.png", graphic, WebPLossy, 0, ClassGraphic, []ImageFormat{FormatJPEG}},
+		{"photo.png", photo, WebPLossy, 0, ClassPhoto, []ImageFormat{FormatPNG}},
+		{"searched.png", photo, WebPLossy, 0.97, ClassPhoto, []ImageFormat{FormatPNG}},
+		{"mixed.png", mixed, WebPLossy, 0, ClassMixed, nil},
+		{"cutout.png", cutout, WebPLossless, 0, ClassPhoto, []ImageFormat{FormatJPEG, FormatPNG}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			inputPath := filepath.Join(testDir, tc.name)
+			writePNG(t, inputPath, tc.img)
+
+			opts := config.Options{Quality: 80, Format: AutoFormat, WebPMode: tc.webPMode, TargetSSIM: tc.targetSSIM}
+			result := ProcessImage(inputPath, filepath.Base(inputPath), filepath.Join(testDir, "out", tc.name), opts, false)
+			if !result.Success {
+				t.Fatalf("ProcessImage failed: %s", result.Error)
+			}
+			choice := result.FormatChoice
+			if choice == nil || choice.Class != tc.class {
+				t.Fatalf("expected class %s, got %+v", tc.class, choice)
+			}
+			if len(choice.Candidates) != 4 {
+				t.Fatalf("expected 4 candidates, got %d", len(choice.Candidates))
+			}
+
+			chosen := choice.Chosen()
+			for _, c := range choice.Candidates {
+				if slices.Contains(tc.pruned, c.Format) != (c.Outcome == CandidatePruned) {
+					t.Errorf("%s %s: outcome %s", c.Format, c.Mode, c.Outcome)
+				}
+				if c.Outcome == CandidateLarger && c.Size < chosen.Size {
+					t.Errorf("%s %s (%d bytes) is smaller than the chosen %s (%d bytes)", c.Format, c.Mode, c.Size, chosen.Format, chosen.Size)
+				}
+			}
+			if chosen.SSIM < choice.Floor {
+				t.Errorf("chosen %s has SSIM %v, below %v", chosen.Format, chosen.SSIM, choice.Floor)
+			}
+			if usesQuality(chosen.Format, candidateOptions(chosen, opts)) && result.Quality != chosen.Quality {
+				t.Errorf("chosen %s was tried at quality %d, written at %d", chosen.Format, chosen.Quality, result.Quality)
+			}
+
+			if result.FileType != string(chosen.Format) || filepath.Ext(result.OutputPath) != outputExtensions[chosen.Format] {
+				t.Errorf("chose %s, wrote %s as %s", chosen.Format, result.OutputPath, result.FileType)
+			}
+			if _, err := decodeImage(result.OutputPath, chosen.Format); err != nil {
+				t.Errorf("output does not decode: %v", err)
+			}
+		})
+	}
+
+	// A source no candidate saves enough on is kept in its own format
+	inputPath := filepath.Join(testDir, "kept.png")
+	writePNG(t, inputPath, photo)
+	opts := config.Options{Quality: 80, Format: AutoFormat, MinSavingPercent: 99}
+	result := ProcessImage(inputPath, filepath.Base(inputPath), filepath.Join(testDir, "kept", "kept.png"), opts, false)
+	if !result.Success {
+		t.Fatalf("ProcessImage failed: %s", result.Error)
+	}
+	if chosen := result.FormatChoice.Chosen(); chosen.Format == FormatPNG {
+		t.Fatalf("expected a format other than PNG chosen for a photo, got %s", chosen.Format)
+	}
+	if !result.KeptOriginal || result.FileType != string(FormatPNG) || result.OutputPath != filepath.Join(testDir, "kept", "kept.png") {
+		t.Errorf("expected the source kept as PNG, got %s as %s (kept: %v)", result.OutputPath, result.FileType, result.KeptOriginal)
+	}
+	if entries, err := os.ReadDir(filepath.Join(testDir, "kept")); err != nil || len(entries) != 1 {
+		t.Errorf("expected only the kept source written, got %v (%v)", entries, err)
+	}
+
+	derived := DerivedPaths(filepath.Join("out", "a.png"), config.Options{Format: AutoFormat})
+	if !slices.Contains(derived, filepath.Join("out", "a.jpg")) || !slices.Contains(derived, filepath.Join("out", "a.webp")) {
+		t.Errorf("expected every candidate path reserved, got %v", derived)
+	}
+}
+
+func TestProcessImageAnimatedGIF(t *testing.T) {
+	testDir := t.TempDir()
+	gifPath := filepath.Join(testDir, "anim.gif")
+
+	palette := color.Palette{
+		color.RGBA{0, 0, 255, 255},
+		color.RGBA{255, 0, 0, 255},
+		color.RGBA{0, 255, 0, 255},
+		color.RGBA{},
+	}
+	// A full frame with a red square at (x, x)
+	square := func(x int) *image.Paletted {
+		m := image.NewPaletted(image.Rect(0, 0, 40, 40), palette)
+		for i := 0; i < 8*8; i++ {
+			m.SetColorIndex(x+i%8, x+i/8, 1)
+		}
+		return m
+	}
+	green := image.NewPaletted(image.Rect(30, 30, 36, 36), palette)
+	for i := range green.Pix {
+		green.Pix[i] = 2
+	}
+
+	src := &gif.GIF{
+		// The third frame repeats the second and should be merged into it
+		Image:     []*image.Paletted{square(5), square(15), square(15), green},
+		Delay:     []int{10, 20, 30, 40},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalNone, gif.DisposalBackground},
+		LoopCount: 3,
+	}
+	f, err := os.Create(gifPath)
+	if err != nil {
+		t.Fatalf("failed to create test GIF: %v", err)
+	}
+	if err := gif.EncodeAll(f, src); err != nil {
+		t.Fatalf("failed to encode test GIF: %v", err)
+	}
+	f.Close()
+
+	outputPath := filepath.Join(testDir, "out", "anim.gif")
+	result := ProcessImage(gifPath, filepath.Base(gifPath), outputPath, config.Options{Quality: 80, Width: 20, WebP: true}, false)
+	if !result.Success {
+		t.Fatalf("ProcessImage failed: %s", result.Error)
+	}
+	if result.FileType != "gif" || len(result.Variants) != 0 {
+		t.Errorf("expected a GIF without variants, got %s with %d variants", result.FileType, len(result.Variants))
+	}
+	if want := []string{StepResize, StepWebP}; !slices.Equal(result.SkippedSteps, want) {
+		t.Errorf("expected skipped steps %v, got %v", want, result.SkippedSteps)
+	}
+
+	// A watermark cannot be stamped on every frame, so the GIF fails
+	// rather than going out unmarked
+	mark := config.Watermark{Image: image.NewRGBA(image.Rect(0, 0, 4, 4)), Scale: 10, Opacity: 1}
+	marked := ProcessImage(gifPath, filepath.Base(gifPath), filepath.Join(testDir, "marked", "anim.gif"), config.Options{Quality: 80, Watermark: mark}, false)
+	if marked.Success || !strings.Contains(marked.Error, "watermark") {
+		t.Errorf("expected watermarking a GIF to fail, got %+v", marked)
+	}
+	if result.BytesSaved <= 0 {
+		t.Errorf("expected positive BytesSaved, got %d", result.BytesSaved)
+	}
+
+	f, err = os.Open(outputPath)
+	if err != nil {
+		t.Fatalf("output file not found: %v", err)
+	}
+	defer f.Close()
+	out, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatalf("output does not decode: %v", err)
+	}
+
+	if len(out.Image) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(out.Image))
+	}
+	if out.LoopCount != 3 {
+		t.Errorf("expected loop count 3, got %d", out.LoopCount)
+	}
+	wantDelay := []int{10, 50, 40}
+	wantDisposal := []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalBackground}
+	for i := range out.Image {
+		if out.Delay[i] != wantDelay[i] || out.Disposal[i] != wantDisposal[i] {
+			t.Errorf("frame %d: expected delay %d disposal %d, got %d and %d", i, wantDelay[i], wantDisposal[i], out.Delay[i], out.Disposal[i])
+		}
+	}
+	// The moved square only changes the area covered by both squares
+	if b := out.Image[1].Bounds(); b != image.Rect(5, 5, 23, 23) {
+		t.Errorf("expected second frame cropped to the moved square, got %v", b)
+	}
+
+	// Decode the source too, so both canvases get the logical screen size
+	srcFile, err := os.Open(gifPath)
+	if err != nil {
+		t.Fatalf("failed to open test GIF: %v", err)
+	}
+	defer srcFile.Close()
+	decoded, err := gif.DecodeAll(srcFile)
+	if err != nil {
+		t.Fatalf("failed to decode test GIF: %v", err)
+	}
+	want := compositeGIF(decoded)
+	want = append(want[:2], want[3])
+	got := compositeGIF(out)
+	for i := range got {
+		if string(got[i].Pix) != string(want[i].Pix) {
+			t.Errorf("frame %d does not display the same picture", i)
+		}
+	}
+}
+
+// compositeGIF returns the picture shown for each frame of g
+func compositeGIF(g *gif.GIF) []*image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	var shown []*image.RGBA
+	for i, m := range g.Image {
+		draw.Draw(canvas, m.Bounds(), m, m.Bounds().Min, draw.Over)
+		shown = append(shown, cloneRGBA(canvas))
+		if g.Disposal[i] == gif.DisposalBackground {
+			draw.Draw(canvas, m.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+	return shown
+}
+
+func TestQuantizePNG(t *testing.T) {
+	// A colorful gradient with a semi-transparent edge and a transparent corner
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			a := uint8(255)
+			if x >= 56 {
+				a = 128
+			}
+			if x < 8 && y < 8 {
+				a = 0
+			}
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), uint8(255 - x*2), a})
+		}
+	}
+
+	for _, dither := range []string{DitherNone, DitherFloydSteinberg, DitherOrdered} {
+		t.Run(dither, func(t *testing.T) {
+			out, ok := quantizePNG(img, 50, dither).(*image.Paletted)
+			if !ok {
+				t.Fatalf("expected a paletted image")
+			}
+			if len(out.Palette) > 136 {
+				t.Errorf("expected at most 136 colors at quality 50, got %d", len(out.Palette))
+			}
+
+			var sumErr float64
+			for y := 0; y < 64; y++ {
+				for x := 0; x < 64; x++ {
+					want := img.NRGBAAt(x, y)
+					got := color.NRGBAModel.Convert(out.At(x, y)).(color.NRGBA)
+					if want.A == 0 {
+						if got.A != 0 {
+							t.Fatalf("transparent pixel at %d,%d became %v", x, y, got)
+						}
+						continue
+					}
+					if d := int(got.A) - int(want.A); d < -8 || d > 8 {
+						t.Fatalf("alpha at %d,%d: expected %d, got %d", x, y, want.A, got.A)
+					}
+					for _, d := range []int{int(got.R) - int(want.R), int(got.G) - int(want.G), int(got.B) - int(want.B)} {
+						sumErr += float64(d * d)
+					}
+				}
+			}
+			// The gradient needs its own hues, not a gray ramp
+			if rms := math.Sqrt(sumErr / (64 * 64 * 3)); rms > 12 {
+				t.Errorf("RMS color error %.1f is too large", rms)
+			}
+		})
+	}
+
+	// Images that fit in the palette keep their exact colors
+	few := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := 0; i < 64; i++ {
+		few.SetNRGBA(i%8, i/8, color.NRGBA{uint8(i % 4 * 60), 200, uint8(i / 16 * 70), uint8(255 - i%2*100)})
+	}
+	out := quantizePNG(few, 1, DitherFloydSteinberg)
+	for i := 0; i < 64; i++ {
+		if got := color.NRGBAModel.Convert(out.At(i%8, i/8)); got != few.NRGBAAt(i%8, i/8) {
+			t.Fatalf("pixel %d changed from %v to %v", i, few.NRGBAAt(i%8, i/8), got)
+		}
+	}
+}
+
+func TestProcessImagePNGLossless(t *testing.T) {
+	testDir := t.TempDir()
+	pngPath := filepath.Join(testDir, "gradient.png")
+
+	img := image.NewNRGBA(image.Rect(0, 0, 48, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 48; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 5), uint8(y * 5), uint8(x * y), uint8(128 + x)})
+		}
+	}
+	writePNG(t, pngPath, img)
+
+	for _, zopfli := range []bool{false, true} {
+		outputPath := filepath.Join(testDir, fmt.Sprintf("zopfli-%t", zopfli), "gradient.png")
+		opts := config.Options{Quality: 10, PNGMode: PNGLossless, Zopfli: zopfli}
+		result := ProcessImage(pngPath, filepath.Base(pngPath), outputPath, opts, false)
+		if !result.Success {
+			t.Fatalf("ProcessImage failed: %s", result.Error)
+		}
+		if result.Encoding != PNGLossless {
+			t.Errorf("expected %s encoding, got %q", PNGLossless, result.Encoding)
+		}
+		if result.BytesSaved <= 0 {
+			t.Errorf("expected recompression to save bytes, got %d", result.BytesSaved)
+		}
+
+		out, err := decodeImage(outputPath, FormatPNG)
+		if err != nil {
+			t.Fatalf("output does not decode: %v", err)
+		}
+		for y := 0; y < 48; y++ {
+			for x := 0; x < 48; x++ {
+				if got := color.NRGBAModel.Convert(out.At(x, y)); got != img.NRGBAAt(x, y) {
+					t.Fatalf("pixel %d,%d changed from %v to %v", x, y, img.NRGBAAt(x, y), got)
+				}
+			}
+		}
+	}
+}
+
+func TestProcessImageKeepsOriginal(t *testing.T) {
+	testDir := t.TempDir()
+	pngPath := filepath.Join(testDir, "gradient.png")
+
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 8), uint8(y * 8), 64, 255})
+		}
+	}
+	writePNG(t, pngPath, img)
+
+	// The first pass recompresses; a second pass over its output has nothing
+	// left to save and must copy the file rather than grow it
+	opts := config.Options{Quality: 80, PNGMode: PNGLossless, MinSavingBytes: 1}
+	firstPath := filepath.Join(testDir, "first", "gradient.png")
+	first := ProcessImage(pngPath, filepath.Base(pngPath), firstPath, opts, false)
+	if !first.Success || first.KeptOriginal {
+		t.Fatalf("unexpected first pass: %+v", first)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		input string
+		opts  config.Options
+	}{
+		{"already optimized", firstPath, opts},
+		{"percent", pngPath, config.Options{Quality: 80, PNGMode: PNGLossless, MinSavingPercent: 99}},
+		{"bytes", pngPath, config.Options{Quality: 80, PNGMode: PNGLossless, MinSavingBytes: 1 << 20}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			outputPath := filepath.Join(testDir, tc.name, "gradient.png")
+			result := ProcessImage(tc.input, filepath.Base(tc.input), outputPath, tc.opts, false)
+			if !result.Success {
+				t.Fatalf("ProcessImage failed: %s", result.Error)
+			}
+			if !result.KeptOriginal || result.BytesSaved != 0 || result.ProcessedSize != result.OriginalSize {
+				t.Fatalf("expected the original to be kept: %+v", result)
+			}
+			if result.SSIM != 1 || result.PSNR != metric.MaxPSNR || result.OutputWidth != 32 {
+				t.Errorf("kept original measured as %+v", result)
+			}
+
+			want, _ := os.ReadFile(tc.input)
+			got, err := os.ReadFile(outputPath)
+			if err != nil {
+				t.Fatalf("output missing: %v", err)
+			}
+			if string(got) != string(want) {
+				t.Error("kept output differs from its source")
+			}
+		})
+	}
+
+	// A resized image is written at its new size however little it saves
+	resizedPath := filepath.Join(testDir, "resized", "gradient.png")
+	resized := ProcessImage(pngPath, filepath.Base(pngPath), resizedPath, config.Options{Quality: 80, PNGMode: PNGLossless, Width: 30, MinSavingPercent: 99}, false)
+	if !resized.Success || resized.KeptOriginal {
+		t.Fatalf("expected the resized image to be written: %+v", resized)
+	}
+	if resized.OutputWidth != 30 || resized.OutputHeight != 30 {
+		t.Errorf("expected 30x30 output, got %dx%d", resized.OutputWidth, resized.OutputHeight)
+	}
+	out, err := decodeImage(resizedPath, FormatPNG)
+	if err != nil {
+		t.Fatalf("output does not decode: %v", err)
+	}
+	if out.Bounds().Dx() != 30 {
+		t.Errorf("expected a 30px wide file, got %d", out.Bounds().Dx())
+	}
+}
+
+func TestProcessImageJPEGEncoding(t *testing.T) {
+	testDir := t.TempDir()
+	jpegPath := filepath.Join(testDir, "photo.jpg")
+	if err := os.WriteFile(jpegPath, testJPEG(t, 64, 48), 0644); err != nil {
+		t.Fatalf("failed to write test JPEG: %v", err)
+	}
+
+	for _, tc := range []struct {
+		opts     config.Options
+		encoding string
+		frame    []byte // start of frame marker
+		sampling byte   // luma sampling factors
+	}{
+		{config.Options{Quality: 80}, JPEGBaseline, []byte{0xff, 0xc0}, 0x22},
+		{config.Options{Quality: 80, JPEGMode: JPEGProgressive}, JPEGProgressive, []byte{0xff, 0xc2}, 0x22},
+		{config.Options{Quality: 80, JPEGMode: JPEGBaseline, JPEGHuffman: HuffmanStandard, Subsampling: Subsampling444}, JPEGBaseline, []byte{0xff, 0xc0}, 0x11},
+	} {
+		outputPath := filepath.Join(testDir, tc.encoding+tc.opts.Subsampling, "photo.jpg")
+		result := ProcessImage(jpegPath, filepath.Base(jpegPath), outputPath, tc.opts, false)
+		if !result.Success {
+			t.Fatalf("ProcessImage failed: %s", result.Error)
+		}
+		if result.Encoding != tc.encoding {
+			t.Errorf("expected encoding %q, got %q", tc.encoding, result.Encoding)
+		}
+
+		data, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("output missing: %v", err)
+		}
+		at := bytes.Index(data, tc.frame)
+		if at < 0 {
+			t.Fatalf("%s: frame header %x not found", tc.encoding, tc.frame)
+		}
+		if sampling := data[at+11]; sampling != tc.sampling {
+			t.Errorf("%s: expected luma sampling %#x, got %#x", tc.encoding, tc.sampling, sampling)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+			t.Errorf("%s: output does not decode: %v", tc.encoding, err)
+		}
+	}
+}
+
+func TestProcessImageJPEGLossless(t *testing.T) {
+	testDir := t.TempDir()
+	jpegPath := filepath.Join(testDir, "photo.jpg")
+	exif := jpegmeta.Segment{Marker: jpegmeta.APP1, Data: testExif(160, 120, 1, nil)}
+	if err := os.WriteFile(jpegPath, testJPEG(t, 160, 120, exif), 0644); err != nil {
+		t.Fatalf("failed to write test JPEG: %v", err)
+	}
+	decode := func(path string) image.Image {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("output missing: %v", err)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s does not decode: %v", path, err)
+		}
+		return img
+	}
+	want := decode(jpegPath)
+
+	// A low quality would show if the pixels were re-encoded, and running
+	// again over the output must not change them either
+	opts := config.Options{Quality: 30, JPEGLossless: true, Metadata: []string{MetadataAll}}
+	input := jpegPath
+	for pass := 1; pass <= 2; pass++ {
+		outputPath := filepath.Join(testDir, fmt.Sprint(pass), "photo.jpg")
+		result := ProcessImage(input, filepath.Base(input), outputPath, opts, false)
+		if !result.Success {
+			t.Fatalf("pass %d: ProcessImage failed: %s", pass, result.Error)
+		}
+		if result.Encoding != JPEGLossless {
+			t.Errorf("pass %d: expected encoding %q, got %q", pass, JPEGLossless, result.Encoding)
+		}
+		if pass == 1 && result.BytesSaved <= 0 {
+			t.Errorf("expected savings, got %d bytes", result.BytesSaved)
+		}
+		got := decode(outputPath)
+		for y := 0; y < 120; y++ {
+			for x := 0; x < 160; x++ {
+				if got.At(x, y) != want.At(x, y) {
+					t.Fatalf("pass %d: pixel (%d,%d) changed from %v to %v", pass, x, y, want.At(x, y), got.At(x, y))
+				}
+			}
+		}
+		if !slices.ContainsFunc(readSegments(t, outputPath), jpegmeta.IsExif) {
+			t.Errorf("pass %d: EXIF data dropped", pass)
+		}
+		input = outputPath
+	}
+
+	// Resizing needs the pixels
+	result := ProcessImage(jpegPath, filepath.Base(jpegPath), filepath.Join(testDir, "resized.jpg"), config.Options{Quality: 80, Width: 40, JPEGLossless: true}, false)
+	if !result.Success || result.Encoding != JPEGBaseline {
+		t.Errorf("expected a baseline re-encode when resizing, got %q (%s)", result.Encoding, result.Error)
+	}
+
+	// A JPEG converted to WebP is re-encoded, and --target-ssim still
+	// searches its quality
+	toWebP := config.Options{Quality: 80, TargetSSIM: 0.97, Conversions: map[string]string{"jpeg": "webp"}}
+	searched := ProcessImage(jpegPath, filepath.Base(jpegPath), filepath.Join(testDir, "searched.webp"), toWebP, false)
+	toWebP.JPEGLossless = true
+	result = ProcessImage(jpegPath, filepath.Base(jpegPath), filepath.Join(testDir, "converted.webp"), toWebP, false)
+	if !result.Success || !searched.Success {
+		t.Fatalf("ProcessImage failed: %s%s", result.Error, searched.Error)
+	}
+	if result.Quality != searched.Quality {
+		t.Errorf("expected --target-ssim quality %d for WebP output, got %d", searched.Quality, result.Quality)
+	}
+}
+
+func TestProcessImageMaxBytes(t *testing.T) {
+	testDir := t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 200, 150))
+	rng := rand.New(rand.NewSource(1))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i/800) + uint8(rng.Intn(40))
+	}
+	jpegData := new(bytes.Buffer)
+	if err := jpeg.Encode(jpegData, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("failed to encode JPEG: %v", err)
+	}
+	jpegPath := filepath.Join(testDir, "photo.jpg")
+	pngPath := filepath.Join(testDir, "photo.png")
+	if err := os.WriteFile(jpegPath, jpegData.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write test JPEG: %v", err)
+	}
+	writePNG(t, pngPath, img)
+
+	for _, tc := range []struct {
+		name    string
+		input   string
+		opts    config.Options
+		budget  int64
+		quality bool // lowered below the configured 95
+		shrunk  bool
+		err     string
+	}{
+		{"lowers quality", jpegPath, config.Options{MaxBytes: 12000}, 12000, true, false, ""},
+		{"per-format budget wins", jpegPath, config.Options{MaxBytes: 500, JPEGMaxBytes: 1 << 20}, 1 << 20, false, false, ""},
+		{"cannot fit", jpegPath, config.Options{MaxBytes: 300}, 300, false, false, "the smallest output is"},
+		{"shrinks", jpegPath, config.Options{MaxBytes: 2000, MaxBytesResize: true}, 2000, true, true, ""},
+		{"lossless cannot fit", pngPath, config.Options{PNGMaxBytes: 2000, PNGMode: PNGLossless}, 2000, false, false, "without shrinking"},
+		{"lossless shrinks", pngPath, config.Options{PNGMaxBytes: 20000, PNGMode: PNGLossless, MaxBytesResize: true}, 20000, false, true, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Quality = 95
+			outputPath := filepath.Join(testDir, strings.ReplaceAll(tc.name, " ", "-"), filepath.Base(tc.input))
+			result := ProcessImage(tc.input, filepath.Base(tc.input), outputPath, tc.opts, false)
+			if tc.err != "" {
+				if result.Success || !strings.Contains(result.Error, tc.err) {
+					t.Fatalf("expected an error containing %q, got %q", tc.err, result.Error)
+				}
+				return
+			}
+			if !result.Success {
+				t.Fatalf("ProcessImage failed: %s", result.Error)
+			}
+			if result.ProcessedSize > tc.budget {
+				t.Errorf("output is %d bytes, over the %d byte budget", result.ProcessedSize, tc.budget)
+			}
+			if lowered := result.Quality < 95; tc.opts.PNGMode == "" && lowered != tc.quality {
+				t.Errorf("unexpected quality %d", result.Quality)
+			}
+			if shrunk := result.FittedWidth > 0; shrunk != tc.shrunk {
+				t.Fatalf("unexpected fitted width %d", result.FittedWidth)
+			}
+			if !tc.shrunk {
+				return
+			}
+			f, err := os.Open(outputPath)
+			if err != nil {
+				t.Fatalf("output missing: %v", err)
+			}
+			defer f.Close()
+			cfg, _, err := image.DecodeConfig(f)
+			if err != nil {
+				t.Fatalf("output does not decode: %v", err)
+			}
+			if cfg.Width != result.FittedWidth || cfg.Width >= 200 {
+				t.Errorf("expected width %d, got %d", result.FittedWidth, cfg.Width)
+			}
+		})
+	}
+}
+
+func TestProcessImageTargetSSIM(t *testing.T) {
+	testDir := t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+	smooth := image.NewRGBA(image.Rect(0, 0, 160, 120))
+	detailed := image.NewRGBA(image.Rect(0, 0, 160, 120))
+	for y := 0; y < 120; y++ {
+		for x := 0; x < 160; x++ {
+			smooth.Set(x, y, color.RGBA{uint8(x), uint8(y), 90, 255})
+			v := uint8(rng.Intn(256))
+			detailed.Set(x, y, color.RGBA{v, v / 2, uint8(x), 255})
+		}
+	}
+
+	qualities := map[string]int{}
+	for name, img := range map[string]image.Image{"smooth": smooth, "detailed": detailed} {
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 100}); err != nil {
+			t.Fatalf("failed to encode JPEG: %v", err)
+		}
+		inputPath := filepath.Join(testDir, name+".jpg")
+		if err := os.WriteFile(inputPath, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("failed to write test JPEG: %v", err)
+		}
+		source, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("source does not decode: %v", err)
+		}
+
+		outputPath := filepath.Join(testDir, "out", name+".jpg")
+		result := ProcessImage(inputPath, filepath.Base(inputPath), outputPath, config.Options{Quality: 80, TargetSSIM: 0.97}, false)
+		if !result.Success {
+			t.Fatalf("%s: ProcessImage failed: %s", name, result.Error)
+		}
+		if result.Quality < 1 || result.Quality > 100 {
+			t.Fatalf("%s: unexpected quality %d", name, result.Quality)
+		}
+		qualities[name] = result.Quality
+
+		data, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("output missing: %v", err)
+		}
+		output, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: output does not decode: %v", name, err)
+		}
+		if score, err := metric.SSIM(source, output); err != nil || score < 0.97 {
+			t.Errorf("%s: SSIM %v at quality %d (%v)", name, score, result.Quality, err)
+		}
+	}
+	if qualities["smooth"] >= qualities["detailed"] {
+		t.Errorf("smooth image got quality %d, detailed one %d", qualities["smooth"], qualities["detailed"])
+	}
+}
+
+// Offsets within the TIFF data written by testExif
+const (
+	testExifWidth      = 70
+	testExifHeight     = 82
+	testExifThumbStart = 100
+	testExifThumbLen   = 112
+)
+
+// testExif returns a little-endian EXIF payload: an image directory with a
+// copyright, the orientation and the EXIF directory pointer, an EXIF
+// directory with the pixel dimensions, then a thumbnail directory and the
+// thumbnail itself
+func testExif(width, height uint32, orientation uint16, thumb []byte) []byte {
+	le := binary.LittleEndian
+	tiff := make([]byte, 120)
+	copy(tiff, "II*\x00")
+	le.PutUint32(tiff[4:], 8)
+	entry := func(at int, tag, typ uint16, value uint32) {
+		le.PutUint16(tiff[at:], tag)
+		le.PutUint16(tiff[at+2:], typ)
+		le.PutUint32(tiff[at+4:], 1)
+		le.PutUint32(tiff[at+8:], value)
+	}
+	le.PutUint16(tiff[8:], 3)
+	entry(10, 0x8298, 2, 50)
+	le.PutUint32(tiff[14:], 9)
+	entry(22, 0x0112, 3, uint32(orientation))
+	entry(34, 0x8769, 4, 60)
+	le.PutUint32(tiff[46:], 90)
+	copy(tiff[50:], "Jane Doe\x00")
+	le.PutUint16(tiff[60:], 2)
+	entry(62, 0xa002, 4, width)
+	entry(74, 0xa003, 4, height)
+	le.PutUint16(tiff[90:], 2)
+	entry(92, 0x0201, 4, 120)
+	entry(104, 0x0202, 4, uint32(len(thumb)))
+	return append(append([]byte("Exif\x00\x00"), tiff...), thumb...)
+}
+
+// writePNG encodes img as a PNG file at path
+func writePNG(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create test PNG: %v", err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatalf("failed to encode test PNG: %v", err)
+	}
+}
+
+// testJPEG encodes a gradient JPEG and inserts the given segments
+func testJPEG(t *testing.T, width, height int, segments ...jpegmeta.Segment) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 90, 255})
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("failed to encode JPEG: %v", err)
+	}
+	data, err := jpegmeta.Insert(buf.Bytes(), segments)
+	if err != nil {
+		t.Fatalf("failed to add metadata: %v", err)
+	}
+	return data
+}
+
+// readSegments returns the metadata segments of a JPEG file
+func readSegments(t *testing.T, path string) []jpegmeta.Segment {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("output missing: %v", err)
+	}
+	segments, err := jpegmeta.Read(data)
+	if err != nil {
+		t.Fatalf("output segments unreadable: %v", err)
+	}
+	return segments
+}
+
+func TestProcessImageQualityMetrics(t *testing.T) {
+	testDir := t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 160, 120))
+	for y := 0; y < 120; y++ {
+		for x := 0; x < 160; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y * 2), uint8(x ^ y), 255})
+		}
+	}
+	inputPath := filepath.Join(testDir, "pattern.png")
+	writePNG(t, inputPath, img)
+
+	// A lossy, resized conversion and its WebP copy both lose a little
+	opts := config.Options{Quality: 80, Width: 40, WebP: true, Conversions: map[string]string{"png": "jpeg"}}
+	result := ProcessImage(inputPath, filepath.Base(inputPath), filepath.Join(testDir, "lossy", "pattern.jpg"), opts, false)
+	if !result.Success || len(result.Variants) != 1 {
+		t.Fatalf("ProcessImage failed: %+v", result)
+	}
+	for _, r := range []Result{result, result.Variants[0]} {
+		if r.SourceWidth != 160 || r.SourceHeight != 120 || r.OutputWidth != 40 || r.OutputHeight != 30 {
+			t.Errorf("%s: dimensions %dx%d -> %dx%d", r.FileType, r.SourceWidth, r.SourceHeight, r.OutputWidth, r.OutputHeight)
+		}
+		if r.Quality != 80 {
+			t.Errorf("%s: quality %d, want 80", r.FileType, r.Quality)
+		}
+		if r.SSIM <= 0.5 || r.SSIM >= 1 || r.PSNR <= 20 || r.PSNR >= metric.MaxPSNR {
+			t.Errorf("%s: SSIM %v, PSNR %v", r.FileType, r.SSIM, r.PSNR)
+		}
+	}
+
+	// WebP is measured through our own decoder, whose colors match the
+	// encoder's
+	smooth := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			smooth.Set(x, y, color.RGBA{uint8(60 + 2*x), uint8(40 + 2*y), uint8(200 - x - y), 255})
+		}
+	}
+	data, _, err := encodeWebP(smooth, WebPLossy, 90)
+	if err != nil {
+		t.Fatalf("failed to encode WebP: %v", err)
+	}
+	decoded, err := decodeData(data, FormatWebP)
+	if err != nil {
+		t.Fatalf("WebP does not decode: %v", err)
+	}
+	if psnr, _ := metric.PSNR(smooth, decoded); psnr < 40 {
+		t.Errorf("WebP at quality 90 measured at PSNR %v", psnr)
+	}
+
+	// Lossless output reproduces every pixel
+	opts = config.Options{Quality: 80, PNGMode: PNGLossless}
+	result = ProcessImage(inputPath, filepath.Base(inputPath), filepath.Join(testDir, "lossless", "pattern.png"), opts, false)
+	if !result.Success {
+		t.Fatalf("ProcessImage failed: %s", result.Error)
+	}
+	if result.SSIM != 1 || result.PSNR != metric.MaxPSNR || result.Quality != 0 {
+		t.Errorf("lossless: SSIM %v, PSNR %v, quality %d", result.SSIM, result.PSNR, result.Quality)
+	}
+	if result.OutputWidth != 160 || result.OutputHeight != 120 {
+		t.Errorf("lossless: output %dx%d", result.OutputWidth, result.OutputHeight)
+	}
+}
+
+func TestResize(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for _, tc := range []struct {
+		name string
+		opts config.Options
+		w, h int
+	}{
+		{"none", config.Options{}, 400, 200},
+		{"width", config.Options{Width: 100}, 100, 50},
+		{"height", config.Options{Height: 50}, 100, 50},
+		{"fill", config.Options{Width: 100, Height: 100}, 100, 100},
+		{"scale", config.Options{Scale: 25}, 100, 50},
+		{"bounds never enlarge", config.Options{MaxWidth: 1000}, 400, 200},
+		{"bounds", config.Options{MaxWidth: 300, MaxHeight: 50}, 100, 50},
+		{"bounds after width", config.Options{Width: 800, MaxHeight: 100}, 200, 100},
+		{"megapixels", config.Options{MaxMegapixels: 0.02}, 200, 100},
+		{"upscale", config.Options{Width: 800}, 800, 400},
+		{"no upscale", config.Options{Width: 800, NoUpscale: true}, 400, 200},
+		{"no upscale crops", config.Options{Width: 800, Height: 100, NoUpscale: true}, 400, 100},
+		{"filter and sharpen", config.Options{Width: 50, Resample: ResampleNearest, Sharpen: 1}, 50, 25},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, _, resized := resize(img, tc.opts, nil)
+			if size := out.Bounds().Size(); size.X != tc.w || size.Y != tc.h {
+				t.Errorf("got %dx%d, want %dx%d", size.X, size.Y, tc.w, tc.h)
+			}
+			if want := tc.w != 400 || tc.h != 200; resized != want {
+				t.Errorf("resized = %t, want %t", resized, want)
+			}
+		})
+	}
+}
+
+func TestProcessImageSizes(t *testing.T) {
+	testDir := t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+	inputPath := filepath.Join(testDir, "wide.png")
+	writePNG(t, inputPath, img)
+
+	// Widths at or above the source's are skipped
+	outputPath := filepath.Join(testDir, "out", "wide.png")
+	opts := config.Options{Quality: 80, WebP: true, Sizes: []int{100, 200, 400, 800}}
+	result := ProcessImage(inputPath, filepath.Base(inputPath), outputPath, opts, false)
+	if !result.Success {
+		t.Fatalf("ProcessImage failed: %s", result.Error)
+	}
+
+	want := map[string]int{"wide.webp": 400, "wide-100.png": 100, "wide-100.webp": 100, "wide-200.png": 200, "wide-200.webp": 200}
+	if len(result.Variants) != len(want) {
+		t.Fatalf("expected %d variants, got %+v", len(want), result.Variants)
+	}
+	for _, variant := range result.Variants {
+		name := filepath.Base(variant.OutputPath)
+		width, ok := want[name]
+		if !ok || !variant.Success {
+			t.Errorf("unexpected variant %s: %+v", name, variant)
+			continue
+		}
+		if variant.OutputWidth != width || variant.OutputHeight != width/2 || variant.SourceWidth != 400 {
+			t.Errorf("%s: %dx%d from %d wide", name, variant.OutputWidth, variant.OutputHeight, variant.SourceWidth)
+		}
+		data, err := os.ReadFile(variant.OutputPath)
+		if err != nil {
+			t.Fatalf("%s missing: %v", name, err)
+		}
+		img, err := decodeData(data, FormatFromExt(filepath.Ext(name)))
+		if err != nil || img.Bounds().Dx() != width {
+			t.Errorf("%s does not decode at width %d: %v", name, width, err)
+		}
+	}
+
+	var derived []string
+	for _, path := range DerivedPaths(outputPath, opts) {
+		derived = append(derived, filepath.Base(path))
+	}
+	if want := []string{"wide.webp", "wide-100.png", "wide-100.webp", "wide-200.png", "wide-200.webp", "wide-400.png", "wide-400.webp", "wide-800.png", "wide-800.webp"}; !slices.Equal(derived, want) {
+		t.Errorf("derived paths %v, want %v", derived, want)
+	}
+
+	// Filling a square box, the copies are scaled from the square crop
+	opts = config.Options{Quality: 80, Width: 100, Height: 100, Sizes: []int{50, 150, 250}}
+	result = ProcessImage(inputPath, filepath.Base(inputPath), filepath.Join(testDir, "square", "wide.png"), opts, false)
+	if !result.Success || len(result.Variants) != 2 {
+		t.Fatalf("expected 2 variants, got %+v (%s)", result.Variants, result.Error)
+	}
+	for _, variant := range result.Variants {
+		if variant.OutputWidth != variant.OutputHeight {
+			t.Errorf("%s: %dx%d, want a square", filepath.Base(variant.OutputPath), variant.OutputWidth, variant.OutputHeight)
+		}
+	}
+}
+
+func TestCropWindow(t *testing.T) {
+	// Noise on the right, a skin-colored patch on the left, flat gray
+	// between them
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 300; x++ {
+			c := color.RGBA{128, 128, 128, 255}
+			switch {
+			case x >= 220:
+				v := uint8(rng.Intn(256))
+				c = color.RGBA{v, v, v, 255}
+			case x >= 20 && x < 80 && y >= 20 && y < 80:
+				c = color.RGBA{224, 172, 138, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	for _, tc := range []struct {
+		strategy string
+		focal    *config.FocalPoint
+		lo, hi   int
+	}{
+		{CropCenter, nil, 100, 100},
+		{CropEdges, nil, 170, 200},
+		{CropEntropy, nil, 170, 200},
+		{CropSkin, nil, 0, 20},
+		{CropSkin, &config.FocalPoint{X: 0.9, Y: 0.5}, 200, 200},
+		{CropCenter, &config.FocalPoint{X: 0.4, Y: 0.5}, 70, 70},
+	} {
+		r := cropWindow(img, 100, 100, tc.strategy, tc.focal)
+		if r.Dx() != 100 || r.Dy() != 100 || r.Min.Y != 0 || r.Min.X < tc.lo || r.Min.X > tc.hi {
+			t.Errorf("%s (focal %v): window %v, want x in [%d, %d]", tc.strategy, tc.focal, r, tc.lo, tc.hi)
+		}
+	}
+
+	// The crop is reported in source pixels
+	_, crop, _ := resize(image.NewRGBA(image.Rect(0, 0, 600, 200)), config.Options{Width: 150, Height: 150}, nil)
+	if crop != image.Rect(200, 0, 400, 200) {
+		t.Errorf("crop %v, want (200,0)-(400,200)", crop)
+	}
+
+	// Focal points are looked up by path relative to the input directory
+	testDir := t.TempDir()
+	sidecar := filepath.Join(testDir, "focal.json")
+	if err := os.WriteFile(sidecar, []byte(`{"shop/shoe.jpg": {"x": 0.25, "y": 0.75}}`), 0644); err != nil {
+		t.Fatalf("failed to write sidecar: %v", err)
+	}
+	points, err := LoadFocalPoints(sidecar)
+	if err != nil {
+		t.Fatalf("LoadFocalPoints failed: %v", err)
+	}
+	opts := config.Options{FocalPoints: points}
+	if p := focalPoint(filepath.Join("shop", "shoe.jpg"), opts); p == nil || *p != (config.FocalPoint{X: 0.25, Y: 0.75}) {
+		t.Errorf("focal point of shop/shoe.jpg: %v", p)
+	}
+	if p := focalPoint("shoe.jpg", opts); p != nil {
+		t.Errorf("unexpected focal point for shoe.jpg: %v", p)
+	}
+	if err := os.WriteFile(sidecar, []byte(`{"a.jpg": {"x": 1.5, "y": 0}}`), 0644); err != nil {
+		t.Fatalf("failed to write sidecar: %v", err)
+	}
+	if _, err := LoadFocalPoints(sidecar); err == nil {
+		t.Error("expected an error for a focal point outside the image")
+	}
+}
+
+func TestProcessImageWatermark(t *testing.T) {
+	testDir := t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{128, 128, 128, 255}), image.Point{}, draw.Src)
+	for _, rel := range []string{"gallery/a.png", "gallery/private/b.png", "shop/c.png"} {
+		inputPath := filepath.Join(testDir, "in", rel)
+		if err := os.MkdirAll(filepath.Dir(inputPath), 0755); err != nil {
+			t.Fatalf("failed to create input directory: %v", err)
+		}
+		writePNG(t, inputPath, img)
+	}
+
+	mark := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(mark, mark.Bounds(), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	opts := config.Options{
+		Quality: 80,
+		PNGMode: PNGLossless,
+		Watermark: config.Watermark{
+			Image:    mark,
+			Position: PositionBottomRight,
+			Scale:    10,
+			Margin:   5,
+			Opacity:  1,
+			Include:  []string{"gallery"},
+			Exclude:  []string{"private"},
+		},
+	}
+
+	for rel, want := range map[string]bool{"gallery/a.png": true, "gallery/private/b.png": false, "shop/c.png": false} {
+		outputPath := filepath.Join(testDir, "out", rel)
+		result := ProcessImage(filepath.Join(testDir, "in", rel), rel, outputPath, opts, false)
+		if !result.Success || result.Watermarked != want {
+			t.Fatalf("%s: watermarked = %t, want %t (%s)", rel, result.Watermarked, want, result.Error)
+		}
+		data, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("%s: output missing: %v", rel, err)
+		}
+		out, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: output does not decode: %v", rel, err)
+		}
+
+		// A 20px mark, 10px from the bottom right corner
+		r, _, _, _ := out.At(180, 80).RGBA()
+		if marked := r>>8 == 255; marked != want {
+			t.Errorf("%s: pixel under the mark has red %d", rel, r>>8)
+		}
+		if r, _, _, _ := out.At(195, 95).RGBA(); r>>8 != 128 {
+			t.Errorf("%s: margin has red %d", rel, r>>8)
+		}
+	}
+
+	if _, err := LoadWatermark(filepath.Join(testDir, "logo.svg")); err == nil {
+		t.Error("expected an error for an SVG watermark")
+	}
+}
+
+func TestProcessImageKeepExif(t *testing.T) {
+	testDir := t.TempDir()
+	jpegPath := filepath.Join(testDir, "photo.jpg")
+
+	segments := []jpegmeta.Segment{
+		{Marker: jpegmeta.APP1, Data: testExif(400, 300, 1, testJPEG(t, 160, 120))},
+		{Marker: jpegmeta.APP2, Data: []byte("ICC_PROFILE\x00\x01\x01profile")},
+		{Marker: jpegmeta.APP13, Data: photoshopIPTC("")},
+		{Marker: 0xec, Data: []byte("Ducky")},
+	}
+	if err := os.WriteFile(jpegPath, testJPEG(t, 400, 300, segments...), 0644); err != nil {
+		t.Fatalf("failed to write test JPEG: %v", err)
+	}
+
+	// By default only the ICC profile, which --icc governs, is kept
+	stripped := filepath.Join(testDir, "stripped.jpg")
+	if result := ProcessImage(jpegPath, filepath.Base(jpegPath), stripped, config.Options{Quality: 80}, false); !result.Success {
+		t.Fatalf("ProcessImage failed: %s", result.Error)
+	}
+	if got := readSegments(t, stripped); len(got) != 1 || got[0].Marker != jpegmeta.APP2 {
+		t.Errorf("expected only the ICC profile by default, got %d segments", len(got))
+	}
+
+	kept := filepath.Join(testDir, "kept.jpg")
+	result := ProcessImage(jpegPath, filepath.Base(jpegPath), kept, config.Options{Quality: 80, Width: 200, Metadata: []string{MetadataAll}}, false)
+	if !result.Success {
+		t.Fatalf("ProcessImage failed: %s", result.Error)
+	}
+	got := readSegments(t, kept)
+	if len(got) != 3 {
+		t.Fatalf("expected APP1, APP2 and APP13, got %d segments", len(got))
+	}
+	for i, marker := range []byte{jpegmeta.APP1, jpegmeta.APP2, jpegmeta.APP13} {
+		if got[i].Marker != marker {
+			t.Errorf("segment %d has marker %#x, want %#x", i, got[i].Marker, marker)
+		}
+	}
+	if !bytes.Equal(got[1].Data, segments[1].Data) || !bytes.Equal(got[2].Data, segments[2].Data) {
+		t.Error("ICC or IPTC segment changed")
+	}
+
+	le := binary.LittleEndian
+	exif := got[0].Data[6:]
+	if !bytes.Contains(exif, []byte("Jane Doe")) {
+		t.Error("copyright lost")
+	}
+	if w, h := le.Uint32(exif[testExifWidth:]), le.Uint32(exif[testExifHeight:]); w != 200 || h != 150 {
+		t.Errorf("expected EXIF dimensions 200x150, got %dx%d", w, h)
+	}
+	offset, length := le.Uint32(exif[testExifThumbStart:]), le.Uint32(exif[testExifThumbLen:])
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(exif[offset : offset+length]))
+	if err != nil {
+		t.Fatalf("thumbnail does not decode: %v", err)
+	}
+	if cfg.Width != 160 || cfg.Height != 120 {
+		t.Errorf("unexpected thumbnail size %dx%d", cfg.Width, cfg.Height)
+	}
+}
+
+// privateExif returns a little-endian EXIF payload with a make and an
+// artist, a body serial number in the EXIF directory and a GPS directory
+// with a latitude
+func TestProcessImageLocationChunks(t *testing.T) {
+	testDir := t.TempDir()
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 8), uint8(y * 8), 64, 255})
+		}
+	}
+	var plain bytes.Buffer
+	if err := png.Encode(&plain, img); err != nil {
+		t.Fatalf("failed to encode test PNG: %v", err)
+	}
+	var lossless bytes.Buffer
+	if err := bitwebp.EncodeLossless(&lossless, img); err != nil {
+		t.Fatalf("failed to encode test WebP: %v", err)
+	}
+
+	packet := "<x:xmpmeta xmlns:x=\"adobe:ns:meta/\"><rdf:Description exif:GPSLatitude=\"10,1N\" exif:GPSLongitude=\"20,1E\"/></x:xmpmeta>"
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte(fmt.Sprintf("\nexif\n%8d\n%s\n", len(privateExif()), hex.EncodeToString(privateExif()))))
+	zw.Close()
+
+	inputs := map[string][]byte{
+		"xmp.png":     insertPNGChunk(plain.Bytes(), "iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"+packet)),
+		"rawexif.png": insertPNGChunk(plain.Bytes(), "zTXt", append([]byte("Raw profile type exif\x00\x00"), compressed.Bytes()...)),
+		"xmp.webp":    webPWithXMP(t, lossless.Bytes(), 32, 32, []byte(packet)),
+		"xmp.gif":     gifWithXMP(t, img, []byte(packet)),
+	}
+	for name, data := range inputs {
+		t.Run(name, func(t *testing.T) {
+			inputPath := filepath.Join(testDir, name)
+			if err := os.WriteFile(inputPath, data, 0644); err != nil {
+				t.Fatalf("failed to write %s: %v", name, err)
+			}
+
+			// Re-encoding saves nothing worth keeping, yet the source must
+			// not be copied with its location
+			outputPath := filepath.Join(testDir, "out", name)
+			opts := config.Options{Quality: 80, PNGMode: PNGLossless, WebPMode: WebPLossless, MinSavingBytes: 1 << 20}
+			result := ProcessImage(inputPath, filepath.Base(inputPath), outputPath, opts, false)
+			if !result.Success {
+				t.Fatalf("ProcessImage failed: %s", result.Error)
+			}
+			if !result.HasLocation {
+				t.Error("expected the location to be reported")
+			}
+			if result.KeptOriginal {
+				t.Error("expected the source to be re-encoded, not kept")
+			}
+			out, err := os.ReadFile(outputPath)
+			if err != nil {
+				t.Fatalf("output missing: %v", err)
+			}
+			if hasLocation(out, FormatFromExt(filepath.Ext(name))) || bytes.Contains(out, []byte("GPS")) {
+				t.Error("output still holds GPS coordinates")
+			}
+		})
+	}
+}
+
+// insertPNGChunk returns a PNG file with a chunk added after IHDR
+func insertPNGChunk(data []byte, name string, body []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	chunk = append(append(chunk, name...), body...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	ihdrEnd := 8 + 12 + int(binary.BigEndian.Uint32(data[8:]))
+	return append(append(append([]byte(nil), data[:ihdrEnd]...), chunk...), data[ihdrEnd:]...)
+}
+
+// webPWithXMP returns a simple WebP file turned into an extended one with
+// an XMP chunk
+func webPWithXMP(t *testing.T, data []byte, width, height int, packet []byte) []byte {
+	t.Helper()
+	if string(data[12:16]) != "VP8L" {
+		t.Fatalf("expected a lossless WebP, got %q", data[12:16])
+	}
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x04 // XMP
+	vp8x[4], vp8x[5], vp8x[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+	vp8x[7], vp8x[8], vp8x[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+
+	chunk := func(name string, body []byte) []byte {
+		out := binary.LittleEndian.AppendUint32([]byte(name), uint32(len(body)))
+		out = append(out, body...)
+		if len(body)%2 == 1 {
+			out = append(out, 0)
+		}
+		return out
+	}
+	body := append([]byte("WEBP"), chunk("VP8X", vp8x)...)
+	body = append(body, data[12:]...)
+	body = append(body, chunk("XMP ", packet)...)
+	return append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body))), body...)
+}
+
+// gifWithXMP returns img as a GIF file with an XMP application extension
+// before the image
+func gifWithXMP(t *testing.T, img image.Image, packet []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("failed to encode test GIF: %v", err)
+	}
+	data := buf.Bytes()
+	at := 13
+	if data[10]&0x80 != 0 {
+		at += 3 << (data[10]&7 + 1)
+	}
+
+	// The magic trailer lets readers skip the raw packet as sub-blocks
+	ext := append([]byte("\x21\xff\x0bXMP DataXMP"), packet...)
+	ext = append(ext, 1)
+	for b := 0xff; b >= 0; b-- {
+		ext = append(ext, byte(b))
+	}
+	ext = append(ext, 0)
+	return slices.Concat(data[:at], ext, data[at:])
+}
+
+// photoshopIPTC returns an APP13 payload with an IPTC record and, unless
+// xmp is empty, an XMP resource
+func photoshopIPTC(xmp string) []byte {
+	resource := func(id uint16, data string) []byte {
+		block := binary.BigEndian.AppendUint16([]byte("8BIM"), id)
+		block = binary.BigEndian.AppendUint32(append(block, 0, 0), uint32(len(data)))
+		if len(data)%2 != 0 {
+			data += "\x00"
+		}
+		return append(block, data...)
+	}
+	payload := append([]byte("Photoshop 3.0\x00"), resource(0x0404, "\x1c\x02\x74\x00\x04iptc")...)
+	if xmp != "" {
+		payload = append(payload, resource(0x0424, xmp)...)
+	}
+	return payload
+}
+
+func privateExif() []byte {
+	le := binary.LittleEndian
+	tiff := make([]byte, 162)
+	copy(tiff, "II*\x00")
+	le.PutUint32(tiff[4:], 8)
+	entry := func(at int, tag, typ uint16, count, value uint32) {
+		le.PutUint16(tiff[at:], tag)
+		le.PutUint16(tiff[at+2:], typ)
+		le.PutUint32(tiff[at+4:], count)
+		le.PutUint32(tiff[at+8:], value)
+	}
+	le.PutUint16(tiff[8:], 4)
+	entry(10, 0x010f, 2, 5, 62)
+	entry(22, 0x013b, 2, 9, 68)
+	entry(34, 0x8769, 4, 1, 78)
+	entry(46, 0x8825, 4, 1, 108)
+	copy(tiff[62:], "Acme\x00")
+	copy(tiff[68:], "Jane Doe\x00")
+	le.PutUint16(tiff[78:], 1)
+	entry(80, 0xa431, 2, 11, 96)
+	copy(tiff[96:], "SN-1234567\x00")
+	le.PutUint16(tiff[108:], 2)
+	entry(110, 0x0001, 2, 2, 'N')
+	entry(122, 0x0002, 5, 3, 138)
+	for i := 0; i < 3; i++ {
+		le.PutUint32(tiff[138+8*i:], uint32(10+i))
+		le.PutUint32(tiff[142+8*i:], 1)
+	}
+	return append([]byte("Exif\x00\x00"), tiff...)
+}
+
+func TestProcessImageMetadataPolicy(t *testing.T) {
+	testDir := t.TempDir()
+	jpegPath := filepath.Join(testDir, "photo.jpg")
+
+	xmp := "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n" +
+		"<rdf:Description exif:GPSLatitude=\"10,1N\" dc:format=\"image/jpeg\">\n" +
+		"<exif:GPSLongitude>20,1E</exif:GPSLongitude>\n" +
+		"</rdf:Description>\n</x:xmpmeta>"
+	segments := []jpegmeta.Segment{
+		{Marker: jpegmeta.APP1, Data: privateExif()},
+		{Marker: jpegmeta.APP1, Data: []byte(xmp)},
+		{Marker: jpegmeta.APP13, Data: photoshopIPTC(`<rdf:Description exif:GPSLatitude="10,1N"/>`)},
+	}
+	if err := os.WriteFile(jpegPath, testJPEG(t, 64, 48, segments...), 0644); err != nil {
+		t.Fatalf("failed to write test JPEG: %v", err)
+	}
+
+	for _, tc := range []struct {
+		metadata  []string
+		minSaving int64
+		kept      []string
+		removed   []string
+	}{
+		{[]string{MetadataNone}, 0, nil, []string{"Acme", "Jane Doe", "iptc", "xmpmeta"}},
+		{[]string{MetadataCopyright}, 0, []string{"Jane Doe", "iptc"}, []string{"Acme", "xmpmeta"}},
+		{[]string{MetadataCamera}, 0, []string{"Acme"}, []string{"Jane Doe", "iptc", "xmpmeta"}},
+		{[]string{MetadataAll}, 0, []string{"Acme", "Jane Doe", "iptc", "dc:format"}, nil},
+		{[]string{MetadataAll}, 1 << 20, []string{"Acme", "Jane Doe", "iptc", "dc:format"}, nil},
+		{[]string{MetadataNone}, 1 << 20, nil, []string{"Acme", "Jane Doe", "iptc", "xmpmeta"}},
+	} {
+		name := fmt.Sprintf("%s-%d", strings.Join(tc.metadata, ","), tc.minSaving)
+		t.Run(name, func(t *testing.T) {
+			outputPath := filepath.Join(testDir, name, "photo.jpg")
+			opts := config.Options{Quality: 80, Metadata: tc.metadata, MinSavingBytes: tc.minSaving}
+			result := ProcessImage(jpegPath, filepath.Base(jpegPath), outputPath, opts, false)
+			if !result.Success {
+				t.Fatalf("ProcessImage failed: %s", result.Error)
+			}
+			if !result.HasLocation {
+				t.Error("expected the location to be reported")
+			}
+			if result.KeptOriginal != (tc.minSaving > 0) {
+				t.Errorf("unexpected KeptOriginal %t", result.KeptOriginal)
+			}
+
+			data, err := os.ReadFile(outputPath)
+			if err != nil {
+				t.Fatalf("output missing: %v", err)
+			}
+			if hasLocation(data, FormatJPEG) {
+				t.Error("output still holds GPS coordinates")
+			}
+			for _, private := range []string{"SN-1234567", "GPSLatitude", "GPSLongitude"} {
+				if bytes.Contains(data, []byte(private)) {
+					t.Errorf("output still holds %s", private)
+				}
+			}
+			for _, want := range tc.kept {
+				if !bytes.Contains(data, []byte(want)) {
+					t.Errorf("expected %q kept", want)
+				}
+			}
+			for _, unwanted := range tc.removed {
+				if bytes.Contains(data, []byte(unwanted)) {
+					t.Errorf("expected %q removed", unwanted)
+				}
+			}
+		})
+	}
+
+	if err := ValidateMetadata([]string{MetadataAll, MetadataICC}); err == nil {
+		t.Error("expected all combined with a group to be rejected")
+	}
+	if err := ValidateMetadata([]string{"gps"}); err == nil {
+		t.Error("expected an unknown group to be rejected")
+	}
+}
+
+func TestProcessImageAutoOrient(t *testing.T) {
+	testDir := t.TempDir()
+	jpegPath := filepath.Join(testDir, "phone.jpg")
+
+	// Stored sideways: red on the left, blue on the right. Orientation 6
+	// asks for a quarter turn clockwise, which puts red on top.
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	draw.Draw(img, image.Rect(0, 0, 32, 32), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(32, 0, 64, 32), image.NewUniform(color.RGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("failed to encode JPEG: %v", err)
+	}
+	exif := jpegmeta.Segment{Marker: jpegmeta.APP1, Data: testExif(64, 32, 6, testJPEG(t, 160, 80))}
+	data, err := jpegmeta.Insert(buf.Bytes(), []jpegmeta.Segment{exif})
+	if err != nil {
+		t.Fatalf("failed to add metadata: %v", err)
+	}
+	if err := os.WriteFile(jpegPath, data, 0644); err != nil {
+		t.Fatalf("failed to write test JPEG: %v", err)
+	}
+
+	for _, keepExif := range []bool{false, true} {
+		outputPath := filepath.Join(testDir, fmt.Sprintf("keep-%t", keepExif), "phone.jpg")
+		opts := config.Options{Quality: 90, AutoOrient: true}
+		if keepExif {
+			opts.Metadata = []string{MetadataAll}
+		}
+		if result := ProcessImage(jpegPath, filepath.Base(jpegPath), outputPath, opts, false); !result.Success {
+			t.Fatalf("ProcessImage failed: %s", result.Error)
+		}
+
+		out, err := decodeImage(outputPath, FormatJPEG)
+		if err != nil {
+			t.Fatalf("output does not decode: %v", err)
+		}
+		if out.Bounds().Dx() != 32 || out.Bounds().Dy() != 64 {
+			t.Fatalf("expected a 32x64 upright image, got %v", out.Bounds())
+		}
+		if r, _, b, _ := out.At(16, 8).RGBA(); r>>8 < 200 || b>>8 > 50 {
+			t.Errorf("expected red on top, got %v", out.At(16, 8))
+		}
+		if r, _, b, _ := out.At(16, 56).RGBA(); b>>8 < 200 || r>>8 > 50 {
+			t.Errorf("expected blue at the bottom, got %v", out.At(16, 56))
+		}
+
+		if !keepExif {
+			continue
+		}
+		segments := readSegments(t, outputPath)
+		if len(segments) != 1 {
+			t.Fatalf("expected the EXIF segment, got %d segments", len(segments))
+		}
+		parsed, err := jpegmeta.ParseExif(segments[0].Data)
+		if err != nil {
+			t.Fatalf("EXIF does not parse: %v", err)
+		}
+		if parsed.Orientation() != 1 {
+			t.Errorf("expected orientation reset to 1, got %d", parsed.Orientation())
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(parsed.Thumbnail()))
+		if err != nil {
+			t.Fatalf("thumbnail does not decode: %v", err)
+		}
+		if cfg.Width >= cfg.Height {
+			t.Errorf("expected an upright thumbnail, got %dx%d", cfg.Width, cfg.Height)
+		}
+	}
+}
+
+// adobeRGBProfile returns a minimal Adobe RGB (1998) matrix/TRC profile
+func adobeRGBProfile() []byte {
+	colorants := [3][3]float64{{0.6097, 0.2053, 0.1492}, {0.3111, 0.6257, 0.0632}, {0.0195, 0.0609, 0.7446}}
+	desc := append([]byte("desc\x00\x00\x00\x00\x00\x00\x00\x11"), "Adobe RGB (1998)\x00"...)
+	trc := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33") // gamma 563/256
+
+	tags := [][]byte{desc, nil, nil, nil, trc}
+	for i := range 3 {
+		xyz := []byte("XYZ \x00\x00\x00\x00")
+		for row := range 3 {
+			xyz = binary.BigEndian.AppendUint32(xyz, uint32(int32(math.Round(colorants[row][i]*65536))))
+		}
+		tags[1+i] = xyz
+	}
+
+	// r/g/bTRC share one curve
+	names := []string{"desc", "rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"}
+	data := make([]byte, 132+12*len(names))
+	copy(data[16:], "RGB XYZ ")
+	copy(data[36:], "acsp")
+	binary.BigEndian.PutUint32(data[128:], uint32(len(names)))
+	offsets := make([]int, len(tags))
+	for i, tag := range tags {
+		offsets[i] = len(data)
+		data = append(data, tag...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	for i, name := range names {
+		tag := min(i, len(tags)-1)
+		entry := data[132+12*i:]
+		copy(entry, name)
+		binary.BigEndian.PutUint32(entry[4:], uint32(offsets[tag]))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tags[tag])))
+	}
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+	return data
+}
+
+func TestProcessImageICC(t *testing.T) {
+	testDir := t.TempDir()
+	profile := adobeRGBProfile()
+
+	// Adobe RGB (100, 160, 60) is sRGB (53, 161, 46)
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	draw.Draw(img, img.Rect, image.NewUniform(color.NRGBA{100, 160, 60, 255}), image.Point{}, draw.Src)
+	want := color.NRGBA{53, 161, 46, 255}
+	near := func(c color.Color, want color.NRGBA) bool {
+		got := color.NRGBAModel.Convert(c).(color.NRGBA)
+		d := func(a, b uint8) bool { return math.Abs(float64(a)-float64(b)) <= 4 }
+		return d(got.R, want.R) && d(got.G, want.G) && d(got.B, want.B)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatalf("failed to encode JPEG: %v", err)
+	}
+	data, err := jpegmeta.Insert(buf.Bytes(), jpegmeta.ICCSegments(profile))
+	if err != nil {
+		t.Fatalf("failed to add profile: %v", err)
+	}
+	jpegPath := filepath.Join(testDir, "adobe.jpg")
+	if err := os.WriteFile(jpegPath, data, 0644); err != nil {
+		t.Fatalf("failed to write test JPEG: %v", err)
+	}
+
+	buf.Reset()
+	if err := bitpng.Encode(buf, img, &bitpng.Options{ICCProfile: profile}); err != nil {
+		t.Fatalf("failed to encode PNG: %v", err)
+	}
+	pngPath := filepath.Join(testDir, "adobe.png")
+	if err := os.WriteFile(pngPath, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write test PNG: %v", err)
+	}
+
+	for _, tc := range []struct {
+		input  string
+		format ImageFormat
+		mode   string
+		action string
+	}{
+		{jpegPath, FormatJPEG, ICCKeep, ICCKept},
+		{jpegPath, FormatJPEG, ICCSRGB, ICCConverted},
+		{pngPath, FormatPNG, "", ICCKept},
+		{pngPath, FormatPNG, ICCSRGB, ICCConverted},
+	} {
+		name := fmt.Sprintf("%s-%s", tc.format, tc.mode)
+		outputPath := filepath.Join(testDir, name, filepath.Base(tc.input))
+		opts := config.Options{Quality: 95, PNGMode: PNGLossless, ICC: tc.mode, WebP: true, WebPMode: WebPLossless}
+		result := ProcessImage(tc.input, filepath.Base(tc.input), outputPath, opts, false)
+		if !result.Success {
+			t.Fatalf("%s: ProcessImage failed: %s", name, result.Error)
+		}
+		if result.ICCAction != tc.action || result.ICCProfile != "Adobe RGB (1998)" {
+			t.Errorf("%s: unexpected profile handling %q of %q", name, result.ICCAction, result.ICCProfile)
+		}
+
+		out, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("%s: output missing: %v", name, err)
+		}
+		embedded := embeddedProfile(out, tc.format)
+		decoded, err := decodeImage(outputPath, tc.format)
+		if err != nil {
+			t.Fatalf("%s: output does not decode: %v", name, err)
+		}
+		if tc.action == ICCKept {
+			if !bytes.Equal(embedded, profile) {
+				t.Errorf("%s: profile not embedded", name)
+			}
+			if !near(decoded.At(8, 8), color.NRGBA{100, 160, 60, 255}) {
+				t.Errorf("%s: pixels changed to %v", name, decoded.At(8, 8))
+			}
+		} else {
+			if embedded != nil {
+				t.Errorf("%s: profile not dropped", name)
+			}
+			if !near(decoded.At(8, 8), want) {
+				t.Errorf("%s: expected about %v, got %v", name, want, decoded.At(8, 8))
+			}
+		}
+
+		// WebP copies cannot carry the profile, so they are always sRGB
+		webpOut, err := decodeImage(result.Variants[0].OutputPath, FormatWebP)
+		if err != nil {
+			t.Fatalf("%s: WebP copy does not decode: %v", name, err)
+		}
+		if !near(webpOut.At(8, 8), want) {
+			t.Errorf("%s: expected WebP copy of about %v, got %v", name, want, webpOut.At(8, 8))
+		}
+	}
+}
+
+// cmykJPEG encodes a four-component baseline JPEG of flat 8x8 blocks side
+// by side, each given as its stored component samples. The standard library
+// cannot write one, so the DCT is reduced to DC coefficients with a
+// quantizer of 1 and every block ends right after them.
+func cmykJPEG(t *testing.T, segments []jpegmeta.Segment, blocks ...[4]uint8) []byte {
+	t.Helper()
+	segment := func(marker byte, payload ...byte) []byte {
+		return append(binary.BigEndian.AppendUint16([]byte{0xff, marker}, uint16(len(payload)+2)), payload...)
+	}
+
+	out := []byte{0xff, 0xd8}
+	out = append(out, segment(0xdb, append([]byte{0}, bytes.Repeat([]byte{1}, 64)...)...)...)
+	sof := []byte{8, 0, 8}
+	sof = binary.BigEndian.AppendUint16(sof, uint16(8*len(blocks)))
+	sof = append(sof, 4)
+	for c := byte(1); c <= 4; c++ {
+		sof = append(sof, c, 0x11, 0)
+	}
+	out = append(out, segment(0xc0, sof...)...)
+
+	// DC categories 0-11 as 4-bit codes; the only AC symbol, end of block,
+	// is the 1-bit code 0
+	dc := append([]byte{0x00, 0, 0, 0, 12}, make([]byte, 12)...)
+	for s := range byte(12) {
+		dc = append(dc, s)
+	}
+	out = append(out, segment(0xc4, dc...)...)
+	out = append(out, segment(0xc4, append([]byte{0x10, 1}, append(make([]byte, 15), 0)...)...)...)
+	out = append(out, segment(0xda, 4, 1, 0, 2, 0, 3, 0, 4, 0, 0, 63, 0)...)
+
+	var scan []byte
+	var acc uint32
+	var n uint
+	write := func(bits uint32, length uint) {
+		acc = acc<<length | bits&(1<<length-1)
+		for n += length; n >= 8; n -= 8 {
+			b := byte(acc >> (n - 8))
+			if scan = append(scan, b); b == 0xff {
+				scan = append(scan, 0)
+			}
+		}
+	}
+	var predictor [4]int
+	for _, block := range blocks {
+		for c, sample := range block {
+			dcValue := 8 * (int(sample) - 128)
+			diff := dcValue - predictor[c]
+			predictor[c] = dcValue
+			category := uint(0)
+			for v := max(diff, -diff); v > 0; v >>= 1 {
+				category++
+			}
+			write(uint32(category), 4)
+			if diff < 0 {
+				diff += 1<<category - 1
+			}
+			write(uint32(diff), category)
+			write(0, 1)
+		}
+	}
+	write(0x7f, 7) // pad with ones
+	out = append(append(out, scan...), 0xff, 0xd9)
+
+	if segments != nil {
+		var err error
+		if out, err = jpegmeta.Insert(out, segments); err != nil {
+			t.Fatalf("failed to add segments: %v", err)
+		}
+	}
+	return out
+}
+
+func TestProcessImageCMYK(t *testing.T) {
+	testDir := t.TempDir()
+
+	// A profile without a lookup table cannot be used, so it is dropped
+	cmykProfile := make([]byte, 132)
+	binary.BigEndian.PutUint32(cmykProfile, uint32(len(cmykProfile)))
+	copy(cmykProfile[16:], "CMYKLab ")
+	copy(cmykProfile[36:], "acsp")
+
+	// Cyan and black ink; Adobe files store it inverted, YCCK ones store
+	// the inverted CMY as YCbCr
+	yCyan, cbCyan, crCyan := color.RGBToYCbCr(255, 0, 0)
+	for _, tc := range []struct {
+		name     string
+		segments []jpegmeta.Segment
+		blocks   [][4]uint8
+		model    string
+		action   string
+	}{
+		{"adobe", []jpegmeta.Segment{jpegmeta.AdobeSegment(0)}, [][4]uint8{{0, 255, 255, 255}, {255, 255, 255, 0}}, ColorCMYK, ""},
+		{"plain", jpegmeta.ICCSegments(cmykProfile), [][4]uint8{{255, 0, 0, 0}, {0, 0, 0, 255}}, ColorCMYK, ICCDropped},
+		{"ycck", []jpegmeta.Segment{jpegmeta.AdobeSegment(2)}, [][4]uint8{{yCyan, cbCyan, crCyan, 255}, {0, 128, 128, 0}}, ColorYCCK, ""},
+	} {
+		inputPath := filepath.Join(testDir, tc.name+".jpg")
+		if err := os.WriteFile(inputPath, cmykJPEG(t, tc.segments, tc.blocks...), 0644); err != nil {
+			t.Fatalf("failed to write test JPEG: %v", err)
+		}
+		outputPath := filepath.Join(testDir, "out", tc.name+".jpg")
+
+		// Converted print images are written even when they grow
+		opts := config.Options{Quality: 95, MinSavingBytes: 1 << 20}
+		result := ProcessImage(inputPath, filepath.Base(inputPath), outputPath, opts, false)
+		if !result.Success {
+			t.Fatalf("%s: ProcessImage failed: %s", tc.name, result.Error)
+		}
+		if result.SourceColor != tc.model || result.ICCAction != tc.action || result.KeptOriginal {
+			t.Errorf("%s: unexpected result %+v", tc.name, result)
+		}
+
+		out, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("%s: output missing: %v", tc.name, err)
+		}
+		if isCMYK(out) || embeddedProfile(out, FormatJPEG) != nil {
+			t.Errorf("%s: output is not plain sRGB", tc.name)
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: output does not decode: %v", tc.name, err)
+		}
+		for i, want := range []color.NRGBA{{0, 255, 255, 255}, {0, 0, 0, 255}} {
+			got := color.NRGBAModel.Convert(decoded.At(8*i+4, 4)).(color.NRGBA)
+			d := func(a, b uint8) bool { return math.Abs(float64(a)-float64(b)) <= 8 }
+			if !d(got.R, want.R) || !d(got.G, want.G) || !d(got.B, want.B) {
+				t.Errorf("%s: block %d is %v, want about %v", tc.name, i, got, want)
+			}
+		}
+	}
+}
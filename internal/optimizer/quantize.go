@@ -0,0 +1,401 @@
+package optimizer
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// Dithering methods selectable with --dither
+const (
+	DitherNone           = "none"
+	DitherFloydSteinberg = "floyd-steinberg"
+	DitherOrdered        = "ordered"
+)
+
+// ValidDither reports whether method is a known dithering method
+func ValidDither(method string) bool {
+	switch method {
+	case DitherNone, DitherFloydSteinberg, DitherOrdered:
+		return true
+	default:
+		return false
+	}
+}
+
+// kmeansBudget caps the palette refinement work (colors × palette entries ×
+// passes) so very colorful images are not slowed down by it
+const kmeansBudget = 1 << 26
+
+// quantizePNG reduces the image to a palette derived from its own colors.
+// Images that already fit in the palette keep their exact colors.
+func quantizePNG(img image.Image, quality int, dither string) image.Image {
+	// Calculate number of colors based on quality
+	// Quality 100 = 256 colors (no reduction)
+	// Quality 50 = 128 colors
+	// Quality 1 = 16 colors
+	maxColors := 16 + (quality * 240 / 100) // Range: 16 to 256
+	if maxColors > 256 {
+		maxColors = 256
+	}
+	if maxColors < 16 {
+		maxColors = 16
+	}
+
+	src := imaging.Clone(img)
+	hist := colorHistogram(src)
+
+	q := &quantizer{cache: make(map[uint32]uint8)}
+	if len(hist) <= maxColors {
+		// Exact palette, nothing to dither
+		for _, e := range hist {
+			q.add(e.c)
+		}
+		return q.remap(src, DitherNone)
+	}
+
+	for _, c := range medianCut(hist, maxColors) {
+		q.add(c)
+	}
+	return q.remap(src, dither)
+}
+
+// histEntry is a distinct color of the image with its pixel count and
+// position in the perceptual space
+type histEntry struct {
+	c color.NRGBA
+	p vec4
+	n int
+}
+
+// vec4 is a color in alpha-weighted Oklab: (L·α, a·α, b·α, α). Scaling by
+// alpha makes differences in barely visible pixels matter less, and all fully
+// transparent pixels coincide.
+type vec4 [4]float64
+
+func (v vec4) dist(w vec4) float64 {
+	d0, d1, d2, d3 := v[0]-w[0], v[1]-w[1], v[2]-w[2], v[3]-w[3]
+	return d0*d0 + d1*d1 + d2*d2 + d3*d3
+}
+
+// colorHistogram counts the distinct colors of m. Fully transparent pixels
+// are counted as one color regardless of their RGB values.
+func colorHistogram(m *image.NRGBA) []histEntry {
+	counts := make(map[uint32]int)
+	for i := 0; i < len(m.Pix); i += 4 {
+		counts[packNRGBA(color.NRGBA{m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3]})]++
+	}
+
+	hist := make([]histEntry, 0, len(counts))
+	for key, n := range counts {
+		c := unpackNRGBA(key)
+		hist = append(hist, histEntry{c: c, p: perceptual(c), n: n})
+	}
+	// Map iteration order is random; keep palettes deterministic
+	sort.Slice(hist, func(i, j int) bool { return packNRGBA(hist[i].c) < packNRGBA(hist[j].c) })
+	return hist
+}
+
+// medianCut splits the histogram into at most k boxes, always splitting the
+// box with the largest squared error at its weighted median, then refines the
+// box means with a few k-means passes
+func medianCut(hist []histEntry, k int) []color.NRGBA {
+	boxes := []colorBox{newColorBox(hist)}
+	for len(boxes) < k {
+		best := -1
+		for i, b := range boxes {
+			if len(b.entries) > 1 && (best < 0 || b.sse > boxes[best].sse) {
+				best = i
+			}
+		}
+		if best < 0 || boxes[best].sse == 0 {
+			break
+		}
+		lo, hi := boxes[best].split()
+		boxes[best] = lo
+		boxes = append(boxes, hi)
+	}
+
+	centers := make([]vec4, len(boxes))
+	for i, b := range boxes {
+		centers[i] = b.mean
+	}
+
+	passes := 3
+	if work := len(hist) * len(centers); work > 0 && passes > kmeansBudget/work {
+		passes = kmeansBudget / work
+	}
+	for pass := 0; pass < passes; pass++ {
+		sums := make([]vec4, len(centers))
+		weights := make([]float64, len(centers))
+		for _, e := range hist {
+			i := nearest(centers, e.p)
+			for j := range sums[i] {
+				sums[i][j] += e.p[j] * float64(e.n)
+			}
+			weights[i] += float64(e.n)
+		}
+		for i := range centers {
+			if weights[i] > 0 {
+				for j := range centers[i] {
+					centers[i][j] = sums[i][j] / weights[i]
+				}
+			}
+		}
+	}
+
+	palette := make([]color.NRGBA, len(centers))
+	for i, p := range centers {
+		palette[i] = fromPerceptual(p)
+	}
+	return palette
+}
+
+// colorBox is a set of histogram entries with their weighted mean and
+// squared error
+type colorBox struct {
+	entries []histEntry
+	mean    vec4
+	sse     float64
+}
+
+func newColorBox(entries []histEntry) colorBox {
+	b := colorBox{entries: entries}
+	var total float64
+	for _, e := range entries {
+		for j := range b.mean {
+			b.mean[j] += e.p[j] * float64(e.n)
+		}
+		total += float64(e.n)
+	}
+	for j := range b.mean {
+		b.mean[j] /= total
+	}
+	for _, e := range entries {
+		b.sse += e.p.dist(b.mean) * float64(e.n)
+	}
+	return b
+}
+
+// split divides the box at the weighted median of its widest-spread axis
+func (b colorBox) split() (colorBox, colorBox) {
+	var variance vec4
+	for _, e := range b.entries {
+		for j := range variance {
+			d := e.p[j] - b.mean[j]
+			variance[j] += d * d * float64(e.n)
+		}
+	}
+	axis := 0
+	for j := range variance {
+		if variance[j] > variance[axis] {
+			axis = j
+		}
+	}
+
+	sort.Slice(b.entries, func(i, j int) bool { return b.entries[i].p[axis] < b.entries[j].p[axis] })
+
+	var total, seen int
+	for _, e := range b.entries {
+		total += e.n
+	}
+	cut := 1
+	for i, e := range b.entries[:len(b.entries)-1] {
+		seen += e.n
+		cut = i + 1
+		if 2*seen >= total {
+			break
+		}
+	}
+	return newColorBox(b.entries[:cut]), newColorBox(b.entries[cut:])
+}
+
+// quantizer maps colors to the nearest entry of a palette
+type quantizer struct {
+	palette color.Palette
+	points  []vec4
+	cache   map[uint32]uint8
+}
+
+func (q *quantizer) add(c color.NRGBA) {
+	q.palette = append(q.palette, c)
+	q.points = append(q.points, perceptual(c))
+}
+
+// index returns the palette index closest to c
+func (q *quantizer) index(c color.NRGBA) uint8 {
+	key := packNRGBA(c)
+	if i, ok := q.cache[key]; ok {
+		return i
+	}
+	i := uint8(nearest(q.points, perceptual(c)))
+	q.cache[key] = i
+	return i
+}
+
+// bayer8 is the 8x8 ordered dithering threshold matrix
+var bayer8 = [8][8]float64{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// remap draws m with the quantizer's palette using the given dithering
+func (q *quantizer) remap(m *image.NRGBA, dither string) *image.Paletted {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := image.NewPaletted(image.Rect(0, 0, w, h), q.palette)
+
+	// Error diffusion state for the current and next row
+	var cur, next [][4]float64
+	if dither == DitherFloydSteinberg {
+		cur = make([][4]float64, w+2)
+		next = make([][4]float64, w+2)
+	}
+	// Ordered dithering spreads roughly half a palette step around each pixel
+	spread := 128 / math.Cbrt(float64(len(q.palette)))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px := m.Pix[y*m.Stride+4*x:]
+			c := color.NRGBA{px[0], px[1], px[2], px[3]}
+
+			switch {
+			case c.A == 0:
+				// Fully transparent pixels neither take nor pass on error
+			case dither == DitherFloydSteinberg:
+				var v [4]float64
+				for j := range v {
+					v[j] = float64(px[j]) + cur[x+1][j]
+				}
+				c = color.NRGBA{clampByte(v[0]), clampByte(v[1]), clampByte(v[2]), clampByte(v[3])}
+				got := q.palette[q.index(c)].(color.NRGBA)
+				gotv := [4]float64{float64(got.R), float64(got.G), float64(got.B), float64(got.A)}
+				for j := range v {
+					e := v[j] - gotv[j]
+					cur[x+2][j] += e * 7 / 16
+					next[x][j] += e * 3 / 16
+					next[x+1][j] += e * 5 / 16
+					next[x+2][j] += e * 1 / 16
+				}
+			case dither == DitherOrdered:
+				t := (bayer8[y%8][x%8]+0.5)/64 - 0.5
+				d := t * spread
+				c = color.NRGBA{clampByte(float64(c.R) + d), clampByte(float64(c.G) + d), clampByte(float64(c.B) + d), c.A}
+			}
+
+			out.Pix[y*out.Stride+x] = q.index(c)
+		}
+		if cur != nil {
+			cur, next = next, cur
+			for i := range next {
+				next[i] = [4]float64{}
+			}
+		}
+	}
+	return out
+}
+
+func nearest(points []vec4, p vec4) int {
+	best, bestDist := 0, math.Inf(1)
+	for i, q := range points {
+		if d := q.dist(p); d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return best
+}
+
+// srgbToLinear maps 8-bit sRGB values to linear light
+var srgbToLinear = func() (t [256]float64) {
+	for i := range t {
+		v := float64(i) / 255
+		if v <= 0.04045 {
+			t[i] = v / 12.92
+		} else {
+			t[i] = math.Pow((v+0.055)/1.055, 2.4)
+		}
+	}
+	return t
+}()
+
+func linearToSRGB(v float64) uint8 {
+	if v <= 0.0031308 {
+		v *= 12.92
+	} else {
+		v = 1.055*math.Pow(v, 1/2.4) - 0.055
+	}
+	return clampByte(v * 255)
+}
+
+// perceptual converts c to alpha-weighted Oklab
+func perceptual(c color.NRGBA) vec4 {
+	if c.A == 0 {
+		return vec4{}
+	}
+	r, g, b := srgbToLinear[c.R], srgbToLinear[c.G], srgbToLinear[c.B]
+
+	l := math.Cbrt(0.4122214708*r + 0.5363325363*g + 0.0514459929*b)
+	m := math.Cbrt(0.2119034982*r + 0.6806995451*g + 0.1073969566*b)
+	s := math.Cbrt(0.0883024619*r + 0.2817188376*g + 0.6299787005*b)
+
+	a := float64(c.A) / 255
+	return vec4{
+		a * (0.2104542553*l + 0.7936177850*m - 0.0040720468*s),
+		a * (1.9779984951*l - 2.4285922050*m + 0.4505937099*s),
+		a * (0.0259040371*l + 0.7827717662*m - 0.8086757660*s),
+		a,
+	}
+}
+
+// fromPerceptual converts alpha-weighted Oklab back to a color
+func fromPerceptual(p vec4) color.NRGBA {
+	a := p[3]
+	if a*255 < 0.5 {
+		return color.NRGBA{}
+	}
+	L, A, B := p[0]/a, p[1]/a, p[2]/a
+
+	l := L + 0.3963377774*A + 0.2158037573*B
+	m := L - 0.1055613458*A - 0.0638541728*B
+	s := L - 0.0894841775*A - 1.2914855480*B
+	l, m, s = l*l*l, m*m*m, s*s*s
+
+	return color.NRGBA{
+		linearToSRGB(4.0767416621*l - 3.3077115913*m + 0.2309699292*s),
+		linearToSRGB(-1.2684380046*l + 2.6097574011*m - 0.3413193965*s),
+		linearToSRGB(-0.0041960863*l - 0.7034186147*m + 1.7076147010*s),
+		clampByte(a * 255),
+	}
+}
+
+func clampByte(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// packNRGBA packs c into a map key, folding every fully transparent color
+// into zero
+func packNRGBA(c color.NRGBA) uint32 {
+	if c.A == 0 {
+		return 0
+	}
+	return uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
+}
+
+func unpackNRGBA(key uint32) color.NRGBA {
+	return color.NRGBA{uint8(key >> 24), uint8(key >> 16), uint8(key >> 8), uint8(key)}
+}
@@ -0,0 +1,134 @@
+package optimizer
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+	"github.com/zulfikawr/bitrim/internal/config"
+)
+
+// Resampling filters selectable with --resample
+const (
+	ResampleLanczos    = "lanczos"
+	ResampleCatmullRom = "catmull-rom"
+	ResampleMitchell   = "mitchell"
+	ResampleLinear     = "linear"
+	ResampleBox        = "box"
+	ResampleNearest    = "nearest"
+)
+
+// ValidResample reports whether filter is a known resampling filter
+func ValidResample(filter string) bool {
+	switch filter {
+	case ResampleLanczos, ResampleCatmullRom, ResampleMitchell, ResampleLinear, ResampleBox, ResampleNearest:
+		return true
+	default:
+		return false
+	}
+}
+
+// resampleFilter returns the named resampling filter, Lanczos when the name
+// is empty
+func resampleFilter(filter string) imaging.ResampleFilter {
+	switch filter {
+	case ResampleCatmullRom:
+		return imaging.CatmullRom
+	case ResampleMitchell:
+		return imaging.MitchellNetravali
+	case ResampleLinear:
+		return imaging.Linear
+	case ResampleBox:
+		return imaging.Box
+	case ResampleNearest:
+		return imaging.NearestNeighbor
+	default:
+		return imaging.Lanczos
+	}
+}
+
+// resize scales img as the resize options ask and reports whether its size
+// changed. Width or height alone keeps the aspect ratio, both fill that box
+// and crop what sticks out, and Scale is a percentage. The maximum
+// dimensions and megapixels then shrink the result, never enlarging it, and
+// NoUpscale keeps any image from growing past its source size. Downscaled
+// images are sharpened by Sharpen.
+//
+// The window kept when cropping is placed on the focal point, if any, or
+// by the Crop strategy, and returned in the coordinates of img; it is empty
+// when nothing was cropped.
+func resize(img image.Image, opts config.Options, focal *config.FocalPoint) (image.Image, image.Rectangle, bool) {
+	sw, sh := img.Bounds().Dx(), img.Bounds().Dy()
+	if sw == 0 || sh == 0 {
+		return img, image.Rectangle{}, false
+	}
+
+	// The size asked for; a box to fill when both sides are given
+	fill := opts.Width > 0 && opts.Height > 0
+	w, h := float64(sw), float64(sh)
+	switch {
+	case fill:
+		w, h = float64(opts.Width), float64(opts.Height)
+	case opts.Width > 0:
+		w, h = float64(opts.Width), float64(sh)*float64(opts.Width)/float64(sw)
+	case opts.Height > 0:
+		w, h = float64(sw)*float64(opts.Height)/float64(sh), float64(opts.Height)
+	case opts.Scale > 0:
+		w, h = float64(sw)*opts.Scale/100, float64(sh)*opts.Scale/100
+	}
+
+	// Limits shrink it, keeping its aspect ratio
+	limit := 1.0
+	if opts.MaxWidth > 0 {
+		limit = min(limit, float64(opts.MaxWidth)/w)
+	}
+	if opts.MaxHeight > 0 {
+		limit = min(limit, float64(opts.MaxHeight)/h)
+	}
+	if opts.MaxMegapixels > 0 {
+		limit = min(limit, math.Sqrt(opts.MaxMegapixels*1e6/(w*h)))
+	}
+	boxW, boxH := pixels(w*limit), pixels(h*limit)
+
+	// The scale factor, covering the box when filling it
+	scale := float64(boxW) / float64(sw)
+	if fill {
+		scale = max(scale, float64(boxH)/float64(sh))
+	}
+	if opts.NoUpscale && scale > 1 {
+		scale = 1
+		boxW, boxH = min(boxW, sw), min(boxH, sh)
+	}
+	scaledW, scaledH := boxW, boxH
+	if fill {
+		scaledW, scaledH = max(pixels(float64(sw)*scale), boxW), max(pixels(float64(sh)*scale), boxH)
+	}
+	if scaledW == sw && scaledH == sh && boxW == sw && boxH == sh {
+		return img, image.Rectangle{}, false
+	}
+
+	origin := img.Bounds().Min
+	if scaledW != sw || scaledH != sh {
+		img = imaging.Resize(img, scaledW, scaledH, resampleFilter(opts.Resample))
+	}
+	var crop image.Rectangle
+	if boxW != scaledW || boxH != scaledH {
+		window := cropWindow(img, boxW, boxH, opts.Crop, focal).Sub(img.Bounds().Min)
+		img = imaging.Crop(img, window.Add(img.Bounds().Min))
+
+		// Map the window back onto the source
+		crop = image.Rect(
+			window.Min.X*sw/scaledW, window.Min.Y*sh/scaledH,
+			window.Max.X*sw/scaledW, window.Max.Y*sh/scaledH,
+		).Add(origin)
+	}
+	if opts.Sharpen > 0 && scale < 1 {
+		img = imaging.Sharpen(img, opts.Sharpen)
+	}
+	return img, crop, true
+}
+
+// pixels rounds a length to whole pixels, at least one
+func pixels(length float64) int {
+	return max(int(length+0.5), 1)
+}
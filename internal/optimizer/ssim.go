@@ -0,0 +1,66 @@
+package optimizer
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/zulfikawr/bitrim/internal/metric"
+	"github.com/zulfikawr/bitrim/internal/webp"
+)
+
+// qualityForSSIM binary-searches the lowest quality whose output, decoded
+// again, reaches the target SSIM against img, assuming SSIM grows with
+// quality. When no quality reaches it, the highest is returned.
+func qualityForSSIM(img image.Image, format ImageFormat, target float64, resized bool, encode encodeFunc) (int, error) {
+	lo, hi := 1, 100
+	for lo < hi {
+		q := (lo + hi) / 2
+		data, _, err := encode(img, q, resized)
+		if err != nil {
+			return 0, err
+		}
+		decoded, err := decodeData(data, format)
+		if err != nil {
+			return 0, err
+		}
+		score, err := metric.SSIM(img, decoded)
+		if err != nil {
+			return 0, err
+		}
+		if score >= target {
+			hi = q
+		} else {
+			lo = q + 1
+		}
+	}
+	return lo, nil
+}
+
+// measure records the dimensions of an output and how faithfully it
+// reproduces ref, the image encoded. An output that cannot be measured
+// is still written, without the metrics.
+func measure(result *Result, ref image.Image, data []byte, format ImageFormat) {
+	result.OutputWidth, result.OutputHeight = ref.Bounds().Dx(), ref.Bounds().Dy()
+	decoded, err := decodeData(data, format)
+	if err != nil {
+		return
+	}
+	ssim, err := metric.SSIM(ref, decoded)
+	if err != nil {
+		return
+	}
+	psnr, err := metric.PSNR(ref, decoded)
+	if err != nil {
+		return
+	}
+	result.PSNR, result.SSIM = psnr, ssim
+}
+
+// decodeData decodes an encoded image of the given format
+func decodeData(data []byte, format ImageFormat) (image.Image, error) {
+	if format == FormatWebP {
+		return webp.Decode(bytes.NewReader(data))
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
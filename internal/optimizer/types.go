@@ -1,13 +1,22 @@
 package optimizer
 
+import "image"
+
 // Result represents the outcome of processing a file
 type Result struct {
 	// Original file path
 	FilePath string
 
-	// File type (jpg, png, svg)
+	// Path relative to the input directory
+	RelativePath string
+
+	// File type of the output (jpeg, png, webp, svg)
 	FileType string
 
+	// Format of the input file; differs from FileType when the image was
+	// converted (e.g. tiff -> jpeg)
+	SourceFormat string
+
 	// Original file size in bytes
 	OriginalSize int64
 
@@ -23,8 +32,73 @@ type Result struct {
 	// Whether processing was successful
 	Success bool
 
+	// Whether the file was deliberately not processed (e.g. output path collision)
+	Skipped bool
+
+	// Whether the source was copied unchanged because re-encoding did not
+	// save the configured minimum
+	KeptOriginal bool
+
+	// Encoding used for the output when a format has several (e.g.
+	// "progressive" or "baseline" for JPEG, "lossy" or "lossless" for WebP)
+	Encoding string
+
+	// Encoder quality the output was made with, after --target-ssim and
+	// any size budget; 0 for lossless encodings and kept originals
+	Quality int
+
+	// Width an image was shrunk to so that it fits its size budget; 0 when
+	// it was not
+	FittedWidth int
+
+	// Region of the source kept when filling a --width by --height box, in
+	// source pixels after any rotation; empty when nothing was cropped
+	Crop image.Rectangle
+
+	// Whether the watermark was stamped on the image and its copies
+	Watermarked bool
+
+	// Steps asked for that an animated GIF kept as GIF went without:
+	// StepResize, StepSizes and StepWebP
+	SkippedSteps []string
+
+	// How --format auto picked the output format, with the sizes of the
+	// candidates that lost; nil without it
+	FormatChoice *FormatChoice
+
+	// Dimensions of the decoded source and of the output; 0 for SVG and GIF
+	SourceWidth  int
+	SourceHeight int
+	OutputWidth  int
+	OutputHeight int
+
+	// How faithfully the output reproduces the pixels encoded, measured on
+	// the output decoded again: PSNR in decibels and SSIM up to 1. A kept
+	// original scores 1 and metric.MaxPSNR; 0 when not measured.
+	PSNR float64
+	SSIM float64
+
+	// Description of the source's embedded ICC profile, if it has one
+	ICCProfile string
+
+	// What happened to the embedded ICC profile: ICCKept, ICCConverted or
+	// ICCDropped; empty when there was none
+	ICCAction string
+
+	// Whether the source held GPS coordinates, which are never written to
+	// the output
+	HasLocation bool
+
+	// Color model of a print source converted to sRGB (ColorCMYK or
+	// ColorYCCK); empty for RGB and gray sources
+	SourceColor string
+
 	// Error message if processing failed
 	Error string
+
+	// Additional outputs derived from the same source (e.g. WebP copies),
+	// each with its own sizes and savings
+	Variants []Result
 }
 
 // ImageFormat represents supported image formats
@@ -35,4 +109,9 @@ const (
 	FormatPNG  ImageFormat = "png"
 	FormatWebP ImageFormat = "webp"
 	FormatSVG  ImageFormat = "svg"
+	FormatGIF  ImageFormat = "gif" // only written for GIF input
+
+	// Input-only formats, converted to one of the above on output
+	FormatBMP  ImageFormat = "bmp"
+	FormatTIFF ImageFormat = "tiff"
 )
@@ -0,0 +1,111 @@
+package optimizer
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/zulfikawr/bitrim/internal/config"
+)
+
+// SizedPath returns the path of the copy of outputPath written at width by
+// --sizes (e.g. photo-640.jpg)
+func SizedPath(outputPath string, width int) string {
+	ext := filepath.Ext(outputPath)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(outputPath, ext), width, ext)
+}
+
+// DerivedPaths returns the extra files an image output may come with: its
+// --sizes copies and, with --webp, the WebP copies of all of them. With
+// --format auto, the output and its copies may take any candidate format.
+func DerivedPaths(outputPath string, opts config.Options) []string {
+	format := FormatFromExt(filepath.Ext(outputPath))
+	if format == FormatGIF || format == "" {
+		return nil
+	}
+	formats := []ImageFormat{format}
+	if opts.Format == AutoFormat {
+		for _, f := range []ImageFormat{FormatJPEG, FormatPNG, FormatWebP} {
+			if f != format {
+				formats = append(formats, f)
+			}
+		}
+	}
+
+	var paths []string
+	for _, f := range formats {
+		main := withExtension(outputPath, f)
+		outputs := []string{main}
+		for _, width := range opts.Sizes {
+			outputs = append(outputs, SizedPath(main, width))
+		}
+		for _, output := range outputs {
+			if output != outputPath {
+				paths = append(paths, output)
+			}
+			if opts.WebP && f != FormatWebP {
+				paths = append(paths, WebPPath(output))
+			}
+		}
+	}
+	return paths
+}
+
+// scaleToWidth scales img to a --sizes width with the configured filter and
+// sharpening
+func scaleToWidth(img image.Image, width int, opts config.Options) image.Image {
+	scaled := imaging.Resize(img, width, 0, resampleFilter(opts.Resample))
+	if opts.Sharpen > 0 {
+		scaled = imaging.Sharpen(scaled, opts.Sharpen)
+	}
+	return scaled
+}
+
+// writeVariant encodes img into an extra output at path, such as a WebP or
+// --sizes copy, picking its quality and fitting its size budget as for the
+// main output. It reports the output as its own file so savings are tracked
+// per format.
+func writeVariant(img image.Image, format ImageFormat, resized bool, inputPath string, path string, originalSize int64, opts config.Options, dryRun bool, encode encodeFunc) Result {
+	result := Result{
+		FilePath:     inputPath,
+		FileType:     string(format),
+		OriginalSize: originalSize,
+		OutputPath:   path,
+	}
+
+	quality := formatQuality(format, opts)
+	if opts.TargetSSIM > 0 && usesQuality(format, opts) {
+		var err error
+		if quality, err = qualityForSSIM(storedPixels(img, format, opts), format, opts.TargetSSIM, resized, encode); err != nil {
+			result.Error = fmt.Sprintf("failed to search quality: %v", err)
+			return result
+		}
+	}
+
+	data, encoding, err := encode(img, quality, resized)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to encode image: %v", err)
+		return result
+	}
+	result.Encoding, result.Quality = encoding, effectiveQuality(encoding, quality)
+	if data, img, err = applyBudget(&result, format, data, img, quality, resized, opts, encode); err != nil {
+		result.Error = fmt.Sprintf("failed to fit in %d bytes: %v", maxBytes(format, opts), err)
+		return result
+	}
+	measure(&result, storedPixels(img, format, opts), data, format)
+
+	if !dryRun {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			result.Error = fmt.Sprintf("failed to write output file: %v", err)
+			return result
+		}
+	}
+
+	result.ProcessedSize = int64(len(data))
+	result.BytesSaved = result.OriginalSize - result.ProcessedSize
+	result.Success = true
+	return result
+}
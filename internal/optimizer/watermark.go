@@ -0,0 +1,110 @@
+package optimizer
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/zulfikawr/bitrim/internal/config"
+)
+
+// Watermark positions selectable with --watermark-position
+const (
+	PositionTopLeft     = "top-left"
+	PositionTop         = "top"
+	PositionTopRight    = "top-right"
+	PositionLeft        = "left"
+	PositionCenter      = "center"
+	PositionRight       = "right"
+	PositionBottomLeft  = "bottom-left"
+	PositionBottom      = "bottom"
+	PositionBottomRight = "bottom-right"
+)
+
+// ValidPosition reports whether position is a known watermark position
+func ValidPosition(position string) bool {
+	switch position {
+	case PositionTopLeft, PositionTop, PositionTopRight,
+		PositionLeft, PositionCenter, PositionRight,
+		PositionBottomLeft, PositionBottom, PositionBottomRight:
+		return true
+	default:
+		return false
+	}
+}
+
+// LoadWatermark decodes the overlay image of --watermark
+func LoadWatermark(path string) (image.Image, error) {
+	ext := filepath.Ext(path)
+	if strings.EqualFold(ext, ".svg") {
+		return nil, errors.New("SVG watermarks cannot be rasterized; export the logo as PNG")
+	}
+	format := FormatFromExt(ext)
+	if format == "" {
+		return nil, fmt.Errorf("unsupported watermark format %q", ext)
+	}
+	return decodeImage(path, format)
+}
+
+// watermarks reports whether the watermark applies to the image at
+// relPath: it must match an include glob, if there are any, and no exclude
+// glob. Globs use forward slashes on any OS.
+func watermarks(relPath string, opts config.Options) bool {
+	if opts.Watermark.Image == nil {
+		return false
+	}
+	rel := filepath.ToSlash(relPath)
+	if len(opts.Watermark.Include) > 0 && !matchesAny(rel, opts.Watermark.Include) {
+		return false
+	}
+	return !matchesAny(rel, opts.Watermark.Exclude)
+}
+
+// matchesAny reports whether any of the globs matches a slash-separated
+// relative path or one of its parent directories, by path or by name
+func matchesAny(rel string, globs []string) bool {
+	for _, glob := range globs {
+		glob = strings.TrimSpace(glob)
+		for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+			if ok, _ := path.Match(glob, p); ok {
+				return true
+			}
+			if ok, _ := path.Match(glob, path.Base(p)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyWatermark stamps the watermark onto img, scaled to its configured
+// share of the width and no taller than img, inset by the margin from the
+// edges of its position
+func applyWatermark(img image.Image, wm config.Watermark) image.Image {
+	b, mb := img.Bounds(), wm.Image.Bounds()
+	w := float64(b.Dx()) * wm.Scale / 100
+	h := w * float64(mb.Dy()) / float64(mb.Dx())
+	if h > float64(b.Dy()) {
+		w, h = w*float64(b.Dy())/h, float64(b.Dy())
+	}
+	mark := imaging.Resize(wm.Image, pixels(w), pixels(h), imaging.Lanczos)
+
+	margin := int(float64(b.Dx())*wm.Margin/100 + 0.5)
+	slackX, slackY := b.Dx()-mark.Bounds().Dx(), b.Dy()-mark.Bounds().Dy()
+	x, y := slackX/2, slackY/2
+	if strings.HasSuffix(wm.Position, "left") {
+		x = min(margin, slackX)
+	} else if strings.HasSuffix(wm.Position, "right") {
+		x = max(slackX-margin, 0)
+	}
+	if strings.HasPrefix(wm.Position, "top") {
+		y = min(margin, slackY)
+	} else if strings.HasPrefix(wm.Position, "bottom") {
+		y = max(slackY-margin, 0)
+	}
+	return imaging.Overlay(img, mark, image.Pt(x, y).Add(b.Min), wm.Opacity)
+}
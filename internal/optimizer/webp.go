@@ -0,0 +1,69 @@
+package optimizer
+
+import (
+	"bytes"
+	"image"
+	"path/filepath"
+	"strings"
+
+	"github.com/zulfikawr/bitrim/internal/config"
+	"github.com/zulfikawr/bitrim/internal/webp"
+)
+
+// WebP encodings selectable with --webp-mode
+const (
+	WebPLossy    = "lossy"
+	WebPLossless = "lossless"
+	WebPSmallest = "smallest" // encode both and keep the smaller file
+)
+
+// ValidWebPMode reports whether mode is a known WebP encoding mode
+func ValidWebPMode(mode string) bool {
+	switch mode {
+	case WebPLossy, WebPLossless, WebPSmallest:
+		return true
+	default:
+		return false
+	}
+}
+
+// WebPPath returns the path of the WebP copy written next to outputPath
+func WebPPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".webp"
+}
+
+// writeWebP encodes img as WebP next to outputPath and reports the result as
+// its own file so savings are tracked per format
+func writeWebP(img image.Image, inputPath string, outputPath string, originalSize int64, opts config.Options, dryRun bool) Result {
+	encode := func(img image.Image, quality int, _ bool) ([]byte, string, error) {
+		return encodeWebP(img, opts.WebPMode, quality)
+	}
+	return writeVariant(img, FormatWebP, false, inputPath, WebPPath(outputPath), originalSize, opts, dryRun, encode)
+}
+
+// encodeWebP encodes img in the given mode (lossy when empty) and returns
+// the data together with the encoding that produced it
+func encodeWebP(img image.Image, mode string, quality int) ([]byte, string, error) {
+	var lossy, lossless []byte
+
+	if mode != WebPLossless {
+		buf := new(bytes.Buffer)
+		if err := webp.EncodeLossy(buf, img, quality); err != nil {
+			return nil, "", err
+		}
+		lossy = buf.Bytes()
+	}
+
+	if mode == WebPLossless || mode == WebPSmallest {
+		buf := new(bytes.Buffer)
+		if err := webp.EncodeLossless(buf, img); err != nil {
+			return nil, "", err
+		}
+		lossless = buf.Bytes()
+	}
+
+	if lossless == nil || (lossy != nil && len(lossy) <= len(lossless)) {
+		return lossy, WebPLossy, nil
+	}
+	return lossless, WebPLossless, nil
+}
@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Collision policies for files that resolve to the same output path
+const (
+	CollisionError  = "error"
+	CollisionSuffix = "suffix"
+	CollisionSkip   = "skip"
+)
+
+// OutputLayout maps input files to output paths, mirroring the input tree
+// under the output root unless flattening is requested
+type OutputLayout struct {
+	outputDir string
+	flatten   bool
+	policy    string
+	claimed   map[string]string // lower-cased output path -> input path that claimed it
+
+	// Rename, if set, adjusts a job's output path before it is claimed
+	// (such as changing the extension of converted images)
+	Rename func(job FileInfo, outputPath string) string
+
+	// Siblings, if set, returns extra files written next to a job's output
+	// (such as WebP copies); they are claimed together with the output path
+	Siblings func(job FileInfo, outputPath string) []string
+}
+
+// NewOutputLayout creates a new OutputLayout
+func NewOutputLayout(outputDir string, flatten bool, policy string) *OutputLayout {
+	if policy == "" {
+		policy = CollisionSuffix
+	}
+	return &OutputLayout{
+		outputDir: outputDir,
+		flatten:   flatten,
+		policy:    policy,
+		claimed:   make(map[string]string),
+	}
+}
+
+// ValidCollisionPolicy reports whether policy is a known collision policy
+func ValidCollisionPolicy(policy string) bool {
+	switch policy {
+	case CollisionError, CollisionSuffix, CollisionSkip:
+		return true
+	default:
+		return false
+	}
+}
+
+// Resolve fills in the output path of a file and records any collision.
+// It is not safe for concurrent use; the coordinator calls it from a single
+// goroutine so that suffixes are assigned in walk order.
+func (l *OutputLayout) Resolve(job FileInfo) FileInfo {
+	rel := job.RelPath
+	if rel == "" {
+		rel = filepath.Base(job.Path)
+	}
+	if l.flatten {
+		rel = filepath.Base(rel)
+	}
+
+	outputPath := filepath.Join(l.outputDir, rel)
+	if l.Rename != nil {
+		outputPath = l.Rename(job, outputPath)
+	}
+	owner, taken := l.owner(job, outputPath)
+	if !taken {
+		l.claim(job, outputPath)
+		job.OutputPath = outputPath
+		return job
+	}
+
+	switch l.policy {
+	case CollisionSuffix:
+		ext := filepath.Ext(outputPath)
+		stem := strings.TrimSuffix(outputPath, ext)
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s-%d%s", stem, i, ext)
+			if _, exists := l.owner(job, candidate); !exists {
+				l.claim(job, candidate)
+				job.OutputPath = candidate
+				return job
+			}
+		}
+	default:
+		job.OutputPath = outputPath
+		job.Collision = l.policy
+		job.CollidesWith = owner
+		return job
+	}
+}
+
+// paths returns the output path and any siblings written alongside it
+func (l *OutputLayout) paths(job FileInfo, outputPath string) []string {
+	paths := []string{outputPath}
+	if l.Siblings != nil {
+		paths = append(paths, l.Siblings(job, outputPath)...)
+	}
+	return paths
+}
+
+// owner returns the input that already claimed outputPath or one of its siblings
+func (l *OutputLayout) owner(job FileInfo, outputPath string) (string, bool) {
+	for _, p := range l.paths(job, outputPath) {
+		if owner, taken := l.claimed[claimKey(p)]; taken {
+			return owner, true
+		}
+	}
+	return "", false
+}
+
+// claim reserves outputPath and its siblings for job
+func (l *OutputLayout) claim(job FileInfo, outputPath string) {
+	for _, p := range l.paths(job, outputPath) {
+		l.claimed[claimKey(p)] = job.Path
+	}
+}
+
+// claimKey normalises an output path so that names differing only in case
+// collide, as they would on case-insensitive filesystems
+func claimKey(path string) string {
+	return strings.ToLower(filepath.Clean(path))
+}
@@ -1,11 +1,19 @@
 package pipeline
 
 import (
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/zulfikawr/bitrim/internal/config"
+	"github.com/zulfikawr/bitrim/internal/optimizer"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
 )
 
 func TestWalker(t *testing.T) {
@@ -125,3 +133,170 @@ func TestPipelineStats(t *testing.T) {
 		t.Errorf("expected %.0f average savings, got %d", float64(expectedAvg), stats.AverageSavingsPerFile())
 	}
 }
+
+func TestOutputLayoutMirrorsTree(t *testing.T) {
+	testDir := t.TempDir()
+	inputDir := filepath.Join(testDir, "in")
+	outputDir := filepath.Join(testDir, "out")
+
+	for _, sub := range []string{"a", "b"} {
+		if err := os.MkdirAll(filepath.Join(inputDir, sub), 0755); err != nil {
+			t.Fatalf("failed to create %s: %v", sub, err)
+		}
+		svg := []byte("<svg>\n  <rect id=\"" + sub + "\"/>\n</svg>\n")
+		if err := os.WriteFile(filepath.Join(inputDir, sub, "logo.svg"), svg, 0644); err != nil {
+			t.Fatalf("failed to create test SVG: %v", err)
+		}
+	}
+
+	opts := config.Options{Quality: 80, Concurrency: 2}
+	stats, err := NewCoordinator(inputDir, outputDir, opts).Run()
+	if err != nil {
+		t.Fatalf("pipeline error: %v", err)
+	}
+	if stats.SuccessfulFiles != 2 {
+		t.Fatalf("expected 2 successful files, got %d", stats.SuccessfulFiles)
+	}
+
+	for _, sub := range []string{"a", "b"} {
+		data, err := os.ReadFile(filepath.Join(outputDir, sub, "logo.svg"))
+		if err != nil {
+			t.Fatalf("mirrored output missing: %v", err)
+		}
+		if !strings.Contains(string(data), sub) {
+			t.Errorf("output %s/logo.svg has wrong content: %s", sub, data)
+		}
+	}
+
+	for _, r := range stats.ProcessedFiles {
+		if r.RelativePath != filepath.Join(filepath.Base(filepath.Dir(r.FilePath)), "logo.svg") {
+			t.Errorf("unexpected relative path %q for %s", r.RelativePath, r.FilePath)
+		}
+	}
+}
+
+func TestOutputLayoutCollisions(t *testing.T) {
+	jobs := []FileInfo{
+		{Path: "in/a/logo.png", RelPath: filepath.Join("a", "logo.png")},
+		{Path: "in/b/logo.png", RelPath: filepath.Join("b", "logo.png")},
+		{Path: "in/c/logo.png", RelPath: filepath.Join("c", "logo.png")},
+	}
+
+	suffix := NewOutputLayout("out", true, CollisionSuffix)
+	want := []string{"logo.png", "logo-1.png", "logo-2.png"}
+	for i, job := range jobs {
+		got := suffix.Resolve(job)
+		if got.Collision != "" {
+			t.Fatalf("suffix policy reported collision for %s", job.Path)
+		}
+		if got.OutputPath != filepath.Join("out", want[i]) {
+			t.Errorf("expected %s, got %s", filepath.Join("out", want[i]), got.OutputPath)
+		}
+	}
+
+	skip := NewOutputLayout("out", true, CollisionSkip)
+	skip.Resolve(jobs[0])
+	if got := skip.Resolve(jobs[1]); got.Collision != CollisionSkip || got.CollidesWith != jobs[0].Path {
+		t.Errorf("expected skip collision with %s, got %q/%q", jobs[0].Path, got.Collision, got.CollidesWith)
+	}
+
+	mirrored := NewOutputLayout("out", false, CollisionError)
+	for _, job := range jobs {
+		if got := mirrored.Resolve(job); got.Collision != "" {
+			t.Errorf("mirrored layout should not collide, got %q for %s", got.Collision, job.Path)
+		}
+	}
+}
+
+func TestPipelineConvertsInputFormats(t *testing.T) {
+	testDir := t.TempDir()
+	inputDir := filepath.Join(testDir, "in")
+	outputDir := filepath.Join(testDir, "out")
+	if err := os.MkdirAll(inputDir, 0755); err != nil {
+		t.Fatalf("failed to create input dir: %v", err)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	writeFile := func(name string, encode func(io.Writer) error) {
+		f, err := os.Create(filepath.Join(inputDir, name))
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		defer f.Close()
+		if err := encode(f); err != nil {
+			t.Fatalf("failed to encode %s: %v", name, err)
+		}
+	}
+	writeFile("scan.tiff", func(w io.Writer) error { return tiff.Encode(w, img, nil) })
+	writeFile("scan.jpg", func(w io.Writer) error { return jpeg.Encode(w, img, nil) })
+	writeFile("icon.bmp", func(w io.Writer) error { return bmp.Encode(w, img) })
+
+	opts := config.Options{Quality: 80, Concurrency: 1, OnCollision: CollisionSuffix}
+	stats, err := NewCoordinator(inputDir, outputDir, opts).Run()
+	if err != nil {
+		t.Fatalf("pipeline error: %v", err)
+	}
+	if stats.SuccessfulFiles != 3 {
+		t.Fatalf("expected 3 successful files, got %d: %+v", stats.SuccessfulFiles, stats.ProcessedFiles)
+	}
+
+	// scan.tiff becomes a JPEG and must not overwrite the real scan.jpg
+	for _, name := range []string{"icon.png", "scan.jpg", "scan-1.jpg"} {
+		if _, err := os.Stat(filepath.Join(outputDir, name)); err != nil {
+			t.Errorf("expected output %s: %v", name, err)
+		}
+	}
+	for _, r := range stats.ProcessedFiles {
+		if filepath.Ext(r.FilePath) == ".tiff" && (r.SourceFormat != "tiff" || r.FileType != "jpeg") {
+			t.Errorf("expected tiff -> jpeg, got %s -> %s", r.SourceFormat, r.FileType)
+		}
+	}
+}
+
+func TestPipelineMatchesRelativePaths(t *testing.T) {
+	testDir := t.TempDir()
+	inputDir := filepath.Join(testDir, "in")
+	for _, rel := range []string{filepath.Join("gallery", "a.png"), "b.png"} {
+		path := filepath.Join(inputDir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create %s: %v", rel, err)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("failed to create test PNG: %v", err)
+		}
+		if err := png.Encode(f, image.NewGray(image.Rect(0, 0, 40, 40))); err != nil {
+			t.Fatalf("failed to encode test PNG: %v", err)
+		}
+		f.Close()
+	}
+
+	// Watermark globs match the walker's relative paths, whatever the
+	// options say the input directory is
+	opts := config.Options{
+		Quality:     80,
+		Concurrency: 2,
+		Watermark: config.Watermark{
+			Image:    image.NewGray(image.Rect(0, 0, 4, 4)),
+			Position: optimizer.PositionBottomRight,
+			Scale:    10,
+			Opacity:  1,
+			Include:  []string{"gallery"},
+		},
+	}
+	stats, err := NewCoordinator(inputDir, filepath.Join(testDir, "out"), opts).Run()
+	if err != nil {
+		t.Fatalf("pipeline error: %v", err)
+	}
+	for _, r := range stats.ProcessedFiles {
+		if want := filepath.Base(r.FilePath) == "a.png"; r.Watermarked != want {
+			t.Errorf("%s: watermarked = %t, want %t (%s)", r.RelativePath, r.Watermarked, want, r.Error)
+		}
+	}
+	if len(stats.ProcessedFiles) != 2 {
+		t.Errorf("expected 2 processed files, got %d", len(stats.ProcessedFiles))
+	}
+}
@@ -1,7 +1,9 @@
 package pipeline
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
@@ -61,11 +63,25 @@ func (wp *WorkerPool) worker() {
 			os.MkdirAll(wp.outputDir, 0755)
 		}
 
+		outputPath := job.OutputPath
+		if outputPath == "" {
+			outputPath = filepath.Join(wp.outputDir, filepath.Base(job.Path))
+			if job.Type == "image" {
+				outputPath = optimizer.ConvertedPath(outputPath, wp.opts.Conversions)
+			}
+		}
+
 		// Process based on file type
-		if job.Type == "image" {
-			result = optimizer.ProcessImage(job.Path, wp.outputDir, wp.opts, wp.opts.DryRun)
+		if job.Collision != "" {
+			result = collisionResult(job)
+		} else if job.Type == "image" {
+			result = optimizer.ProcessImage(job.Path, job.RelPath, outputPath, wp.opts, wp.opts.DryRun)
 		} else if job.Type == "svg" {
-			result = optimizer.ProcessSVG(job.Path, wp.outputDir, wp.opts.DryRun)
+			result = optimizer.ProcessSVG(job.Path, outputPath, wp.opts.DryRun)
+		}
+		result.RelativePath = job.RelPath
+		for i := range result.Variants {
+			result.Variants[i].RelativePath = job.RelPath
 		}
 
 		// Send result to results channel
@@ -75,6 +91,21 @@ func (wp *WorkerPool) worker() {
 	}
 }
 
+// collisionResult reports a file whose output path was already claimed
+func collisionResult(job FileInfo) optimizer.Result {
+	result := optimizer.Result{
+		FilePath:   job.Path,
+		OutputPath: job.OutputPath,
+	}
+	if job.Collision == CollisionSkip {
+		result.Skipped = true
+		result.Error = fmt.Sprintf("skipped: output path already used by %s", job.CollidesWith)
+	} else {
+		result.Error = fmt.Sprintf("output path collision with %s", job.CollidesWith)
+	}
+	return result
+}
+
 // Coordinator manages the entire pipeline: walker, worker pool, and results collection
 type Coordinator struct {
 	inputDir  string
@@ -95,11 +126,13 @@ func NewCoordinator(inputDir string, outputDir string, opts config.Options) *Coo
 func (c *Coordinator) Run() (PipelineStats, error) {
 	stats := PipelineStats{
 		ProcessedFiles: make([]optimizer.Result, 0),
+		Formats:        make(map[string]*FormatStats),
 	}
 
 	// Create channels
-	jobsCh := make(chan FileInfo, 100)          // Buffered channel for jobs
-	resultsCh := make(chan ProcessResult, 100)  // Buffered channel for results
+	walkCh := make(chan FileInfo, 100)         // Files found by the walker
+	jobsCh := make(chan FileInfo, 100)         // Buffered channel for jobs
+	resultsCh := make(chan ProcessResult, 100) // Buffered channel for results
 
 	// Parse ignore patterns
 	var ignorePatterns []string
@@ -108,7 +141,22 @@ func (c *Coordinator) Run() (PipelineStats, error) {
 	}
 
 	// Create and start walker (producer)
-	walker := NewWalker(c.inputDir, jobsCh, ignorePatterns, c.opts.MaxDepth, c.opts.MinSize)
+	walker := NewWalker(c.inputDir, walkCh, ignorePatterns, c.opts.MaxDepth, c.opts.MinSize)
+	layout := NewOutputLayout(c.outputDir, c.opts.Flatten, c.opts.OnCollision)
+	layout.Rename = func(job FileInfo, outputPath string) string {
+		if job.Type != "image" {
+			return outputPath
+		}
+		return optimizer.ConvertedPath(outputPath, c.opts.Conversions)
+	}
+	if c.opts.WebP || len(c.opts.Sizes) > 0 || c.opts.Format == optimizer.AutoFormat {
+		layout.Siblings = func(job FileInfo, outputPath string) []string {
+			if job.Type != "image" {
+				return nil
+			}
+			return optimizer.DerivedPaths(outputPath, c.opts)
+		}
+	}
 
 	// Create and start worker pool (consumers)
 	wp := NewWorkerPool(c.opts.Concurrency, jobsCh, resultsCh, c.opts, c.outputDir)
@@ -117,6 +165,14 @@ func (c *Coordinator) Run() (PipelineStats, error) {
 	// Start a goroutine to walk the directory
 	go func() {
 		walker.Walk()
+		close(walkCh)
+	}()
+
+	// Resolve output paths in walk order so collision suffixes are stable
+	go func() {
+		for job := range walkCh {
+			jobsCh <- layout.Resolve(job)
+		}
 		close(jobsCh) // Signal workers that no more jobs are coming
 	}()
 
@@ -128,9 +184,29 @@ func (c *Coordinator) Run() (PipelineStats, error) {
 
 	// Aggregate results
 	for result := range resultsCh {
+		if result.Result.HasLocation {
+			stats.LocationFiles = append(stats.LocationFiles, result.Result.RelativePath)
+		}
 		if result.Result.Success {
 			stats.SuccessfulFiles++
 			stats.TotalBytesSaved += result.Result.BytesSaved
+			if result.Result.KeptOriginal {
+				stats.KeptOriginalFiles++
+			}
+			if result.Result.SourceColor != "" {
+				stats.CMYKFiles++
+			}
+			if len(result.Result.SkippedSteps) > 0 {
+				stats.SkippedStepFiles = append(stats.SkippedStepFiles, result.Result.RelativePath)
+			}
+			stats.addFormat(result.Result)
+			for _, variant := range result.Result.Variants {
+				if variant.Success {
+					stats.addFormat(variant)
+				}
+			}
+		} else if result.Result.Skipped {
+			stats.SkippedFiles++
 		} else {
 			stats.FailedFiles++
 		}
@@ -10,16 +10,60 @@ type PipelineStats struct {
 	// Total number of files that failed
 	FailedFiles int
 
+	// Total number of files skipped without processing
+	SkippedFiles int
+
+	// Successful files whose original was kept because re-encoding did not
+	// save enough
+	KeptOriginalFiles int
+
+	// Successful files converted from print CMYK or YCCK to sRGB
+	CMYKFiles int
+
+	// Relative paths of the files whose GPS coordinates were removed
+	LocationFiles []string
+
+	// Relative paths of the animated GIFs that went without resizing or
+	// copies asked for
+	SkippedStepFiles []string
+
 	// Total bytes saved across all files
 	TotalBytesSaved int64
 
 	// Individual results for each file
 	ProcessedFiles []optimizer.Result
+
+	// Successful outputs aggregated by output format, including variants
+	Formats map[string]*FormatStats
+}
+
+// FormatStats aggregates the outputs written in one format
+type FormatStats struct {
+	Files         int
+	OriginalSize  int64
+	ProcessedSize int64
+	BytesSaved    int64
+}
+
+// addFormat records a successful output under its format
+func (ps *PipelineStats) addFormat(result optimizer.Result) {
+	if ps.Formats == nil {
+		ps.Formats = make(map[string]*FormatStats)
+	}
+	fs, ok := ps.Formats[result.FileType]
+	if !ok {
+		fs = &FormatStats{}
+		ps.Formats[result.FileType] = fs
+	}
+	fs.Files++
+	fs.OriginalSize += result.OriginalSize
+	fs.ProcessedSize += result.ProcessedSize
+	fs.BytesSaved += result.BytesSaved
 }
 
 // TotalFiles returns the total number of files processed
 func (ps *PipelineStats) TotalFiles() int {
-	return ps.SuccessfulFiles + ps.FailedFiles
+	return ps.SuccessfulFiles + ps.FailedFiles + ps.SkippedFiles
 }
 
 // AverageSavingsPerFile returns the average bytes saved per file
@@ -30,11 +74,12 @@ func (ps *PipelineStats) AverageSavingsPerFile() int64 {
 	return ps.TotalBytesSaved / int64(ps.SuccessfulFiles)
 }
 
-// SuccessRate returns the percentage of successful files
+// SuccessRate returns the percentage of successful files.
+// Skipped files are not counted as attempts.
 func (ps *PipelineStats) SuccessRate() float64 {
-	total := ps.TotalFiles()
-	if total == 0 {
+	attempted := ps.SuccessfulFiles + ps.FailedFiles
+	if attempted == 0 {
 		return 0
 	}
-	return float64(ps.SuccessfulFiles) / float64(total) * 100
+	return float64(ps.SuccessfulFiles) / float64(attempted) * 100
 }
@@ -8,8 +8,14 @@ import (
 
 // FileInfo represents a file to be processed
 type FileInfo struct {
-	Path string
-	Type string // "image" or "svg"
+	Path    string
+	RelPath string // Path relative to the walker's root directory
+	Type    string // "image" or "svg"
+
+	// Set by the output layout before the file reaches a worker
+	OutputPath   string
+	Collision    string // "error" or "skip" when OutputPath clashed with an earlier file
+	CollidesWith string // Input path that already claimed OutputPath
 }
 
 // Walker scans a directory recursively and sends files to the jobs channel
@@ -78,9 +84,14 @@ func (w *Walker) walkDir(dir string, depth int) error {
 			fileType := getFileType(ext)
 
 			if fileType != "" {
+				relPath, err := filepath.Rel(w.rootDir, path)
+				if err != nil {
+					relPath = entry.Name()
+				}
 				w.jobsCh <- FileInfo{
-					Path: path,
-					Type: fileType,
+					Path:    path,
+					RelPath: relPath,
+					Type:    fileType,
 				}
 			}
 		}
@@ -108,6 +119,8 @@ func getFileType(ext string) string {
 		return "image"
 	case ".png":
 		return "image"
+	case ".webp", ".gif", ".bmp", ".tif", ".tiff":
+		return "image"
 	case ".svg":
 		return "svg"
 	default:
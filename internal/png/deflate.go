@@ -0,0 +1,474 @@
+package png
+
+import (
+	"encoding/binary"
+	"hash/adler32"
+	"math"
+
+	"github.com/zulfikawr/bitrim/internal/huffman"
+)
+
+// Deflate limits (RFC 1951)
+const (
+	windowSize = 32768
+	minMatch   = 3
+	maxMatch   = 258
+	maxBits    = 15 // longest literal/length or distance code
+	maxCLBits  = 7  // longest code length code
+)
+
+// Search limits for the match finder
+const (
+	hashBits = 16
+	maxChain = 1024 // chain entries visited per position
+)
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+	// Order in which code length code lengths are stored
+	clOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// lengthSymbol maps a match length to its length code (0-28, add 257)
+var lengthSymbol = func() (t [maxMatch + 1]uint8) {
+	for code, base := range lengthBase {
+		for l := int(base); l < int(base)+1<<lengthExtra[code] && l <= maxMatch; l++ {
+			t[l] = uint8(code)
+		}
+	}
+	return t
+}()
+
+// distSymbol returns the distance code (0-29) for a match distance
+func distSymbol(dist int) int {
+	code := 0
+	for code+1 < len(distBase) && int(distBase[code+1]) <= dist {
+		code++
+	}
+	return code
+}
+
+// token is a literal byte (dist 0) or a back-reference
+type token struct {
+	litLen uint16
+	dist   uint16
+}
+
+// match is a back-reference candidate found by the match finder
+type match struct {
+	length uint16
+	dist   uint16
+}
+
+// zlibOptimal compresses data as a zlib stream, searching for the cheapest
+// LZ77 parse under a bit cost model that is refined over several iterations.
+// This is the approach of Zopfli: orders of magnitude slower than
+// compress/zlib, but usually a few percent smaller.
+func zlibOptimal(data []byte, iterations int) []byte {
+	offsets, matches := findMatches(data)
+
+	model := fixedCostModel()
+	var best []byte
+	for i := 0; i < iterations; i++ {
+		tokens := optimalParse(data, offsets, matches, model)
+		out := deflateBlock(tokens)
+		if best != nil && len(out) >= len(best) {
+			break
+		}
+		best = out
+		model = statisticsCostModel(tokens)
+	}
+
+	stream := make([]byte, 0, len(best)+6)
+	stream = append(stream, 0x78, 0xda) // deflate, 32K window, best compression
+	stream = append(stream, best...)
+	return binary.BigEndian.AppendUint32(stream, adler32.Checksum(data))
+}
+
+// findMatches records, for every position, the back-references on the
+// length/distance front: each is longer than the previous one and found at
+// the smallest distance giving that length. matches[offsets[i]:offsets[i+1]]
+// belong to position i.
+func findMatches(data []byte) ([]int32, []match) {
+	n := len(data)
+	offsets := make([]int32, n+1)
+	var matches []match
+
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, n)
+
+	for i := 0; i < n; i++ {
+		offsets[i] = int32(len(matches))
+		if i+minMatch > n {
+			continue
+		}
+		h := (uint32(data[i])<<16 | uint32(data[i+1])<<8 | uint32(data[i+2])) * 2654435761 >> (32 - hashBits)
+
+		limit := n - i
+		if limit > maxMatch {
+			limit = maxMatch
+		}
+		best := minMatch - 1
+		steps := 0
+		for cand := head[h]; cand >= 0 && i-int(cand) <= windowSize && steps < maxChain; cand = prev[cand] {
+			steps++
+			c := int(cand)
+			if data[c+best] != data[i+best] {
+				continue
+			}
+			l := 0
+			for l < limit && data[c+l] == data[i+l] {
+				l++
+			}
+			if l > best {
+				best = l
+				matches = append(matches, match{uint16(l), uint16(i - c)})
+				if l == limit {
+					break
+				}
+			}
+		}
+
+		prev[i] = head[h]
+		head[h] = int32(i)
+	}
+	offsets[n] = int32(len(matches))
+	return offsets, matches
+}
+
+// costModel holds the estimated bit cost of every literal/length and
+// distance symbol, excluding extra bits
+type costModel struct {
+	litLen [286]float64
+	dist   [30]float64
+}
+
+// fixedCostModel uses the code lengths of the fixed Huffman codes
+func fixedCostModel() *costModel {
+	m := &costModel{}
+	for s := range m.litLen {
+		switch {
+		case s < 144:
+			m.litLen[s] = 8
+		case s < 256:
+			m.litLen[s] = 9
+		case s < 280:
+			m.litLen[s] = 7
+		default:
+			m.litLen[s] = 8
+		}
+	}
+	for s := range m.dist {
+		m.dist[s] = 5
+	}
+	return m
+}
+
+// statisticsCostModel estimates symbol costs from their entropy in a parse
+func statisticsCostModel(tokens []token) *costModel {
+	litFreq, distFreq := tokenFrequencies(tokens)
+	m := &costModel{}
+	entropyCosts(litFreq[:], m.litLen[:])
+	entropyCosts(distFreq[:], m.dist[:])
+	return m
+}
+
+func entropyCosts(freqs []uint32, costs []float64) {
+	var total float64
+	for _, f := range freqs {
+		total += float64(f)
+	}
+	if total == 0 {
+		return
+	}
+	log2Total := math.Log2(total)
+	for s, f := range freqs {
+		if f == 0 {
+			// Unused symbols would need a code of their own
+			costs[s] = log2Total + 1
+		} else {
+			costs[s] = log2Total - math.Log2(float64(f))
+		}
+	}
+}
+
+// optimalParse finds the cheapest sequence of literals and matches under
+// the cost model by a shortest path search over positions
+func optimalParse(data []byte, offsets []int32, matches []match, model *costModel) []token {
+	n := len(data)
+
+	var lengthCost [maxMatch + 1]float64
+	for l := minMatch; l <= maxMatch; l++ {
+		sym := lengthSymbol[l]
+		lengthCost[l] = model.litLen[257+int(sym)] + float64(lengthExtra[sym])
+	}
+
+	cost := make([]float64, n+1)
+	for i := 1; i <= n; i++ {
+		cost[i] = math.Inf(1)
+	}
+	from := make([]match, n+1) // how each position was reached; length 1 is a literal
+
+	for i := 0; i < n; i++ {
+		if math.IsInf(cost[i], 1) {
+			continue
+		}
+
+		// Inside long runs of one byte the best step is always a full
+		// length match at distance 1; take it without trying every length
+		if i > 0 && runLength(data, i-1, 2*maxMatch+1) > 2*maxMatch {
+			c := cost[i] + lengthCost[maxMatch] + model.dist[0]
+			if c < cost[i+maxMatch] {
+				cost[i+maxMatch] = c
+				from[i+maxMatch] = match{maxMatch, 1}
+			}
+			// Positions in between are only reachable through this match
+			for j := i + 1; j < i+maxMatch; j++ {
+				cost[j] = math.Inf(1)
+			}
+			i += maxMatch - 1
+			continue
+		}
+
+		if c := cost[i] + model.litLen[data[i]]; c < cost[i+1] {
+			cost[i+1] = c
+			from[i+1] = match{1, 0}
+		}
+
+		shorter := minMatch - 1
+		for _, m := range matches[offsets[i]:offsets[i+1]] {
+			ds := distSymbol(int(m.dist))
+			dc := model.dist[ds] + float64(distExtra[ds])
+			for l := shorter + 1; l <= int(m.length); l++ {
+				if c := cost[i] + lengthCost[l] + dc; c < cost[i+l] {
+					cost[i+l] = c
+					from[i+l] = match{uint16(l), m.dist}
+				}
+			}
+			shorter = int(m.length)
+		}
+	}
+
+	var tokens []token
+	for i := n; i > 0; {
+		f := from[i]
+		if f.dist == 0 {
+			tokens = append(tokens, token{litLen: uint16(data[i-1])})
+		} else {
+			tokens = append(tokens, token{litLen: f.length, dist: f.dist})
+		}
+		i -= int(f.length)
+	}
+	for l, r := 0, len(tokens)-1; l < r; l, r = l+1, r-1 {
+		tokens[l], tokens[r] = tokens[r], tokens[l]
+	}
+	return tokens
+}
+
+// runLength counts how many bytes starting at i equal data[i], up to max
+func runLength(data []byte, i, max int) int {
+	n := 1
+	for n < max && i+n < len(data) && data[i+n] == data[i] {
+		n++
+	}
+	return n
+}
+
+// tokenFrequencies counts literal/length and distance symbols, including
+// the end of block symbol
+func tokenFrequencies(tokens []token) ([286]uint32, [30]uint32) {
+	var litFreq [286]uint32
+	var distFreq [30]uint32
+	for _, t := range tokens {
+		if t.dist == 0 {
+			litFreq[t.litLen]++
+		} else {
+			litFreq[257+int(lengthSymbol[t.litLen])]++
+			distFreq[distSymbol(int(t.dist))]++
+		}
+	}
+	litFreq[256]++
+	return litFreq, distFreq
+}
+
+// deflateBlock encodes tokens as a single final block with dynamic Huffman
+// codes and returns the raw deflate stream
+func deflateBlock(tokens []token) []byte {
+	litFreq, distFreq := tokenFrequencies(tokens)
+	// Give the distance tree two codes so it is complete even when no match
+	// is used, which some decoders require
+	used := 0
+	for _, f := range distFreq {
+		if f > 0 {
+			used++
+		}
+	}
+	for s := 0; used < 2; s++ {
+		if distFreq[s] == 0 {
+			distFreq[s] = 1
+			used++
+		}
+	}
+
+	litLens := huffman.Lengths(litFreq[:], maxBits)
+	distLens := huffman.Lengths(distFreq[:], maxBits)
+	litCodes := reversedCodes(litLens)
+	distCodes := reversedCodes(distLens)
+
+	hlit := 257
+	for s := len(litLens); s > 257; s-- {
+		if litLens[s-1] != 0 {
+			hlit = s
+			break
+		}
+	}
+	hdist := 1
+	for s := len(distLens); s > 1; s-- {
+		if distLens[s-1] != 0 {
+			hdist = s
+			break
+		}
+	}
+
+	// Run-length encode both code length sequences together
+	lengths := append(append([]uint8(nil), litLens[:hlit]...), distLens[:hdist]...)
+	clSyms := runLengthCodes(lengths)
+	var clFreq [19]uint32
+	for _, s := range clSyms {
+		clFreq[s.sym]++
+	}
+	clLens := huffman.Lengths(clFreq[:], maxCLBits)
+	clCodes := reversedCodes(clLens)
+	hclen := 4
+	for i := len(clOrder); i > 4; i-- {
+		if clLens[clOrder[i-1]] != 0 {
+			hclen = i
+			break
+		}
+	}
+
+	bw := &bitWriter{}
+	bw.writeBits(1, 1) // final block
+	bw.writeBits(2, 2) // dynamic Huffman codes
+	bw.writeBits(uint32(hlit-257), 5)
+	bw.writeBits(uint32(hdist-1), 5)
+	bw.writeBits(uint32(hclen-4), 4)
+	for _, s := range clOrder[:hclen] {
+		bw.writeBits(uint32(clLens[s]), 3)
+	}
+	for _, s := range clSyms {
+		bw.writeBits(uint32(clCodes[s.sym]), uint(clLens[s.sym]))
+		switch s.sym {
+		case 16:
+			bw.writeBits(uint32(s.extra), 2)
+		case 17:
+			bw.writeBits(uint32(s.extra), 3)
+		case 18:
+			bw.writeBits(uint32(s.extra), 7)
+		}
+	}
+
+	for _, t := range tokens {
+		if t.dist == 0 {
+			bw.writeBits(uint32(litCodes[t.litLen]), uint(litLens[t.litLen]))
+			continue
+		}
+		ls := int(lengthSymbol[t.litLen])
+		bw.writeBits(uint32(litCodes[257+ls]), uint(litLens[257+ls]))
+		bw.writeBits(uint32(t.litLen-lengthBase[ls]), uint(lengthExtra[ls]))
+		ds := distSymbol(int(t.dist))
+		bw.writeBits(uint32(distCodes[ds]), uint(distLens[ds]))
+		bw.writeBits(uint32(t.dist-distBase[ds]), uint(distExtra[ds]))
+	}
+	bw.writeBits(uint32(litCodes[256]), uint(litLens[256]))
+	return bw.bytes()
+}
+
+// clSymbol is a code length code with its extra bits
+type clSymbol struct {
+	sym   uint8
+	extra uint8
+}
+
+// runLengthCodes encodes code lengths with the repeat codes 16 (previous
+// length 3-6 times), 17 (3-10 zeros) and 18 (11-138 zeros)
+func runLengthCodes(lengths []uint8) []clSymbol {
+	var out []clSymbol
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+
+		if l == 0 {
+			for run >= 11 {
+				n := min(run, 138)
+				out = append(out, clSymbol{18, uint8(n - 11)})
+				run -= n
+			}
+			if run >= 3 {
+				out = append(out, clSymbol{17, uint8(run - 3)})
+				run = 0
+			}
+		} else {
+			out = append(out, clSymbol{l, 0})
+			run--
+			for run >= 3 {
+				n := min(run, 6)
+				out = append(out, clSymbol{16, uint8(n - 3)})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			out = append(out, clSymbol{l, 0})
+		}
+	}
+	return out
+}
+
+// reversedCodes returns canonical codes bit-reversed for LSB-first output
+func reversedCodes(lengths []uint8) []uint16 {
+	codes := huffman.Codes(lengths)
+	for s, l := range lengths {
+		codes[s] = huffman.Reverse(codes[s], l)
+	}
+	return codes
+}
+
+// bitWriter accumulates bits least-significant-bit first, as deflate
+// requires
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+// writeBits appends the low n bits of v (n <= 32)
+func (w *bitWriter) writeBits(v uint32, n uint) {
+	w.acc |= uint64(v&(1<<n-1)) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+// bytes flushes any partial byte and returns the written data
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc = 0
+		w.nbits = 0
+	}
+	return w.buf
+}
@@ -0,0 +1,160 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Keywords of the text chunks holding an XMP packet, and EXIF data written
+// hex-encoded by ImageMagick and exiftool
+const (
+	xmpKeyword     = "XML:com.adobe.xmp"
+	rawExifKeyword = "Raw profile type exif"
+	rawAPP1Keyword = "Raw profile type APP1"
+)
+
+// Exif returns the EXIF data (a TIFF structure) of the eXIf chunk of a PNG
+// file, or nil if it has none
+func Exif(data []byte) ([]byte, error) {
+	return findChunk(data, "eXIf", "IEND")
+}
+
+// RawExif returns the EXIF data (a TIFF structure) of a PNG file's "Raw
+// profile type exif" or "Raw profile type APP1" text chunk, or nil if it has
+// none
+func RawExif(data []byte) ([]byte, error) {
+	text, err := findText(data, rawExifKeyword, rawAPP1Keyword)
+	if text == nil || err != nil {
+		return nil, err
+	}
+
+	// A newline, the profile type, the length in bytes and the hex digits,
+	// split over lines
+	fields := bytes.Fields(text)
+	if len(fields) < 3 {
+		return nil, errors.New("png: malformed raw profile")
+	}
+	length, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return nil, errors.New("png: malformed raw profile")
+	}
+	profile, err := hex.DecodeString(string(bytes.Join(fields[2:], nil)))
+	if err != nil {
+		return nil, err
+	}
+	if length < len(profile) {
+		profile = profile[:length]
+	}
+	return bytes.TrimPrefix(profile, []byte("Exif\x00\x00")), nil
+}
+
+// XMP returns the XMP packet of the iTXt chunk keyed XML:com.adobe.xmp of a
+// PNG file, or nil if it has none
+func XMP(data []byte) ([]byte, error) {
+	return findText(data, xmpKeyword)
+}
+
+// findText returns the text of the first tEXt, zTXt or iTXt chunk with one
+// of the keywords, decompressed, or nil if there is none
+func findText(data []byte, keywords ...string) ([]byte, error) {
+	var text []byte
+	err := eachChunk(data, func(name string, chunk []byte) (bool, error) {
+		if name != "tEXt" && name != "zTXt" && name != "iTXt" {
+			return true, nil
+		}
+		sep := bytes.IndexByte(chunk, 0)
+		if sep < 0 {
+			return true, nil
+		}
+		keyword, body := string(chunk[:sep]), chunk[sep+1:]
+		found := false
+		for _, k := range keywords {
+			found = found || keyword == k
+		}
+		if !found {
+			return true, nil
+		}
+
+		compressed := name == "zTXt"
+		switch name {
+		case "zTXt":
+			// The compression method
+			if len(body) < 1 {
+				return false, errors.New("png: malformed zTXt chunk")
+			}
+			body = body[1:]
+		case "iTXt":
+			// The compression flag and method, then the language tag and
+			// translated keyword, each null-terminated
+			if len(body) < 2 {
+				return false, errors.New("png: malformed iTXt chunk")
+			}
+			compressed = body[0] == 1
+			body = body[2:]
+			for i := 0; i < 2; i++ {
+				end := bytes.IndexByte(body, 0)
+				if end < 0 {
+					return false, errors.New("png: malformed iTXt chunk")
+				}
+				body = body[end+1:]
+			}
+		}
+		if !compressed {
+			text = body
+			return false, nil
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		defer zr.Close()
+		text, err = io.ReadAll(zr)
+		return false, err
+	})
+	return text, err
+}
+
+// findChunk returns the data of the first chunk called name, or nil if
+// there is none before a chunk called stop
+func findChunk(data []byte, name string, stop string) ([]byte, error) {
+	var found []byte
+	err := eachChunk(data, func(n string, chunk []byte) (bool, error) {
+		switch n {
+		case name:
+			found = chunk
+			return false, nil
+		case stop:
+			return false, nil
+		}
+		return true, nil
+	})
+	return found, err
+}
+
+// eachChunk calls fn with the name and data of every chunk of a PNG file
+// up to IEND, for as long as it returns true
+func eachChunk(data []byte, fn func(name string, chunk []byte) (bool, error)) error {
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return errors.New("png: not a PNG file")
+	}
+	for pos := 8; pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || pos+12+length > len(data) {
+			return errors.New("png: chunk is truncated")
+		}
+		name := string(data[pos+4 : pos+8])
+		if name == "IEND" {
+			return nil
+		}
+		if more, err := fn(name, data[pos+8:pos+8+length]); !more || err != nil {
+			return err
+		}
+		pos += 12 + length
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"image"
+	"io"
+)
+
+// iccpName is the profile name written in iCCP chunks
+const iccpName = "ICC profile"
+
+// ICCProfile returns the ICC profile embedded in the iCCP chunk of a PNG
+// file, or nil if it has none
+func ICCProfile(data []byte) ([]byte, error) {
+	// The profile must come before the image data
+	chunk, err := findChunk(data, "iCCP", "IDAT")
+	if chunk == nil || err != nil {
+		return nil, err
+	}
+
+	// Profile name, a null separator and the compression method
+	sep := bytes.IndexByte(chunk, 0)
+	if sep < 0 || sep+2 > len(chunk) {
+		return nil, errors.New("png: malformed iCCP chunk")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(chunk[sep+2:]))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// iccpChunk returns the payload of an iCCP chunk holding profile
+func iccpChunk(profile []byte) ([]byte, error) {
+	compressed, err := zlibCompress(profile)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(iccpName), 0, 0), compressed...), nil
+}
+
+// suitsProfile returns the candidates whose color type an ICC profile may
+// describe: gray types for a gray profile and color types for any other.
+// Gray 8-bit images with a color profile fall back to RGB.
+func suitsProfile(img image.Image, rasters []*raster, profile []byte) []*raster {
+	gray := len(profile) >= 20 && string(profile[16:20]) == "GRAY"
+	var out []*raster
+	for _, r := range rasters {
+		if (r.colorType == ctGray || r.colorType == ctGrayAlpha) == gray {
+			out = append(out, r)
+		}
+	}
+	if _, wide := toNRGBA64(img); len(out) == 0 && !gray && !wide {
+		m := toNRGBA(img)
+		out = append(out, trueColorRaster(m, m.Opaque()))
+	}
+	return out
+}
@@ -0,0 +1,313 @@
+// Package png implements a lossless PNG encoder that reduces images to the
+// smallest color type and bit depth that holds them, tries every scanline
+// filter strategy and several deflate settings, and keeps the smallest file.
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Options controls how hard the encoder searches
+type Options struct {
+	// Zopfli recompresses the best candidate with the exhaustive deflate
+	// encoder (much slower, typically a few percent smaller)
+	Zopfli bool
+
+	// ICCProfile is embedded in an iCCP chunk. Only color types the profile
+	// can describe are considered (see suitsProfile); if none can hold the
+	// pixels exactly, the profile is dropped.
+	ICCProfile []byte
+}
+
+var errEmptyImage = errors.New("png: image has no pixels")
+
+// zopfliIterations is the number of cost model refinements of the
+// exhaustive deflate encoder
+const zopfliIterations = 8
+
+// PNG color types
+const (
+	ctGray      = 0
+	ctRGB       = 2
+	ctPaletted  = 3
+	ctGrayAlpha = 4
+	ctRGBA      = 6
+)
+
+// Filter strategies tried for every image: each of the five PNG filters on
+// every row, then the per-row adaptive choice
+const (
+	filterNone = iota
+	filterSub
+	filterUp
+	filterAverage
+	filterPaeth
+	filterAdaptive
+	nFilterStrategies
+)
+
+// Encode writes img to w as a PNG. Pixels are stored exactly, in the
+// smallest color type and bit depth that can hold them (see candidates).
+func Encode(w io.Writer, img image.Image, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if b := img.Bounds(); b.Dx() <= 0 || b.Dy() <= 0 {
+		return errEmptyImage
+	}
+
+	rasters := candidates(img)
+	var iccp []byte
+	if opts.ICCProfile != nil {
+		if suited := suitsProfile(img, rasters, opts.ICCProfile); len(suited) > 0 {
+			chunk, err := iccpChunk(opts.ICCProfile)
+			if err != nil {
+				return err
+			}
+			rasters, iccp = suited, chunk
+		}
+	}
+
+	var best, bestFiltered []byte
+	var bestRaster *raster
+	for _, r := range rasters {
+		for strategy := 0; strategy < nFilterStrategies; strategy++ {
+			filtered := r.filter(strategy)
+			compressed, err := zlibCompress(filtered)
+			if err != nil {
+				return err
+			}
+			if best == nil || r.overhead()+len(compressed) < bestRaster.overhead()+len(best) {
+				best, bestFiltered, bestRaster = compressed, filtered, r
+			}
+		}
+	}
+
+	if opts.Zopfli {
+		if compressed := zlibOptimal(bestFiltered, zopfliIterations); len(compressed) < len(best) {
+			best = compressed
+		}
+	}
+
+	return bestRaster.write(w, best, iccp)
+}
+
+// raster is an image as PNG scanlines, before filtering
+type raster struct {
+	width, height int
+	colorType     uint8
+	bitDepth      uint8
+	bpp           int // bytes per complete pixel, at least 1, for filtering
+	rows          [][]byte
+	palette       []color.NRGBA
+}
+
+// overhead is the size of the PLTE and tRNS chunks
+func (r *raster) overhead() int {
+	if r.colorType != ctPaletted {
+		return 0
+	}
+	n := 12 + 3*len(r.palette)
+	if t := r.transparentEntries(); t > 0 {
+		n += 12 + t
+	}
+	return n
+}
+
+// transparentEntries is the length of the tRNS chunk: palette entries up
+// to the last one that is not fully opaque
+func (r *raster) transparentEntries() int {
+	for i := len(r.palette) - 1; i >= 0; i-- {
+		if r.palette[i].A != 0xff {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// filter returns the scanlines filtered with the given strategy, each
+// prefixed by its filter type byte
+func (r *raster) filter(strategy int) []byte {
+	n := len(r.rows[0])
+	out := make([]byte, 0, r.height*(n+1))
+	prev := make([]byte, n)
+	var candidates [5][]byte
+	for i := range candidates {
+		candidates[i] = make([]byte, n)
+	}
+
+	for _, row := range r.rows {
+		if strategy != filterAdaptive {
+			filterRow(candidates[strategy], row, prev, strategy, r.bpp)
+			out = append(out, byte(strategy))
+			out = append(out, candidates[strategy]...)
+		} else {
+			// Pick the filter with the smallest sum of absolute signed
+			// residuals, the heuristic recommended by the PNG specification
+			best, bestSum := 0, -1
+			for f := range candidates {
+				filterRow(candidates[f], row, prev, f, r.bpp)
+				sum := 0
+				for _, v := range candidates[f] {
+					sum += int(absInt8(v))
+				}
+				if bestSum < 0 || sum < bestSum {
+					best, bestSum = f, sum
+				}
+			}
+			out = append(out, byte(best))
+			out = append(out, candidates[best]...)
+		}
+		prev = row
+	}
+	return out
+}
+
+// filterRow writes row filtered against prev into dst
+func filterRow(dst, row, prev []byte, filter, bpp int) {
+	switch filter {
+	case filterNone:
+		copy(dst, row)
+	case filterSub:
+		for i := range row {
+			var a byte
+			if i >= bpp {
+				a = row[i-bpp]
+			}
+			dst[i] = row[i] - a
+		}
+	case filterUp:
+		for i := range row {
+			dst[i] = row[i] - prev[i]
+		}
+	case filterAverage:
+		for i := range row {
+			var a int
+			if i >= bpp {
+				a = int(row[i-bpp])
+			}
+			dst[i] = row[i] - byte((a+int(prev[i]))/2)
+		}
+	case filterPaeth:
+		for i := range row {
+			var a, c byte
+			if i >= bpp {
+				a, c = row[i-bpp], prev[i-bpp]
+			}
+			dst[i] = row[i] - paeth(a, prev[i], c)
+		}
+	}
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func absInt8(v byte) byte {
+	if v >= 128 {
+		return -v
+	}
+	return v
+}
+
+// zlibCompress compresses data with the strongest compress/zlib setting
+func zlibCompress(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw, err := zlib.NewWriterLevel(buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// write emits the PNG signature and chunks around the compressed image data
+func (r *raster) write(w io.Writer, idat []byte, iccp []byte) error {
+	if _, err := io.WriteString(w, "\x89PNG\r\n\x1a\n"); err != nil {
+		return err
+	}
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(r.width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(r.height))
+	ihdr[8] = r.bitDepth
+	ihdr[9] = r.colorType
+	if err := writeChunk(w, "IHDR", ihdr); err != nil {
+		return err
+	}
+
+	if iccp != nil {
+		if err := writeChunk(w, "iCCP", iccp); err != nil {
+			return err
+		}
+	}
+
+	if r.colorType == ctPaletted {
+		plte := make([]byte, 0, 3*len(r.palette))
+		trns := make([]byte, 0, len(r.palette))
+		for _, c := range r.palette {
+			plte = append(plte, c.R, c.G, c.B)
+			trns = append(trns, c.A)
+		}
+		if err := writeChunk(w, "PLTE", plte); err != nil {
+			return err
+		}
+		// Trailing opaque entries are implied
+		if t := r.transparentEntries(); t > 0 {
+			if err := writeChunk(w, "tRNS", trns[:t]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writeChunk(w, "IDAT", idat); err != nil {
+		return err
+	}
+	return writeChunk(w, "IEND", nil)
+}
+
+func writeChunk(w io.Writer, name string, data []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	copy(header[4:], name)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	footer := make([]byte, 4)
+	binary.BigEndian.PutUint32(footer, crc.Sum32())
+
+	for _, b := range [][]byte{header, data, footer} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	stdpng "image/png"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// testImages returns one image of every type the encoder stores natively
+func testImages() map[string]image.Image {
+	const w, h = 37, 23 // odd sizes exercise partial bytes and filter edges
+	rgba := image.NewNRGBA(image.Rect(0, 0, w, h))
+	opaque := image.NewNRGBA(image.Rect(0, 0, w, h))
+	gray := image.NewGray(image.Rect(0, 0, w, h))
+	gray16 := image.NewGray16(image.Rect(0, 0, w, h))
+	wide := image.NewNRGBA64(image.Rect(0, 0, w, h))
+	premul := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{uint8(x * 7), uint8(y * 11), uint8(x * y), uint8(255 - x*3)}
+			rgba.SetNRGBA(x, y, c)
+			c.A = 255
+			opaque.SetNRGBA(x, y, c)
+			premul.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+			gray.SetGray(x, y, color.Gray{uint8(x * y)})
+			gray16.SetGray16(x, y, color.Gray16{uint16(x * y * 97)})
+			wide.SetNRGBA64(x, y, color.NRGBA64{uint16(x * 1777), uint16(y * 2999), 1, uint16(65535 - x)})
+		}
+	}
+
+	images := map[string]image.Image{
+		"nrgba":   rgba,
+		"opaque":  opaque,
+		"rgba":    premul,
+		"gray":    gray,
+		"gray16":  gray16,
+		"nrgba64": wide,
+	}
+	for _, n := range []int{2, 4, 16, 200} {
+		palette := make(color.Palette, n)
+		for i := range palette {
+			palette[i] = color.NRGBA{uint8(i), uint8(255 - i), uint8(i * 3), uint8(255 - i%3*100)}
+		}
+		m := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+		for i := range m.Pix {
+			m.Pix[i] = uint8(i * 31 % n)
+		}
+		images[fmt.Sprintf("paletted%d", n)] = m
+	}
+	return images
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for name, img := range testImages() {
+		for _, zopfli := range []bool{false, true} {
+			buf := new(bytes.Buffer)
+			if err := Encode(buf, img, &Options{Zopfli: zopfli}); err != nil {
+				t.Fatalf("%s: Encode failed: %v", name, err)
+			}
+			decoded, err := stdpng.Decode(buf)
+			if err != nil {
+				t.Fatalf("%s (zopfli %v): output does not decode: %v", name, zopfli, err)
+			}
+
+			b := img.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					want := color.NRGBA64Model.Convert(img.At(x, y))
+					got := color.NRGBA64Model.Convert(decoded.At(x, y))
+					if want != got {
+						t.Fatalf("%s (zopfli %v): pixel %d,%d changed from %v to %v", name, zopfli, x, y, want, got)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeSmallerThanStandard(t *testing.T) {
+	// A smooth gradient compresses much better with the right filter
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+
+	std := new(bytes.Buffer)
+	if err := stdpng.Encode(std, img); err != nil {
+		t.Fatalf("image/png failed: %v", err)
+	}
+	ours := new(bytes.Buffer)
+	if err := Encode(ours, img, nil); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if ours.Len() > std.Len() {
+		t.Errorf("expected at most %d bytes, got %d", std.Len(), ours.Len())
+	}
+}
+
+func TestZlibOptimal(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	inputs := map[string][]byte{
+		"empty":  {},
+		"byte":   {42},
+		"run":    bytes.Repeat([]byte{7}, 5000),
+		"random": make([]byte, 3000),
+		"text":   bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 300),
+	}
+	rng.Read(inputs["random"])
+	mixed := make([]byte, 0, 40000)
+	for len(mixed) < 40000 {
+		n := rng.Intn(300)
+		if rng.Intn(2) == 0 {
+			mixed = append(mixed, bytes.Repeat([]byte{byte(rng.Intn(4))}, n)...)
+		} else if len(mixed) > 1000 {
+			start := rng.Intn(len(mixed) - 500)
+			mixed = append(mixed, mixed[start:start+rng.Intn(500)]...)
+		} else {
+			for i := 0; i < n; i++ {
+				mixed = append(mixed, byte(rng.Intn(256)))
+			}
+		}
+	}
+	inputs["mixed"] = mixed
+
+	for name, data := range inputs {
+		compressed := zlibOptimal(data, zopfliIterations)
+		zr, err := zlib.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("%s: invalid zlib header: %v", name, err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("%s: stream does not inflate: %v", name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: round trip changed the data", name)
+		}
+
+		standard, err := zlibCompress(data)
+		if err != nil {
+			t.Fatalf("%s: zlib failed: %v", name, err)
+		}
+		if len(data) > 1000 && name != "random" && len(compressed) > len(standard) {
+			t.Errorf("%s: expected at most %d bytes, got %d", name, len(standard), len(compressed))
+		}
+	}
+}
+
+func TestEncodeReducesColorType(t *testing.T) {
+	const w, h = 40, 30
+	fill := func(m draw.Image, at func(x, y int) color.Color) image.Image {
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				m.Set(x, y, at(x, y))
+			}
+		}
+		return m
+	}
+	rect := image.Rect(0, 0, w, h)
+
+	cases := []struct {
+		name      string
+		img       image.Image
+		colorType uint8
+		bitDepth  uint8
+	}{
+		{"opaque rgba", fill(image.NewNRGBA(rect), func(x, y int) color.Color {
+			return color.NRGBA{uint8(x * 6), uint8(y * 8), uint8(x * y), 255}
+		}), ctRGB, 8},
+		{"black and white", fill(image.NewNRGBA(rect), func(x, y int) color.Color {
+			return color.NRGBA{uint8((x + y) % 2 * 255), uint8((x + y) % 2 * 255), uint8((x + y) % 2 * 255), 255}
+		}), ctGray, 1},
+		{"gray levels", fill(image.NewRGBA(rect), func(x, y int) color.Color {
+			v := uint8(x*y) | 1
+			return color.RGBA{v, v, v, 255}
+		}), ctGray, 8},
+		{"gray with alpha", fill(image.NewNRGBA(rect), func(x, y int) color.Color {
+			return color.NRGBA{uint8(x * 6), uint8(x * 6), uint8(x * 6), uint8(y * 8)}
+		}), ctGrayAlpha, 8},
+		{"three colors", fill(image.NewNRGBA(rect), func(x, y int) color.Color {
+			return []color.NRGBA{{255, 0, 0, 255}, {0, 0, 255, 255}, {0, 0, 0, 0}}[(x/4+y)%3]
+		}), ctPaletted, 2},
+		{"8-bit values in 16 bits", fill(image.NewNRGBA64(rect), func(x, y int) color.Color {
+			return color.NRGBA64{uint16(x*6) * 257, uint16(y*8) * 257, uint16(uint8(x*y)) * 257, 0xffff}
+		}), ctRGB, 8},
+		{"16-bit gray", fill(image.NewGray16(rect), func(x, y int) color.Color {
+			return color.Gray16{uint16(x*1000 + y)}
+		}), ctGray, 16},
+	}
+
+	for _, tc := range cases {
+		buf := new(bytes.Buffer)
+		if err := Encode(buf, tc.img, nil); err != nil {
+			t.Fatalf("%s: Encode failed: %v", tc.name, err)
+		}
+		// IHDR data starts after the signature, chunk length and type
+		ihdr := buf.Bytes()[16:29]
+		if ihdr[9] != tc.colorType || ihdr[8] != tc.bitDepth {
+			t.Errorf("%s: expected color type %d at %d bits, got %d at %d bits", tc.name, tc.colorType, tc.bitDepth, ihdr[9], ihdr[8])
+		}
+
+		decoded, err := stdpng.Decode(buf)
+		if err != nil {
+			t.Fatalf("%s: output does not decode: %v", tc.name, err)
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				want := color.NRGBA64Model.Convert(tc.img.At(x, y))
+				if got := color.NRGBA64Model.Convert(decoded.At(x, y)); got != want {
+					t.Fatalf("%s: pixel %d,%d changed from %v to %v", tc.name, x, y, want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeICCProfile(t *testing.T) {
+	// Only the header fields the encoder looks at matter here
+	profile := func(space string) []byte {
+		p := make([]byte, 200)
+		copy(p[16:], space)
+		copy(p[36:], "acsp")
+		return p
+	}
+	gray := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i)
+	}
+	bilevel := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range bilevel.Pix {
+		bilevel.Pix[i] = uint8(i % 2 * 255)
+	}
+	colorful := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := range colorful.Pix {
+		colorful.Pix[i] = uint8(i * 3)
+	}
+
+	cases := []struct {
+		name      string
+		img       image.Image
+		profile   []byte
+		colorType uint8
+		embedded  bool
+	}{
+		{"gray image, gray profile", gray, profile("GRAY"), ctGray, true},
+		{"gray image, RGB profile", gray, profile("RGB "), ctPaletted, true},
+		{"1-bit gray image, RGB profile", bilevel, profile("RGB "), ctRGB, true},
+		{"color image, RGB profile", colorful, profile("RGB "), ctRGBA, true},
+		{"color image, gray profile", colorful, profile("GRAY"), ctRGBA, false},
+	}
+	for _, tc := range cases {
+		buf := new(bytes.Buffer)
+		if err := Encode(buf, tc.img, &Options{ICCProfile: tc.profile}); err != nil {
+			t.Fatalf("%s: Encode failed: %v", tc.name, err)
+		}
+		if ct := buf.Bytes()[25]; ct != tc.colorType {
+			t.Errorf("%s: expected color type %d, got %d", tc.name, tc.colorType, ct)
+		}
+
+		got, err := ICCProfile(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%s: ICCProfile failed: %v", tc.name, err)
+		}
+		if embedded := got != nil; embedded != tc.embedded {
+			t.Errorf("%s: expected embedded=%t", tc.name, tc.embedded)
+		} else if embedded && !bytes.Equal(got, tc.profile) {
+			t.Errorf("%s: profile changed", tc.name)
+		}
+		if _, err := stdpng.Decode(buf); err != nil {
+			t.Fatalf("%s: output does not decode: %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// candidates returns the ways of storing img without changing a pixel that
+// are worth compressing: alpha is dropped when every pixel is opaque, color
+// when every pixel is gray, 16-bit samples are halved when the low byte
+// always repeats the high byte, gray levels are packed into 1, 2 or 4 bits
+// when they allow it, and images with at most 256 colors are also tried as
+// a 1, 2, 4 or 8-bit palette.
+func candidates(img image.Image) []*raster {
+	if wide, ok := toNRGBA64(img); ok {
+		if !fitsIn8Bits(wide) {
+			return []*raster{wideRaster(wide)}
+		}
+		img = narrow(wide)
+	}
+
+	m := toNRGBA(img)
+	isOpaque, isGray := m.Opaque(), grayscale(m)
+
+	var out []*raster
+	switch {
+	case isGray && isOpaque:
+		depth := grayDepth(m)
+		out = append(out, grayRaster(m, depth))
+		if depth < 8 {
+			// A palette cannot beat packed gray levels
+			return out
+		}
+	case isGray:
+		out = append(out, grayAlphaRaster(m))
+	default:
+		out = append(out, trueColorRaster(m, isOpaque))
+	}
+
+	if r := palettedRaster(m); r != nil {
+		out = append(out, r)
+	}
+	return out
+}
+
+// toNRGBA64 converts images with 16-bit samples to NRGBA64. It reports
+// false for 8-bit images.
+func toNRGBA64(img image.Image) (*image.NRGBA64, bool) {
+	switch m := img.(type) {
+	case *image.NRGBA64:
+		return m, true
+	case *image.Gray16, *image.RGBA64:
+		b := img.Bounds()
+		wide := image.NewNRGBA64(b)
+		draw.Draw(wide, b, img, b.Min, draw.Src)
+		return wide, true
+	default:
+		return nil, false
+	}
+}
+
+// toNRGBA converts img to NRGBA. Palettes are converted entry by entry, as
+// going through premultiplied alpha would round translucent colors.
+func toNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	switch m := img.(type) {
+	case *image.NRGBA:
+		return m
+	case *image.Paletted:
+		colors := make([]color.NRGBA, len(m.Palette))
+		for i, c := range m.Palette {
+			colors[i] = color.NRGBAModel.Convert(c).(color.NRGBA)
+		}
+		out := image.NewNRGBA(b)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				c := colors[m.Pix[y*m.Stride+x]]
+				p := out.Pix[y*out.Stride+4*x:]
+				p[0], p[1], p[2], p[3] = c.R, c.G, c.B, c.A
+			}
+		}
+		return out
+	default:
+		out := image.NewNRGBA(b)
+		draw.Draw(out, b, img, b.Min, draw.Src)
+		return out
+	}
+}
+
+// fitsIn8Bits reports whether every 16-bit sample is an 8-bit value scaled
+// by 257, so that dropping the low byte loses nothing
+func fitsIn8Bits(m *image.NRGBA64) bool {
+	for y := 0; y < m.Rect.Dy(); y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+8*m.Rect.Dx()]
+		for i := 0; i < len(row); i += 2 {
+			if row[i] != row[i+1] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// narrow keeps the high byte of every sample
+func narrow(m *image.NRGBA64) *image.NRGBA {
+	out := image.NewNRGBA(m.Rect)
+	for y := 0; y < m.Rect.Dy(); y++ {
+		src := m.Pix[y*m.Stride:]
+		dst := out.Pix[y*out.Stride : y*out.Stride+4*m.Rect.Dx()]
+		for i := range dst {
+			dst[i] = src[2*i]
+		}
+	}
+	return out
+}
+
+func grayscale(m *image.NRGBA) bool {
+	for y := 0; y < m.Rect.Dy(); y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+4*m.Rect.Dx()]
+		for i := 0; i < len(row); i += 4 {
+			if row[i] != row[i+1] || row[i] != row[i+2] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// grayDepth returns the smallest bit depth that represents every gray level
+// of m exactly. Levels at depth d are multiples of 255/(2^d-1).
+func grayDepth(m *image.NRGBA) uint8 {
+	var used [256]bool
+	for y := 0; y < m.Rect.Dy(); y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+4*m.Rect.Dx()]
+		for i := 0; i < len(row); i += 4 {
+			used[row[i]] = true
+		}
+	}
+	for _, depth := range []uint8{1, 2, 4} {
+		step := 255 / (1<<depth - 1)
+		fits := true
+		for v, ok := range used {
+			if ok && v%step != 0 {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			return depth
+		}
+	}
+	return 8
+}
+
+func newRasterFor(m image.Rectangle, colorType, bitDepth uint8, bpp int) *raster {
+	return &raster{
+		width:     m.Dx(),
+		height:    m.Dy(),
+		colorType: colorType,
+		bitDepth:  bitDepth,
+		bpp:       bpp,
+		rows:      make([][]byte, m.Dy()),
+	}
+}
+
+// grayRaster stores the red channel of m as gray levels of the given depth
+func grayRaster(m *image.NRGBA, depth uint8) *raster {
+	r := newRasterFor(m.Rect, ctGray, depth, 1)
+	step := 255 / (1<<depth - 1)
+	levels := make([]uint8, r.width)
+	for y := range r.rows {
+		src := m.Pix[y*m.Stride:]
+		for x := range levels {
+			levels[x] = src[4*x] / uint8(step)
+		}
+		r.rows[y] = packRow(levels, depth)
+	}
+	return r
+}
+
+func grayAlphaRaster(m *image.NRGBA) *raster {
+	r := newRasterFor(m.Rect, ctGrayAlpha, 8, 2)
+	for y := range r.rows {
+		src := m.Pix[y*m.Stride:]
+		row := make([]byte, 2*r.width)
+		for x := 0; x < r.width; x++ {
+			row[2*x], row[2*x+1] = src[4*x], src[4*x+3]
+		}
+		r.rows[y] = row
+	}
+	return r
+}
+
+func trueColorRaster(m *image.NRGBA, isOpaque bool) *raster {
+	if !isOpaque {
+		r := newRasterFor(m.Rect, ctRGBA, 8, 4)
+		for y := range r.rows {
+			r.rows[y] = append([]byte(nil), m.Pix[y*m.Stride:y*m.Stride+4*r.width]...)
+		}
+		return r
+	}
+
+	r := newRasterFor(m.Rect, ctRGB, 8, 3)
+	for y := range r.rows {
+		src := m.Pix[y*m.Stride : y*m.Stride+4*r.width]
+		row := make([]byte, 0, 3*r.width)
+		for i := 0; i < len(src); i += 4 {
+			row = append(row, src[i], src[i+1], src[i+2])
+		}
+		r.rows[y] = row
+	}
+	return r
+}
+
+// palettedRaster stores m with a palette of its exact colors, or returns nil
+// if it has more than 256. Entries that are not fully opaque come first so
+// the tRNS chunk stays short.
+func palettedRaster(m *image.NRGBA) *raster {
+	index := make(map[color.NRGBA]uint8)
+	var translucent, solid []color.NRGBA
+	for y := 0; y < m.Rect.Dy(); y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+4*m.Rect.Dx()]
+		for i := 0; i < len(row); i += 4 {
+			c := color.NRGBA{row[i], row[i+1], row[i+2], row[i+3]}
+			if _, ok := index[c]; ok {
+				continue
+			}
+			if len(index) == 256 {
+				return nil
+			}
+			index[c] = 0
+			if c.A == 0xff {
+				solid = append(solid, c)
+			} else {
+				translucent = append(translucent, c)
+			}
+		}
+	}
+	palette := append(translucent, solid...)
+	for i, c := range palette {
+		index[c] = uint8(i)
+	}
+
+	var depth uint8 = 8
+	switch {
+	case len(palette) <= 2:
+		depth = 1
+	case len(palette) <= 4:
+		depth = 2
+	case len(palette) <= 16:
+		depth = 4
+	}
+
+	r := newRasterFor(m.Rect, ctPaletted, depth, 1)
+	r.palette = palette
+	indices := make([]uint8, r.width)
+	for y := range r.rows {
+		src := m.Pix[y*m.Stride:]
+		for x := range indices {
+			p := src[4*x:]
+			indices[x] = index[color.NRGBA{p[0], p[1], p[2], p[3]}]
+		}
+		r.rows[y] = packRow(indices, depth)
+	}
+	return r
+}
+
+// wideRaster stores m with 16-bit samples, dropping alpha and color where
+// every pixel allows it
+func wideRaster(m *image.NRGBA64) *raster {
+	isGray := true
+	for y := 0; y < m.Rect.Dy() && isGray; y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+8*m.Rect.Dx()]
+		for i := 0; i < len(row); i += 8 {
+			if row[i] != row[i+2] || row[i+1] != row[i+3] || row[i] != row[i+4] || row[i+1] != row[i+5] {
+				isGray = false
+				break
+			}
+		}
+	}
+
+	// Sample offsets within an 8-byte pixel, two bytes each
+	channels := []int{0, 2, 4, 6}
+	colorType := uint8(ctRGBA)
+	switch {
+	case isGray && m.Opaque():
+		channels, colorType = []int{0}, ctGray
+	case isGray:
+		channels, colorType = []int{0, 6}, ctGrayAlpha
+	case m.Opaque():
+		channels, colorType = []int{0, 2, 4}, ctRGB
+	}
+
+	r := newRasterFor(m.Rect, colorType, 16, 2*len(channels))
+	for y := range r.rows {
+		src := m.Pix[y*m.Stride:]
+		row := make([]byte, 0, r.width*r.bpp)
+		for x := 0; x < r.width; x++ {
+			for _, c := range channels {
+				row = append(row, src[8*x+c], src[8*x+c+1])
+			}
+		}
+		r.rows[y] = row
+	}
+	return r
+}
+
+// packRow packs values of the given bit depth into bytes, most significant
+// bits first
+func packRow(values []uint8, depth uint8) []byte {
+	if depth == 8 {
+		return append([]byte(nil), values...)
+	}
+	perByte := 8 / int(depth)
+	row := make([]byte, (len(values)+perByte-1)/perByte)
+	for x, v := range values {
+		shift := 8 - int(depth)*(x%perByte+1)
+		row[x/perByte] |= v << shift
+	}
+	return row
+}
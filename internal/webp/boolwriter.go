@@ -0,0 +1,75 @@
+package webp
+
+// boolWriter is the VP8 boolean entropy encoder (RFC 6386 section 7.3)
+type boolWriter struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolWriter() *boolWriter {
+	return &boolWriter{rng: 255, bitCount: 24}
+}
+
+// writeBit codes bit, where prob is the probability (out of 256) of a zero
+func (e *boolWriter) writeBit(bit bool, prob uint8) {
+	split := 1 + ((e.rng-1)*uint32(prob))>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.carry()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.buf = append(e.buf, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// writeUint codes the low n bits of v, most significant bit first
+func (e *boolWriter) writeUint(v uint32, n uint, prob uint8) {
+	for n > 0 {
+		n--
+		e.writeBit(v>>n&1 == 1, prob)
+	}
+}
+
+// carry propagates an overflow of bottom into the bytes already written
+func (e *boolWriter) carry() {
+	i := len(e.buf) - 1
+	for i >= 0 && e.buf[i] == 255 {
+		e.buf[i] = 0
+		i--
+	}
+	if i >= 0 {
+		e.buf[i]++
+	}
+}
+
+// bytes flushes the encoder and returns the coded data
+func (e *boolWriter) bytes() []byte {
+	c := e.bitCount
+	v := e.bottom
+	if v&(1<<(32-c)) != 0 {
+		e.carry()
+	}
+	v <<= uint(c & 7)
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for i := 0; i < 4; i++ {
+		e.buf = append(e.buf, byte(v>>24))
+		v <<= 8
+	}
+	return e.buf
+}
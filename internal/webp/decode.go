@@ -0,0 +1,102 @@
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// Decode reads a WebP image. Lossy images come back from golang.org/x/image
+// as raw YCbCr planes, which image/color would interpret as full-range JFIF;
+// they are converted here with the limited-range BT.601 coefficients that
+// libwebp (and every browser) uses instead.
+func Decode(r io.Reader) (image.Image, error) {
+	img, err := xwebp.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	switch m := img.(type) {
+	case *image.YCbCr:
+		return yuvToNRGBA(m, nil), nil
+	case *image.NYCbCrA:
+		return yuvToNRGBA(&m.YCbCr, m), nil
+	default:
+		return img, nil
+	}
+}
+
+// yuvToNRGBA converts 4:2:0 planes to NRGBA, taking alpha from a when it
+// is not nil
+func yuvToNRGBA(m *image.YCbCr, a *image.NYCbCrA) *image.NRGBA {
+	b := m.Rect
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := out.Pix[(y-b.Min.Y)*out.Stride:]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			yi := m.YOffset(x, y)
+			ci := m.COffset(x, y)
+			yy := int(m.Y[yi])
+			u, v := int(m.Cb[ci]), int(m.Cr[ci])
+
+			p := row[4*(x-b.Min.X):]
+			p[0] = clipYUV(mulHi(yy, 19077) + mulHi(v, 26149) - 14234)
+			p[1] = clipYUV(mulHi(yy, 19077) - mulHi(u, 6419) - mulHi(v, 13320) + 8708)
+			p[2] = clipYUV(mulHi(yy, 19077) + mulHi(u, 33050) - 17685)
+			p[3] = 0xff
+			if a != nil {
+				p[3] = a.A[a.AOffset(x, y)]
+			}
+		}
+	}
+	return out
+}
+
+func mulHi(v, coeff int) int {
+	return v * coeff >> 8
+}
+
+// clipYUV scales a 14-bit fixed point channel value to 0-255
+func clipYUV(v int) uint8 {
+	if v&^16383 == 0 {
+		return uint8(v >> 6)
+	}
+	if v < 0 {
+		return 0
+	}
+	return 255
+}
+
+// Exif returns the EXIF data (a TIFF structure) of the EXIF chunk of a WebP
+// file, or nil if it has none
+func Exif(data []byte) []byte {
+	// Some writers keep the JPEG segment's header
+	return bytes.TrimPrefix(findChunk(data, "EXIF"), []byte("Exif\x00\x00"))
+}
+
+// XMP returns the XMP packet of the XMP chunk of a WebP file, or nil if it
+// has none
+func XMP(data []byte) []byte {
+	return findChunk(data, "XMP ")
+}
+
+// findChunk returns the data of the first chunk called name of a WebP file,
+// or nil if there is none
+func findChunk(data []byte, name string) []byte {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil
+	}
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size < 0 || pos+8+size > len(data) {
+			return nil
+		}
+		if string(data[pos:pos+4]) == name {
+			return data[pos+8 : pos+8+size]
+		}
+		pos += 8 + size + size%2
+	}
+	return nil
+}
@@ -0,0 +1,880 @@
+package webp
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/zulfikawr/bitrim/internal/huffman"
+)
+
+// VP8L bitstream constants, see the WebP lossless bitstream specification
+const (
+	vp8lSignature = 0x2f
+
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+	transformColorIndexing = 3
+
+	nLiteralCodes  = 256
+	nLengthCodes   = 24
+	nDistanceCodes = 40
+
+	maxCopyLength   = 4096
+	maxCopyDistance = 1<<20 - 120
+	maxCodeLength   = 15
+
+	colorCacheMultiplier = 0x1e35a7bd
+
+	predictorBits = 4
+
+	hashBits  = 18
+	maxChain  = 48
+	maxImgDim = 1 << 14
+)
+
+// codeLengthCodeOrder is the order in which code length code lengths are sent
+var codeLengthCodeOrder = [19]uint8{
+	17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// distanceMapTable maps plane codes 1..120 to (dy<<4 | 8-dx) neighbourhood offsets
+var distanceMapTable = [120]uint8{
+	0x18, 0x07, 0x17, 0x19, 0x28, 0x06, 0x27, 0x29, 0x16, 0x1a,
+	0x26, 0x2a, 0x38, 0x05, 0x37, 0x39, 0x15, 0x1b, 0x36, 0x3a,
+	0x25, 0x2b, 0x48, 0x04, 0x47, 0x49, 0x14, 0x1c, 0x35, 0x3b,
+	0x46, 0x4a, 0x24, 0x2c, 0x58, 0x45, 0x4b, 0x34, 0x3c, 0x03,
+	0x57, 0x59, 0x13, 0x1d, 0x56, 0x5a, 0x23, 0x2d, 0x44, 0x4c,
+	0x55, 0x5b, 0x33, 0x3d, 0x68, 0x02, 0x67, 0x69, 0x12, 0x1e,
+	0x66, 0x6a, 0x22, 0x2e, 0x54, 0x5c, 0x43, 0x4d, 0x65, 0x6b,
+	0x32, 0x3e, 0x78, 0x01, 0x77, 0x79, 0x53, 0x5d, 0x11, 0x1f,
+	0x64, 0x6c, 0x42, 0x4e, 0x76, 0x7a, 0x21, 0x2f, 0x75, 0x7b,
+	0x31, 0x3f, 0x63, 0x6d, 0x52, 0x5e, 0x00, 0x74, 0x7c, 0x41,
+	0x4f, 0x10, 0x20, 0x62, 0x6e, 0x30, 0x73, 0x7d, 0x51, 0x5f,
+	0x40, 0x72, 0x7e, 0x61, 0x6f, 0x50, 0x71, 0x7f, 0x60, 0x70,
+}
+
+var errTooLarge = errors.New("webp: image dimensions exceed 16384x16384")
+
+// token kinds produced by the backward reference search
+const (
+	tokenLiteral = iota
+	tokenCache
+	tokenCopy
+)
+
+// token is a literal pixel, a color cache hit or an LZ77 copy
+type token struct {
+	kind   uint8
+	argb   uint32 // literal pixel, or cache index for tokenCache
+	length uint32 // copy length
+	dist   uint32 // copy distance code (plane code mapped)
+}
+
+// prefixCode is a Huffman code ready for writing
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint16 // bit-reversed for the LSB-first writer
+}
+
+func (c *prefixCode) write(bw *bitWriter, sym uint32) {
+	bw.writeBits(uint32(c.codes[sym]), uint(c.lengths[sym]))
+}
+
+// encodeVP8L returns the VP8L bitstream (without RIFF framing) for img
+func encodeVP8L(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w < 1 || h < 1 || w > maxImgDim || h > maxImgDim {
+		return nil, errTooLarge
+	}
+
+	argb, hasAlpha := toARGB(img)
+
+	// Palette images usually compress best with the color indexing
+	// transform, but try the predictor path too and keep the smaller one
+	var best []byte
+	if palette := collectPalette(argb, 256); palette != nil {
+		bw := &bitWriter{}
+		writeHeader(bw, w, h, hasAlpha)
+		writePaletted(bw, argb, w, h, palette)
+		best = bw.bytes()
+	}
+
+	bw := &bitWriter{}
+	writeHeader(bw, w, h, hasAlpha)
+	writePredicted(bw, argb, w, h)
+	if out := bw.bytes(); best == nil || len(out) < len(best) {
+		best = out
+	}
+	return best, nil
+}
+
+// encodeAlphaVP8L returns the headerless VP8L stream stored in an ALPH
+// chunk, with the alpha plane of img carried in the green channel
+func encodeAlphaVP8L(img *image.NRGBA) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	argb := make([]uint32, w*h)
+	for y := 0; y < h; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < w; x++ {
+			argb[y*w+x] = 0xff000000 | uint32(row[4*x+3])<<8
+		}
+	}
+
+	var best []byte
+	if palette := collectPalette(argb, 256); palette != nil {
+		bw := &bitWriter{}
+		writePaletted(bw, argb, w, h, palette)
+		best = bw.bytes()
+	}
+
+	bw := &bitWriter{}
+	writePredicted(bw, argb, w, h)
+	if out := bw.bytes(); best == nil || len(out) < len(best) {
+		best = out
+	}
+	return best
+}
+
+func writeHeader(bw *bitWriter, w, h int, hasAlpha bool) {
+	bw.writeBits(vp8lSignature, 8)
+	bw.writeBits(uint32(w-1), 14)
+	bw.writeBits(uint32(h-1), 14)
+	if hasAlpha {
+		bw.writeBits(1, 1)
+	} else {
+		bw.writeBits(0, 1)
+	}
+	bw.writeBits(0, 3) // version
+}
+
+// writePredicted writes the subtract-green and predictor transforms followed
+// by the residual image
+func writePredicted(bw *bitWriter, argb []uint32, w, h int) {
+	pix := make([]uint32, len(argb))
+	copy(pix, argb)
+	subtractGreen(pix)
+
+	residual, modes := applyPredictor(pix, w, h, predictorBits)
+
+	bw.writeBits(1, 1)
+	bw.writeBits(transformSubtractGreen, 2)
+
+	bw.writeBits(1, 1)
+	bw.writeBits(transformPredictor, 2)
+	bw.writeBits(predictorBits-2, 3)
+	writeEntropyImage(bw, modes, tiles(w, predictorBits), false)
+
+	bw.writeBits(0, 1) // no more transforms
+	writeEntropyImage(bw, residual, w, true)
+}
+
+// writePaletted writes the color indexing transform followed by the
+// (possibly bundled) index image
+func writePaletted(bw *bitWriter, argb []uint32, w, h int, palette []uint32) {
+	index := make(map[uint32]uint32, len(palette))
+	for i, c := range palette {
+		index[c] = uint32(i)
+	}
+
+	// Pack several small indices into one pixel when the palette is tiny
+	xbits := 0
+	switch n := len(palette); {
+	case n <= 2:
+		xbits = 3
+	case n <= 4:
+		xbits = 2
+	case n <= 16:
+		xbits = 1
+	}
+	packedW := tiles(w, xbits)
+	bitsPerIndex := uint(8 >> xbits)
+	packed := make([]uint32, packedW*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := index[argb[y*w+x]]
+			p := y*packedW + x>>xbits
+			packed[p] |= i << (bitsPerIndex * uint(x&(1<<xbits-1)))
+		}
+	}
+	for i, v := range packed {
+		packed[i] = 0xff000000 | v<<8
+	}
+
+	// The palette itself is delta coded against the previous entry
+	deltas := make([]uint32, len(palette))
+	deltas[0] = palette[0]
+	for i := 1; i < len(palette); i++ {
+		deltas[i] = subPixels(palette[i], palette[i-1])
+	}
+
+	bw.writeBits(1, 1)
+	bw.writeBits(transformColorIndexing, 2)
+	bw.writeBits(uint32(len(palette)-1), 8)
+	writeEntropyImage(bw, deltas, len(palette), false)
+
+	bw.writeBits(0, 1) // no more transforms
+	writeEntropyImage(bw, packed, packedW, true)
+}
+
+// writeEntropyImage writes an entropy-coded image: color cache info, the
+// (single) group of prefix codes, and the coded pixels
+func writeEntropyImage(bw *bitWriter, argb []uint32, w int, topLevel bool) {
+	refs := backwardReferences(argb, w)
+
+	cacheBits, tokens := chooseColorCache(argb, refs)
+
+	if cacheBits > 0 {
+		bw.writeBits(1, 1)
+		bw.writeBits(uint32(cacheBits), 4)
+	} else {
+		bw.writeBits(0, 1)
+	}
+	if topLevel {
+		bw.writeBits(0, 1) // a single group of prefix codes for the whole image
+	}
+
+	hist := newHistograms(cacheBits)
+	hist.add(tokens)
+
+	var codes [5]prefixCode
+	for i, freqs := range hist.all() {
+		codes[i] = writePrefixCode(bw, freqs)
+	}
+
+	green, red, blue, alpha, dist := &codes[0], &codes[1], &codes[2], &codes[3], &codes[4]
+	for _, t := range tokens {
+		switch t.kind {
+		case tokenLiteral:
+			green.write(bw, t.argb>>8&0xff)
+			red.write(bw, t.argb>>16&0xff)
+			blue.write(bw, t.argb&0xff)
+			alpha.write(bw, t.argb>>24)
+		case tokenCache:
+			green.write(bw, nLiteralCodes+nLengthCodes+t.argb)
+		case tokenCopy:
+			sym, n, extra := prefixEncode(t.length)
+			green.write(bw, nLiteralCodes+sym)
+			bw.writeBits(extra, n)
+			sym, n, extra = prefixEncode(t.dist)
+			dist.write(bw, sym)
+			bw.writeBits(extra, n)
+		}
+	}
+}
+
+// histograms counts symbol usage for the five prefix codes of a group
+type histograms struct {
+	green, red, blue, alpha, dist []uint32
+}
+
+func newHistograms(cacheBits int) *histograms {
+	cacheSize := 0
+	if cacheBits > 0 {
+		cacheSize = 1 << cacheBits
+	}
+	return &histograms{
+		green: make([]uint32, nLiteralCodes+nLengthCodes+cacheSize),
+		red:   make([]uint32, nLiteralCodes),
+		blue:  make([]uint32, nLiteralCodes),
+		alpha: make([]uint32, nLiteralCodes),
+		dist:  make([]uint32, nDistanceCodes),
+	}
+}
+
+func (hs *histograms) add(tokens []token) {
+	for _, t := range tokens {
+		switch t.kind {
+		case tokenLiteral:
+			hs.green[t.argb>>8&0xff]++
+			hs.red[t.argb>>16&0xff]++
+			hs.blue[t.argb&0xff]++
+			hs.alpha[t.argb>>24]++
+		case tokenCache:
+			hs.green[nLiteralCodes+nLengthCodes+t.argb]++
+		case tokenCopy:
+			sym, _, _ := prefixEncode(t.length)
+			hs.green[nLiteralCodes+sym]++
+			sym, _, _ = prefixEncode(t.dist)
+			hs.dist[sym]++
+		}
+	}
+}
+
+func (hs *histograms) all() [5][]uint32 {
+	return [5][]uint32{hs.green, hs.red, hs.blue, hs.alpha, hs.dist}
+}
+
+// cost estimates the number of bits needed to code the histograms
+func (hs *histograms) cost() float64 {
+	total := 0.0
+	for _, freqs := range hs.all() {
+		total += entropy(freqs)
+	}
+	return total
+}
+
+// entropy returns the Shannon cost in bits of coding freqs, plus a rough
+// allowance for transmitting the code itself
+func entropy(freqs []uint32) float64 {
+	var sum uint64
+	used := 0
+	for _, f := range freqs {
+		sum += uint64(f)
+		if f > 0 {
+			used++
+		}
+	}
+	if sum == 0 {
+		return 0
+	}
+	bitsTotal := 0.0
+	for _, f := range freqs {
+		if f > 0 {
+			bitsTotal += float64(f) * math.Log2(float64(sum)/float64(f))
+		}
+	}
+	return bitsTotal + float64(used)*4
+}
+
+// chooseColorCache converts literals to color cache hits for a few cache
+// sizes and returns the size with the lowest estimated cost
+func chooseColorCache(argb []uint32, refs []token) (int, []token) {
+	bestBits, bestTokens := 0, refs
+	hist := newHistograms(0)
+	hist.add(refs)
+	bestCost := hist.cost()
+
+	for _, cacheBits := range []int{4, 6, 8, 10} {
+		tokens := applyColorCache(argb, refs, cacheBits)
+		hist := newHistograms(cacheBits)
+		hist.add(tokens)
+		if cost := hist.cost(); cost < bestCost {
+			bestBits, bestTokens, bestCost = cacheBits, tokens, cost
+		}
+	}
+	return bestBits, bestTokens
+}
+
+// applyColorCache replaces literals that are present in a color cache of
+// the given size with cache hits, mirroring the decoder's cache updates
+func applyColorCache(argb []uint32, refs []token, cacheBits int) []token {
+	cache := make([]uint32, 1<<cacheBits)
+	valid := make([]bool, 1<<cacheBits)
+	shift := 32 - uint(cacheBits)
+	out := make([]token, 0, len(refs))
+
+	pos := 0
+	for _, t := range refs {
+		switch t.kind {
+		case tokenLiteral:
+			key := (t.argb * colorCacheMultiplier) >> shift
+			if valid[key] && cache[key] == t.argb {
+				out = append(out, token{kind: tokenCache, argb: key})
+			} else {
+				out = append(out, t)
+			}
+			cache[key], valid[key] = t.argb, true
+			pos++
+		case tokenCopy:
+			out = append(out, t)
+			for _, p := range argb[pos : pos+int(t.length)] {
+				key := (p * colorCacheMultiplier) >> shift
+				cache[key], valid[key] = p, true
+			}
+			pos += int(t.length)
+		}
+	}
+	return out
+}
+
+// backwardReferences finds LZ77 copies with a hash chain over pixel pairs
+func backwardReferences(argb []uint32, w int) []token {
+	n := len(argb)
+	tokens := make([]token, 0, n/2+1)
+	planeCodes := planeCodeMap(w)
+
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, n)
+
+	insert := func(i int) {
+		if i+1 >= n {
+			return
+		}
+		hsh := hashPair(argb[i], argb[i+1])
+		prev[i] = head[hsh]
+		head[hsh] = int32(i)
+	}
+
+	matchLen := func(i, j int) int {
+		limit := n - i
+		if limit > maxCopyLength {
+			limit = maxCopyLength
+		}
+		l := 0
+		for l < limit && argb[i+l] == argb[j+l] {
+			l++
+		}
+		return l
+	}
+
+	for i := 0; i < n; {
+		bestLen, bestDist := 0, 0
+
+		// The pixel to the left and the one above are cheap to reference
+		for _, d := range [2]int{1, w} {
+			if d <= i {
+				if l := matchLen(i, i-d); l > bestLen {
+					bestLen, bestDist = l, d
+				}
+			}
+		}
+
+		if i+1 < n {
+			chain := 0
+			for j := head[hashPair(argb[i], argb[i+1])]; j >= 0 && chain < maxChain; j = prev[j] {
+				d := i - int(j)
+				if d > maxCopyDistance {
+					break
+				}
+				if l := matchLen(i, int(j)); l > bestLen {
+					bestLen, bestDist = l, d
+					if l == maxCopyLength {
+						break
+					}
+				}
+				chain++
+			}
+		}
+
+		code := distanceCode(bestDist, planeCodes)
+		minLen := 3
+		if code <= 4 {
+			minLen = 2
+		}
+		if bestLen >= minLen {
+			tokens = append(tokens, token{kind: tokenCopy, length: uint32(bestLen), dist: code})
+			for k := 0; k < bestLen; k++ {
+				insert(i + k)
+			}
+			i += bestLen
+			continue
+		}
+
+		tokens = append(tokens, token{kind: tokenLiteral, argb: argb[i]})
+		insert(i)
+		i++
+	}
+	return tokens
+}
+
+func hashPair(a, b uint32) uint32 {
+	return ((a * 0x9e3779b1) ^ (b*0x85ebca6b + 0x1b873593)) * 0xc2b2ae35 >> (32 - hashBits)
+}
+
+// planeCodeMap returns, for small linear distances, the smallest plane code
+// the decoder maps to that distance for an image of width w
+func planeCodeMap(w int) map[int]uint32 {
+	m := make(map[int]uint32, len(distanceMapTable))
+	for i := len(distanceMapTable) - 1; i >= 0; i-- {
+		c := int(distanceMapTable[i])
+		d := (c>>4)*w + 8 - c&0xf
+		if d < 1 {
+			d = 1
+		}
+		m[d] = uint32(i + 1)
+	}
+	return m
+}
+
+// distanceCode maps a linear LZ77 distance to its VP8L distance code
+func distanceCode(dist int, planeCodes map[int]uint32) uint32 {
+	if code, ok := planeCodes[dist]; ok {
+		return code
+	}
+	return uint32(dist) + uint32(len(distanceMapTable))
+}
+
+// prefixEncode splits a length or distance code (>= 1) into a prefix
+// symbol and its extra bits
+func prefixEncode(v uint32) (sym uint32, nExtra uint, extra uint32) {
+	n := v - 1
+	if n < 4 {
+		return n, 0, 0
+	}
+	hi := uint(bits.Len32(n) - 1)
+	second := (n >> (hi - 1)) & 1
+	nExtra = hi - 1
+	return uint32(2*hi) + second, nExtra, n & (1<<nExtra - 1)
+}
+
+// writePrefixCode builds a Huffman code for freqs, writes it to the
+// bitstream and returns it for coding symbols
+func writePrefixCode(bw *bitWriter, freqs []uint32) prefixCode {
+	code := prefixCode{
+		lengths: make([]uint8, len(freqs)),
+		codes:   make([]uint16, len(freqs)),
+	}
+
+	var used []int
+	for sym, f := range freqs {
+		if f > 0 {
+			used = append(used, sym)
+		}
+	}
+
+	// Simple codes hold one or two symbols below 256 with no tree
+	if len(used) == 0 || (len(used) <= 2 && used[len(used)-1] < 256) {
+		if len(used) == 0 {
+			used = []int{0}
+		}
+		bw.writeBits(1, 1)
+		bw.writeBits(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			bw.writeBits(0, 1)
+			bw.writeBits(uint32(used[0]), 1)
+		} else {
+			bw.writeBits(1, 1)
+			bw.writeBits(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			bw.writeBits(uint32(used[1]), 8)
+			code.lengths[used[0]], code.lengths[used[1]] = 1, 1
+			code.codes[used[1]] = 1
+		}
+		return code
+	}
+
+	lengths := huffman.Lengths(freqs, maxCodeLength)
+	bw.writeBits(0, 1)
+	writeCodeLengths(bw, lengths)
+
+	// A tree with a single symbol is decoded with zero bits
+	if len(used) == 1 {
+		return code
+	}
+	codes := huffman.Codes(lengths)
+	for sym, l := range lengths {
+		code.lengths[sym] = l
+		code.codes[sym] = huffman.Reverse(codes[sym], l)
+	}
+	return code
+}
+
+// writeCodeLengths writes code lengths using the code length code and its
+// run-length symbols 16 (repeat previous), 17 and 18 (repeat zero)
+func writeCodeLengths(bw *bitWriter, lengths []uint8) {
+	type clToken struct {
+		sym   uint8
+		extra uint32
+	}
+	var tokens []clToken
+	prev := uint8(8)
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		switch {
+		case l == 0 && run >= 11:
+			if run > 138 {
+				run = 138
+			}
+			tokens = append(tokens, clToken{18, uint32(run - 11)})
+		case l == 0 && run >= 3:
+			if run > 10 {
+				run = 10
+			}
+			tokens = append(tokens, clToken{17, uint32(run - 3)})
+		case l != 0 && l == prev && run >= 3:
+			if run > 6 {
+				run = 6
+			}
+			tokens = append(tokens, clToken{16, uint32(run - 3)})
+		default:
+			run = 1
+			tokens = append(tokens, clToken{l, 0})
+			if l != 0 {
+				prev = l
+			}
+		}
+		i += run
+	}
+
+	var freqs [19]uint32
+	for _, t := range tokens {
+		freqs[t.sym]++
+	}
+	clLengths := huffman.Lengths(freqs[:], 7)
+
+	n := len(codeLengthCodeOrder)
+	for n > 4 && clLengths[codeLengthCodeOrder[n-1]] == 0 {
+		n--
+	}
+	bw.writeBits(uint32(n-4), 4)
+	for _, sym := range codeLengthCodeOrder[:n] {
+		bw.writeBits(uint32(clLengths[sym]), 3)
+	}
+
+	used := 0
+	for _, f := range freqs {
+		if f > 0 {
+			used++
+		}
+	}
+	clCodes := huffman.Codes(clLengths)
+
+	bw.writeBits(0, 1) // code lengths for the whole alphabet follow
+	for _, t := range tokens {
+		if used > 1 {
+			l := clLengths[t.sym]
+			bw.writeBits(uint32(huffman.Reverse(clCodes[t.sym], l)), uint(l))
+		}
+		switch t.sym {
+		case 16:
+			bw.writeBits(t.extra, 2)
+		case 17:
+			bw.writeBits(t.extra, 3)
+		case 18:
+			bw.writeBits(t.extra, 7)
+		}
+	}
+}
+
+// toNRGBA returns img as a zero-origin *image.NRGBA
+func toNRGBA(img image.Image) *image.NRGBA {
+	if n, ok := img.(*image.NRGBA); ok && n.Rect.Min == (image.Point{}) {
+		return n
+	}
+	b := img.Bounds()
+	n := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(n, n.Bounds(), img, b.Min, draw.Src)
+	return n
+}
+
+// toARGB flattens img into VP8L's packed ARGB order and reports whether any
+// pixel is not fully opaque
+func toARGB(img image.Image) ([]uint32, bool) {
+	n := toNRGBA(img)
+	w, h := n.Rect.Dx(), n.Rect.Dy()
+	argb := make([]uint32, w*h)
+	hasAlpha := false
+	for y := 0; y < h; y++ {
+		row := n.Pix[y*n.Stride:]
+		for x := 0; x < w; x++ {
+			r, g, b, a := row[4*x], row[4*x+1], row[4*x+2], row[4*x+3]
+			if a != 0xff {
+				hasAlpha = true
+			}
+			argb[y*w+x] = uint32(a)<<24 | uint32(r)<<16 | uint32(g)<<8 | uint32(b)
+		}
+	}
+	return argb, hasAlpha
+}
+
+// collectPalette returns the sorted distinct colors of argb, or nil when
+// there are more than max
+func collectPalette(argb []uint32, max int) []uint32 {
+	seen := make(map[uint32]struct{}, max+1)
+	for _, c := range argb {
+		if _, ok := seen[c]; !ok {
+			seen[c] = struct{}{}
+			if len(seen) > max {
+				return nil
+			}
+		}
+	}
+	palette := make([]uint32, 0, len(seen))
+	for c := range seen {
+		palette = append(palette, c)
+	}
+	sort.Slice(palette, func(i, j int) bool { return palette[i] < palette[j] })
+	return palette
+}
+
+// tiles returns the number of 1<<bits sized tiles covering size pixels
+func tiles(size, bits int) int {
+	return (size + 1<<bits - 1) >> bits
+}
+
+// subtractGreen applies the subtract-green transform in place
+func subtractGreen(argb []uint32) {
+	for i, p := range argb {
+		g := p >> 8 & 0xff
+		r := (p>>16 - g) & 0xff
+		b := (p - g) & 0xff
+		argb[i] = p&0xff00ff00 | r<<16 | b
+	}
+}
+
+// applyPredictor chooses a predictor mode per tile and returns the residual
+// image together with the mode sub-image
+func applyPredictor(argb []uint32, w, h, tileBits int) (residual []uint32, modes []uint32) {
+	tw, th := tiles(w, tileBits), tiles(h, tileBits)
+	modes = make([]uint32, tw*th)
+	residual = make([]uint32, len(argb))
+	size := 1 << tileBits
+
+	for ty := 0; ty < th; ty++ {
+		for tx := 0; tx < tw; tx++ {
+			x0, y0 := tx*size, ty*size
+			x1, y1 := min(x0+size, w), min(y0+size, h)
+
+			bestMode, bestCost := 0, uint64(math.MaxUint64)
+			for mode := 0; mode < 14; mode++ {
+				var cost uint64
+				for y := max(y0, 1); y < y1; y++ {
+					for x := max(x0, 1); x < x1; x++ {
+						i := y*w + x
+						cost += residualCost(subPixels(argb[i], predict(mode, argb, i, w)))
+					}
+				}
+				if cost < bestCost {
+					bestMode, bestCost = mode, cost
+				}
+			}
+			modes[ty*tw+tx] = 0xff000000 | uint32(bestMode)<<8
+
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					i := y*w + x
+					var pred uint32
+					switch {
+					case x == 0 && y == 0:
+						pred = 0xff000000
+					case y == 0:
+						pred = argb[i-1]
+					case x == 0:
+						pred = argb[i-w]
+					default:
+						pred = predict(bestMode, argb, i, w)
+					}
+					residual[i] = subPixels(argb[i], pred)
+				}
+			}
+		}
+	}
+	return residual, modes
+}
+
+// residualCost scores a residual by the magnitude of its signed channels
+func residualCost(r uint32) uint64 {
+	var cost uint64
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(int8(r >> shift))
+		if v < 0 {
+			v = -v
+		}
+		cost += uint64(v)
+	}
+	return cost
+}
+
+// predict evaluates predictor mode for pixel i (not on the first row or
+// column). The top-right neighbour of the last column wraps to the first
+// pixel of the current row, matching the decoder's memory layout.
+func predict(mode int, argb []uint32, i, w int) uint32 {
+	l := argb[i-1]
+	t := argb[i-w]
+	tl := argb[i-w-1]
+	tr := argb[i-w+1]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return average2(average2(l, tr), t)
+	case 6:
+		return average2(l, tl)
+	case 7:
+		return average2(l, t)
+	case 8:
+		return average2(tl, t)
+	case 9:
+		return average2(t, tr)
+	case 10:
+		return average2(average2(l, tl), average2(t, tr))
+	case 11:
+		return selectPredictor(l, t, tl)
+	case 12:
+		return clampAddSubtractFull(l, t, tl)
+	default:
+		return clampAddSubtractHalf(average2(l, t), tl)
+	}
+}
+
+// average2 is the per-channel truncating average of two pixels
+func average2(a, b uint32) uint32 {
+	return (((a ^ b) & 0xfefefefe) >> 1) + (a & b)
+}
+
+// subPixels subtracts b from a per channel, modulo 256
+func subPixels(a, b uint32) uint32 {
+	alphaAndGreen := 0x00ff00ff + (a & 0xff00ff00) - (b & 0xff00ff00)
+	redAndBlue := 0xff00ff00 + (a & 0x00ff00ff) - (b & 0x00ff00ff)
+	return alphaAndGreen&0xff00ff00 | redAndBlue&0x00ff00ff
+}
+
+func channelAbsDiff(a, b uint32) int {
+	var sum int
+	for shift := 0; shift < 32; shift += 8 {
+		d := int(a>>shift&0xff) - int(b>>shift&0xff)
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return sum
+}
+
+func selectPredictor(l, t, tl uint32) uint32 {
+	pl := channelAbsDiff(tl, t)
+	pt := channelAbsDiff(tl, l)
+	if pl < pt {
+		return l
+	}
+	return t
+}
+
+func clampAddSubtractFull(a, b, c uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(a>>shift&0xff) + int(b>>shift&0xff) - int(c>>shift&0xff)
+		out |= uint32(clamp255(v)) << shift
+	}
+	return out
+}
+
+func clampAddSubtractHalf(a, b uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		av, bv := int(a>>shift&0xff), int(b>>shift&0xff)
+		out |= uint32(clamp255(av+(av-bv)/2)) << shift
+	}
+	return out
+}
+
+func clamp255(v int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return v
+}
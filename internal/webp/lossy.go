@@ -0,0 +1,928 @@
+package webp
+
+import (
+	"errors"
+	"image"
+	"io"
+	"math"
+)
+
+// VP8 (lossy) bitstream constants, see RFC 6386
+const (
+	maxVP8Dim = 1<<14 - 1
+
+	// maxLevel is the largest quantized coefficient magnitude we emit
+	maxLevel = 2047
+
+	// nTokenProbs is the number of adaptive token probabilities; token
+	// events with a larger index use the constant probability index-nTokenProbs
+	nTokenProbs = nPlane * nBand * nContext * nProb
+
+	// vp8xFlagAlpha marks a VP8X file as carrying an ALPH chunk
+	vp8xFlagAlpha = 0x10
+)
+
+// Intra prediction modes, in the decoder's numbering
+const (
+	predDC = iota
+	predTM
+	predVE
+	predHE
+	nPredModes
+)
+
+var (
+	errLossyTooLarge  = errors.New("webp: image dimensions exceed 16383x16383")
+	errHeaderTooLarge = errors.New("webp: VP8 header partition exceeds 512KiB")
+)
+
+// EncodeLossy writes img to w as a lossy (VP8) WebP file. quality ranges from
+// 0 (smallest file) to 100 (best quality), as for JPEG. Transparency is kept
+// losslessly in a separate alpha chunk.
+func EncodeLossy(w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	if b.Dx() < 1 || b.Dy() < 1 || b.Dx() > maxVP8Dim || b.Dy() > maxVP8Dim {
+		return errLossyTooLarge
+	}
+
+	nrgba := toNRGBA(img)
+	frame, err := encodeVP8(nrgba, quality)
+	if err != nil {
+		return err
+	}
+
+	if opaque(nrgba) {
+		return writeRIFF(w, chunk{"VP8 ", frame})
+	}
+
+	// ALPH header: no pre-processing, no filtering, VP8L compression
+	alpha := append([]byte{1}, encodeAlphaVP8L(nrgba)...)
+	return writeRIFF(w,
+		chunk{"VP8X", vp8xHeader(b.Dx(), b.Dy(), vp8xFlagAlpha)},
+		chunk{"ALPH", alpha},
+		chunk{"VP8 ", frame},
+	)
+}
+
+// vp8xHeader returns the payload of an extended-format VP8X chunk
+func vp8xHeader(w, h int, flags byte) []byte {
+	data := make([]byte, 10)
+	data[0] = flags
+	putUint24(data[4:], uint32(w-1))
+	putUint24(data[7:], uint32(h-1))
+	return data
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+// opaque reports whether every pixel of img is fully opaque
+func opaque(img *image.NRGBA) bool {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	for y := 0; y < h; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < w; x++ {
+			if row[4*x+3] != 0xff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// qualityToQuantizer maps a 0-100 quality to a VP8 quantizer index (0-127),
+// using the same curve as libwebp so that quality settings are comparable
+func qualityToQuantizer(quality int) int {
+	if quality < 0 {
+		quality = 0
+	}
+	if quality > 100 {
+		quality = 100
+	}
+	c := float64(quality) / 100
+	linear := 2*c - 1
+	if c < 0.75 {
+		linear = c * 2 / 3
+	}
+	q := int(127 * (1 - math.Cbrt(linear)))
+	if q < 0 {
+		q = 0
+	}
+	if q > 127 {
+		q = 127
+	}
+	return q
+}
+
+// quantMatrix holds the DC and AC step sizes of one coefficient type, with
+// the rounding bias (in 1/256ths of a step) applied when quantizing
+type quantMatrix struct {
+	q    [2]int32
+	bias [2]int32
+}
+
+func (m *quantMatrix) quantize(c int32, pos int) int16 {
+	k := 0
+	if pos > 0 {
+		k = 1
+	}
+	neg := c < 0
+	if neg {
+		c = -c
+	}
+	level := (c*256 + m.bias[k]*m.q[k]) / (m.q[k] * 256)
+	if level > maxLevel {
+		level = maxLevel
+	}
+	if neg {
+		level = -level
+	}
+	return int16(level)
+}
+
+func (m *quantMatrix) dequantize(level int16, pos int) int32 {
+	if pos > 0 {
+		return int32(level) * m.q[1]
+	}
+	return int32(level) * m.q[0]
+}
+
+// mbInfo is the per-macroblock data coded in the first partition
+type mbInfo struct {
+	yMode, uvMode int
+	skip          bool
+}
+
+// nzContext records which 4x4 blocks along a macroblock edge had non-zero
+// coefficients; it provides the token contexts for neighbouring blocks
+type nzContext struct {
+	y    [4]uint8
+	u, v [2]uint8
+	y2   uint8
+}
+
+// vp8Encoder encodes one key frame using 16x16 luma and 8x8 chroma intra
+// prediction
+type vp8Encoder struct {
+	w, h     int
+	mbw, mbh int
+
+	qIndex     int
+	y1, y2, uv quantMatrix
+
+	// Source and reconstructed planes, padded to whole macroblocks. The
+	// reconstruction is what the decoder sees before loop filtering, which
+	// is what intra prediction uses.
+	srcY, srcU, srcV []uint8
+	recY, recU, recV []uint8
+	yStride          int
+	uvStride         int
+
+	mbs     []mbInfo
+	topNz   []nzContext
+	leftNz  nzContext
+	events  []uint32 // token partition, as (probability index << 1 | bit)
+	counts  [nTokenProbs][2]uint32
+	skipped int
+}
+
+// encodeVP8 returns the VP8 key frame (without RIFF framing) for img
+func encodeVP8(img *image.NRGBA, quality int) ([]byte, error) {
+	e := newVP8Encoder(img, quality)
+	for mby := 0; mby < e.mbh; mby++ {
+		e.leftNz = nzContext{}
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.encodeMacroblock(mbx, mby)
+		}
+	}
+	return e.assemble()
+}
+
+func newVP8Encoder(img *image.NRGBA, quality int) *vp8Encoder {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	e := &vp8Encoder{
+		w:   w,
+		h:   h,
+		mbw: (w + 15) / 16,
+		mbh: (h + 15) / 16,
+	}
+	e.yStride = e.mbw * 16
+	e.uvStride = e.mbw * 8
+	e.mbs = make([]mbInfo, 0, e.mbw*e.mbh)
+	e.topNz = make([]nzContext, e.mbw)
+
+	q := qualityToQuantizer(quality)
+	e.qIndex = q
+	uvDC := q
+	if uvDC > 117 {
+		uvDC = 117
+	}
+	y2AC := int32(dequantTableAC[q]) * 155 / 100
+	if y2AC < 8 {
+		y2AC = 8
+	}
+	e.y1 = quantMatrix{q: [2]int32{int32(dequantTableDC[q]), int32(dequantTableAC[q])}, bias: [2]int32{96, 110}}
+	e.y2 = quantMatrix{q: [2]int32{int32(dequantTableDC[q]) * 2, y2AC}, bias: [2]int32{96, 108}}
+	e.uv = quantMatrix{q: [2]int32{int32(dequantTableDC[uvDC]), int32(dequantTableAC[q])}, bias: [2]int32{110, 115}}
+
+	e.srcY, e.srcU, e.srcV = toYUV420(img, e.mbw, e.mbh)
+	e.recY = make([]uint8, len(e.srcY))
+	e.recU = make([]uint8, len(e.srcU))
+	e.recV = make([]uint8, len(e.srcV))
+	return e
+}
+
+// toYUV420 converts img to limited-range BT.601 planes with 2x2 averaged
+// chroma, replicating the last row and column to fill whole macroblocks
+func toYUV420(img *image.NRGBA, mbw, mbh int) (yp, up, vp []uint8) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	yStride, uvStride := mbw*16, mbw*8
+	yp = make([]uint8, yStride*mbh*16)
+	up = make([]uint8, uvStride*mbh*8)
+	vp = make([]uint8, uvStride*mbh*8)
+
+	pixel := func(x, y int) (int, int, int) {
+		if x >= w {
+			x = w - 1
+		}
+		if y >= h {
+			y = h - 1
+		}
+		p := img.Pix[y*img.Stride+4*x:]
+		return int(p[0]), int(p[1]), int(p[2])
+	}
+
+	for y := 0; y < mbh*16; y++ {
+		for x := 0; x < yStride; x++ {
+			r, g, b := pixel(x, y)
+			yp[y*yStride+x] = uint8((16839*r + 33059*g + 6420*b + 16<<16 + 1<<15) >> 16)
+		}
+	}
+	for y := 0; y < mbh*8; y++ {
+		for x := 0; x < uvStride; x++ {
+			var r, g, b int
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				pr, pg, pb := pixel(2*x+d[0], 2*y+d[1])
+				r, g, b = r+pr, g+pg, b+pb
+			}
+			up[y*uvStride+x] = clipUV(-9719*r - 19081*g + 28800*b)
+			vp[y*uvStride+x] = clipUV(28800*r - 24116*g - 4684*b)
+		}
+	}
+	return yp, up, vp
+}
+
+// clipUV scales a chroma value computed from the sum of four pixels
+func clipUV(v int) uint8 {
+	v = (v + 1<<17 + 128<<18) >> 18
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// encodeMacroblock chooses prediction modes, transforms and quantizes the
+// residual, records its tokens and reconstructs the macroblock
+func (e *vp8Encoder) encodeMacroblock(mbx, mby int) {
+	var (
+		y2      [16]int16
+		y1      [16][16]int16
+		u, v    [4][16]int16
+		nonZero bool
+	)
+
+	// Luma: 16x16 prediction, with the DC of each 4x4 block sent through
+	// the second-order (Walsh-Hadamard) transform
+	yOff := mby*16*e.yStride + mbx*16
+	yMode := e.predict(e.srcY, e.recY, yOff, e.yStride, 16, mbx, mby)
+
+	var dcs [16]int32
+	var coeffs [16][16]int32
+	for n := 0; n < 16; n++ {
+		off := yOff + (n/4)*4*e.yStride + (n%4)*4
+		coeffs[n] = forwardDCT(e.srcY, e.recY, off, e.yStride)
+		dcs[n] = coeffs[n][0]
+	}
+	wht := forwardWHT(dcs)
+	var dqY2 [16]int32
+	for i := range wht {
+		y2[i] = e.y2.quantize(wht[i], i)
+		dqY2[i] = e.y2.dequantize(y2[i], i)
+		nonZero = nonZero || y2[i] != 0
+	}
+	dcOut := inverseWHT(dqY2)
+	for n := 0; n < 16; n++ {
+		var dq [16]int32
+		dq[0] = dcOut[n]
+		for i := 1; i < 16; i++ {
+			y1[n][i] = e.y1.quantize(coeffs[n][i], i)
+			dq[i] = e.y1.dequantize(y1[n][i], i)
+			nonZero = nonZero || y1[n][i] != 0
+		}
+		off := yOff + (n/4)*4*e.yStride + (n%4)*4
+		inverseDCT(dq, e.recY, off, e.yStride)
+	}
+
+	// Chroma: both planes share one 8x8 prediction mode
+	uvOff := mby*8*e.uvStride + mbx*8
+	uvMode := e.predictChroma(uvOff, mbx, mby)
+	for _, p := range []struct {
+		src, rec []uint8
+		levels   *[4][16]int16
+	}{{e.srcU, e.recU, &u}, {e.srcV, e.recV, &v}} {
+		for n := 0; n < 4; n++ {
+			off := uvOff + (n/2)*4*e.uvStride + (n%2)*4
+			c := forwardDCT(p.src, p.rec, off, e.uvStride)
+			var dq [16]int32
+			for i := range c {
+				p.levels[n][i] = e.uv.quantize(c[i], i)
+				dq[i] = e.uv.dequantize(p.levels[n][i], i)
+				nonZero = nonZero || p.levels[n][i] != 0
+			}
+			inverseDCT(dq, p.rec, off, e.uvStride)
+		}
+	}
+
+	info := mbInfo{yMode: yMode, uvMode: uvMode, skip: !nonZero}
+	e.mbs = append(e.mbs, info)
+	top := &e.topNz[mbx]
+	if info.skip {
+		e.skipped++
+		*top = nzContext{}
+		e.leftNz = nzContext{}
+		return
+	}
+
+	// Tokens, in the order the decoder parses them
+	nz := e.putBlock(planeY2, top.y2+e.leftNz.y2, &y2, 0)
+	top.y2, e.leftNz.y2 = nz, nz
+	for by := 0; by < 4; by++ {
+		for bx := 0; bx < 4; bx++ {
+			nz := e.putBlock(planeY1WithY2, top.y[bx]+e.leftNz.y[by], &y1[by*4+bx], 1)
+			top.y[bx], e.leftNz.y[by] = nz, nz
+		}
+	}
+	for _, p := range []struct {
+		levels    *[4][16]int16
+		top, left *[2]uint8
+	}{{&u, &top.u, &e.leftNz.u}, {&v, &top.v, &e.leftNz.v}} {
+		for by := 0; by < 2; by++ {
+			for bx := 0; bx < 2; bx++ {
+				nz := e.putBlock(planeUV, p.top[bx]+p.left[by], &p.levels[by*2+bx], 0)
+				p.top[bx], p.left[by] = nz, nz
+			}
+		}
+	}
+}
+
+// predict picks the 16x16 luma mode with the smallest squared error, writes
+// its prediction into the reconstruction and returns the mode
+func (e *vp8Encoder) predict(src, rec []uint8, off, stride, size, mbx, mby int) int {
+	top, left, corner := edges(rec, off, stride, size, mbx, mby)
+	best, bestErr := predDC, -1
+	var pred, bestPred [16 * 16]uint8
+	for mode := predDC; mode < nPredModes; mode++ {
+		fillPrediction(pred[:size*size], mode, top, left, corner, size, mbx, mby)
+		var sse int
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				d := int(src[off+j*stride+i]) - int(pred[j*size+i])
+				sse += d * d
+			}
+		}
+		if bestErr < 0 || sse < bestErr {
+			best, bestErr = mode, sse
+			bestPred = pred
+		}
+	}
+	for j := 0; j < size; j++ {
+		copy(rec[off+j*stride:off+j*stride+size], bestPred[j*size:(j+1)*size])
+	}
+	return best
+}
+
+// predictChroma picks one 8x8 mode for both chroma planes
+func (e *vp8Encoder) predictChroma(off, mbx, mby int) int {
+	const size = 8
+	uTop, uLeft, uCorner := edges(e.recU, off, e.uvStride, size, mbx, mby)
+	vTop, vLeft, vCorner := edges(e.recV, off, e.uvStride, size, mbx, mby)
+
+	best, bestErr := predDC, -1
+	var pu, pv, bestU, bestV [size * size]uint8
+	for mode := predDC; mode < nPredModes; mode++ {
+		fillPrediction(pu[:], mode, uTop, uLeft, uCorner, size, mbx, mby)
+		fillPrediction(pv[:], mode, vTop, vLeft, vCorner, size, mbx, mby)
+		var sse int
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				du := int(e.srcU[off+j*e.uvStride+i]) - int(pu[j*size+i])
+				dv := int(e.srcV[off+j*e.uvStride+i]) - int(pv[j*size+i])
+				sse += du*du + dv*dv
+			}
+		}
+		if bestErr < 0 || sse < bestErr {
+			best, bestErr = mode, sse
+			bestU, bestV = pu, pv
+		}
+	}
+	for j := 0; j < size; j++ {
+		o := off + j*e.uvStride
+		copy(e.recU[o:o+size], bestU[j*size:(j+1)*size])
+		copy(e.recV[o:o+size], bestV[j*size:(j+1)*size])
+	}
+	return best
+}
+
+// edges returns the reconstructed row above, column left of and pixel
+// above-left of a block, substituting the decoder's constants at the frame
+// edges (127 above the first row, 129 left of the first column)
+func edges(rec []uint8, off, stride, size, mbx, mby int) (top, left []uint8, corner uint8) {
+	top = make([]uint8, size)
+	left = make([]uint8, size)
+	switch {
+	case mby == 0:
+		corner = 0x7f
+		for i := range top {
+			top[i] = 0x7f
+		}
+	default:
+		copy(top, rec[off-stride:off-stride+size])
+		if mbx == 0 {
+			corner = 0x81
+		} else {
+			corner = rec[off-stride-1]
+		}
+	}
+	for j := range left {
+		if mbx == 0 {
+			left[j] = 0x81
+		} else {
+			left[j] = rec[off+j*stride-1]
+		}
+	}
+	return top, left, corner
+}
+
+// fillPrediction writes a size x size intra prediction. DC prediction only
+// averages the edges that exist, as the decoder does.
+func fillPrediction(pred []uint8, mode int, top, left []uint8, corner uint8, size, mbx, mby int) {
+	switch mode {
+	case predDC:
+		var sum, n int
+		if mby > 0 {
+			for _, t := range top {
+				sum += int(t)
+			}
+			n += size
+		}
+		if mbx > 0 {
+			for _, l := range left {
+				sum += int(l)
+			}
+			n += size
+		}
+		dc := uint8(0x80)
+		if n > 0 {
+			dc = uint8((sum + n/2) / n)
+		}
+		for i := range pred {
+			pred[i] = dc
+		}
+	case predTM:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				pred[j*size+i] = clip8(int32(left[j]) + int32(top[i]) - int32(corner))
+			}
+		}
+	case predVE:
+		for j := 0; j < size; j++ {
+			copy(pred[j*size:(j+1)*size], top)
+		}
+	case predHE:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				pred[j*size+i] = left[j]
+			}
+		}
+	}
+}
+
+func clip8(v int32) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// forwardDCT transforms the 4x4 difference between src and the prediction
+// already in rec at off. The integer arithmetic follows libwebp so that the
+// result inverts accurately with the decoder's transform.
+func forwardDCT(src, rec []uint8, off, stride int) [16]int32 {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		o := off + i*stride
+		d0 := int32(src[o]) - int32(rec[o])
+		d1 := int32(src[o+1]) - int32(rec[o+1])
+		d2 := int32(src[o+2]) - int32(rec[o+2])
+		d3 := int32(src[o+3]) - int32(rec[o+3])
+		a0, a1, a2, a3 := d0+d3, d1+d2, d1-d2, d0-d3
+		tmp[0+i*4] = (a0 + a1) * 8
+		tmp[1+i*4] = (a2*2217 + a3*5352 + 1812) >> 9
+		tmp[2+i*4] = (a0 - a1) * 8
+		tmp[3+i*4] = (a3*2217 - a2*5352 + 937) >> 9
+	}
+	var out [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := tmp[0+i] + tmp[12+i]
+		a1 := tmp[4+i] + tmp[8+i]
+		a2 := tmp[4+i] - tmp[8+i]
+		a3 := tmp[0+i] - tmp[12+i]
+		out[0+i] = (a0 + a1 + 7) >> 4
+		out[4+i] = (a2*2217 + a3*5352 + 12000) >> 16
+		if a3 != 0 {
+			out[4+i]++
+		}
+		out[8+i] = (a0 - a1 + 7) >> 4
+		out[12+i] = (a3*2217 - a2*5352 + 51000) >> 16
+	}
+	return out
+}
+
+// forwardWHT transforms the DC coefficients of the 16 luma blocks
+func forwardWHT(in [16]int32) [16]int32 {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		r := in[i*4 : i*4+4]
+		a0, a1 := r[0]+r[2], r[1]+r[3]
+		a2, a3 := r[1]-r[3], r[0]-r[2]
+		tmp[0+i*4] = a0 + a1
+		tmp[1+i*4] = a3 + a2
+		tmp[2+i*4] = a3 - a2
+		tmp[3+i*4] = a0 - a1
+	}
+	var out [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := tmp[0+i] + tmp[8+i]
+		a1 := tmp[4+i] + tmp[12+i]
+		a2 := tmp[4+i] - tmp[12+i]
+		a3 := tmp[0+i] - tmp[8+i]
+		out[0+i] = (a0 + a1) >> 1
+		out[4+i] = (a3 + a2) >> 1
+		out[8+i] = (a3 - a2) >> 1
+		out[12+i] = (a0 - a1) >> 1
+	}
+	return out
+}
+
+// inverseWHT mirrors the decoder's inverse Walsh-Hadamard transform and
+// returns the DC coefficient of each luma block
+func inverseWHT(in [16]int32) [16]int32 {
+	var m, out [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := in[0+i] + in[12+i]
+		a1 := in[4+i] + in[8+i]
+		a2 := in[4+i] - in[8+i]
+		a3 := in[0+i] - in[12+i]
+		m[0+i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		dc := m[0+i*4] + 3
+		a0 := dc + m[3+i*4]
+		a1 := m[1+i*4] + m[2+i*4]
+		a2 := m[1+i*4] - m[2+i*4]
+		a3 := dc - m[3+i*4]
+		out[i*4+0] = (a0 + a1) >> 3
+		out[i*4+1] = (a3 + a2) >> 3
+		out[i*4+2] = (a0 - a1) >> 3
+		out[i*4+3] = (a3 - a2) >> 3
+	}
+	return out
+}
+
+// inverseDCT mirrors the decoder's inverse DCT, adding the residual to the
+// prediction in rec at off
+func inverseDCT(c [16]int32, rec []uint8, off, stride int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2)
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2)
+	)
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := c[i] + c[8+i]
+		b := c[i] - c[8+i]
+		cc := (c[4+i]*c2)>>16 - (c[12+i]*c1)>>16
+		d := (c[4+i]*c1)>>16 + (c[12+i]*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + cc
+		m[i][2] = b - cc
+		m[i][3] = a - d
+	}
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		cc := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		o := off + j*stride
+		rec[o+0] = clip8(int32(rec[o+0]) + (a+d)>>3)
+		rec[o+1] = clip8(int32(rec[o+1]) + (b+cc)>>3)
+		rec[o+2] = clip8(int32(rec[o+2]) + (b-cc)>>3)
+		rec[o+3] = clip8(int32(rec[o+3]) + (a-d)>>3)
+	}
+}
+
+// probIndex returns the flat index of a token probability
+func probIndex(plane int, band uint8, ctx int) int {
+	return ((plane*nBand+int(band))*nContext + ctx) * nProb
+}
+
+// put records a token bit coded with an adaptive probability
+func (e *vp8Encoder) put(bit bool, idx int) {
+	b := uint32(0)
+	if bit {
+		b = 1
+	}
+	e.events = append(e.events, uint32(idx)<<1|b)
+	e.counts[idx][b]++
+}
+
+// putConst records a token bit coded with a fixed probability
+func (e *vp8Encoder) putConst(bit bool, prob uint8) {
+	b := uint32(0)
+	if bit {
+		b = 1
+	}
+	e.events = append(e.events, uint32(nTokenProbs+int(prob))<<1|b)
+}
+
+// putBlock records the tokens of one 4x4 block (levels in raster order),
+// starting at scan position first, and reports whether anything but an
+// immediate end-of-block was coded
+func (e *vp8Encoder) putBlock(plane int, ctx uint8, levels *[16]int16, first int) uint8 {
+	last := -1
+	for n := 15; n >= first; n-- {
+		if levels[zigzag[n]] != 0 {
+			last = n
+			break
+		}
+	}
+
+	n := first
+	p := probIndex(plane, bands[n], int(ctx))
+	if last < 0 {
+		e.put(false, p) // end of block
+		return 0
+	}
+	e.put(true, p)
+
+	for n < 16 {
+		level := int32(levels[zigzag[n]])
+		v := level
+		if v < 0 {
+			v = -v
+		}
+		n++
+		if v == 0 {
+			e.put(false, p+1)
+			p = probIndex(plane, bands[n], 0)
+			continue
+		}
+		e.put(true, p+1)
+
+		next := 2
+		switch {
+		case v == 1:
+			e.put(false, p+2)
+			next = 1
+		case v <= 4:
+			e.put(true, p+2)
+			e.put(false, p+3)
+			if v == 2 {
+				e.put(false, p+4)
+			} else {
+				e.put(true, p+4)
+				e.put(v == 4, p+5)
+			}
+		case v <= 10:
+			e.put(true, p+2)
+			e.put(true, p+3)
+			e.put(false, p+6)
+			if v <= 6 {
+				e.put(false, p+7)
+				e.putConst(v == 6, 159)
+			} else {
+				e.put(true, p+7)
+				e.putConst((v-7)>>1 == 1, 165)
+				e.putConst((v-7)&1 == 1, 145)
+			}
+		default:
+			e.put(true, p+2)
+			e.put(true, p+3)
+			e.put(true, p+6)
+			cat := 0
+			for cat < 3 && v >= 3+(8<<(cat+1)) {
+				cat++
+			}
+			e.put(cat >= 2, p+8)
+			e.put(cat&1 == 1, p+9+cat>>1)
+			extra := v - (3 + 8<<cat)
+			tab := cat3456[cat]
+			for i, prob := range tab {
+				e.putConst(extra>>(len(tab)-1-i)&1 == 1, prob)
+			}
+		}
+		e.putConst(level < 0, 128) // sign
+
+		if n == 16 {
+			return 1
+		}
+		p = probIndex(plane, bands[n], next)
+		if n > last {
+			e.put(false, p) // end of block
+			return 1
+		}
+		e.put(true, p)
+	}
+	return 1
+}
+
+// tokenProbs returns the token probabilities to use for the recorded events
+// and which of them differ from the defaults and must be sent
+func (e *vp8Encoder) tokenProbs() (probs [nTokenProbs]uint8, update [nTokenProbs]bool) {
+	for i := 0; i < nTokenProbs; i++ {
+		def := flatDefaultProb(i)
+		upd := flatUpdateProb(i)
+		probs[i] = def
+
+		c0, c1 := e.counts[i][0], e.counts[i][1]
+		total := c0 + c1
+		if total == 0 {
+			continue
+		}
+		p := (c0*256 + total/2) / total
+		if p < 1 {
+			p = 1
+		}
+		if p > 255 {
+			p = 255
+		}
+		newProb := uint8(p)
+		if newProb == def {
+			continue
+		}
+
+		oldCost := bitCost(false, def)*float64(c0) + bitCost(true, def)*float64(c1) + bitCost(false, upd)
+		newCost := bitCost(false, newProb)*float64(c0) + bitCost(true, newProb)*float64(c1) + bitCost(true, upd) + 8
+		if newCost < oldCost {
+			probs[i] = newProb
+			update[i] = true
+		}
+	}
+	return probs, update
+}
+
+func flatDefaultProb(i int) uint8 {
+	return defaultTokenProb[i/(nBand*nContext*nProb)][i/(nContext*nProb)%nBand][i/nProb%nContext][i%nProb]
+}
+
+func flatUpdateProb(i int) uint8 {
+	return tokenProbUpdateProb[i/(nBand*nContext*nProb)][i/(nContext*nProb)%nBand][i/nProb%nContext][i%nProb]
+}
+
+// bitCost returns the cost in bits of coding bit with probability prob
+func bitCost(bit bool, prob uint8) float64 {
+	p := float64(prob) / 256
+	if bit {
+		p = 1 - p
+	}
+	return -math.Log2(p)
+}
+
+// filterLevel derives a normal loop filter strength from the quantizer,
+// roughly following libwebp's default filter strength
+func (e *vp8Encoder) filterLevel() int {
+	level := int(dequantTableAC[e.qIndex]) * 5 / 12
+	if level < 2 {
+		return 0
+	}
+	if level > 63 {
+		return 63
+	}
+	return level
+}
+
+// assemble writes the frame header, the first partition (frame settings
+// and per-macroblock modes) and the token partition
+func (e *vp8Encoder) assemble() ([]byte, error) {
+	probs, update := e.tokenProbs()
+
+	total := len(e.mbs)
+	skipProb := uint32(255)
+	if e.skipped > 0 {
+		skipProb = (uint32(total-e.skipped)*256 + uint32(total)/2) / uint32(total)
+		if skipProb < 1 {
+			skipProb = 1
+		}
+		if skipProb > 255 {
+			skipProb = 255
+		}
+	}
+
+	hdr := newBoolWriter()
+	hdr.writeBit(false, 128) // color space
+	hdr.writeBit(false, 128) // clamping required
+	hdr.writeBit(false, 128) // no segmentation
+
+	hdr.writeBit(false, 128) // normal loop filter
+	hdr.writeUint(uint32(e.filterLevel()), 6, 128)
+	hdr.writeUint(0, 3, 128) // sharpness
+	hdr.writeBit(false, 128) // no loop filter deltas
+
+	hdr.writeUint(0, 2, 128) // one token partition
+
+	hdr.writeUint(uint32(e.qIndex), 7, 128)
+	for i := 0; i < 5; i++ {
+		hdr.writeBit(false, 128) // no quantizer deltas
+	}
+	hdr.writeBit(false, 128) // refresh entropy probs
+
+	for i := 0; i < nTokenProbs; i++ {
+		hdr.writeBit(update[i], flatUpdateProb(i))
+		if update[i] {
+			hdr.writeUint(uint32(probs[i]), 8, 128)
+		}
+	}
+
+	hdr.writeBit(true, 128) // skip flags are coded
+	hdr.writeUint(skipProb, 8, 128)
+
+	for _, mb := range e.mbs {
+		hdr.writeBit(mb.skip, uint8(skipProb))
+		hdr.writeBit(true, 145) // 16x16 luma prediction
+		switch mb.yMode {
+		case predDC:
+			hdr.writeBit(false, 156)
+			hdr.writeBit(false, 163)
+		case predVE:
+			hdr.writeBit(false, 156)
+			hdr.writeBit(true, 163)
+		case predHE:
+			hdr.writeBit(true, 156)
+			hdr.writeBit(false, 128)
+		case predTM:
+			hdr.writeBit(true, 156)
+			hdr.writeBit(true, 128)
+		}
+		switch mb.uvMode {
+		case predDC:
+			hdr.writeBit(false, 142)
+		case predVE:
+			hdr.writeBit(true, 142)
+			hdr.writeBit(false, 114)
+		case predHE:
+			hdr.writeBit(true, 142)
+			hdr.writeBit(true, 114)
+			hdr.writeBit(false, 183)
+		case predTM:
+			hdr.writeBit(true, 142)
+			hdr.writeBit(true, 114)
+			hdr.writeBit(true, 183)
+		}
+	}
+	first := hdr.bytes()
+	if len(first) >= 1<<19 {
+		return nil, errHeaderTooLarge
+	}
+
+	tokens := newBoolWriter()
+	for _, ev := range e.events {
+		idx := int(ev >> 1)
+		prob := uint8(idx - nTokenProbs)
+		if idx < nTokenProbs {
+			prob = probs[idx]
+		}
+		tokens.writeBit(ev&1 == 1, prob)
+	}
+	part := tokens.bytes()
+
+	// Frame tag: key frame, version 0, shown, first partition size
+	tag := uint32(1<<4) | uint32(len(first))<<5
+	out := make([]byte, 0, 10+len(first)+len(part))
+	out = append(out, byte(tag), byte(tag>>8), byte(tag>>16))
+	out = append(out, 0x9d, 0x01, 0x2a)
+	out = append(out, byte(e.w), byte(e.w>>8), byte(e.h), byte(e.h>>8))
+	out = append(out, first...)
+	return append(out, part...), nil
+}
@@ -0,0 +1,57 @@
+// Package webp implements a pure Go WebP encoder.
+package webp
+
+import (
+	"encoding/binary"
+	"image"
+	"io"
+)
+
+// EncodeLossless writes img to w as a lossless (VP8L) WebP file
+func EncodeLossless(w io.Writer, img image.Image) error {
+	data, err := encodeVP8L(img)
+	if err != nil {
+		return err
+	}
+	return writeRIFF(w, chunk{"VP8L", data})
+}
+
+// chunk is a single RIFF chunk
+type chunk struct {
+	fourCC string
+	data   []byte
+}
+
+// writeRIFF frames the chunks in a RIFF/WEBP container
+func writeRIFF(w io.Writer, chunks ...chunk) error {
+	size := 4 // "WEBP"
+	for _, c := range chunks {
+		size += 8 + len(c.data) + len(c.data)&1
+	}
+
+	header := make([]byte, 12)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(size))
+	copy(header[8:], "WEBP")
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, c := range chunks {
+		var ch [8]byte
+		copy(ch[:], c.fourCC)
+		binary.LittleEndian.PutUint32(ch[4:], uint32(len(c.data)))
+		if _, err := w.Write(ch[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(c.data); err != nil {
+			return err
+		}
+		if len(c.data)&1 == 1 {
+			if _, err := w.Write([]byte{0}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// testImage returns a gradient with noise and, optionally, varying alpha
+func testImage(w, h int, alpha bool) *image.NRGBA {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			a := uint8(255)
+			if alpha {
+				a = uint8(x * 255 / w)
+			}
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(x*4) + uint8(rng.Intn(8)),
+				G: uint8(y * 3),
+				B: uint8((x + y) * 2),
+				A: a,
+			})
+		}
+	}
+	return img
+}
+
+// fewColorImage returns an image with n distinct colors in stripes
+func fewColorImage(w, h, n int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := (x/3 + y/5) % n
+			img.SetNRGBA(x, y, color.NRGBA{uint8(i * 37), uint8(i * 91), uint8(255 - i*13), uint8(255 - i%2*100)})
+		}
+	}
+	return img
+}
+
+func assertSamePixels(t *testing.T, want *image.NRGBA, got image.Image) {
+	t.Helper()
+	if got.Bounds().Dx() != want.Bounds().Dx() || got.Bounds().Dy() != want.Bounds().Dy() {
+		t.Fatalf("size mismatch: want %v, got %v", want.Bounds(), got.Bounds())
+	}
+	for y := 0; y < want.Bounds().Dy(); y++ {
+		for x := 0; x < want.Bounds().Dx(); x++ {
+			w := want.NRGBAAt(x, y)
+			g := color.NRGBAModel.Convert(got.At(got.Bounds().Min.X+x, got.Bounds().Min.Y+y)).(color.NRGBA)
+			if w != g {
+				t.Fatalf("pixel (%d,%d): want %v, got %v", x, y, w, g)
+			}
+		}
+	}
+}
+
+func TestEncodeLosslessRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"opaque", testImage(67, 45, false)},
+		{"alpha", testImage(40, 33, true)},
+		{"two colors", fewColorImage(50, 20, 2)},
+		{"four colors", fewColorImage(31, 17, 4)},
+		{"sixteen colors", fewColorImage(64, 64, 16)},
+		{"palette", fewColorImage(70, 70, 200)},
+		{"single pixel", testImage(1, 1, false)},
+		{"single row", testImage(300, 1, true)},
+		{"single column", testImage(1, 123, false)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeLossless(&buf, tc.img); err != nil {
+				t.Fatalf("EncodeLossless: %v", err)
+			}
+			got, err := xwebp.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			assertSamePixels(t, tc.img, got)
+		})
+	}
+}
+
+func TestEncodeLosslessCompresses(t *testing.T) {
+	img := fewColorImage(256, 256, 8)
+	var buf bytes.Buffer
+	if err := EncodeLossless(&buf, img); err != nil {
+		t.Fatalf("EncodeLossless: %v", err)
+	}
+	if raw := len(img.Pix); buf.Len() > raw/20 {
+		t.Errorf("expected strong compression of a striped image, got %d bytes from %d", buf.Len(), raw)
+	}
+}
+
+// lumaPSNR compares the luma plane of a decoded lossy image with the luma
+// the encoder derived from want
+func lumaPSNR(t *testing.T, want *image.NRGBA, got image.Image) float64 {
+	t.Helper()
+	var ycc *image.YCbCr
+	switch g := got.(type) {
+	case *image.YCbCr:
+		ycc = g
+	case *image.NYCbCrA:
+		ycc = &g.YCbCr
+	default:
+		t.Fatalf("expected a YCbCr image, got %T", got)
+	}
+
+	w, h := want.Rect.Dx(), want.Rect.Dy()
+	if ycc.Rect.Dx() != w || ycc.Rect.Dy() != h {
+		t.Fatalf("size mismatch: want %v, got %v", want.Rect, ycc.Rect)
+	}
+	mbw := (w + 15) / 16
+	srcY, _, _ := toYUV420(want, mbw, (h+15)/16)
+
+	var sse float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			d := float64(srcY[y*mbw*16+x]) - float64(ycc.Y[y*ycc.YStride+x])
+			sse += d * d
+		}
+	}
+	if sse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255*float64(w*h)/sse)
+}
+
+func TestEncodeLossyRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"opaque", testImage(67, 45, false)},
+		{"alpha", testImage(40, 33, true)},
+		{"large", testImage(200, 150, false)},
+		{"single pixel", testImage(1, 1, false)},
+		{"single row", testImage(300, 1, true)},
+		{"single column", testImage(1, 123, false)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeLossy(&buf, tc.img, 80); err != nil {
+				t.Fatalf("EncodeLossy: %v", err)
+			}
+			got, err := xwebp.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if psnr := lumaPSNR(t, tc.img, got); psnr < 30 {
+				t.Errorf("luma PSNR %.1f dB is too low", psnr)
+			}
+
+			if opaque(tc.img) {
+				if _, ok := got.(*image.YCbCr); !ok {
+					t.Errorf("expected an opaque image, got %T", got)
+				}
+				return
+			}
+			nycc, ok := got.(*image.NYCbCrA)
+			if !ok {
+				t.Fatalf("expected an image with alpha, got %T", got)
+			}
+			for y := 0; y < tc.img.Rect.Dy(); y++ {
+				for x := 0; x < tc.img.Rect.Dx(); x++ {
+					want := tc.img.NRGBAAt(x, y).A
+					if a := nycc.A[y*nycc.AStride+x]; a != want {
+						t.Fatalf("alpha at (%d,%d): want %d, got %d", x, y, want, a)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeLossyQuality(t *testing.T) {
+	img := testImage(128, 96, false)
+
+	var sizes []int
+	var psnrs []float64
+	for _, q := range []int{20, 60, 95} {
+		var buf bytes.Buffer
+		if err := EncodeLossy(&buf, img, q); err != nil {
+			t.Fatalf("EncodeLossy(%d): %v", q, err)
+		}
+		got, err := xwebp.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("decode quality %d: %v", q, err)
+		}
+		sizes = append(sizes, buf.Len())
+		psnrs = append(psnrs, lumaPSNR(t, img, got))
+	}
+
+	for i := 1; i < len(sizes); i++ {
+		if sizes[i] <= sizes[i-1] || psnrs[i] <= psnrs[i-1] {
+			t.Errorf("expected size and PSNR to grow with quality, got sizes %v, PSNR %v", sizes, psnrs)
+		}
+	}
+	if raw := len(img.Pix); sizes[1] > raw/8 {
+		t.Errorf("expected quality 60 to compress well, got %d bytes from %d", sizes[1], raw)
+	}
+}
+
+func TestDecodeLossyColors(t *testing.T) {
+	colors := []color.NRGBA{
+		{20, 20, 20, 255},
+		{235, 235, 235, 255},
+		{200, 30, 40, 255},
+		{30, 60, 180, 128},
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 16))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 16; y++ {
+			img.SetNRGBA(x, y, colors[x/16])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeLossy(&buf, img, 90); err != nil {
+		t.Fatalf("EncodeLossy: %v", err)
+	}
+	got, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	for i, want := range colors {
+		// Sample the middle of each patch, away from chroma bleeding
+		c := color.NRGBAModel.Convert(got.At(i*16+8, 8)).(color.NRGBA)
+		for _, d := range []int{int(c.R) - int(want.R), int(c.G) - int(want.G), int(c.B) - int(want.B)} {
+			if d < -6 || d > 6 {
+				t.Errorf("patch %d: want %v, got %v", i, want, c)
+				break
+			}
+		}
+		if c.A != want.A {
+			t.Errorf("patch %d: want alpha %d, got %d", i, want.A, c.A)
+		}
+	}
+}